@@ -18,6 +18,7 @@ import (
 	"github.com/holdno/gopherCron/utils"
 
 	winfra "github.com/spacegrower/watermelon/infra"
+	wregister "github.com/spacegrower/watermelon/infra/register"
 	wutils "github.com/spacegrower/watermelon/infra/utils"
 	"github.com/spacegrower/watermelon/infra/wlog"
 	"go.uber.org/zap"
@@ -45,9 +46,12 @@ type client struct {
 	authenticator   *Authenticator
 
 	cronpb.UnimplementedAgentServer
-	metrics *Metrics
+	metrics      *Metrics
+	resultQueue  *resultQueue
+	planSnapshot *planSnapshotStore
 
-	srv *winfra.Srv[infra.NodeMetaRemote]
+	srv      *winfra.Srv[infra.NodeMetaRemote]
+	registry wregister.ServiceRegister[infra.NodeMetaRemote]
 }
 
 type Client interface {
@@ -127,9 +131,24 @@ func (agent *client) loadConfigAndSetupAgentFunc() func() error {
 				}
 			}
 			agent.metrics = NewMonitor(agent.localip, cfg.Prometheus.PushGateway, cfg.Prometheus.JobName)
+			if cfg.PlanSnapshotPath != "" {
+				var err error
+				if agent.planSnapshot, err = newPlanSnapshotStore(cfg.PlanSnapshotPath); err != nil {
+					agent.logger.Panic("failed to setup plan snapshot store", zap.String("path", cfg.PlanSnapshotPath), zap.Error(err))
+				}
+			}
+			if cfg.ResultQueuePath != "" {
+				var err error
+				if agent.resultQueue, err = newResultQueue(cfg.ResultQueuePath); err != nil {
+					agent.logger.Panic("failed to setup task result queue", zap.String("path", cfg.ResultQueuePath), zap.Error(err))
+				}
+			}
 		} else if agent.configPath == "" {
 			return fmt.Errorf("invalid config path")
 		}
+		if cfg.ShutdownTimeout <= 0 {
+			cfg.ShutdownTimeout = 600
+		}
 		agent.cfg = cfg
 
 		if cfg.ReportAddr != "" {
@@ -151,6 +170,12 @@ func (agent *client) loadConfigAndSetupAgentFunc() func() error {
 
 		// remove all old plan
 		agent.scheduler.RemoveAll()
+		// 先从本地快照恢复调度计划，注册成功后中心会全量下发任务并对齐
+		var projectIDs []int64
+		for _, v := range cfg.Auth.Projects {
+			projectIDs = append(projectIDs, v.ProjectID)
+		}
+		agent.scheduler.LoadPlanSnapshots(projectIDs)
 		agent.authenticator = NewAuthenticator(cfg.Auth.Projects)
 
 		if agent.srvShutdownFunc != nil { // 先停掉旧配置启动的服务
@@ -175,6 +200,11 @@ func NewClient(configPath string) Client {
 
 	setupFunc()
 
+	if agent.resultQueue != nil {
+		// 补报上次运行遗留及后续产生的任务结果
+		go agent.replayTaskResults(agent.resultQueue)
+	}
+
 	agent.onCommand = func(e *cronpb.CommandRequest) (*cronpb.Result, error) {
 		var err error
 		switch e.Command {
@@ -207,13 +237,23 @@ func (c *client) Close() {
 	if !c.isClose {
 		c.isClose = true
 		close(c.closeChan)
-		// 中断服务，停止接收新的调度信息
+		// 通知中心正在等待任务结束，期间与中心断开连接不会被当作失联
+		c.notifyDraining(time.Now().Add(time.Duration(c.cfg.ShutdownTimeout)*time.Second + time.Duration(c.cfg.Timeout)*time.Second*3))
+		// 中断服务，从中心注销并停止接收新的调度信息
 		if c.srvShutdownFunc != nil {
 			c.srvShutdownFunc()
 		}
-		// 关闭本地调度器 并 等待执行中的任务结束
+		// 关闭本地调度器 并 等待执行中的任务结束，超时后强制结束剩余任务
 		if c.scheduler != nil {
-			c.scheduler.Stop()
+			c.scheduler.Stop(time.Duration(c.cfg.ShutdownTimeout) * time.Second)
+		}
+		// 任务全部结束后才停止后台补报，退出过程中结束的任务结果在等待期间即可上报
+		// 尽量在退出前完成剩余任务结果的上报，未完成的部分会在下次启动后补报
+		if c.resultQueue != nil {
+			c.resultQueue.Stop()
+			if !c.flushResultQueue(c.resultQueue, time.Duration(c.cfg.Timeout)*time.Second*3) {
+				wlog.Warn("some task results are not reported yet, they will be reported after the agent restarts")
+			}
 		}
 		// 等待所有任务运行结束
 		if c.daemon != nil {
@@ -74,7 +74,8 @@ func handleRealTimeResult(ctx context.Context, output *strings.Builder, logOutpu
 	return wait
 }
 
-func execute(ctx context.Context, shell, command string, logger wlog.Logger) (*strings.Builder, error) {
+// execute 执行命令，env为追加到当前进程环境变量之后的额外环境变量
+func execute(ctx context.Context, shell, command string, env []string, logger wlog.Logger) (*strings.Builder, error) {
 	var (
 		cmd           = forkProcess(ctx, shell, command)
 		stdoutPipe, _ = cmd.StdoutPipe()
@@ -90,6 +91,10 @@ func execute(ctx context.Context, shell, command string, logger wlog.Logger) (*s
 	//	goto FinishWithError
 	//}
 
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
 	wait := handleRealTimeResult(ctx, output, logger, stdoutPipe, stderrPipe)
 
 	// 执行命令
@@ -134,7 +139,7 @@ func (a *client) ExecuteTask(info *common.TaskExecutingInfo) *common.TaskExecute
 	}
 
 	// 启动一个协成来执行shell命令
-	std, err := execute(info.CancelCtx, a.cfg.Shell, info.Task.Command,
+	std, err := execute(info.CancelCtx, a.cfg.Shell, info.Task.Command, workflowEnv(info.Task.FlowInfo),
 		a.logger.With(zap.String("task_id", info.Task.TaskID),
 			zap.Int64("project_id", info.Task.ProjectID)))
 	if err != nil {
@@ -151,3 +156,18 @@ func (a *client) ExecuteTask(info *common.TaskExecutingInfo) *common.TaskExecute
 
 	return result
 }
+
+// workflowEnv 将workflow的运行参数及上游任务输出的变量转换为环境变量
+func workflowEnv(flow *common.WorkflowInfo) []string {
+	if flow == nil || len(flow.Params)+len(flow.Outputs) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(flow.Params)+len(flow.Outputs))
+	for k, v := range flow.Params {
+		env = append(env, common.WORKFLOW_PARAM_ENV_PREFIX+strings.ToUpper(k)+"="+v)
+	}
+	for k, v := range flow.Outputs {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
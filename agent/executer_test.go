@@ -41,7 +41,7 @@ func TestApp_ExecuteTask(t *testing.T) {
 		fmt.Println("canceled")
 	}()
 
-	std, err := execute(ctx, "/bin/sh", "echo hello world", wlog.With())
+	std, err := execute(ctx, "/bin/sh", "echo hello world", nil, wlog.With())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,6 +51,20 @@ func TestApp_ExecuteTask(t *testing.T) {
 	}
 }
 
+func TestExecuteWithWorkflowParams(t *testing.T) {
+	env := workflowEnv(&common.WorkflowInfo{
+		Params:  map[string]string{"date": "2024-01-02"},
+		Outputs: map[string]string{"GOPHERCRON_OUTPUT_1_11_FILE": "/tmp/x; echo injected"},
+	})
+	std, err := execute(context.Background(), "/bin/sh", "echo $GOPHERCRON_PARAM_DATE ${GOPHERCRON_OUTPUT_1_11_FILE}", env, wlog.With())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(std.String()); got != "2024-01-02 /tmp/x; echo injected" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
+
 func TestOffCounter(t *testing.T) {
 	offCounter := &atomic.Bool{}
 
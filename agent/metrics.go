@@ -2,6 +2,7 @@ package agent
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/holdno/gopherCron/pkg/metrics"
 
@@ -14,6 +15,8 @@ type Metrics struct {
 	systemError     *prometheus.CounterVec
 	registerCounter *prometheus.CounterVec
 	taskRuntime     *prometheus.HistogramVec
+	resultBacklog   *prometheus.GaugeVec
+	resultAge       *prometheus.GaugeVec
 }
 
 func NewMonitor(instance, pushGatewayEndpoint, pushGatewayJobName string) *Metrics {
@@ -25,6 +28,8 @@ func NewMonitor(instance, pushGatewayEndpoint, pushGatewayJobName string) *Metri
 	m.systemError = m.provider.NewCounterVec("system_error", []string{"reason"})
 	m.registerCounter = m.provider.NewCounterVec("register_count", nil)
 	m.taskRuntime = m.provider.NewHistogramVec("task_runtime", []string{"project_id", "task_id", "task_name"})
+	m.resultBacklog = m.provider.NewGaugeVec("task_result_backlog", nil)
+	m.resultAge = m.provider.NewGaugeVec("task_result_backlog_age_seconds", nil)
 	return m
 }
 
@@ -36,6 +41,16 @@ func (s *Metrics) SetJobCount(count int) {
 	s.task.WithLabelValues().Set(float64(count))
 }
 
+// SetResultBacklog 记录本地待上报任务结果的积压数量及最早一条的积压时长
+func (s *Metrics) SetResultBacklog(count int, oldest time.Time) {
+	s.resultBacklog.WithLabelValues().Set(float64(count))
+	if count == 0 || oldest.IsZero() {
+		s.resultAge.WithLabelValues().Set(0)
+		return
+	}
+	s.resultAge.WithLabelValues().Set(time.Since(oldest).Seconds())
+}
+
 func (s *Metrics) SystemErrInc(reason string) {
 	s.systemError.WithLabelValues(reason).Inc()
 }
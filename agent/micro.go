@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 	winfra "github.com/spacegrower/watermelon/infra"
 	wregister "github.com/spacegrower/watermelon/infra/register"
 	"github.com/spacegrower/watermelon/infra/wlog"
+	"github.com/spacegrower/watermelon/pkg/safe"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
@@ -92,9 +94,32 @@ func (a *client) SetupMicroService() *winfra.Srv[infra.NodeMetaRemote] {
 	}()
 
 	a.srv = srv
+	a.registry = register
 	return srv
 }
 
+// notifyDraining 携带退出截止时间重新注册，中心在截止时间前不会将本agent上运行中的任务视为失联
+func (a *client) notifyDraining(deadline time.Time) {
+	updater, ok := a.registry.(register.TagUpdater)
+	if !ok {
+		return
+	}
+	done := make(chan error, 1)
+	go safe.Run(func() {
+		done <- updater.UpdateTags(map[string]string{
+			common.AGENT_TAG_DRAINING_DEADLINE: strconv.FormatInt(deadline.Unix(), 10),
+		})
+	})
+	select {
+	case err := <-done:
+		if err != nil {
+			wlog.Warn("failed to notify center that the agent is draining", zap.Error(err))
+		}
+	case <-time.After(time.Duration(a.cfg.Timeout) * time.Second):
+		wlog.Warn("timeout to notify center that the agent is draining")
+	}
+}
+
 func (a *client) MustSetupRemoteRegisterV2() wregister.ServiceRegister[infra.NodeMetaRemote] {
 	genMetadata := func(ctx context.Context, reqMethod string) context.Context {
 		md := metadata.NewOutgoingContext(ctx, metadata.New(map[string]string{
@@ -214,6 +239,10 @@ func (a *client) Schedule(ctx context.Context, req *cronpb.ScheduleRequest) (*cr
 			return nil, status.Error(codes.Aborted, "failed to build task plan: "+err.Error())
 		}
 		plan.PlanTime = time.Now()
+		if task.RescheduleInfo != nil && task.RescheduleInfo.PlanTime > 0 {
+			// agent失联后的重新调度，沿用原计划时间
+			plan.PlanTime = time.Unix(task.RescheduleInfo.PlanTime, 0)
+		}
 		if err = a.TryStartTask(*plan); err != nil {
 			return nil, status.Error(codes.Aborted, "failed to execute task: "+err.Error())
 		}
@@ -222,8 +251,9 @@ func (a *client) Schedule(ctx context.Context, req *cronpb.ScheduleRequest) (*cr
 		if err != nil {
 			return nil, err
 		}
-		// 下发 task
-		if _, taskExecuting := a.scheduler.CheckTaskExecuting(task.SchedulerKey()); taskExecuting {
+		// 下发 task，试运行不实际执行，不受正在执行的任务影响
+		dryRun := task.FlowInfo != nil && task.FlowInfo.DryRun
+		if _, taskExecuting := a.scheduler.CheckTaskExecuting(task.SchedulerKey()); taskExecuting && !dryRun {
 			return nil, status.Error(codes.AlreadyExists, "the task already executing, try again later")
 		}
 		plan, err := common.BuildWorkflowTaskSchedulerPlan(task.TaskInfo)
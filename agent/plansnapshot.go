@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+
+	"go.uber.org/zap"
+)
+
+// planSnapshot 项目调度计划的本地快照，agent重启时中心不可用也能继续调度无需抢锁(Noseize)的任务
+type planSnapshot struct {
+	ProjectID  int64              `json:"project_id"`
+	Revision   int64              `json:"revision"` // 最近一次与中心对齐时中心的revision
+	Hash       string             `json:"hash"`
+	UpdateTime int64              `json:"update_time"`
+	Tasks      []*common.TaskInfo `json:"tasks"`
+}
+
+type planSnapshotStore struct {
+	dir string
+}
+
+func newPlanSnapshotStore(dir string) (*planSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &planSnapshotStore{dir: dir}, nil
+}
+
+func (s *planSnapshotStore) path(projectID int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("project_%d.json", projectID))
+}
+
+func (s *planSnapshotStore) Save(snapshot *planSnapshot) error {
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	target := s.path(snapshot.ProjectID)
+	if err = os.WriteFile(target+".tmp", value, 0644); err != nil {
+		return err
+	}
+	return os.Rename(target+".tmp", target)
+}
+
+// Load 读取项目的调度计划快照，快照不存在时返回nil
+func (s *planSnapshotStore) Load(projectID int64) (*planSnapshot, error) {
+	value, err := os.ReadFile(s.path(projectID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshot planSnapshot
+	if err = json.Unmarshal(value, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// savePlanSnapshot 将项目当前的调度计划写入本地快照
+func (ts *TaskScheduler) savePlanSnapshot(projectID int64) {
+	if ts.a.planSnapshot == nil {
+		return
+	}
+	ts.consistency.locker.RLock()
+	held := ts.consistency.snapshotHeld[projectID]
+	ts.consistency.locker.RUnlock()
+	if held {
+		// 内存中只有从快照恢复的部分任务，写入会丢失快照中的其他任务
+		return
+	}
+
+	snapshot := &planSnapshot{
+		ProjectID:  projectID,
+		UpdateTime: time.Now().Unix(),
+	}
+	ts.PlanRange(func(key string, value *common.TaskSchedulePlan) bool {
+		if value.Task.ProjectID == projectID {
+			snapshot.Tasks = append(snapshot.Tasks, value.Task)
+		}
+		return true
+	})
+
+	ts.consistency.locker.RLock()
+	snapshot.Hash = ts.consistency.planhash[projectID]
+	snapshot.Revision = ts.consistency.revision[projectID]
+	ts.consistency.locker.RUnlock()
+
+	if err := ts.a.planSnapshot.Save(snapshot); err != nil {
+		ts.a.metrics.SystemErrInc("agent_plan_snapshot_save_failure")
+		ts.a.logger.Error("failed to save plan snapshot", zap.Int64("project_id", projectID), zap.Error(err))
+	}
+}
+
+// LoadPlanSnapshots 启动时从本地快照恢复调度计划
+// 中心恢复连接后会全量下发任务并通过 TASK_EVENT_RECONCILE 对齐，所以这里仅恢复不依赖中心锁的Noseize任务
+// 快照文件保持完整，对齐前不会被部分恢复的调度计划覆盖
+func (ts *TaskScheduler) LoadPlanSnapshots(projectIDs []int64) {
+	if ts.a.planSnapshot == nil {
+		return
+	}
+
+	for _, projectID := range projectIDs {
+		snapshot, err := ts.a.planSnapshot.Load(projectID)
+		if err != nil {
+			ts.a.logger.Error("failed to load plan snapshot", zap.Int64("project_id", projectID), zap.Error(err))
+			continue
+		}
+		if snapshot == nil {
+			continue
+		}
+
+		var loaded int
+		for _, task := range snapshot.Tasks {
+			if task.Status != common.TASK_STATUS_START || task.Noseize != common.TASK_EXECUTE_NOSEIZE {
+				continue
+			}
+			plan, err := common.BuildTaskSchedulerPlan(&common.TaskWithOperator{TaskInfo: task}, common.NormalPlan)
+			if err != nil {
+				ts.a.logger.Error("failed to build task schedule plan from snapshot", zap.Int64("project_id", projectID),
+					zap.String("task_id", task.TaskID), zap.Error(err))
+				continue
+			}
+			ts.SetPlan(task.SchedulerKey(), plan)
+			loaded++
+		}
+
+		ts.consistency.locker.Lock()
+		ts.consistency.revision[projectID] = snapshot.Revision
+		if loaded < len(snapshot.Tasks) {
+			ts.consistency.snapshotHeld[projectID] = true
+		}
+		ts.consistency.locker.Unlock()
+
+		ts.a.logger.Info("load plan snapshot", zap.Int64("project_id", projectID), zap.Int64("revision", snapshot.Revision),
+			zap.Int("tasks", len(snapshot.Tasks)), zap.Int("loaded", loaded))
+	}
+}
+
+// ReconcilePlans 中心全量下发任务后，移除本地已不存在于中心的任务，并校验两端的调度计划hash
+func (ts *TaskScheduler) ReconcilePlans(info *common.PlanReconcileInfo) {
+	exists := make(map[string]bool, len(info.TaskIDs))
+	for _, taskID := range info.TaskIDs {
+		exists[common.GenTaskSchedulerKey(info.ProjectID, taskID)] = true
+	}
+
+	var removed []string
+	ts.PlanRange(func(key string, value *common.TaskSchedulePlan) bool {
+		if value.Task.ProjectID == info.ProjectID && !exists[key] {
+			ts.PlanTable.Delete(key)
+			removed = append(removed, value.Task.TaskID)
+		}
+		return true
+	})
+
+	ts.consistency.locker.Lock()
+	ts.consistency.revision[info.ProjectID] = info.Revision
+	delete(ts.consistency.snapshotHeld, info.ProjectID)
+	ts.consistency.locker.Unlock()
+
+	ts.CalcPlanHash()
+	hash, _ := ts.GetProjectTaskHash(info.ProjectID)
+	if hash != info.Hash {
+		ts.a.metrics.SystemErrInc("agent_plan_reconcile_mismatch")
+		ts.a.logger.Warn("plan hash is different from center after reconcile", zap.Int64("project_id", info.ProjectID),
+			zap.String("local_hash", hash), zap.String("center_hash", info.Hash), zap.Int64("revision", info.Revision))
+	}
+	ts.savePlanSnapshot(info.ProjectID)
+
+	ts.a.logger.Info("plans reconciled with center", zap.Int64("project_id", info.ProjectID),
+		zap.Int64("revision", info.Revision), zap.Strings("removed", removed))
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"os/exec"
 	"syscall"
+	"time"
 )
 
 func forkProcess(ctx context.Context, shell, command string) *exec.Cmd {
@@ -14,5 +15,11 @@ func forkProcess(ctx context.Context, shell, command string) *exec.Cmd {
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	// ctx结束时结束整个进程组，避免shell派生的子进程成为孤儿进程继续运行
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// 子进程持有的stdio未释放时，最多等待该时长后强制返回
+	cmd.WaitDelay = time.Second * 5
 	return cmd
 }
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const resultQueueFileExt = ".json"
+
+// resultQueue 任务执行结果的本地预写队列
+// 任务结束后结果先落盘，再由后台按写入顺序上报中心，中心不可用时结果保留在磁盘中，恢复后按顺序补报
+type resultQueue struct {
+	dir    string
+	locker sync.Mutex
+	seq    uint64
+	notify chan struct{}
+	// sending 保证同一时间只有一个上报过程
+	sending sync.Mutex
+	// stop 关闭后后台补报退出，需在执行中的任务全部结束后再关闭，保证退出过程中产生的结果及时上报
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type resultQueueEntry struct {
+	EnqueueTime int64                 `json:"enqueue_time"`
+	Result      common.TaskFinishedV2 `json:"result"`
+}
+
+func newResultQueue(dir string) (*resultQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &resultQueue{
+		dir:    dir,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Stop 停止后台补报，剩余的记录由 flushResultQueue 上报
+func (q *resultQueue) Stop() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+// Push 将任务结果写入磁盘，写入成功后才会返回
+func (q *resultQueue) Push(result common.TaskFinishedV2) error {
+	value, err := json.Marshal(resultQueueEntry{
+		EnqueueTime: time.Now().Unix(),
+		Result:      result,
+	})
+	if err != nil {
+		return err
+	}
+
+	q.locker.Lock()
+	q.seq++
+	// 文件名按写入时间及序号排序，保证补报顺序与写入顺序一致
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), q.seq%1000000, resultQueueFileExt)
+	q.locker.Unlock()
+
+	tmpFile := filepath.Join(q.dir, name+".tmp")
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(value); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err = os.Rename(tmpFile, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// List 按写入顺序返回队列中的全部记录
+func (q *resultQueue) List() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, v := range entries {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), resultQueueFileExt) {
+			continue
+		}
+		names = append(names, v.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (q *resultQueue) Read(name string) (*resultQueueEntry, error) {
+	value, err := os.ReadFile(filepath.Join(q.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var entry resultQueueEntry
+	if err = json.Unmarshal(value, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (q *resultQueue) Remove(name string) error {
+	err := os.Remove(filepath.Join(q.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Backlog 返回积压的记录数及最早一条记录的写入时间
+func (q *resultQueue) Backlog() (int, time.Time) {
+	names, err := q.List()
+	if err != nil || len(names) == 0 {
+		return 0, time.Time{}
+	}
+	var oldest time.Time
+	if entry, err := q.Read(names[0]); err == nil {
+		oldest = time.Unix(entry.EnqueueTime, 0)
+	}
+	return len(names), oldest
+}
+
+// replayTaskResults 按写入顺序将队列中的任务结果上报至中心，上报失败时退避重试，保证结果不丢失且不乱序
+// 队列停止后退出，剩余的记录由 flushResultQueue 在退出前尽量上报
+func (a *client) replayTaskResults(q *resultQueue) {
+	var (
+		backoff    = time.Second
+		maxBackoff = time.Minute
+	)
+	for {
+		count, oldest := q.Backlog()
+		a.metrics.SetResultBacklog(count, oldest)
+		if count == 0 {
+			select {
+			case <-q.notify:
+			case <-time.After(time.Minute):
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+
+		if err := a.reportQueuedResults(q); err == nil {
+			backoff = time.Second
+			continue
+		}
+		select {
+		case <-time.After(backoff):
+		case <-q.stop:
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// reportQueuedResults 按写入顺序上报队列中的全部记录，遇到上报失败时停止并返回错误，未上报的记录留待重试
+func (a *client) reportQueuedResults(q *resultQueue) error {
+	// 后台补报与退出前的上报不能同时进行，否则同一条记录会被重复上报
+	q.sending.Lock()
+	defer q.sending.Unlock()
+
+	names, err := q.List()
+	if err != nil {
+		a.logger.Error("failed to list task result queue", zap.String("dir", q.dir), zap.Error(err))
+		return err
+	}
+
+	for _, name := range names {
+		entry, err := q.Read(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			// 损坏的记录无法补报，直接移除避免阻塞队列
+			a.metrics.SystemErrInc("agent_result_queue_corrupted")
+			a.logger.Error("failed to read task result from queue, drop it", zap.String("file", name), zap.Error(err))
+			q.Remove(name)
+			continue
+		}
+
+		if err = a.sendTaskFinished(entry.Result); err != nil {
+			if gerr, _ := status.FromError(err); gerr.Code() == codes.InvalidArgument {
+				// 中心无法处理的记录，重试也无法成功
+				a.logger.Error("task result is rejected by center, drop it", zap.String("file", name),
+					zap.String("task_id", entry.Result.TaskID), zap.String("tmp_id", entry.Result.TmpID), zap.Error(err))
+				q.Remove(name)
+				continue
+			}
+			a.metrics.SystemErrInc("agent_status_report_failure")
+			a.logger.Warn(fmt.Sprintf("task: %s, id: %s, tmp_id: %s, failed to report task result, waiting to retry, error: %v",
+				entry.Result.TaskName, entry.Result.TaskID, entry.Result.TmpID, err))
+			return err
+		}
+
+		if err = q.Remove(name); err != nil {
+			a.logger.Error("failed to remove reported task result from queue", zap.String("file", name), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// flushResultQueue 在agent退出前上报积压的任务结果，超时返回false
+func (a *client) flushResultQueue(q *resultQueue, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if count, _ := q.Backlog(); count == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		if err := a.reportQueuedResults(q); err != nil {
+			time.Sleep(time.Millisecond * 200)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"google.golang.org/grpc"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/config"
+	"github.com/holdno/gopherCron/pkg/cronpb"
+	"github.com/holdno/gopherCron/pkg/infra/register"
+)
+
+func TestResultQueueOrder(t *testing.T) {
+	q, err := newResultQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err = q.Push(common.TaskFinishedV2{TaskID: "task", TmpID: fmt.Sprintf("tmp-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, oldest := q.Backlog()
+	if count != 5 || oldest.IsZero() {
+		t.Fatalf("unexpected backlog, count: %d, oldest: %v", count, oldest)
+	}
+
+	names, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		entry, err := q.Read(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Result.TmpID != fmt.Sprintf("tmp-%d", i) {
+			t.Fatalf("unexpected order, index %d got %s", i, entry.Result.TmpID)
+		}
+		if err = q.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count, _ = q.Backlog(); count != 0 {
+		t.Fatalf("queue should be empty, got %d", count)
+	}
+}
+
+type replayCenter struct {
+	cronpb.CenterClient
+	locker   sync.Mutex
+	failures int
+	reported []string
+}
+
+func (c *replayCenter) StatusReporter(ctx context.Context, in *cronpb.ScheduleReply, opts ...grpc.CallOption) (*cronpb.Result, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return nil, errors.New("center unavailable")
+	}
+	var result common.TaskFinishedV2
+	if err := json.Unmarshal(in.Event.Value, &result); err != nil {
+		return nil, err
+	}
+	c.reported = append(c.reported, result.TmpID)
+	return &cronpb.Result{Result: true}, nil
+}
+
+func TestReplayTaskResults(t *testing.T) {
+	q, err := newResultQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := &replayCenter{failures: 1}
+	agent := &client{
+		cfg:       &config.ClientConfig{Timeout: 5},
+		logger:    wlog.With(),
+		metrics:   NewMonitor("127.0.0.1", "", ""),
+		centerSrv: register.CenterClient{CenterClient: center},
+		closeChan: make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		agent.replayTaskResults(q)
+		close(done)
+	}()
+
+	// agent开始退出后，执行中的任务结束时产生的结果仍需由后台补报
+	close(agent.closeChan)
+	for i := 0; i < 3; i++ {
+		if err = q.Push(common.TaskFinishedV2{TaskID: "task", TmpID: fmt.Sprintf("tmp-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if count, _ := q.Backlog(); count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("task results are not replayed after the agent starts closing")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	center.locker.Lock()
+	if want := []string{"tmp-0", "tmp-1", "tmp-2"}; !reflect.DeepEqual(center.reported, want) {
+		t.Fatalf("unexpected replay order, got %v, want %v", center.reported, want)
+	}
+	center.locker.Unlock()
+
+	q.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("replay should exit after the queue is stopped")
+	}
+}
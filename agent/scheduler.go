@@ -8,8 +8,6 @@ import (
 	"io"
 	"math/rand/v2"
 	"runtime"
-	"sort"
-	"strings"
 	"sync"
 	"time"
 
@@ -40,6 +38,8 @@ type TaskScheduler struct {
 
 type consistency struct {
 	planhash          map[int64]string
+	revision          map[int64]int64 // 各项目最近一次与中心对齐时中心的revision
+	snapshotHeld      map[int64]bool  // 从快照中只恢复了部分任务的项目，与中心对齐前不覆盖其快照
 	latestRefreshTime time.Time
 	debounce          func()
 	once              sync.Once
@@ -49,7 +49,6 @@ type consistency struct {
 func (ts *TaskScheduler) PlanHashDebouncer() func() {
 	ts.consistency.once.Do(func() {
 		ts.consistency.debounce = utils.NewDebounce(time.Second, ts.CalcPlanHash)
-		ts.consistency.planhash = make(map[int64]string)
 	})
 	return ts.consistency.debounce
 }
@@ -59,22 +58,54 @@ func initScheduler(agent *client) *TaskScheduler {
 		a:                     agent,
 		TaskEventChan:         make(chan *common.TaskEvent, 3000),
 		TaskExecuteResultChan: make(chan *common.TaskExecuteResult, 3000),
-		consistency:           &consistency{},
+		consistency: &consistency{
+			planhash:     make(map[int64]string),
+			revision:     make(map[int64]int64),
+			snapshotHeld: make(map[int64]bool),
+		},
 	}
 	return scheduler
 }
 
-func (ts *TaskScheduler) Stop() {
-	// 调度器关闭，最多等待10分钟来结束当前运行中的任务
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+// agent关闭时被强制结束的任务会在执行结果中携带该信息
+const shutdownInterruptedReason = "agent关闭，等待超时，任务被强制中断"
+
+func (ts *TaskScheduler) Stop(timeout time.Duration) {
+	// 调度器关闭，最多等待timeout来结束当前运行中的任务
+	wlog.Info("starting to shut down the scheduler", zap.Duration("timeout", timeout))
+	isTimeout := ts.waitExecutingTasks(timeout)
+	if isTimeout {
+		// 超时后强制结束剩余任务(整个进程组)，被中断任务的结果会携带中断原因上报至中心
+		count := 0
+		ts.TaskExecutingTable.Range(func(key, value interface{}) bool {
+			info := value.(*common.TaskExecutingInfo)
+			wlog.Warn("interrupt task because of agent shutdown",
+				zap.String("task_id", info.Task.TaskID),
+				zap.Int64("project_id", info.Task.ProjectID),
+				zap.String("tmp_id", info.TmpID))
+			info.Interrupt()
+			count++
+			return true
+		})
+		wlog.Warn(fmt.Sprintf("scheduler shutdown timeout, %d tasks have been interrupted", count))
+		// 等待被中断的任务完成结果上报
+		ts.waitExecutingTasks(time.Minute)
+	}
+	ts.PushTaskResult(nil) // 全部任务执行完成后发送空结果，通知调度器退出
+	wlog.Info("the scheduler has been shut down", zap.Bool("timeout", isTimeout))
+}
+
+// waitExecutingTasks 等待执行中的任务全部结束，超时返回true
+func (ts *TaskScheduler) waitExecutingTasks(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	wlog.Info("starting to shut down the scheduler")
 	for {
 		count := ts.TaskExecutingCount()
-		if count == 0 || ctx.Err() != nil {
-			ts.PushTaskResult(nil) // 全部任务执行完成后发送空结果，通知调度器退出
-			wlog.Info("the scheduler has been shut down", zap.Bool("timeout", ctx.Err() != nil))
-			return
+		if count == 0 {
+			return false
+		}
+		if ctx.Err() != nil {
+			return true
 		}
 		wlog.Info(fmt.Sprintf("scheduler shutting down, waiting for %d tasks to finish", count))
 		time.Sleep(time.Second)
@@ -126,14 +157,16 @@ func (a *client) GetPlan(key string) (*common.TaskSchedulePlan, bool) {
 
 func (ts *TaskScheduler) CalcPlanHash() {
 	var (
-		projectPlanList = make(map[int64][]string)
-		commandMap      = make(map[string]string)
-		taskCounter     = 0
+		projectPlans = make(map[int64]map[string]string)
+		taskCounter  = 0
+		changed      []int64
 	)
 
 	ts.PlanRange(func(key string, value *common.TaskSchedulePlan) bool {
-		projectPlanList[value.Task.ProjectID] = append(projectPlanList[value.Task.ProjectID], key)
-		commandMap[key] = value.Task.Command
+		if projectPlans[value.Task.ProjectID] == nil {
+			projectPlans[value.Task.ProjectID] = make(map[string]string)
+		}
+		projectPlans[value.Task.ProjectID][key] = value.Task.Command
 		taskCounter++
 		return true
 	})
@@ -141,28 +174,27 @@ func (ts *TaskScheduler) CalcPlanHash() {
 	ts.a.metrics.task.With(nil).Set(float64(taskCounter))
 
 	ts.consistency.locker.Lock()
-	defer ts.consistency.locker.Unlock()
-
 	for k := range ts.consistency.planhash {
-		if len(projectPlanList[k]) == 0 {
+		if len(projectPlans[k]) == 0 {
 			delete(ts.consistency.planhash, k)
+			changed = append(changed, k)
 		}
 	}
 
-	for projectid, list := range projectPlanList {
-		sort.Slice(list, func(i, j int) bool {
-			return list[i] < list[j]
-		})
-		var b strings.Builder
-		for _, v := range list {
-			b.WriteString(v)
-			b.WriteString(";")
-			b.WriteString(commandMap[v])
-			b.WriteString(";")
+	for projectid, plans := range projectPlans {
+		hash := common.BuildPlanHash(plans)
+		if ts.consistency.planhash[projectid] != hash {
+			changed = append(changed, projectid)
 		}
-		ts.consistency.planhash[projectid] = utils.MakeMD5(b.String())
+		ts.consistency.planhash[projectid] = hash
 	}
 	ts.consistency.latestRefreshTime = time.Now()
+	ts.consistency.locker.Unlock()
+
+	// 调度计划发生变化的项目同步更新本地快照
+	for _, projectID := range changed {
+		ts.savePlanSnapshot(projectID)
+	}
 }
 
 func (ts *TaskScheduler) GetProjectTaskHash(projectID int64) (string, int64) {
@@ -290,6 +322,9 @@ func (a *client) handleTaskEvent(event *common.TaskEvent) {
 		if taskExecuteInfo, taskExecuting = a.scheduler.CheckTaskExecuting(event.Task.SchedulerKey()); taskExecuting {
 			taskExecuteInfo.CancelFunc()
 		}
+	case common.TASK_EVENT_RECONCILE:
+		// 中心全量下发任务结束，对齐本地调度计划
+		a.scheduler.ReconcilePlans(event.Reconcile)
 	}
 }
 
@@ -349,6 +384,10 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 		return fmt.Errorf("agent %s is closing", a.GetIP())
 	}
 
+	if plan.Task.FlowInfo != nil && plan.Task.FlowInfo.DryRun {
+		return a.dryRunTask(plan)
+	}
+
 	if taskExecuteInfo, taskExecuting = a.scheduler.CheckTaskExecuting(plan.Task.SchedulerKey()); taskExecuting {
 		errMsg := "任务执行中，重复调度，上一周期任务仍未结束，请确保任务超时时间配置合理或检查任务是否运行正常"
 		if plan.Type == common.ActivePlan {
@@ -360,7 +399,10 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 			TaskID:    plan.Task.TaskID,
 			ProjectID: plan.Task.ProjectID,
 			Message:   errMsg,
-		}))
+		}).WithLevel(warning.LevelWarning))
+		if plan.Type == common.NormalPlan {
+			go a.reportTaskSkipped(plan, errMsg)
+		}
 		return errors.New(errMsg)
 	}
 
@@ -388,7 +430,7 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 					TaskID:    plan.Task.TaskID,
 					ProjectID: plan.Task.ProjectID,
 					Message:   fmt.Sprintf("任务执行失败，panic: %v\n%s", r, string(buf[:n])),
-				}))
+				}).WithLevel(warning.LevelCritical))
 
 				a.logger.With(zap.Any("fields", map[string]interface{}{
 					"error":      r,
@@ -427,7 +469,7 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 						TaskID:    taskExecuteInfo.Task.TaskID,
 						ProjectID: taskExecuteInfo.Task.ProjectID,
 						Message:   fmt.Sprintf("任务执行加锁失败: %s", err.Error()),
-					}))
+					}).WithLevel(warning.LevelCritical))
 				}
 
 				errSignal.Send(err)
@@ -485,6 +527,9 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 		// 执行任务
 		result = a.ExecuteTask(taskExecuteInfo)
 		if result.Err != "" {
+			if taskExecuteInfo.Interrupted() {
+				cancelReason.WriteString(shutdownInterruptedReason)
+			}
 			cancelReason.WriteStringPrefix("任务执行结果: " + result.Err)
 			result.Err = cancelReason.String()
 		}
@@ -495,6 +540,68 @@ func (a *client) TryStartTask(plan common.TaskSchedulePlan) error {
 	return errSignal.WaitOne()
 }
 
+// dryRunTask workflow试运行的任务不执行命令，也不占用任务的执行状态及锁，上报开始后直接上报成功
+func (a *client) dryRunTask(plan common.TaskSchedulePlan) error {
+	plan.Task.ClientIP = a.GetIP()
+	taskExecuteInfo := common.BuildTaskExecuteInfo(plan)
+	defer taskExecuteInfo.CancelFunc()
+
+	value, _ := json.Marshal(taskExecuteInfo)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.cfg.Timeout)*time.Second)
+	defer cancel()
+	if _, err := a.GetStatusReporter()(ctx, &cronpb.ScheduleReply{
+		ProjectId: plan.Task.ProjectID,
+		Event: &cronpb.Event{
+			Type:      common.TASK_STATUS_RUNNING_V2,
+			Version:   common.VERSION_TYPE_V2,
+			Value:     value,
+			EventTime: time.Now().Unix(),
+		},
+	}); err != nil {
+		return fmt.Errorf("agent上报任务开始状态失败: %s", err.Error())
+	}
+
+	now := time.Now()
+	go reportTaskResult(a, taskExecuteInfo, plan, &common.TaskExecuteResult{
+		ExecuteInfo: taskExecuteInfo,
+		Output:      "dry-run",
+		StartTime:   now,
+		EndTime:     now,
+	})
+	return nil
+}
+
+// reportTaskSkipped 上报因上一周期任务未结束而跳过的调度，中心据此推送 task-skipped 事件
+func (a *client) reportTaskSkipped(plan common.TaskSchedulePlan, reason string) {
+	now := time.Now().Unix()
+	value, _ := json.Marshal(common.TaskFinishedV2{
+		TaskName:  plan.Task.Name,
+		TaskID:    plan.Task.TaskID,
+		Command:   plan.Task.Command,
+		ProjectID: plan.Task.ProjectID,
+		Status:    common.TASK_STATUS_SKIPPED_V2,
+		TmpID:     plan.TmpID,
+		PlanTime:  plan.PlanTime.Unix(),
+		StartTime: now,
+		EndTime:   now,
+		Error:     reason,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.cfg.Timeout)*time.Second)
+	defer cancel()
+	if _, err := a.GetStatusReporter()(ctx, &cronpb.ScheduleReply{
+		ProjectId: plan.Task.ProjectID,
+		Event: &cronpb.Event{
+			Type:      common.TASK_STATUS_SKIPPED_V2,
+			Version:   common.VERSION_TYPE_V2,
+			Value:     value,
+			EventTime: now,
+		},
+	}); err != nil {
+		a.logger.Error("failed to report skipped task", zap.String("task_id", plan.Task.TaskID),
+			zap.Int64("project_id", plan.Task.ProjectID), zap.Error(err))
+	}
+}
+
 // getSchedulerLatency 避免分布式集群上锁偏斜 (每台机器的时钟可能不是特别的准确 导致某一台机器总能抢到锁)
 // v2.4.5版本开始结合节点权重做一些策略，权重更大的节点，等待时间可能更小，从而做到权重大的节点调度机会更高
 // v2.4.5节点的权重配置，取值范围在0-100之间，超出则取边界值
@@ -608,14 +715,22 @@ func reportTaskResult(a *client, taskExecuteInfo *common.TaskExecutingInfo, plan
 		TmpID:     taskExecuteInfo.TmpID,
 		PlanTime:  taskExecuteInfo.PlanTime.Unix(),
 	}
+	if taskExecuteInfo.Task.RescheduleInfo != nil {
+		f.Attempt = taskExecuteInfo.Task.RescheduleInfo.Attempt
+	}
 	if plan.UserId != 0 {
 		f.Operator = fmt.Sprintf("%s(%d)", plan.UserName, plan.UserId)
 	}
 	if taskExecuteInfo.Task.FlowInfo != nil {
 		f.WorkflowID = taskExecuteInfo.Task.FlowInfo.WorkflowID
+		f.WorkflowRunID = taskExecuteInfo.Task.FlowInfo.RunID
+		f.WorkflowDryRun = taskExecuteInfo.Task.FlowInfo.DryRun
 	}
 	if result != nil {
 		f.Result = result.Output
+		if f.WorkflowID != 0 {
+			f.Outputs = common.ParseTaskOutputs(result.Output)
+		}
 		f.StartTime = result.StartTime.Unix()
 		f.EndTime = result.EndTime.Unix()
 		if result.Err != "" {
@@ -623,20 +738,20 @@ func reportTaskResult(a *client, taskExecuteInfo *common.TaskExecutingInfo, plan
 			f.Error = result.Err
 		}
 	}
-	value, _ := json.Marshal(f)
+
+	if a.resultQueue != nil {
+		// 结果先落盘，由后台按顺序上报，中心不可用时不会丢失
+		if err := a.resultQueue.Push(f); err == nil {
+			return
+		} else {
+			a.metrics.SystemErrInc("agent_result_queue_write_failure")
+			a.logger.Error("failed to persist task result, report it directly", zap.String("task_id", f.TaskID),
+				zap.Int64("project_id", f.ProjectID), zap.String("tmp_id", f.TmpID), zap.Error(err))
+		}
+	}
+
 	if err := retry.Do(func() error {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.cfg.Timeout)*time.Second)
-		defer cancel()
-		_, err := a.GetStatusReporter()(ctx, &cronpb.ScheduleReply{
-			ProjectId: plan.Task.ProjectID,
-			Event: &cronpb.Event{
-				Type:      common.TASK_STATUS_FINISHED_V2,
-				Version:   common.VERSION_TYPE_V2,
-				Value:     value,
-				EventTime: time.Now().Unix(),
-			},
-		})
-		return err
+		return a.sendTaskFinished(f)
 	}, retry.Attempts(3), retry.DelayType(retry.BackOffDelay),
 		retry.MaxJitter(time.Second*30), retry.LastErrorOnly(true)); err != nil {
 		a.metrics.SystemErrInc("agent_status_report_failure")
@@ -646,12 +761,32 @@ func reportTaskResult(a *client, taskExecuteInfo *common.TaskExecutingInfo, plan
 			TaskID:    plan.Task.TaskID,
 			ProjectID: plan.Task.ProjectID,
 			Message:   "agent上报任务运行结束状态失败: " + err.Error(),
-		}))
+		}).WithLevel(warning.LevelWarning))
 		a.logger.Error(fmt.Sprintf("task: %s, id: %s, tmp_id: %s, failed to change running status, the task is finished, error: %v",
 			plan.Task.Name, plan.Task.TaskID, plan.TmpID, err))
 	}
 }
 
+// sendTaskFinished 上报任务运行结束状态
+func (a *client) sendTaskFinished(f common.TaskFinishedV2) error {
+	if a.centerSrv.CenterClient == nil {
+		return errors.New("center client is not ready")
+	}
+	value, _ := json.Marshal(f)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.cfg.Timeout)*time.Second)
+	defer cancel()
+	_, err := a.GetStatusReporter()(ctx, &cronpb.ScheduleReply{
+		ProjectId: f.ProjectID,
+		Event: &cronpb.Event{
+			Type:      common.TASK_STATUS_FINISHED_V2,
+			Version:   common.VERSION_TYPE_V2,
+			Value:     value,
+			EventTime: time.Now().Unix(),
+		},
+	})
+	return err
+}
+
 // 处理任务结果
 func (a *client) handleTaskResult(result *common.TaskExecuteResult) {
 	err := retry.Do(func() error {
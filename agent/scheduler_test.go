@@ -1,8 +1,11 @@
 package agent
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/holdno/gopherCron/common"
 )
 
 func TestSchedulerLatency(t *testing.T) {
@@ -43,3 +46,37 @@ func TestSchedulerLatencyWithRunningCounter(t *testing.T) {
 	t.Log("l50:", sCounter)
 	t.Log("l100:", bCounter)
 }
+
+func TestStopInterruptsExecutingTasks(t *testing.T) {
+	ts := initScheduler(nil)
+	newInfo := func(taskID string) *common.TaskExecutingInfo {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &common.TaskExecutingInfo{
+			Task:       &common.TaskInfo{TaskID: taskID, ProjectID: 1},
+			TmpID:      taskID,
+			CancelCtx:  ctx,
+			CancelFunc: cancel,
+		}
+	}
+
+	finished := newInfo("finished")
+	executing := newInfo("executing")
+	key := common.GenTaskSchedulerKey(1, "executing")
+	ts.SetExecutingTask(key, executing)
+	go func() {
+		<-executing.CancelCtx.Done()
+		ts.TaskExecutingTable.Delete(key)
+	}()
+
+	ts.Stop(0)
+
+	if !executing.Interrupted() {
+		t.Fatal("the task cancelled by stop should be marked as interrupted")
+	}
+	if finished.Interrupted() {
+		t.Fatal("the task not cancelled by stop should not be marked as interrupted")
+	}
+	if result := <-ts.TaskExecuteResultChan; result != nil {
+		t.Fatal("stop should notify the scheduler to exit with an empty result")
+	}
+}
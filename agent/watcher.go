@@ -2,6 +2,7 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/spacegrower/watermelon/infra/wlog"
@@ -172,6 +173,17 @@ func (a *client) handlerEventFromCenter(event *cronpb.Event) error {
 			return err
 		}
 		taskEvent = common.BuildTaskEvent(common.TASK_EVENT_KILL, task)
+	case common.REMOTE_EVENT_DISPATCH_DONE:
+		// 中心全量下发项目任务结束
+		var reconcile common.PlanReconcileInfo
+		if err = json.Unmarshal(event.Value, &reconcile); err != nil {
+			wlog.Error("failed to unmarshal plan reconcile info", zap.String("value", string(event.Value)), zap.Error(err))
+			return err
+		}
+		taskEvent = &common.TaskEvent{
+			EventType: common.TASK_EVENT_RECONCILE,
+			Reconcile: &reconcile,
+		}
 	default:
 		return nil
 	}
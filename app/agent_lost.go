@@ -0,0 +1,395 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/pkg/cronpb"
+	"github.com/holdno/gopherCron/pkg/warning"
+	"github.com/holdno/gopherCron/utils"
+
+	"github.com/holdno/gocommons/selection"
+	"github.com/jinzhu/gorm"
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"github.com/spacegrower/watermelon/pkg/safe"
+	"go.uber.org/zap"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// agent断开后检查其运行中任务状态的间隔
+	agentLostCheckInterval = 10 * time.Second
+	// 任务超时后额外等待agent上报结果的时间
+	agentLostReportGrace = 30 * time.Second
+	// 检查运行中任务所在agent是否仍在注册中心的间隔
+	agentLostSweepInterval = time.Minute
+)
+
+// startAgentLostCheck 定期检查运行中任务所在的agent是否仍在注册中心
+// 用于覆盖中心异常退出时agent的注册租约过期、但没有中心触发反注册处理的情况
+func startAgentLostCheck(app *app) {
+	app.election(common.BuildAgentLostMasterKey(), func(s *concurrency.Session) error {
+		wlog.Info("new agent lost check leader")
+		app.metrics.CustomInc("agent_lost_check_leader", app.localip, "")
+
+		t := time.NewTicker(agentLostSweepInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.Done():
+				return nil
+			case <-app.ctx.Done():
+				return nil
+			case <-t.C:
+			}
+			if err := app.checkLostAgents(); err != nil {
+				wlog.Error("failed to check lost agents", zap.Error(err))
+			}
+		}
+	})
+}
+
+// checkLostAgents 跟踪所在agent已不在注册中心的运行中任务
+func (a *app) checkLostAgents() error {
+	projects, err := a.store.Project().GetProject(selection.NewSelector())
+	if err != nil {
+		return err
+	}
+	for _, p := range projects {
+		addrs, err := a.getAgentAddrs(a.GetConfig().Micro.Region, p.ID)
+		if err != nil {
+			wlog.Error("failed to get project agents", zap.Error(err), zap.Int64("project_id", p.ID))
+			continue
+		}
+		alive := make(map[string]bool, len(addrs))
+		for _, v := range addrs {
+			alive[v.attr.Host] = true
+		}
+		draining := make(map[string]bool)
+
+		runnings, err := a.getAgentRunningTasks("", p.ID)
+		if err != nil {
+			wlog.Error("failed to get running tasks", zap.Error(err), zap.Int64("project_id", p.ID))
+			continue
+		}
+		for taskID, running := range runnings {
+			if alive[running.AgentIP] {
+				continue
+			}
+			if _, checked := draining[running.AgentIP]; !checked {
+				draining[running.AgentIP] = a.isAgentDraining(running.AgentIP)
+			}
+			if draining[running.AgentIP] {
+				continue
+			}
+			projectID, taskID, running := p.ID, taskID, running
+			go safe.Run(func() {
+				a.watchAgentLostTask(running.AgentIP, projectID, taskID, running)
+			})
+		}
+	}
+	return nil
+}
+
+// HandleAgentDeregistered agent与中心断开连接(注销或租约过期)后，跟踪其名下仍处于运行状态的任务
+// agent重新注册且确认任务仍在运行、或任务正常上报了结果，则结束跟踪
+// 否则认为agent已失联，将任务标记为 agent-lost，并对开启了失联重调度的任务以相同的计划时间重新调度到项目下的其他agent
+// 正常退出的agent会先通知中心其正在等待任务结束，截止时间前断开连接不做跟踪，超过截止时间仍未上报结果的任务由定期检查处理
+func (a *app) HandleAgentDeregistered(agentIP string, projectIDs []int64) {
+	a.handleAgentWebHook(common.WEBHOOK_TYPE_AGENT_OFFLINE, agentIP, projectIDs)
+
+	if a.isAgentDraining(agentIP) {
+		wlog.Info("agent is draining, skip agent lost check", zap.String("agent_ip", agentIP))
+		return
+	}
+
+	handled := make(map[int64]bool)
+	for _, projectID := range projectIDs {
+		if handled[projectID] {
+			continue
+		}
+		handled[projectID] = true
+
+		runnings, err := a.getAgentRunningTasks(agentIP, projectID)
+		if err != nil {
+			wlog.Error("failed to get running tasks of deregistered agent", zap.Error(err),
+				zap.String("agent_ip", agentIP), zap.Int64("project_id", projectID))
+			continue
+		}
+
+		for taskID, running := range runnings {
+			taskID, running := taskID, running
+			go safe.Run(func() {
+				a.watchAgentLostTask(agentIP, projectID, taskID, running)
+			})
+		}
+	}
+}
+
+// MarkAgentDraining 记录agent正在退出并等待运行中的任务结束，记录在截止时间及上报结果的宽限时间后自动过期
+func (a *app) MarkAgentDraining(agentIP string, deadline time.Time) error {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	ttl := int64(time.Until(deadline.Add(agentLostReportGrace)) / time.Second)
+	if ttl <= 0 {
+		return nil
+	}
+	lease, err := a.etcd.Lease().Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = a.etcd.KV().Put(ctx, common.BuildAgentDrainingKey(agentIP), a.GetIP(), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// clearAgentDraining agent重新注册后清除退出记录，之后断开连接恢复失联跟踪
+func (a *app) clearAgentDraining(agentIP string) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	if _, err := a.etcd.KV().Delete(ctx, common.BuildAgentDrainingKey(agentIP)); err != nil {
+		wlog.Error("failed to clear agent draining mark", zap.Error(err), zap.String("agent_ip", agentIP))
+	}
+}
+
+// isAgentDraining agent是否正在退出，无法确认时按未退出处理，任务已上报结果时跟踪会自行结束
+func (a *app) isAgentDraining(agentIP string) bool {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := a.etcd.KV().Get(ctx, common.BuildAgentDrainingKey(agentIP))
+	if err != nil {
+		wlog.Error("failed to get agent draining mark", zap.Error(err), zap.String("agent_ip", agentIP))
+		return false
+	}
+	return len(resp.Kvs) > 0
+}
+
+// getAgentRunningTasks 获取项目下由指定agent执行中的非workflow任务, key为task_id，agentIP为空时获取所有agent的
+func (a *app) getAgentRunningTasks(agentIP string, projectID int64) (map[string]common.TaskRunningInfo, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	prefix := common.BuildTaskPrefixKey(projectID)
+	resp, err := a.etcd.KV().Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]common.TaskRunningInfo)
+	suffix := "/" + common.STATUS
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if !strings.HasSuffix(key, suffix) {
+			continue
+		}
+		var running common.TaskRunningInfo
+		if err = json.Unmarshal(kv.Value, &running); err != nil {
+			continue
+		}
+		// workflow任务的失联由workflow调度器负责处理
+		if (agentIP != "" && running.AgentIP != agentIP) || running.Status != common.TASK_STATUS_RUNNING_V2 || running.WorkflowID != 0 {
+			continue
+		}
+		result[strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)] = running
+	}
+	return result, nil
+}
+
+func (a *app) watchAgentLostTask(agentIP string, projectID int64, taskID string, running common.TaskRunningInfo) {
+	task, err := a.GetTask(projectID, taskID)
+	if err != nil {
+		wlog.Warn("the task of deregistered agent is not found, skip agent lost check", zap.Error(err),
+			zap.String("agent_ip", agentIP), zap.Int64("project_id", projectID), zap.String("task_id", taskID))
+		return
+	}
+
+	timeout := task.Timeout
+	if timeout == 0 {
+		timeout = common.DEFAULT_TASK_TIMEOUT_SECONDS
+	}
+	// agent只要存活，任务最迟会在超时时被终止并上报结果
+	deadline := time.Unix(running.Timestamp, 0).Add(time.Duration(timeout)*time.Second + agentLostReportGrace)
+	if !a.claimAgentLostTask(projectID, taskID, running.TmpID, deadline) {
+		// 已由其他中心(或本中心之前的检查)跟踪
+		return
+	}
+
+	ticker := time.NewTicker(agentLostCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.isTaskExecutionReported(projectID, taskID, running.TmpID) {
+			return
+		}
+
+		if stream, err := a.GetAgentStream(a.ctx, projectID, agentIP); err == nil {
+			// agent已重新注册，由agent确认任务是否仍在执行
+			isRunning, err := a.checkAgentTaskRunning(stream, projectID, taskID)
+			stream.Close()
+			if err == nil {
+				if isRunning {
+					return
+				}
+				// agent重启后任务已不在运行且未上报结果
+				break
+			}
+			wlog.Warn("failed to check task running status on agent", zap.Error(err),
+				zap.String("agent_ip", agentIP), zap.Int64("project_id", projectID), zap.String("task_id", taskID))
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+
+	if a.isTaskExecutionReported(projectID, taskID, running.TmpID) {
+		return
+	}
+	a.handleAgentLostTask(agentIP, task, running)
+}
+
+// claimAgentLostTask 标记本中心正在跟踪该任务执行，标记在跟踪结束后自动过期，中心异常退出后可被重新跟踪
+func (a *app) claimAgentLostTask(projectID int64, taskID, tmpID string, deadline time.Time) bool {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	ttl := int64(time.Until(deadline)/time.Second) + int64(3*agentLostCheckInterval/time.Second)
+	if ttl < int64(agentLostSweepInterval/time.Second) {
+		ttl = int64(agentLostSweepInterval / time.Second)
+	}
+	lease, err := a.etcd.Lease().Grant(ctx, ttl)
+	if err != nil {
+		wlog.Error("failed to grant agent lost watch lease", zap.Error(err), zap.Int64("project_id", projectID), zap.String("task_id", taskID))
+		return false
+	}
+	key := common.BuildAgentLostWatchKey(projectID, taskID, tmpID)
+	resp, err := a.etcd.KV().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, a.GetIP(), clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		wlog.Error("failed to claim agent lost task", zap.Error(err), zap.Int64("project_id", projectID), zap.String("task_id", taskID))
+		return false
+	}
+	return resp.Succeeded
+}
+
+// isTaskExecutionReported 任务执行结果是否已经上报
+func (a *app) isTaskExecutionReported(projectID int64, taskID, tmpID string) bool {
+	log, err := a.store.TaskLog().GetOne(projectID, taskID, tmpID)
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			wlog.Error("failed to get task log", zap.Error(err), zap.Int64("project_id", projectID),
+				zap.String("task_id", taskID), zap.String("tmp_id", tmpID))
+			// 无法确认时按已上报处理，避免重复调度
+			return true
+		}
+		return false
+	}
+	return log.EndTime != 0
+}
+
+func (a *app) checkAgentTaskRunning(stream *CenterClient, projectID int64, taskID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := stream.SendEvent(ctx, &cronpb.SendEventRequest{
+		Region:    a.cfg.Micro.Region,
+		ProjectId: projectID,
+		Agent:     stream.addr,
+		Event: &cronpb.ServiceEvent{
+			Id:        utils.GetStrID(),
+			EventTime: time.Now().Unix(),
+			Type:      cronpb.EventType_EVENT_CHECK_RUNNING_REQUEST,
+			Event: &cronpb.ServiceEvent_CheckRunningRequest{
+				CheckRunningRequest: &cronpb.CheckRunningRequest{
+					ProjectId: projectID,
+					TaskId:    taskID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	if resp.GetCheckRunningReply() == nil {
+		return false, fmt.Errorf("unexpected response type %s", resp.Type.String())
+	}
+	return resp.GetCheckRunningReply().Result, nil
+}
+
+// handleAgentLostTask 将失联agent上的任务标记为 agent-lost 并按需重新调度
+func (a *app) handleAgentLostTask(agentIP string, task *common.TaskInfo, running common.TaskRunningInfo) {
+	a.metrics.CustomInc("agent_lost_task", agentIP, fmt.Sprintf("%d_%s", task.ProjectID, task.TaskID))
+
+	result := common.TaskFinishedV2{
+		TaskID:    task.TaskID,
+		TaskName:  task.Name,
+		Command:   task.Command,
+		ProjectID: task.ProjectID,
+		Status:    common.TASK_STATUS_AGENT_LOST_V2,
+		StartTime: running.Timestamp,
+		EndTime:   time.Now().Unix(),
+		TmpID:     running.TmpID,
+		PlanTime:  running.PlanTime,
+		Error:     fmt.Sprintf("agent %s 失联，任务运行状态丢失", agentIP),
+		Attempt:   running.Attempt,
+	}
+
+	var reschedule *common.TaskInfo
+	if task.RescheduleOnAgentLost == 1 {
+		if running.Attempt >= common.AGENT_LOST_RESCHEDULE_LIMIT {
+			result.Error += fmt.Sprintf("，已达到最大重新调度次数(%d)，不再重新调度", common.AGENT_LOST_RESCHEDULE_LIMIT)
+		} else {
+			copied := *task
+			reschedule = &copied
+			reschedule.TmpID = utils.GetStrID()
+			reschedule.RescheduleInfo = &common.RescheduleInfo{
+				PlanTime:    running.PlanTime,
+				Attempt:     running.Attempt + 1,
+				LostAgentIP: agentIP,
+				LostTmpID:   running.TmpID,
+			}
+			result.Error += fmt.Sprintf("，已重新调度(第%d次)，新的执行ID: %s", reschedule.RescheduleInfo.Attempt, reschedule.TmpID)
+		}
+	}
+
+	wlog.Warn("task is lost because of agent lost", zap.String("agent_ip", agentIP), zap.Int64("project_id", task.ProjectID),
+		zap.String("task_id", task.TaskID), zap.String("tmp_id", running.TmpID), zap.Bool("reschedule", reschedule != nil))
+
+	a.SaveTaskLog(agentIP, result)
+	if err := a.HandlerTaskFinished(agentIP, &result); err != nil {
+		wlog.Error("failed to finish the task of lost agent", zap.Error(err), zap.String("agent_ip", agentIP),
+			zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID))
+	}
+
+	a.Warning(warning.NewTaskWarningData(warning.TaskWarning{
+		AgentIP:   agentIP,
+		TaskID:    task.TaskID,
+		TaskName:  task.Name,
+		ProjectID: task.ProjectID,
+		Message:   result.Error,
+	}).WithLevel(warning.LevelCritical))
+
+	if reschedule == nil {
+		return
+	}
+
+	if err := a.TemporarySchedulerTask(&common.User{Name: "system(agent-lost)"}, "", *reschedule); err != nil {
+		wlog.Error("failed to reschedule the task of lost agent", zap.Error(err), zap.String("agent_ip", agentIP),
+			zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID))
+	}
+}
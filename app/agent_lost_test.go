@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/config"
+	"github.com/holdno/gopherCron/pkg/infra"
+	"github.com/spacegrower/watermelon/infra/register"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newMemoryApp(ctx context.Context) *app {
+	return &app{
+		ctx:     ctx,
+		localip: "127.0.0.1",
+		cfg:     &config.ServiceConfig{Deploy: &config.DeployConf{Timeout: 3}},
+		etcd:    memoryEtcd{client: &clientv3.Client{KV: newMemoryKV()}},
+	}
+}
+
+func TestClaimAgentLostTask(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := newMemoryApp(ctx)
+	deadline := time.Now().Add(time.Minute)
+
+	if !a.claimAgentLostTask(1, "task", "tmp1", deadline) {
+		t.Fatal("the first center should claim the task")
+	}
+	if a.claimAgentLostTask(1, "task", "tmp1", deadline) {
+		t.Fatal("the same execution should not be claimed twice")
+	}
+	if !a.claimAgentLostTask(1, "task", "tmp2", deadline) {
+		t.Fatal("another execution of the task should be claimed separately")
+	}
+}
+
+func TestAgentDraining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := newMemoryApp(ctx)
+
+	if a.isAgentDraining("10.0.0.1") {
+		t.Fatal("agent should not be draining before it notifies the center")
+	}
+	// 截止时间已过且超过上报宽限时间，不再记录
+	if err := a.MarkAgentDraining("10.0.0.1", time.Now().Add(-2*agentLostReportGrace)); err != nil {
+		t.Fatal(err)
+	}
+	if a.isAgentDraining("10.0.0.1") {
+		t.Fatal("expired draining deadline should be ignored")
+	}
+
+	if err := a.MarkAgentDraining("10.0.0.1", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !a.isAgentDraining("10.0.0.1") || a.isAgentDraining("10.0.0.2") {
+		t.Fatal("only the draining agent should be skipped by the agent lost check")
+	}
+
+	a.clearAgentDraining("10.0.0.1")
+	if a.isAgentDraining("10.0.0.1") {
+		t.Fatal("draining mark should be cleared after the agent registers again")
+	}
+}
+
+func TestExcludeLostAgent(t *testing.T) {
+	if excludeLostAgent(nil) != nil || excludeLostAgent(&common.RescheduleInfo{}) != nil {
+		t.Fatal("only rescheduling of agent lost tasks should filter agents")
+	}
+	filter := excludeLostAgent(&common.RescheduleInfo{LostAgentIP: "10.0.0.1"})
+	if filter == nil {
+		t.Fatal("rescheduling should exclude the lost agent")
+	}
+	meta := func(host string) infra.NodeMeta {
+		return infra.NodeMeta{NodeMeta: register.NodeMeta{Host: host}}
+	}
+	if filter(meta("10.0.0.1")) {
+		t.Fatal("the lost agent should not be selected")
+	}
+	if !filter(meta("10.0.0.2")) {
+		t.Fatal("other agents should be selectable")
+	}
+}
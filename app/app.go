@@ -31,6 +31,7 @@ import (
 	"github.com/holdno/go-instrumentation/conncache"
 	"github.com/holdno/gocommons/selection"
 	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
 	etcdresolver "github.com/spacegrower/watermelon/infra/resolver/etcd"
 	"github.com/spacegrower/watermelon/infra/wlog"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -69,6 +70,11 @@ type App interface {
 	GetTaskList(projectID int64) ([]*common.TaskListItemWithWorkflows, error)
 	GetTask(projectID int64, taskID string) (*common.TaskInfo, error)
 	TemporarySchedulerTask(user *common.User, host string, task common.TaskInfo) error
+	HandleAgentRegistered(agentIP string, projectIDs []int64)
+	HandleAgentDeregistered(agentIP string, projectIDs []int64)
+	MarkAgentDraining(agentIP string, deadline time.Time) error
+	HandleTaskSkipped(agentIP string, res *common.TaskFinishedV2)
+	GetAgentConsistencyList(projectID int64) ([]common.AgentConsistencyInfo, error)
 	GetTaskLogList(pid int64, tid string, page, pagesize int) ([]*common.TaskLog, error)
 	GetTaskLogDetail(pid int64, tid, tmpID string) (*common.TaskLog, error)
 	GetLogTotalByDate(projects []int64, timestamp int64, errType int) (int, error)
@@ -91,11 +97,19 @@ type App interface {
 	GetIP() string
 	ClusterID() int64
 	GetConfig() *config.ServiceConfig
-	CreateWebHook(projectID int64, types, CallBackURL string) error
+	CreateWebHook(projectID int64, types, CallBackURL, format, tmpl string) error
+	UpdateWebHook(projectID int64, types, CallBackURL, format, tmpl string) error
+	RotateWebHookSecret(projectID int64, types string) (string, error)
+	TestWebHook(projectID int64, types string) (*common.WebHookDelivery, error)
 	GetWebHook(projectID int64, types string) (*common.WebHook, error)
 	GetWebHookList(projectID int64) ([]*common.WebHook, error)
 	DeleteWebHook(tx *gorm.DB, projectID int64, types string) error
 	DeleteAllWebHook(tx *gorm.DB, projectID int64) error
+	GetWebHookDeliveryList(projectID int64, types, status string, page, pagesize uint64) ([]common.WebHookDelivery, int, error)
+	RedeliverWebHook(projectID, deliveryID int64) (*common.WebHookDelivery, error)
+	GetWebHookDeadLetters(projectID int64) ([]WebHookJob, error)
+	RetryWebHookDeadLetter(projectID int64, jobID string) error
+	DeleteWebHookDeadLetter(projectID int64, jobID string) error
 	CheckPermissions(projectID, uid int64, permission gorbac.Permission) error
 	CheckUserPermissionAndGreaterOrEqualAnotherUser(projectID, currentUser, anotherUser int64, permission gorbac.Permission) error
 	CheckUserPermissionAndGreaterOrEqualAnotherRole(projectID, user int64, role string, permission gorbac.Permission) error
@@ -114,13 +128,24 @@ type App interface {
 	GetWorkflowScheduleTasks(workflowID int64) ([]common.WorkflowSchedulePlan, error)
 	GetUserWorkflowPermission(userID, workflowID int64) error
 	GetWorkflowLogList(workflowID int64, page, pagesize uint64) ([]common.WorkflowLog, int, error)
-	CreateWorkflowLog(workflowID int64, startTime, endTime int64, result string) error
+	CreateWorkflowLog(data *common.WorkflowLog, taskLogs []*common.WorkflowTaskLog) error
+	GetWorkflowRunTimeline(workflowID, logID int64) (*WorkflowRunTimeline, error)
+	GetWorkflowTaskDurationTrend(workflowID int64, task WorkflowTaskInfo, limit int) ([]WorkflowTaskDurationItem, error)
 	ClearWorkflowLog(workflowID int64) error
 	GetWorkflowState(workflowID int64) (*PlanState, error)
-	GetWorkflowAllTaskStates(workflowID int64) ([]*WorkflowTaskStates, error)
+	GetWorkflowAllTaskStates(workflowID int64, runID string) ([]*WorkflowTaskStates, error)
+	GetWorkflowRunStates(workflowID int64) ([]*PlanState, error)
 	GetMultiWorkflowTaskList(taskIDs []string) ([]common.WorkflowTask, error)
-	StartWorkflow(workflowID int64) error
+	StartWorkflow(workflowID int64, dryRun bool, params map[string]string) error
+	BackfillWorkflow(workflowID int64, dateParam, startDate, endDate string, params map[string]string) (int, error)
 	KillWorkflow(workflowID int64) error
+	ResumeWorkflow(workflowID, logID int64) error
+	ApproveWorkflowTask(userID, workflowID int64, runID string, task WorkflowTaskInfo, approved bool, remark string) error
+	MarkWorkflowTask(userID, workflowID int64, runID string, task WorkflowTaskInfo, status, reason string) error
+	ExportWorkflowGraph(workflowID int64, format string) (string, error)
+	ExportWorkflowDefinition(workflowID int64, format string) (string, error)
+	ImportWorkflowDefinition(userID int64, oid string, workflowID int64, content []byte, dryRun bool) (*WorkflowImportResult, error)
+	RerunWorkflowTask(workflowID, logID int64, task WorkflowTaskInfo) error
 	UpdateWorkflowTask(userID int64, data common.WorkflowTask) error
 	DeleteWorkflowTask(userID, projectID int64, taskID string) error
 	WorkflowRemoveUser(workflowID, userID int64) error
@@ -136,6 +161,7 @@ type App interface {
 	DeleteTemporaryTask(id int64) error
 	TemporaryTaskSchedule(tmpTask common.TemporaryTask) error
 	AutoCleanScheduledTemporaryTask()
+	AutoCleanWebHookDeliveries()
 
 	BeginTx() *gorm.DB
 	Close()
@@ -208,6 +234,8 @@ type app struct {
 	centerAsyncFinder etcdresolver.AsyncFinder
 
 	tower *Tower
+
+	consistencyGauge *prometheus.GaugeVec
 }
 
 func (a *app) FireTower() *Tower {
@@ -273,6 +301,13 @@ func NewApp(configPath string) App {
 			return app.authenticator.token, nil
 		})
 	}
+	if len(cfg.Alert.Channels) > 0 {
+		router, err := warning.NewRouter(app.Warner, cfg.Alert, wlog.With(zap.String("component", "alert")))
+		if err != nil {
+			panic(err)
+		}
+		app.Warner = router
+	}
 
 	if cfg.Mysql != nil && cfg.Mysql.Service != "" {
 		app.store = sqlStore.MustSetup(cfg.Mysql, wlog.With(zap.String("component", "sqlprovider")), cfg.Mysql.AutoCreate)
@@ -387,7 +422,9 @@ func (a *app) Run() {
 	startCleanupTask(a)
 	startWorkflow(a)
 	startTemporaryTaskWorker(a)
-	// startCalcDataConsistency(a)
+	startCalcDataConsistency(a)
+	startWebHookDelivery(a)
+	startAgentLostCheck(a)
 }
 
 func (a *app) GetVersion() string {
@@ -431,6 +468,7 @@ func startCleanupTask(app *app) {
 			case <-t.C:
 				app.AutoCleanLogs()
 				app.AutoCleanScheduledTemporaryTask()
+				app.AutoCleanWebHookDeliveries()
 			case <-app.ctx.Done():
 				t.Stop()
 				s.Close()
@@ -504,6 +542,8 @@ func startWorkflow(app *app) {
 }
 
 func startCalcDataConsistency(app *app) {
+	// 当前调度计划与中心不一致且未修复的agent数量
+	app.consistencyGauge = app.metrics.NewGaugeVec("agent_plan_out_of_sync", nil)
 	app.election(common.BuildCalaConsistencyMasterKey(), func(s *concurrency.Session) error {
 		wlog.Info("new calc leader")
 		app.metrics.CustomInc("agents_task_calc_leader", app.localip, "")
@@ -0,0 +1,360 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/holdno/gocommons/selection"
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/pkg/cronpb"
+	"github.com/holdno/gopherCron/pkg/warning"
+	"github.com/holdno/gopherCron/utils"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"go.uber.org/zap"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// 连续修复失败达到该次数后强制agent重新注册并告警
+	consistencyRepairFailLimit = 3
+	// 每个agent保留的一致性事件数量
+	consistencyEventsLimit = 20
+	// 修复中的记录随每轮检测续期，agent下线后自动清理
+	consistencyDivergedTTL = 10 * 60
+	// 修复完成的记录保留一天，便于排查
+	consistencyRepairedTTL = 24 * 60 * 60
+	// 全量下发后等待agent重新计算调度计划hash的时间
+	consistencyResyncWait = 3 * time.Second
+)
+
+// CalcAgentDataConsistency 定期比较各agent调度计划与中心(etcd)中的任务是否一致
+// 不一致的agent由中心全量下发任务进行修复，多次修复失败则强制agent重新注册并告警
+func (a *app) CalcAgentDataConsistency(done <-chan struct{}) error {
+	c := time.NewTicker(time.Minute)
+	defer c.Stop()
+	calc := func() error {
+		mtimer := a.metrics.CustomHistogramSet("calc_agent_data_consistency")
+		defer mtimer.ObserveDuration()
+		list, err := a.store.Project().GetProject(selection.NewSelector())
+		if err != nil {
+			return err
+		}
+
+		var diverged int
+		for _, v := range list {
+			count, err := a.checkProjectConsistency(v.ID)
+			if err != nil {
+				wlog.Error("failed to check project agents consistency", zap.Int64("project_id", v.ID), zap.Error(err))
+				continue
+			}
+			diverged += count
+		}
+		a.consistencyGauge.WithLabelValues().Set(float64(diverged))
+		return nil
+	}
+
+	for {
+		select {
+		case <-c.C:
+			if err := calc(); err != nil {
+				a.metrics.CustomInc("calc_agent_data_consistency", a.GetIP(), err.Error())
+				return err
+			}
+		case <-done:
+			return nil
+		case <-a.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// checkProjectConsistency 检测并修复项目下的agent，返回修复后仍不一致的agent数量
+func (a *app) checkProjectConsistency(projectID int64) (int, error) {
+	agents, err := a.FindAgentsV2(a.GetConfig().Micro.Region, projectID)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, v := range agents {
+			v.Close()
+		}
+	}()
+	if len(agents) == 0 {
+		return 0, nil
+	}
+
+	tasks, reconcile, err := a.loadProjectPlans(projectID)
+	if err != nil {
+		return 0, err
+	}
+
+	var diverged int
+	for _, agent := range agents {
+		hash, err := a.getAgentProjectTaskHash(agent, projectID)
+		if err != nil {
+			wlog.Warn("failed to get agent project task hash", zap.String("agent", agent.addr), zap.Int64("project_id", projectID), zap.Error(err))
+			continue
+		}
+
+		info, err := a.getAgentConsistency(projectID, agent.addr)
+		if err != nil {
+			wlog.Error("failed to get agent consistency info", zap.String("agent", agent.addr), zap.Int64("project_id", projectID), zap.Error(err))
+			continue
+		}
+
+		if hash == reconcile.Hash {
+			if info != nil && info.Status == common.AGENT_CONSISTENCY_DIVERGED {
+				a.markAgentConsistencyRepaired(info, hash, "调度计划已与中心一致")
+			}
+			continue
+		}
+
+		if !a.repairAgentConsistency(agent, info, hash, tasks, reconcile) {
+			diverged++
+		}
+	}
+	return diverged, nil
+}
+
+// repairAgentConsistency 向调度计划不一致的agent全量下发任务，返回是否修复成功
+func (a *app) repairAgentConsistency(agent *CenterClient, info *common.AgentConsistencyInfo, agentHash string, tasks [][]byte, reconcile common.PlanReconcileInfo) bool {
+	if info == nil || info.Status != common.AGENT_CONSISTENCY_DIVERGED {
+		var events []common.AgentConsistencyEvent
+		if info != nil {
+			// 保留历史修复记录
+			events = info.Events
+		}
+		info = &common.AgentConsistencyInfo{
+			ProjectID:  reconcile.ProjectID,
+			Agent:      agent.addr,
+			Status:     common.AGENT_CONSISTENCY_DIVERGED,
+			DetectTime: time.Now().Unix(),
+			Events:     events,
+		}
+		a.metrics.CustomInc("agent_plan_diverged", agent.addr, fmt.Sprintf("%d", reconcile.ProjectID))
+		wlog.Warn("agent plan is different from center", zap.String("agent", agent.addr), zap.Int64("project_id", reconcile.ProjectID),
+			zap.String("agent_hash", agentHash), zap.String("center_hash", reconcile.Hash))
+		appendConsistencyEvent(info, common.CONSISTENCY_EVENT_DETECTED, fmt.Sprintf("agent hash: %s, center hash: %s", agentHash, reconcile.Hash))
+	}
+	info.AgentHash = agentHash
+	info.CenterHash = reconcile.Hash
+	info.Revision = reconcile.Revision
+	info.LatestRepairTime = time.Now().Unix()
+
+	appendConsistencyEvent(info, common.CONSISTENCY_EVENT_RESYNC, fmt.Sprintf("全量下发%d个任务，revision: %d", len(tasks), reconcile.Revision))
+	err := a.resyncAgentPlans(agent, tasks, reconcile)
+	if err == nil {
+		time.Sleep(consistencyResyncWait)
+		if agentHash, err = a.getAgentProjectTaskHash(agent, reconcile.ProjectID); err == nil {
+			info.AgentHash = agentHash
+			if agentHash == reconcile.Hash {
+				a.markAgentConsistencyRepaired(info, agentHash, "全量下发后调度计划已与中心一致")
+				return true
+			}
+			err = fmt.Errorf("hash is still different after resync, agent hash: %s, center hash: %s", agentHash, reconcile.Hash)
+		}
+	}
+
+	info.Failures++
+	info.LatestError = err.Error()
+	a.metrics.CustomInc("agent_plan_repair_failed", agent.addr, fmt.Sprintf("%d", reconcile.ProjectID))
+	appendConsistencyEvent(info, common.CONSISTENCY_EVENT_REPAIR_FAILED, fmt.Sprintf("第%d次修复失败: %s", info.Failures, err.Error()))
+	wlog.Error("failed to repair agent plan", zap.String("agent", agent.addr), zap.Int64("project_id", reconcile.ProjectID),
+		zap.Int("failures", info.Failures), zap.Error(err))
+
+	if info.Failures >= consistencyRepairFailLimit && info.Failures%consistencyRepairFailLimit == 0 {
+		// 全量下发无法修复，断开agent的连接使其重新注册
+		message := fmt.Sprintf("agent %s 项目 %d 的调度计划与中心不一致，连续%d次修复失败: %s", agent.addr, reconcile.ProjectID, info.Failures, err.Error())
+		if rerr := a.forceAgentReregister(agent.addr); rerr != nil {
+			message += fmt.Sprintf("，强制重新注册失败: %s", rerr.Error())
+		} else {
+			message += "，已强制agent重新注册"
+		}
+		appendConsistencyEvent(info, common.CONSISTENCY_EVENT_REREGISTER, message)
+
+		if werr := a.Warning(warning.NewSystemWarningData(warning.SystemWarning{
+			Endpoint: agent.addr,
+			Type:     warning.SERVICE_TYPE_AGENT,
+			Message:  message,
+		})); werr != nil {
+			wlog.Error("failed to push agent consistency warning", zap.Error(werr))
+		}
+	}
+
+	if err = a.saveAgentConsistency(info, consistencyDivergedTTL); err != nil {
+		wlog.Error("failed to save agent consistency info", zap.String("agent", agent.addr), zap.Int64("project_id", reconcile.ProjectID), zap.Error(err))
+	}
+	return false
+}
+
+func (a *app) markAgentConsistencyRepaired(info *common.AgentConsistencyInfo, agentHash, message string) {
+	info.Status = common.AGENT_CONSISTENCY_REPAIRED
+	info.AgentHash = agentHash
+	info.Failures = 0
+	info.LatestError = ""
+	appendConsistencyEvent(info, common.CONSISTENCY_EVENT_REPAIRED, message)
+	a.metrics.CustomInc("agent_plan_repaired", info.Agent, fmt.Sprintf("%d", info.ProjectID))
+	wlog.Info("agent plan repaired", zap.String("agent", info.Agent), zap.Int64("project_id", info.ProjectID))
+
+	if err := a.saveAgentConsistency(info, consistencyRepairedTTL); err != nil {
+		wlog.Error("failed to save agent consistency info", zap.String("agent", info.Agent), zap.Int64("project_id", info.ProjectID), zap.Error(err))
+	}
+}
+
+func appendConsistencyEvent(info *common.AgentConsistencyInfo, event, message string) {
+	info.Events = append(info.Events, common.AgentConsistencyEvent{
+		Event:   event,
+		Time:    time.Now().Unix(),
+		Message: message,
+	})
+	if len(info.Events) > consistencyEventsLimit {
+		info.Events = info.Events[len(info.Events)-consistencyEventsLimit:]
+	}
+}
+
+// resyncAgentPlans 通过agent所在中心的stream向agent全量下发项目任务
+func (a *app) resyncAgentPlans(agent *CenterClient, tasks [][]byte, reconcile common.PlanReconcileInfo) error {
+	send := func(eventType string, value []byte) error {
+		ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+		defer cancel()
+		_, err := agent.SendEvent(ctx, &cronpb.SendEventRequest{
+			Region:    a.GetConfig().Micro.Region,
+			ProjectId: reconcile.ProjectID,
+			Agent:     agent.addr,
+			Event: &cronpb.ServiceEvent{
+				Id:        utils.GetStrID(),
+				Type:      cronpb.EventType_EVENT_REGISTER_REPLY,
+				EventTime: time.Now().Unix(),
+				Event: &cronpb.ServiceEvent_RegisterReply{
+					RegisterReply: &cronpb.Event{
+						Version:   common.VERSION_TYPE_V1,
+						Type:      eventType,
+						Value:     value,
+						EventTime: time.Now().Unix(),
+					},
+				},
+			},
+		})
+		return err
+	}
+
+	for _, taskRaw := range tasks {
+		if err := send(common.REMOTE_EVENT_PUT, taskRaw); err != nil {
+			return err
+		}
+	}
+	value, _ := json.Marshal(reconcile)
+	return send(common.REMOTE_EVENT_DISPATCH_DONE, value)
+}
+
+func (a *app) getAgentProjectTaskHash(agent *CenterClient, projectID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	resp, err := agent.SendEvent(ctx, &cronpb.SendEventRequest{
+		Region:    a.GetConfig().Micro.Region,
+		ProjectId: projectID,
+		Agent:     agent.addr,
+		Event: &cronpb.ServiceEvent{
+			Id:        utils.GetStrID(),
+			Type:      cronpb.EventType_EVENT_PROJECT_TASK_HASH_REQUEST,
+			EventTime: time.Now().Unix(),
+			Event: &cronpb.ServiceEvent_ProjectTaskHashRequest{
+				ProjectTaskHashRequest: &cronpb.ProjectTaskHashRequest{
+					ProjectId: projectID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.GetProjectTaskHashReply() == nil {
+		return "", fmt.Errorf("unexpected response type %s", resp.Type.String())
+	}
+	return resp.GetProjectTaskHashReply().Hash, nil
+}
+
+// forceAgentReregister 断开agent与中心的连接，agent会自动重新注册并获取全量任务
+func (a *app) forceAgentReregister(agentAddr string) error {
+	centers, err := a.GetCenterSrvList()
+	if err != nil {
+		return err
+	}
+
+	var removed bool
+	for _, center := range centers {
+		ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+		resp, err := center.RemoveStream(ctx, &cronpb.RemoveStreamRequest{
+			Client: agentAddr,
+		})
+		cancel()
+		center.Close()
+		if err != nil {
+			wlog.Error("failed to remove agent stream", zap.String("center", center.addr), zap.String("agent", agentAddr), zap.Error(err))
+			continue
+		}
+		if resp.Result {
+			removed = true
+		}
+	}
+	if !removed {
+		return fmt.Errorf("agent stream is not found")
+	}
+	return nil
+}
+
+func (a *app) getAgentConsistency(projectID int64, agent string) (*common.AgentConsistencyInfo, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	resp, err := a.etcd.KV().Get(ctx, common.BuildAgentConsistencyKey(projectID, agent))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var info common.AgentConsistencyInfo
+	if err = json.Unmarshal(resp.Kvs[0].Value, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (a *app) saveAgentConsistency(info *common.AgentConsistencyInfo, ttl int64) error {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	lease, err := a.etcd.Lease().Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	value, _ := json.Marshal(info)
+	_, err = a.etcd.KV().Put(ctx, common.BuildAgentConsistencyKey(info.ProjectID, info.Agent), string(value), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// GetAgentConsistencyList 获取项目下调度计划与中心不一致(或近期修复)的agent
+func (a *app) GetAgentConsistencyList(projectID int64) ([]common.AgentConsistencyInfo, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	resp, err := a.etcd.KV().Get(ctx, common.BuildAgentConsistencyPrefixKey(projectID), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取agent一致性状态失败").WithLog(err.Error())
+	}
+
+	list := make([]common.AgentConsistencyInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var info common.AgentConsistencyInfo
+		if err = json.Unmarshal(kv.Value, &info); err != nil {
+			wlog.Error("failed to unmarshal agent consistency info", zap.String("key", string(kv.Key)), zap.Error(err))
+			continue
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -144,7 +145,7 @@ func (a *app) RemoveClientRegister(client string) error {
 	return nil
 }
 
-type JobDispatcher func(taskRaw []byte) error
+type JobDispatcher func(eventType string, value []byte) error
 
 func (a *app) DispatchAgentJob(projectID int64, dispatcher JobDispatcher) error {
 	mtimer := a.metrics.CustomHistogramSet("dispatch_agent_jobs")
@@ -155,10 +156,33 @@ func (a *app) DispatchAgentJob(projectID int64, dispatcher JobDispatcher) error
 		return fmt.Errorf("failed to dispatch agent jobs, empty streams")
 	}
 
+	tasks, reconcile, err := a.loadProjectPlans(projectID)
+	if err != nil {
+		return err
+	}
+
+	wlog.Info("dispatch agent job", zap.Int64("project_id", projectID), zap.Int("tasks", len(tasks)))
+
+	for _, taskRaw := range tasks {
+		if err := dispatcher(common.REMOTE_EVENT_PUT, taskRaw); err != nil {
+			return err
+		}
+	}
+
+	// 全量下发结束后通知agent，agent据此清理本地缓存中已不存在的任务并校验调度计划
+	value, _ := json.Marshal(reconcile)
+	return dispatcher(common.REMOTE_EVENT_DISPATCH_DONE, value)
+}
+
+// loadProjectPlans 获取项目下需要下发给agent的全部任务，以及用于agent对齐调度计划的信息
+func (a *app) loadProjectPlans(projectID int64) ([][]byte, common.PlanReconcileInfo, error) {
 	preKey := common.BuildKey(projectID, "")
 	var (
-		err     error
-		getResp *clientv3.GetResponse
+		err       error
+		getResp   *clientv3.GetResponse
+		reconcile = common.PlanReconcileInfo{
+			ProjectID: projectID,
+		}
 	)
 	if err := utils.RetryFunc(5, func() error {
 		if getResp, err = a.etcd.KV().Get(context.TODO(), preKey, clientv3.WithPrefix()); err != nil {
@@ -174,26 +198,34 @@ func (a *app) DispatchAgentJob(projectID int64, dispatcher JobDispatcher) error
 		if warningErr != nil {
 			wlog.Error(fmt.Sprintf("[agent - TaskWatcher] failed to push warning, %s", err.Error()))
 		}
-		return err
+		return nil, reconcile, err
 	}
 
-	var tasks [][]byte
+	var (
+		tasks [][]byte
+		plans = make(map[string]string)
+	)
+	reconcile.Revision = getResp.Header.Revision
 	for _, kvPair := range getResp.Kvs {
 		if common.IsStatusKey(string(kvPair.Key)) || common.IsAckKey(string(kvPair.Key)) {
 			continue
 		}
 		tasks = append(tasks, kvPair.Value)
-	}
-
-	wlog.Info("dispatch agent job", zap.Int64("project_id", projectID), zap.Int("tasks", len(tasks)))
 
-	for _, taskRaw := range tasks {
-		if err := dispatcher(taskRaw); err != nil {
-			return err
+		var task common.TaskInfo
+		if err = json.Unmarshal(kvPair.Value, &task); err != nil {
+			continue
+		}
+		reconcile.TaskIDs = append(reconcile.TaskIDs, task.TaskID)
+		if task.Status == common.TASK_STATUS_START {
+			plans[task.SchedulerKey()] = task.Command
 		}
 	}
-
-	return nil
+	if len(plans) > 0 {
+		// agent 侧没有调度计划时hash为空
+		reconcile.Hash = common.BuildPlanHash(plans)
+	}
+	return tasks, reconcile, nil
 }
 
 type AgentClient struct {
@@ -370,7 +402,10 @@ func ChooseNode(nodes []*FinderResult) *FinderResult {
 	return nodes[0]
 }
 
-func (a *app) GetAgentStreamRand(ctx context.Context, region string, projectID int64) (*CenterClient, error) {
+// AgentFilter 调度时筛选agent，返回false的agent不参与选择
+type AgentFilter func(meta infra.NodeMeta) bool
+
+func (a *app) GetAgentStreamRand(ctx context.Context, region string, projectID int64, filters ...AgentFilter) (*CenterClient, error) {
 	// client 的连接对象由调用时提供初始化
 	addrs, err := a.getAgentAddrs(region, projectID)
 	if err != nil {
@@ -378,10 +413,16 @@ func (a *app) GetAgentStreamRand(ctx context.Context, region string, projectID i
 	}
 
 	var filtered []*FinderResult
+Next:
 	for _, item := range addrs {
 		if item.attr.CenterServiceEndpoint == "" {
 			continue
 		}
+		for _, filter := range filters {
+			if !filter(item.attr) {
+				continue Next
+			}
+		}
 		filtered = append(filtered, item)
 	}
 
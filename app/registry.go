@@ -7,7 +7,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/holdno/gocommons/selection"
 	"github.com/holdno/gopherCron/pkg/cronpb"
 	"github.com/holdno/gopherCron/pkg/infra"
 	"google.golang.org/grpc/status"
@@ -145,104 +144,6 @@ func (c *streamManager[T]) GetStreams(system int64, srvName string) map[string]*
 	return copiedSrvList
 }
 
-type AgentProjectCompareInfo struct {
-	Hash       string
-	LatestTime int64
-	BeforAddrs []string
-}
-
-func (a *app) CalcAgentDataConsistency(done <-chan struct{}) error {
-	c := time.NewTicker(time.Minute)
-	defer c.Stop()
-	calc := func() error {
-		mtimer := a.metrics.CustomHistogramSet("calc_agent_data_consistency")
-		defer mtimer.ObserveDuration()
-		list, err := a.store.Project().GetProject(selection.NewSelector())
-		if err != nil {
-			return err
-		}
-		var needToRemove []string
-		checkOne := func(projectID int64) error {
-			var compareData *AgentProjectCompareInfo
-			agents, err := a.FindAgents(a.GetConfig().Micro.Region, projectID)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				for _, v := range agents {
-					v.Close()
-				}
-			}()
-			if len(agents) <= 1 {
-				return nil
-			}
-			for _, agent := range agents {
-				resp, err := agent.ProjectTaskHash(context.TODO(), &cronpb.ProjectTaskHashRequest{
-					ProjectId: projectID,
-				})
-				if err != nil {
-					return err
-				}
-				if compareData == nil {
-					compareData = &AgentProjectCompareInfo{
-						Hash:       resp.Hash,
-						LatestTime: resp.LatestUpdateTime,
-						BeforAddrs: []string{agent.addr},
-					}
-				} else if resp.Hash != compareData.Hash {
-					wlog.Warn("got different task hash", zap.String("current_agent", agent.addr), zap.String("before", compareData.Hash), zap.String("after", resp.Hash))
-					if resp.LatestUpdateTime <= compareData.LatestTime {
-						needToRemove = append(needToRemove, agent.addr)
-						compareData.BeforAddrs = append(compareData.BeforAddrs, agent.addr)
-					} else {
-						compareData.LatestTime = resp.LatestUpdateTime
-						compareData.Hash = resp.Hash
-						needToRemove = append(needToRemove, compareData.BeforAddrs...)
-						compareData.BeforAddrs = nil
-					}
-				}
-			}
-			return nil
-		}
-		for _, v := range list {
-			checkOne(v.ID)
-		}
-
-		// centerSrvs, err := a.GetCenterSrvList()
-		// if err != nil {
-		// 	return err
-		// }
-
-		// for _, center := range centerSrvs {
-		// 	for _, addr := range needToRemove {
-		// 		_, err := center.RemoveStream(context.TODO(), &cronpb.RemoveStreamRequest{
-		// 			Client: addr,
-		// 		})
-		// 		if err != nil {
-		// 			center.Close()
-		// 			return err
-		// 		}
-		// 	}
-		// 	center.Close()
-		// }
-		return nil
-	}
-
-	for {
-		select {
-		case <-c.C:
-			if err := calc(); err != nil {
-				a.metrics.CustomInc("calc_agent_data_consistency", a.GetIP(), err.Error())
-				return err
-			}
-		case <-done:
-			return nil
-		case <-a.ctx.Done():
-			return nil
-		}
-	}
-}
-
 type responseMap struct {
 	m cmap.ConcurrentMap[string, *streamResponse]
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/holdno/gopherCron/common"
 	"github.com/holdno/gopherCron/errors"
 	"github.com/holdno/gopherCron/pkg/cronpb"
+	"github.com/holdno/gopherCron/pkg/infra"
 	"github.com/holdno/gopherCron/pkg/warning"
 	"github.com/holdno/gopherCron/utils"
 	"github.com/spacegrower/watermelon/infra/wlog"
@@ -24,11 +25,12 @@ import (
 )
 
 func (a *workflowRunner) scheduleTask(taskInfo *common.TaskInfo) error {
-	if a.InProcess(taskInfo.TaskID) {
+	processKey := workflowProcessKey(taskInfo.FlowInfo.RunID, taskInfo.TaskID)
+	if a.InProcess(processKey) {
 		return nil
 	}
-	defer a.ProcessDone(taskInfo.TaskID)
-	plan := a.GetPlan(taskInfo.FlowInfo.WorkflowID)
+	defer a.ProcessDone(processKey)
+	plan := a.GetRunPlan(taskInfo.FlowInfo.WorkflowID, taskInfo.FlowInfo.RunID)
 	if plan == nil {
 		return nil
 	}
@@ -47,7 +49,7 @@ func (a *workflowRunner) scheduleTask(taskInfo *common.TaskInfo) error {
 
 	cli := a.etcd
 	taskInfo.TmpID = utils.GetStrID()
-	taskStates, err := getWorkflowTaskStates(cli.KV, common.BuildWorkflowTaskStatusKey(taskInfo.FlowInfo.WorkflowID, taskInfo.ProjectID, taskInfo.TaskID))
+	taskStates, err := getWorkflowTaskStates(cli.KV, common.BuildWorkflowTaskStatusKey(taskInfo.FlowInfo.WorkflowID, taskInfo.FlowInfo.RunID, taskInfo.ProjectID, taskInfo.TaskID))
 	if err != nil {
 		return err
 	}
@@ -58,8 +60,9 @@ func (a *workflowRunner) scheduleTask(taskInfo *common.TaskInfo) error {
 		return nil
 	}
 
+	task := plan.Tasks[WorkflowTaskInfo{ProjectID: taskInfo.ProjectID, TaskID: taskInfo.TaskID}]
 	_, err = concurrency.NewSTM(cli, func(s concurrency.STM) error {
-		if err = setWorkflowTaskStarting(s, taskInfo); err != nil {
+		if err = setWorkflowTaskStarting(s, taskInfo, task); err != nil {
 			return err
 		}
 		return nil
@@ -76,10 +79,19 @@ func (a *workflowRunner) scheduleTask(taskInfo *common.TaskInfo) error {
 	defer cancel()
 	value, _ := json.Marshal(taskInfo)
 
-	stream, err := a.app.GetAgentStreamRand(ctx, a.app.GetConfig().Micro.Region, taskInfo.ProjectID)
+	var filters []AgentFilter
+	dryRun := taskInfo.FlowInfo.DryRun
+	if dryRun {
+		filters = append(filters, agentSupportDryRun)
+	}
+	stream, err := a.app.GetAgentStreamRand(ctx, a.app.GetConfig().Micro.Region, taskInfo.ProjectID, filters...)
 	if err != nil {
 		return errors.NewError(http.StatusInternalServerError, fmt.Sprintf("连接agent stream失败, project_id: %d", taskInfo.ProjectID)).WithLog(err.Error())
 	}
+	if stream == nil && dryRun {
+		// 旧版本agent不识别试运行标记，不能通过直连方式下发
+		return errors.NewError(http.StatusBadRequest, fmt.Sprintf("项目中没有支持试运行的agent(需高于%s), project_id: %d", workflowDryRunAgentVersion, taskInfo.ProjectID))
+	}
 	if stream != nil {
 		defer stream.Close()
 		_, err := stream.SendEvent(ctx, &cronpb.SendEventRequest{
@@ -156,6 +168,7 @@ func (a *workflowRunner) scheduleTask(taskInfo *common.TaskInfo) error {
 
 type WorkflowRunningTaskInfo struct {
 	WorkflowID int64
+	RunID      string
 	TmpID      string
 	TaskID     string
 	TaskName   string
@@ -169,6 +182,8 @@ type WorkflowTaskScheduleRecord struct {
 	Status    string `json:"status"`
 	EventTime int64  `json:"event_time"`
 	AgentIP   string `json:"agent_ip"`
+	Attempt   int    `json:"attempt,omitempty"`  // 第几次调度
+	Operator  string `json:"operator,omitempty"` // 审批人或人工操作人
 }
 
 type WorkflowTaskStates struct {
@@ -181,6 +196,35 @@ type WorkflowTaskStates struct {
 	StartTime       int64                         `json:"start_time"`
 	EndTime         int64                         `json:"end_time"`
 	ScheduleRecords []*WorkflowTaskScheduleRecord `json:"schedule_records"`
+	MaxAttempts     int                           `json:"max_attempts,omitempty"`
+	RetryBackoff    int                           `json:"retry_backoff,omitempty"`
+	NextRetryTime   int64                         `json:"next_retry_time,omitempty"`
+	Outputs         map[string]string             `json:"outputs,omitempty"`        // 最近一次执行输出的变量
+	Operator        string                        `json:"operator,omitempty"`       // 人工标记结果的操作人
+	OperateReason   string                        `json:"operate_reason,omitempty"` // 人工标记结果的原因
+}
+
+// AttemptLimit 任务最多可被调度的次数，兼容未记录重试策略的历史状态
+func (s *WorkflowTaskStates) AttemptLimit() int {
+	if s.MaxAttempts <= 0 {
+		return common.WORKFLOW_SCHEDULE_LIMIT
+	}
+	return s.MaxAttempts
+}
+
+// retryDelay 第attempt次调度失败后距离下一次重试的间隔，每次重试翻倍，最长1小时
+func (s *WorkflowTaskStates) retryDelay(attempt int) int64 {
+	if s.RetryBackoff <= 0 || attempt <= 0 {
+		return 0
+	}
+	delay := int64(s.RetryBackoff)
+	for i := 1; i < attempt && delay < 3600; i++ {
+		delay *= 2
+	}
+	if delay > 3600 {
+		delay = 3600
+	}
+	return delay
 }
 
 func (s *WorkflowTaskStates) GetLatestScheduleRecord() *WorkflowTaskScheduleRecord {
@@ -193,7 +237,7 @@ func (s *WorkflowTaskStates) GetLatestScheduleRecord() *WorkflowTaskScheduleReco
 
 // finished 不一定是成功
 func setWorkFlowTaskFinished(kv concurrency.STM, agentIP string, result *common.TaskFinishedV2) (bool, error) {
-	key := common.BuildWorkflowTaskStatusKey(result.WorkflowID, result.ProjectID, result.TaskID)
+	key := common.BuildWorkflowTaskStatusKey(result.WorkflowID, result.WorkflowRunID, result.ProjectID, result.TaskID)
 	states := kv.Get(key)
 	planFinished := false
 
@@ -210,7 +254,8 @@ func setWorkFlowTaskFinished(kv concurrency.STM, agentIP string, result *common.
 	}
 
 	if workflowTaskStates.CurrentStatus == common.TASK_STATUS_DONE_V2 ||
-		workflowTaskStates.CurrentStatus == common.TASK_STATUS_FAIL_V2 {
+		workflowTaskStates.CurrentStatus == common.TASK_STATUS_FAIL_V2 ||
+		workflowTaskStates.CurrentStatus == common.TASK_STATUS_SKIPPED_V2 {
 		return false, nil
 	}
 
@@ -221,15 +266,26 @@ func setWorkFlowTaskFinished(kv concurrency.STM, agentIP string, result *common.
 		Result:    result.Result,
 		EventTime: endTime,
 		AgentIP:   agentIP,
+		Attempt:   workflowTaskStates.ScheduleCount,
 	})
+	workflowTaskStates.Outputs = result.Outputs
 
 	if result.Status == common.TASK_STATUS_FAIL_V2 {
-		if workflowTaskStates.ScheduleCount >= common.WORKFLOW_SCHEDULE_LIMIT {
+		if workflowTaskStates.ScheduleCount >= workflowTaskStates.AttemptLimit() {
 			workflowTaskStates.CurrentStatus = common.TASK_STATUS_FAIL_V2
 			workflowTaskStates.EndTime = endTime
 			planFinished = true
 		} else {
+			delay := workflowTaskStates.retryDelay(workflowTaskStates.ScheduleCount)
 			workflowTaskStates.CurrentStatus = common.TASK_STATUS_NOT_RUNNING_V2
+			workflowTaskStates.NextRetryTime = endTime + delay
+			workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+				TmpID:     result.TmpID,
+				Status:    common.TASK_STATUS_NOT_RUNNING_V2,
+				Result:    fmt.Sprintf("第%d次执行失败，%d秒后进行第%d次重试", workflowTaskStates.ScheduleCount, delay, workflowTaskStates.ScheduleCount),
+				EventTime: endTime,
+				Attempt:   workflowTaskStates.ScheduleCount,
+			})
 		}
 	} else if result.Status == common.TASK_STATUS_DONE_V2 {
 		workflowTaskStates.CurrentStatus = common.TASK_STATUS_DONE_V2
@@ -242,7 +298,7 @@ func setWorkFlowTaskFinished(kv concurrency.STM, agentIP string, result *common.
 }
 
 func setWorkflowTaskNotRunning(kv concurrency.STM, taskInfo WorkflowRunningTaskInfo, reason string) error {
-	key := common.BuildWorkflowTaskStatusKey(taskInfo.WorkflowID, taskInfo.ProjectID, taskInfo.TaskID)
+	key := common.BuildWorkflowTaskStatusKey(taskInfo.WorkflowID, taskInfo.RunID, taskInfo.ProjectID, taskInfo.TaskID)
 	states := kv.Get(key)
 
 	if states == "" {
@@ -269,8 +325,234 @@ func setWorkflowTaskNotRunning(kv concurrency.STM, taskInfo WorkflowRunningTaskI
 	return nil
 }
 
+// setWorkflowTaskSkipped 将未执行过的任务标记为跳过
+func setWorkflowTaskSkipped(kv concurrency.STM, workflowID int64, runID string, task *common.WorkflowTask, reason string) (*WorkflowTaskStates, error) {
+	if task == nil {
+		return nil, errors.NewError(http.StatusInternalServerError, "workflow任务不存在")
+	}
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	workflowTaskStates := WorkflowTaskStates{
+		ProjectID:  task.ProjectID,
+		TaskID:     task.TaskID,
+		WorkflowID: workflowID,
+		Command:    task.Command,
+	}
+	if value := kv.Get(key); value != "" {
+		if err := json.Unmarshal([]byte(value), &workflowTaskStates); err != nil {
+			return nil, errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+		}
+		if workflowTaskStates.CurrentStatus != common.TASK_STATUS_NOT_RUNNING_V2 || workflowTaskStates.ScheduleCount > 0 {
+			// 任务已经开始调度
+			return &workflowTaskStates, nil
+		}
+	}
+
+	now := time.Now().Unix()
+	workflowTaskStates.CurrentStatus = common.TASK_STATUS_SKIPPED_V2
+	workflowTaskStates.StartTime = now
+	workflowTaskStates.EndTime = now
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    common.TASK_STATUS_SKIPPED_V2,
+		Result:    reason,
+		EventTime: now,
+	})
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return &workflowTaskStates, nil
+}
+
+// setWorkflowTaskWaitingApproval 审批节点进入待审批状态，已经在审批中或审批结束的节点不会重复进入
+func setWorkflowTaskWaitingApproval(kv concurrency.STM, workflowID int64, runID string, task *common.WorkflowTask) (bool, error) {
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	workflowTaskStates := WorkflowTaskStates{
+		ProjectID:  task.ProjectID,
+		TaskID:     task.TaskID,
+		WorkflowID: workflowID,
+		Command:    task.Command,
+	}
+	if value := kv.Get(key); value != "" {
+		if err := json.Unmarshal([]byte(value), &workflowTaskStates); err != nil {
+			return false, errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+		}
+		if workflowTaskStates.CurrentStatus != common.TASK_STATUS_NOT_RUNNING_V2 {
+			return false, nil
+		}
+	}
+
+	now := time.Now().Unix()
+	workflowTaskStates.CurrentStatus = common.TASK_STATUS_WAITING_APPROVAL_V2
+	workflowTaskStates.ScheduleCount += 1
+	// 审批节点不重试，拒绝或超时即为最终失败
+	workflowTaskStates.MaxAttempts = workflowTaskStates.ScheduleCount
+	workflowTaskStates.StartTime = now
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    common.TASK_STATUS_WAITING_APPROVAL_V2,
+		Result:    "等待审批",
+		EventTime: now,
+		Attempt:   workflowTaskStates.ScheduleCount,
+	})
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return true, nil
+}
+
+// setWorkflowTaskChildRunning 子workflow节点进入运行状态
+func setWorkflowTaskChildRunning(kv concurrency.STM, workflowID int64, runID string, task *common.WorkflowTask) (bool, error) {
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	workflowTaskStates := WorkflowTaskStates{
+		ProjectID:  task.ProjectID,
+		TaskID:     task.TaskID,
+		WorkflowID: workflowID,
+	}
+	if value := kv.Get(key); value != "" {
+		if err := json.Unmarshal([]byte(value), &workflowTaskStates); err != nil {
+			return false, errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+		}
+		if workflowTaskStates.CurrentStatus != common.TASK_STATUS_NOT_RUNNING_V2 {
+			return false, nil
+		}
+	}
+
+	now := time.Now().Unix()
+	workflowTaskStates.CurrentStatus = common.TASK_STATUS_RUNNING_V2
+	workflowTaskStates.ScheduleCount += 1
+	// 子workflow内部的任务各自有重试策略，节点本身不再重试
+	workflowTaskStates.MaxAttempts = workflowTaskStates.ScheduleCount
+	workflowTaskStates.StartTime = now
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    common.TASK_STATUS_RUNNING_V2,
+		Result:    fmt.Sprintf("启动子workflow(%d)", task.RefWorkflowID),
+		EventTime: now,
+		Attempt:   workflowTaskStates.ScheduleCount,
+	})
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return true, nil
+}
+
+// setWorkflowTaskChildFinished 子workflow运行结束后将结果同步到父workflow节点
+func setWorkflowTaskChildFinished(kv concurrency.STM, workflowID int64, runID string, task WorkflowTaskInfo, succeeded bool, reason string) (bool, error) {
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	states := kv.Get(key)
+	if states == "" {
+		// 父workflow已经结束
+		return false, nil
+	}
+	var workflowTaskStates WorkflowTaskStates
+	if err := json.Unmarshal([]byte(states), &workflowTaskStates); err != nil {
+		return false, errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+	}
+	if workflowTaskStates.CurrentStatus != common.TASK_STATUS_RUNNING_V2 {
+		return false, nil
+	}
+
+	now := time.Now().Unix()
+	workflowTaskStates.CurrentStatus = common.TASK_STATUS_FAIL_V2
+	if succeeded {
+		workflowTaskStates.CurrentStatus = common.TASK_STATUS_DONE_V2
+	}
+	workflowTaskStates.EndTime = now
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    workflowTaskStates.CurrentStatus,
+		Result:    reason,
+		EventTime: now,
+		Attempt:   workflowTaskStates.ScheduleCount,
+	})
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return true, nil
+}
+
+// setWorkflowTaskApprovalResult 记录审批节点的审批结果
+func setWorkflowTaskApprovalResult(kv concurrency.STM, workflowID int64, runID string, task WorkflowTaskInfo, approved bool, operator, reason string) error {
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	states := kv.Get(key)
+	if states == "" {
+		return errors.NewError(http.StatusBadRequest, "该任务不在待审批状态")
+	}
+	var workflowTaskStates WorkflowTaskStates
+	if err := json.Unmarshal([]byte(states), &workflowTaskStates); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+	}
+	if workflowTaskStates.CurrentStatus != common.TASK_STATUS_WAITING_APPROVAL_V2 {
+		return errors.NewError(http.StatusBadRequest, "该任务不在待审批状态")
+	}
+
+	now := time.Now().Unix()
+	workflowTaskStates.CurrentStatus = common.TASK_STATUS_FAIL_V2
+	if approved {
+		workflowTaskStates.CurrentStatus = common.TASK_STATUS_DONE_V2
+	}
+	workflowTaskStates.EndTime = now
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    workflowTaskStates.CurrentStatus,
+		Result:    reason,
+		EventTime: now,
+		Attempt:   workflowTaskStates.ScheduleCount,
+		Operator:  operator,
+	})
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return nil
+}
+
+// setWorkflowTaskManualResult 人工将任务标记为成功或跳过，返回标记前的任务状态
+func setWorkflowTaskManualResult(kv concurrency.STM, workflowID int64, runID string, task *common.WorkflowTask, status, operator, reason string) (string, error) {
+	key := common.BuildWorkflowTaskStatusKey(workflowID, runID, task.ProjectID, task.TaskID)
+	workflowTaskStates := WorkflowTaskStates{
+		ProjectID:     task.ProjectID,
+		TaskID:        task.TaskID,
+		WorkflowID:    workflowID,
+		Command:       task.Command,
+		CurrentStatus: common.TASK_STATUS_NOT_RUNNING_V2,
+	}
+	if value := kv.Get(key); value != "" {
+		if err := json.Unmarshal([]byte(value), &workflowTaskStates); err != nil {
+			return "", errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
+		}
+	}
+	previous := workflowTaskStates.CurrentStatus
+	if err := applyWorkflowTaskManualResult(&workflowTaskStates, status, operator, reason); err != nil {
+		return "", err
+	}
+
+	newStates, _ := json.Marshal(workflowTaskStates)
+	kv.Put(key, string(newStates))
+	return previous, nil
+}
+
+// applyWorkflowTaskManualResult 将人工标记的结果写入任务状态，已结束的任务不能再标记
+func applyWorkflowTaskManualResult(workflowTaskStates *WorkflowTaskStates, status, operator, reason string) error {
+	if workflowTaskStates.CurrentStatus == common.TASK_STATUS_DONE_V2 || workflowTaskStates.CurrentStatus == common.TASK_STATUS_SKIPPED_V2 {
+		return errors.NewError(http.StatusBadRequest, "该任务已经结束")
+	}
+
+	now := time.Now().Unix()
+	if workflowTaskStates.StartTime == 0 {
+		workflowTaskStates.StartTime = now
+	}
+	workflowTaskStates.CurrentStatus = status
+	workflowTaskStates.EndTime = now
+	workflowTaskStates.NextRetryTime = 0
+	workflowTaskStates.Operator = operator
+	workflowTaskStates.OperateReason = reason
+	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
+		Status:    status,
+		Result:    reason,
+		EventTime: now,
+		Attempt:   workflowTaskStates.ScheduleCount,
+		Operator:  operator,
+	})
+	return nil
+}
+
 func setWorkflowTaskRunning(kv concurrency.STM, taskInfo WorkflowRunningTaskInfo) error {
-	key := common.BuildWorkflowTaskStatusKey(taskInfo.WorkflowID, taskInfo.ProjectID, taskInfo.TaskID)
+	key := common.BuildWorkflowTaskStatusKey(taskInfo.WorkflowID, taskInfo.RunID, taskInfo.ProjectID, taskInfo.TaskID)
 	states := kv.Get(key)
 
 	if states == "" {
@@ -281,6 +563,11 @@ func setWorkflowTaskRunning(kv concurrency.STM, taskInfo WorkflowRunningTaskInfo
 	if err := json.Unmarshal([]byte(states), &workflowTaskStates); err != nil {
 		return errors.NewError(http.StatusInternalServerError, "解析workflow运行状态失败").WithLog(err.Error())
 	}
+	if workflowTaskStates.CurrentStatus == common.TASK_STATUS_DONE_V2 ||
+		workflowTaskStates.CurrentStatus == common.TASK_STATUS_SKIPPED_V2 {
+		// 任务已被人工标记结果
+		return nil
+	}
 
 	workflowTaskStates.CurrentStatus = common.TASK_STATUS_RUNNING_V2
 	workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
@@ -295,9 +582,13 @@ func setWorkflowTaskRunning(kv concurrency.STM, taskInfo WorkflowRunningTaskInfo
 	return nil
 }
 
-func setWorkflowTaskStarting(kv concurrency.STM, taskInfo *common.TaskInfo) error {
+func setWorkflowTaskStarting(kv concurrency.STM, taskInfo *common.TaskInfo, task *common.WorkflowTask) error {
+	maxAttempts, retryBackoff := common.WORKFLOW_SCHEDULE_LIMIT, 0
+	if task != nil {
+		maxAttempts, retryBackoff = task.MaxAttempts(), task.RetryBackoff
+	}
 
-	key := common.BuildWorkflowTaskStatusKey(taskInfo.FlowInfo.WorkflowID, taskInfo.ProjectID, taskInfo.TaskID)
+	key := common.BuildWorkflowTaskStatusKey(taskInfo.FlowInfo.WorkflowID, taskInfo.FlowInfo.RunID, taskInfo.ProjectID, taskInfo.TaskID)
 	value := kv.Get(key)
 	var states []byte
 	if value == "" {
@@ -309,10 +600,13 @@ func setWorkflowTaskStarting(kv concurrency.STM, taskInfo *common.TaskInfo) erro
 			Command:       taskInfo.Command,
 			ScheduleCount: 1,
 			StartTime:     time.Now().Unix(),
+			MaxAttempts:   maxAttempts,
+			RetryBackoff:  retryBackoff,
 			ScheduleRecords: []*WorkflowTaskScheduleRecord{{
 				TmpID:     taskInfo.TmpID,
 				Status:    common.TASK_STATUS_STARTING_V2,
 				EventTime: time.Now().Unix(),
+				Attempt:   1,
 			}},
 		})
 	} else {
@@ -325,10 +619,14 @@ func setWorkflowTaskStarting(kv concurrency.STM, taskInfo *common.TaskInfo) erro
 
 		workflowTaskStates.CurrentStatus = common.TASK_STATUS_STARTING_V2
 		workflowTaskStates.ScheduleCount += 1
+		workflowTaskStates.MaxAttempts = maxAttempts
+		workflowTaskStates.RetryBackoff = retryBackoff
+		workflowTaskStates.NextRetryTime = 0
 		workflowTaskStates.ScheduleRecords = append(workflowTaskStates.ScheduleRecords, &WorkflowTaskScheduleRecord{
 			TmpID:     taskInfo.TmpID,
 			Status:    common.TASK_STATUS_STARTING_V2,
 			EventTime: time.Now().Unix(),
+			Attempt:   workflowTaskStates.ScheduleCount,
 		})
 
 		states, _ = json.Marshal(workflowTaskStates)
@@ -367,8 +665,8 @@ func getWorkflowTaskStateWithSTM(kv concurrency.STM, key string) (*WorkflowTaskS
 	return &workflowTaskStates, nil
 }
 
-func getWorkflowAllTaskStates(kv clientv3.KV, workflowID int64) ([]*WorkflowTaskStates, error) {
-	prefix := common.BuildWorkflowTaskStatusKeyPrefix(workflowID)
+func getWorkflowAllTaskStates(kv clientv3.KV, workflowID int64, runID string) ([]*WorkflowTaskStates, error) {
+	prefix := common.BuildWorkflowTaskStatusKeyPrefix(workflowID, runID)
 	ctx, _ := utils.GetContextWithTimeout()
 	resp, err := kv.Get(ctx, prefix, clientv3.WithPrefix())
 	if err != nil {
@@ -443,11 +741,53 @@ type PlanState struct {
 	Reason        string                `json:"reason"`
 	LatestTryTime int64                 `json:"latest_try_time"`
 	Records       []*WorkflowTaskStates `json:"records,omitempty"`
+	ResumeFrom    int64                 `json:"resume_from,omitempty"`   // 从哪一条运行日志恢复
+	Scope         []WorkflowTaskInfo    `json:"scope,omitempty"`         // 本次运行需要调度的任务，为空时调度全部任务
+	Parent        *WorkflowParentInfo   `json:"parent,omitempty"`        // 作为子workflow运行时的父workflow节点
+	RunID         string                `json:"run_id,omitempty"`        // 并发运行的id，主运行为空
+	Queued        int                   `json:"queued,omitempty"`        // 排队等待本次运行结束后执行的次数
+	DryRun        bool                  `json:"dry_run,omitempty"`       // 试运行，任务不实际执行
+	Params        map[string]string     `json:"params,omitempty"`        // 本次运行的参数
+	QueuedParams  []map[string]string   `json:"queued_params,omitempty"` // 排队中的运行的参数，按排队顺序
 }
 
-func getWorkflowPlanState(kv clientv3.KV, workflowID int64) (*PlanState, error) {
+// WorkflowParentInfo 子workflow运行所属的父workflow节点
+type WorkflowParentInfo struct {
+	WorkflowID int64  `json:"workflow_id"`
+	RunID      string `json:"run_id,omitempty"`
+	WorkflowTaskInfo
+}
+
+// InScope 任务是否需要在本次运行中调度
+func (s *PlanState) InScope(task WorkflowTaskInfo) bool {
+	if s == nil || len(s.Scope) == 0 {
+		return true
+	}
+	for _, v := range s.Scope {
+		if v == task {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeDependencies 过滤掉不在本次运行范围内的依赖
+func (s *PlanState) scopeDependencies(deps []WorkflowTaskDependency) []WorkflowTaskDependency {
+	if s == nil || len(s.Scope) == 0 {
+		return deps
+	}
+	var list []WorkflowTaskDependency
+	for _, dep := range deps {
+		if dep.TaskID == "" || s.InScope(dep.WorkflowTaskInfo) {
+			list = append(list, dep)
+		}
+	}
+	return list
+}
+
+func getWorkflowPlanState(kv clientv3.KV, workflowID int64, runID string) (*PlanState, error) {
 	ctx, _ := utils.GetContextWithTimeout()
-	resp, err := kv.Get(ctx, common.BuildWorkflowPlanKey(workflowID))
+	resp, err := kv.Get(ctx, common.BuildWorkflowPlanKey(workflowID, runID))
 	if err != nil {
 		return nil, err
 	}
@@ -462,18 +802,25 @@ func getWorkflowPlanState(kv clientv3.KV, workflowID int64) (*PlanState, error)
 	return &state, nil
 }
 
-func setWorkflowPlanRunning(cli *clientv3.Client, workflowID int64) (*PlanState, error) {
-	var planState PlanState
+func setWorkflowPlanRunning(cli *clientv3.Client, workflowID int64, runID string, params map[string]string) (*PlanState, bool, error) {
+	var (
+		planState PlanState
+		started   bool
+	)
 	_, err := concurrency.NewSTM(cli, func(s concurrency.STM) error {
-		planKey := common.BuildWorkflowPlanKey(workflowID)
+		planKey := common.BuildWorkflowPlanKey(workflowID, runID)
 		state := s.Get(planKey)
+		now := time.Now().Unix()
 
-		if state == "" {
+		started = state == ""
+		if started {
 			planState = PlanState{
 				WorkflowID:    workflowID,
-				StartTime:     time.Now().Unix(),
+				RunID:         runID,
+				StartTime:     now,
 				Status:        common.TASK_STATUS_RUNNING_V2,
-				LatestTryTime: time.Now().Unix(),
+				LatestTryTime: now,
+				Params:        params,
 			}
 			// workflow 开始前 清理一次key
 			// if err := clearWorkflowKeys(cli.KV, workflowID); err != nil {
@@ -483,7 +830,7 @@ func setWorkflowPlanRunning(cli *clientv3.Client, workflowID int64) (*PlanState,
 			if err := json.Unmarshal([]byte(state), &planState); err != nil {
 				return err
 			}
-			planState.LatestTryTime = time.Now().Unix()
+			planState.LatestTryTime = now
 			planState.Status = common.TASK_STATUS_RUNNING_V2
 		}
 
@@ -493,27 +840,239 @@ func setWorkflowPlanRunning(cli *clientv3.Client, workflowID int64) (*PlanState,
 	})
 
 	if err != nil {
+		return nil, false, err
+	}
+	return &planState, started, nil
+}
+
+// setWorkflowPlanDryRunning 创建一次试运行的运行状态，试运行总是以并发运行的方式进行
+func setWorkflowPlanDryRunning(cli *clientv3.Client, workflowID int64, runID string, params map[string]string) (*PlanState, error) {
+	now := time.Now().Unix()
+	planState := PlanState{
+		WorkflowID:    workflowID,
+		RunID:         runID,
+		StartTime:     now,
+		Status:        common.TASK_STATUS_RUNNING_V2,
+		LatestTryTime: now,
+		DryRun:        true,
+		Params:        params,
+	}
+	newState, _ := json.Marshal(planState)
+	ctx, cancel := utils.GetContextWithTimeout()
+	defer cancel()
+	if _, err := cli.KV.Put(ctx, common.BuildWorkflowPlanKey(workflowID, runID), string(newState)); err != nil {
 		return nil, err
 	}
 	return &planState, nil
 }
 
-func clearWorkflowKeys(kv clientv3.KV, workflowID int64) error {
-	// 删除workflow相关的key
-	delKeys := []string{
-		common.BuildWorkflowPlanKey(workflowID),
-		common.BuildWorkflowTaskStatusKeyPrefix(workflowID),
+// queueWorkflowPlanRun 在主运行上登记一次排队的运行，排队数达到limit或主运行已结束时返回false
+func queueWorkflowPlanRun(cli *clientv3.Client, workflowID int64, limit int, params map[string]string) (bool, error) {
+	var queued bool
+	_, err := concurrency.NewSTM(cli, func(s concurrency.STM) error {
+		planKey := common.BuildWorkflowPlanKey(workflowID, "")
+		queued = false
+		state := s.Get(planKey)
+		if state == "" {
+			return nil
+		}
+		var planState PlanState
+		if err := json.Unmarshal([]byte(state), &planState); err != nil {
+			return err
+		}
+		if planState.Status != common.TASK_STATUS_RUNNING_V2 || planState.Queued >= limit {
+			return nil
+		}
+		planState.Queued++
+		planState.QueuedParams = append(planState.QueuedParams, params)
+		newState, _ := json.Marshal(planState)
+		s.Put(planKey, string(newState))
+		queued = true
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
+	return queued, nil
+}
 
-	for _, v := range delKeys {
-		ctx, _ := utils.GetContextWithTimeout()
-		if _, err := kv.Delete(ctx, v, clientv3.WithPrefix()); err != nil {
-			return err
+// setWorkflowPlanQueuedRunning 上一次运行结束后启动排队中的运行，剩余的排队数由新的运行继承
+func setWorkflowPlanQueuedRunning(cli *clientv3.Client, workflowID int64, queued int, params map[string]string, queuedParams []map[string]string) (*PlanState, bool, error) {
+	var (
+		planState PlanState
+		started   bool
+	)
+	_, err := concurrency.NewSTM(cli, func(s concurrency.STM) error {
+		planKey := common.BuildWorkflowPlanKey(workflowID, "")
+		started = false
+		if s.Get(planKey) != "" {
+			return nil
+		}
+
+		now := time.Now().Unix()
+		planState = PlanState{
+			WorkflowID:    workflowID,
+			StartTime:     now,
+			Status:        common.TASK_STATUS_RUNNING_V2,
+			LatestTryTime: now,
+			Queued:        queued,
+			Params:        params,
+			QueuedParams:  queuedParams,
+		}
+		newState, _ := json.Marshal(planState)
+		s.Put(planKey, string(newState))
+		started = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &planState, started, nil
+}
+
+// queueWorkflowPlanRuns 将多次运行依次加入主运行的排队中，不受排队数上限限制
+// 主运行不存在时以第一次运行启动主运行，返回是否启动了新的运行
+func queueWorkflowPlanRuns(cli *clientv3.Client, workflowID int64, runs []map[string]string) (*PlanState, bool, error) {
+	var (
+		planState PlanState
+		started   bool
+	)
+	_, err := concurrency.NewSTM(cli, func(s concurrency.STM) error {
+		planKey := common.BuildWorkflowPlanKey(workflowID, "")
+		started = false
+		if state := s.Get(planKey); state != "" {
+			planState = PlanState{}
+			if err := json.Unmarshal([]byte(state), &planState); err != nil {
+				return err
+			}
+			planState.Queued += len(runs)
+			planState.QueuedParams = append(planState.QueuedParams, runs...)
+		} else {
+			now := time.Now().Unix()
+			planState = PlanState{
+				WorkflowID:    workflowID,
+				StartTime:     now,
+				Status:        common.TASK_STATUS_RUNNING_V2,
+				LatestTryTime: now,
+				Params:        runs[0],
+				Queued:        len(runs) - 1,
+				QueuedParams:  runs[1:],
+			}
+			started = true
+		}
+		newState, _ := json.Marshal(planState)
+		s.Put(planKey, string(newState))
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &planState, started, nil
+}
+
+// setWorkflowPlanResumed 基于历史运行结果恢复workflow运行状态，preserved中的任务状态会被保留，不再重复调度
+func setWorkflowPlanResumed(cli *clientv3.Client, workflowID, resumeFrom int64, preserved []*WorkflowTaskStates, scope []WorkflowTaskInfo, params map[string]string) (*PlanState, error) {
+	now := time.Now().Unix()
+	planState := PlanState{
+		WorkflowID:    workflowID,
+		StartTime:     now,
+		Status:        common.TASK_STATUS_RUNNING_V2,
+		LatestTryTime: now,
+		ResumeFrom:    resumeFrom,
+		Scope:         scope,
+		Params:        params,
+	}
+
+	// 上一次运行残留的任务状态，新的运行开始前会先写入plan key，事务中读取plan key即可保证这里列出的key没有被新的运行改写
+	ctx, _ := utils.GetContextWithTimeout()
+	stale, err := cli.KV.Get(ctx, common.BuildWorkflowTaskStatusKeyPrefix(workflowID, ""), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = concurrency.NewSTM(cli, func(s concurrency.STM) error {
+		planKey := common.BuildWorkflowPlanKey(workflowID, "")
+		if s.Get(planKey) != "" {
+			return errors.NewError(http.StatusBadRequest, "workflow正在运行中")
 		}
+
+		for _, kv := range stale.Kvs {
+			s.Del(string(kv.Key))
+		}
+		for _, v := range preserved {
+			states, _ := json.Marshal(v)
+			s.Put(common.BuildWorkflowTaskStatusKey(workflowID, "", v.ProjectID, v.TaskID), string(states))
+		}
+
+		newState, _ := json.Marshal(planState)
+		s.Put(planKey, string(newState))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &planState, nil
+}
+
+// setWorkflowChildPlanRunning 以子workflow的身份启动workflow的一次运行，该运行已存在时返回false
+func setWorkflowChildPlanRunning(cli *clientv3.Client, workflowID int64, runID string, parent *WorkflowParentInfo, params map[string]string) (*PlanState, bool, error) {
+	var (
+		planState PlanState
+		started   bool
+	)
+	_, err := concurrency.NewSTM(cli, func(s concurrency.STM) error {
+		planKey := common.BuildWorkflowPlanKey(workflowID, runID)
+		started = false
+		if s.Get(planKey) != "" {
+			return nil
+		}
+
+		now := time.Now().Unix()
+		planState = PlanState{
+			WorkflowID:    workflowID,
+			RunID:         runID,
+			StartTime:     now,
+			Status:        common.TASK_STATUS_RUNNING_V2,
+			LatestTryTime: now,
+			Parent:        parent,
+			Params:        params,
+		}
+		newState, _ := json.Marshal(planState)
+		s.Put(planKey, string(newState))
+		started = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &planState, started, nil
+}
+
+func clearWorkflowKeys(kv clientv3.KV, workflowID int64, runID string) error {
+	// 删除workflow相关的key，运行状态的key不能按前缀删除，否则会误删id以其为前缀的其他workflow
+	ctx, _ := utils.GetContextWithTimeout()
+	if _, err := kv.Delete(ctx, common.BuildWorkflowPlanKey(workflowID, runID)); err != nil {
+		return err
+	}
+	ctx, _ = utils.GetContextWithTimeout()
+	if _, err := kv.Delete(ctx, common.BuildWorkflowTaskStatusKeyPrefix(workflowID, runID), clientv3.WithPrefix()); err != nil {
+		return err
 	}
 	return nil
 }
 
+// excludeLostAgent agent失联后的重新调度不能再选中失联的agent，非失联重新调度时返回nil
+func excludeLostAgent(info *common.RescheduleInfo) AgentFilter {
+	if info == nil || info.LostAgentIP == "" {
+		return nil
+	}
+	lostAgentIP := info.LostAgentIP
+	return func(meta infra.NodeMeta) bool {
+		return meta.Host != lostAgentIP
+	}
+}
+
 // TemporarySchedulerTask 临时调度任务
 func (a *app) TemporarySchedulerTask(user *common.User, host string, task common.TaskInfo) error {
 	var (
@@ -562,19 +1121,27 @@ func (a *app) TemporarySchedulerTask(user *common.User, host string, task common
 		}
 	}
 
-	var stream *CenterClient
+	var (
+		stream  *CenterClient
+		filters []AgentFilter
+	)
+	if filter := excludeLostAgent(task.RescheduleInfo); filter != nil {
+		filters = append(filters, filter)
+	}
 	err = retry.Do(func() error {
 		if host == "" {
-			stream, err = a.GetAgentStreamRand(ctx, a.GetConfig().Micro.Region, task.ProjectID)
+			stream, err = a.GetAgentStreamRand(ctx, a.GetConfig().Micro.Region, task.ProjectID, filters...)
 			return err
 		} else {
 			stream, err = a.GetAgentStream(ctx, task.ProjectID, host)
 			return err
 		}
 	}, retry.Attempts(3))
-	if err != nil || (host != "" && stream == nil) {
-		if err == nil {
+	if err != nil || ((host != "" || len(filters) > 0) && stream == nil) {
+		if err == nil && host != "" {
 			err = fmt.Errorf("host %s is unavailable when the temporary task is scheduled", host)
+		} else if err == nil {
+			err = fmt.Errorf("no agent other than the lost agent %s is available", task.RescheduleInfo.LostAgentIP)
 		}
 		resultChan <- buildScheduleErrorResult(err)
 		goto scheduleError
@@ -636,15 +1203,26 @@ scheduleError:
 }
 
 func (a *app) SetTaskRunning(agentIP, agentVersion string, execInfo *common.TaskExecutingInfo) error {
-	runningInfo, _ := json.Marshal(common.TaskRunningInfo{
+	taskRunningInfo := common.TaskRunningInfo{
 		Status:    common.TASK_STATUS_RUNNING_V2,
 		TmpID:     execInfo.TmpID,
 		Timestamp: time.Now().Unix(),
 		AgentIP:   agentIP,
-	})
+		PlanTime:  execInfo.PlanTime.Unix(),
+	}
+	if execInfo.Task.FlowInfo != nil {
+		taskRunningInfo.WorkflowID = execInfo.Task.FlowInfo.WorkflowID
+	}
+	if execInfo.Task.RescheduleInfo != nil {
+		taskRunningInfo.Attempt = execInfo.Task.RescheduleInfo.Attempt
+	}
+	runningInfo, _ := json.Marshal(taskRunningInfo)
+
+	// 试运行的任务不记录任务执行日志，也不改变任务本身的运行状态
+	dryRun := execInfo.Task.FlowInfo != nil && execInfo.Task.FlowInfo.DryRun
 
 	// TODO: 如果不兼容v2.4.6版本，该if可以移除(仅判断移除，内部代码需保留)
-	if utils.CompareVersion("v2.4.6", agentVersion) {
+	if utils.CompareVersion("v2.4.6", agentVersion) && !dryRun {
 		var err error
 		tx := a.store.BeginTx()
 		defer func() {
@@ -669,6 +1247,7 @@ func (a *app) SetTaskRunning(agentIP, agentVersion string, execInfo *common.Task
 		_, err := concurrency.NewSTM(a.etcd.Client(), func(s concurrency.STM) error {
 			err := setWorkflowTaskRunning(s, WorkflowRunningTaskInfo{
 				WorkflowID: execInfo.Task.FlowInfo.WorkflowID,
+				RunID:      execInfo.Task.FlowInfo.RunID,
 				TmpID:      execInfo.TmpID,
 				TaskID:     execInfo.Task.TaskID,
 				TaskName:   execInfo.Task.Name,
@@ -678,10 +1257,15 @@ func (a *app) SetTaskRunning(agentIP, agentVersion string, execInfo *common.Task
 			if err != nil {
 				return err
 			}
-			s.Put(common.BuildTaskStatusKey(execInfo.Task.ProjectID, execInfo.Task.TaskID), string(runningInfo))
+			if !dryRun {
+				s.Put(common.BuildTaskStatusKey(execInfo.Task.ProjectID, execInfo.Task.TaskID), string(runningInfo))
+			}
 			a.PublishMessage(messageWorkflowTaskStatusChanged(execInfo.Task.FlowInfo.WorkflowID, execInfo.Task.ProjectID, execInfo.Task.TaskID, common.TASK_STATUS_RUNNING_V2))
 			return nil
 		})
+		if err == nil && !dryRun {
+			a.handleTaskStartedWebHook(agentIP, execInfo)
+		}
 		return err
 	}
 
@@ -701,6 +1285,7 @@ func (a *app) SetTaskRunning(agentIP, agentVersion string, execInfo *common.Task
 	}
 
 	a.PublishMessage(messageTaskStatusChanged(execInfo.Task.ProjectID, execInfo.Task.TaskID, execInfo.TmpID, common.TASK_STATUS_RUNNING_V2))
+	a.handleTaskStartedWebHook(agentIP, execInfo)
 	return nil
 }
 
@@ -840,6 +1425,11 @@ func (a *app) DelTaskRunningKey(agentIP string, projectID int64, taskID string)
 }
 
 func (a *app) SaveTaskLog(agentIP string, result common.TaskFinishedV2) {
+	if result.WorkflowDryRun {
+		// 试运行的任务没有实际执行，不记录任务执行日志
+		return
+	}
+
 	// log receive
 	logInfo := common.TaskLog{
 		Name:      result.TaskName,
@@ -852,6 +1442,7 @@ func (a *app) SaveTaskLog(agentIP string, result common.TaskFinishedV2) {
 		TaskID:    result.TaskID,
 		ProjectID: result.ProjectID,
 		PlanTime:  result.PlanTime,
+		Attempt:   result.Attempt,
 	}
 
 	opts := selection.NewSelector(selection.NewRequirement("id", selection.Equals, result.ProjectID))
@@ -905,6 +1496,11 @@ func (a *app) SaveTaskLog(agentIP string, result common.TaskFinishedV2) {
 }
 
 func (a *app) HandlerTaskFinished(agentIP string, result *common.TaskFinishedV2) error {
+	if result.WorkflowDryRun {
+		// 试运行的任务只推进workflow的运行，不涉及任务本身的状态及webhook
+		return a.workflowRunner.handleTaskResultV1(agentIP, result)
+	}
+
 	err := a.DelTaskRunningKey(agentIP, result.ProjectID, result.TaskID)
 	if err != nil {
 		return errors.NewError(http.StatusInternalServerError, "设置任务运行状态失败").WithLog(err.Error())
@@ -178,6 +178,24 @@ func (a *app) TemporaryTaskSchedule(tmpTask common.TemporaryTask) error {
 	if err = a.TemporarySchedulerTask(userInfo, tmpTask.Host, *task); err != nil {
 		return err
 	}
+
+	var operator string
+	if userInfo.ID != 0 {
+		operator = fmt.Sprintf("%s(%d)", userInfo.Name, userInfo.ID)
+	}
+	a.triggerWebHook(tmpTask.ProjectID, common.WEBHOOK_TYPE_TEMPORARY_TASK_SCHEDULED, time.Now(), func(p *common.Project) interface{} {
+		return common.WebHookTemporaryTaskBody{
+			TaskID:       task.TaskID,
+			TaskName:     task.Name,
+			ProjectID:    tmpTask.ProjectID,
+			ProjectName:  p.Title,
+			Command:      task.Command,
+			TmpID:        tmpTask.TmpID,
+			Host:         tmpTask.Host,
+			ScheduleTime: tmpTask.ScheduleTime,
+			Operator:     operator,
+		}
+	})
 	return nil
 }
 
@@ -2,15 +2,23 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/avast/retry-go/v4"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/holdno/gocommons/selection"
 	"github.com/jinzhu/gorm"
 	"github.com/spacegrower/watermelon/infra/wlog"
+	"github.com/spacegrower/watermelon/pkg/safe"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 
 	"github.com/holdno/gopherCron/common"
@@ -19,7 +27,8 @@ import (
 	"github.com/holdno/gopherCron/utils"
 )
 
-func (a *app) CreateWebHook(projectID int64, types, callbackUrl string) error {
+// CreateWebHook 创建webhook，format为空时推送CloudEvent，tmpl仅在自定义模板格式下使用
+func (a *app) CreateWebHook(projectID int64, types, callbackUrl, format, tmpl string) error {
 	hook, err := a.GetWebHook(projectID, types)
 	if err != nil {
 		return err
@@ -28,11 +37,25 @@ func (a *app) CreateWebHook(projectID int64, types, callbackUrl string) error {
 	if hook != nil {
 		return errors.NewError(http.StatusForbidden, "当前webhook类型已存在")
 	}
+	if !isValidWebHookType(types) {
+		return errors.NewError(http.StatusBadRequest, "不支持的webhook类型: "+types)
+	}
+	if err = validateWebHookFormat(types, format, tmpl); err != nil {
+		return err
+	}
+
+	secret, err := generateWebHookSecret()
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "生成webhook签名密钥失败").WithLog(err.Error())
+	}
 
 	err = a.store.WebHook().Create(common.WebHook{
 		CallbackURL: callbackUrl,
 		ProjectID:   projectID,
 		Type:        types,
+		Secret:      secret,
+		Format:      format,
+		Template:    tmpl,
 		CreateTime:  time.Now().Unix(),
 	})
 
@@ -45,6 +68,55 @@ func (a *app) CreateWebHook(projectID int64, types, callbackUrl string) error {
 	return nil
 }
 
+// UpdateWebHook 修改webhook的回调地址与推送格式，签名密钥保持不变，早期创建的webhook没有签名密钥时在此补充生成
+func (a *app) UpdateWebHook(projectID int64, types, callbackUrl, format, tmpl string) error {
+	hook, err := a.GetWebHook(projectID, types)
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return errors.NewError(http.StatusNotFound, "webhook不存在")
+	}
+	if err = validateWebHookFormat(types, format, tmpl); err != nil {
+		return err
+	}
+
+	hook.CallbackURL = callbackUrl
+	hook.Format = format
+	hook.Template = tmpl
+	if format != common.WEBHOOK_FORMAT_TEMPLATE {
+		hook.Template = ""
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = generateWebHookSecret(); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "生成webhook签名密钥失败").WithLog(err.Error())
+		}
+	}
+	if err = a.store.WebHook().Update(nil, *hook); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "更新webhook失败").WithLog(err.Error())
+	}
+	return nil
+}
+
+// RotateWebHookSecret 重新生成webhook的签名密钥并返回，旧密钥立即失效
+func (a *app) RotateWebHookSecret(projectID int64, types string) (string, error) {
+	hook, err := a.GetWebHook(projectID, types)
+	if err != nil {
+		return "", err
+	}
+	if hook == nil {
+		return "", errors.NewError(http.StatusNotFound, "webhook不存在")
+	}
+
+	if hook.Secret, err = generateWebHookSecret(); err != nil {
+		return "", errors.NewError(http.StatusInternalServerError, "生成webhook签名密钥失败").WithLog(err.Error())
+	}
+	if err = a.store.WebHook().Update(nil, *hook); err != nil {
+		return "", errors.NewError(http.StatusInternalServerError, "更新webhook签名密钥失败").WithLog(err.Error())
+	}
+	return hook.Secret, nil
+}
+
 func (a *app) GetWebHookList(projectID int64) ([]*common.WebHook, error) {
 	list, err := a.store.WebHook().GetList(projectID)
 	if err != nil && err != gorm.ErrRecordNotFound {
@@ -87,9 +159,93 @@ func (a *app) DeleteAllWebHook(tx *gorm.DB, projectID int64) error {
 		return errObj
 	}
 
+	err = a.store.WebHookDelivery().Clear(tx, selection.NewSelector(selection.NewRequirement("project_id", selection.Equals, projectID)))
+	if err != nil {
+		errObj := errors.ErrInternalError
+		errObj.Log = "[WebHook - DeleteAllWebHook] failed to clear webhook deliveries by project id: " + err.Error()
+		return errObj
+	}
+
+	// 死信随项目一起清理，失败不影响项目删除
+	if _, err = a.etcd.KV().Delete(context.TODO(), common.BuildWebhookDeadLetterKeyPrefix(projectID), clientv3.WithPrefix()); err != nil {
+		wlog.Error("failed to clear webhook dead letters", zap.Int64("project_id", projectID), zap.Error(err))
+	}
+
 	return nil
 }
 
+// generateWebHookSecret 生成webhook签名密钥
+func generateWebHookSecret() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// GetWebHookDeliveryList 获取项目下webhook的推送记录，types与status为空时不过滤
+func (a *app) GetWebHookDeliveryList(projectID int64, types, status string, page, pagesize uint64) ([]common.WebHookDelivery, int, error) {
+	opts := selection.NewSelector(selection.NewRequirement("project_id", selection.Equals, projectID))
+	if types != "" {
+		opts.AddQuery(selection.NewRequirement("type", selection.Equals, types))
+	}
+	if status != "" {
+		opts.AddQuery(selection.NewRequirement("status", selection.Equals, status))
+	}
+	list, err := a.store.WebHookDelivery().GetList(opts, page, pagesize)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, 0, errors.NewError(http.StatusInternalServerError, "获取webhook推送记录失败").WithLog(err.Error())
+	}
+
+	total, err := a.store.WebHookDelivery().GetTotal(opts)
+	if err != nil {
+		return nil, 0, errors.NewError(http.StatusInternalServerError, "获取webhook推送记录总数失败").WithLog(err.Error())
+	}
+	return list, total, nil
+}
+
+// RedeliverWebHook 将历史推送内容重新推送到该类型webhook当前的回调地址，只尝试一次，事件id保持不变便于接收方去重
+func (a *app) RedeliverWebHook(projectID, deliveryID int64) (*common.WebHookDelivery, error) {
+	origin, err := a.store.WebHookDelivery().GetOne(projectID, deliveryID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewError(http.StatusNotFound, "推送记录不存在")
+		}
+		return nil, errors.NewError(http.StatusInternalServerError, "获取webhook推送记录失败").WithLog(err.Error())
+	}
+
+	hook, err := a.GetWebHook(projectID, origin.Type)
+	if err != nil {
+		return nil, err
+	}
+	if hook == nil {
+		return nil, errors.NewError(http.StatusBadRequest, "该类型的webhook已被删除: "+origin.Type)
+	}
+	p, err := a.GetProject(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, errors.NewError(http.StatusNotFound, "项目不存在")
+	}
+
+	delivery, err := a.deliverWebHook(hook, p.Token, origin.EventID, []byte(origin.Payload), 1, origin.ID)
+	if err != nil {
+		wlog.Error("failed to redeliver webhook", zap.String("type", hook.Type), zap.Int64("project_id", projectID),
+			zap.Int64("delivery_id", deliveryID), zap.Error(err))
+	}
+	// 推送失败的原因记录在推送记录中，由调用方查看
+	return delivery, nil
+}
+
+// AutoCleanWebHookDeliveries 清理7天前的webhook推送记录
+func (a *app) AutoCleanWebHookDeliveries() {
+	opt := selection.NewSelector(selection.NewRequirement("create_time", selection.LessThan, time.Now().Unix()-86400*7))
+	if err := a.store.WebHookDelivery().Clear(nil, opt); err != nil {
+		wlog.Error("failed to clean webhook deliveries by auto clean", zap.Error(err))
+	}
+}
+
 func (a *app) DeleteAllWorkflowTask(tx *gorm.DB, projectID int64) error {
 	err := a.store.WorkflowTask().DeleteAll(tx, projectID)
 	if err != nil {
@@ -101,6 +257,146 @@ func (a *app) DeleteAllWorkflowTask(tx *gorm.DB, projectID int64) error {
 	return nil
 }
 
+// 支持订阅的webhook类型
+var webHookTypes = map[string]struct{}{
+	common.WEBHOOK_TYPE_TASK_RESULT:              {},
+	common.WEBHOOK_TYPE_TASK_FAILURE:             {},
+	common.WEBHOOK_TYPE_TASK_STARTED:             {},
+	common.WEBHOOK_TYPE_TASK_TIMEOUT:             {},
+	common.WEBHOOK_TYPE_TASK_SKIPPED:             {},
+	common.WEBHOOK_TYPE_WORKFLOW_STARTED:         {},
+	common.WEBHOOK_TYPE_WORKFLOW_FINISHED:        {},
+	common.WEBHOOK_TYPE_WORKFLOW_FAILED:          {},
+	common.WEBHOOK_TYPE_AGENT_ONLINE:             {},
+	common.WEBHOOK_TYPE_AGENT_OFFLINE:            {},
+	common.WEBHOOK_TYPE_TEMPORARY_TASK_SCHEDULED: {},
+}
+
+func isValidWebHookType(types string) bool {
+	_, exist := webHookTypes[types]
+	return exist
+}
+
+// isTaskTimeout 任务是否因超过超时时间被终止
+func isTaskTimeout(res *common.TaskFinishedV2) bool {
+	return res.Error != "" && strings.Contains(res.Error, context.DeadlineExceeded.Error())
+}
+
+// buildWebHookEvent 将事件负载封装为CloudEvent，返回事件id与请求内容
+func (a *app) buildWebHookEvent(subject, eventType string, data interface{}, eventTime time.Time) (string, []byte) {
+	event := cloudevents.NewEvent()
+	event.SetID(utils.GetStrID())
+	event.SetSubject(subject)
+	event.SetData(cloudevents.ApplicationJSON, data)
+	event.SetSource(fmt.Sprintf("%s-%d", common.GOPHERCRON_CENTER_NAME, a.ClusterID()))
+	event.SetType(eventType)
+	event.SetTime(eventTime)
+	reqData, _ := event.MarshalJSON()
+	return event.ID(), reqData
+}
+
+// 推送记录中保存的响应内容与错误信息的最大长度
+const (
+	webHookDeliveryResponseLimit = 512
+	webHookDeliveryErrorLimit    = 255
+)
+
+// deliverWebHook 对推送内容签名后回调一次webhook地址，并保存本次推送记录
+func (a *app) deliverWebHook(hook *common.WebHook, token, eventID string, reqData []byte, attempt int, redeliveryOf int64) (*common.WebHookDelivery, error) {
+	delivery := &common.WebHookDelivery{
+		ProjectID:    hook.ProjectID,
+		Type:         hook.Type,
+		EventID:      eventID,
+		CallbackURL:  hook.CallbackURL,
+		Payload:      string(reqData),
+		Attempt:      attempt,
+		RedeliveryOf: redeliveryOf,
+		Status:       common.WEBHOOK_DELIVERY_STATUS_FAILURE,
+		CreateTime:   time.Now().Unix(),
+	}
+
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, hook.CallbackURL, bytes.NewReader(reqData))
+		if err != nil {
+			return errors.NewError(http.StatusInternalServerError, err.Error())
+		}
+		if isCloudEventFormat(hook.Format) {
+			// 项目token仅兼容早期的cloudevent回调，聊天机器人及自定义模板的地址多为第三方服务，不能携带
+			req.Header.Add("Authorization", token)
+			req.Header.Set("Content-Type", "application/cloudevents+json")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		// 未设置secret的webhook(早期创建，尚未更新或重新生成密钥)不签名
+		if hook.Secret != "" {
+			timestamp := time.Now().Unix()
+			req.Header.Set(common.WEBHOOK_HEADER_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+			req.Header.Set(common.WEBHOOK_HEADER_SIGNATURE, common.SignWebHookPayload(hook.Secret, timestamp, reqData))
+		}
+
+		start := time.Now()
+		resp, err := a.httpClient.Do(req)
+		delivery.Latency = time.Since(start).Milliseconds()
+		if err != nil {
+			return errors.NewError(http.StatusInternalServerError, err.Error())
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, webHookDeliveryResponseLimit))
+		delivery.StatusCode = resp.StatusCode
+		delivery.Response = strings.ToValidUTF8(string(body), "")
+		if resp.StatusCode != http.StatusOK {
+			return errors.NewError(resp.StatusCode, "回调响应失败，"+resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		delivery.Error = err.Error()
+		if len(delivery.Error) > webHookDeliveryErrorLimit {
+			delivery.Error = strings.ToValidUTF8(delivery.Error[:webHookDeliveryErrorLimit], "")
+		}
+	} else {
+		delivery.Status = common.WEBHOOK_DELIVERY_STATUS_SUCCESS
+	}
+
+	if serr := a.store.WebHookDelivery().Create(nil, delivery); serr != nil {
+		wlog.Error("failed to save webhook delivery", zap.String("type", hook.Type), zap.Int64("project_id", hook.ProjectID),
+			zap.String("event_id", eventID), zap.Error(serr))
+	}
+	return delivery, err
+}
+
+// triggerWebHook 将事件加入项目下订阅了hookType的webhook的推送队列，buildData根据项目信息生成事件负载
+func (a *app) triggerWebHook(projectID int64, hookType string, eventTime time.Time, buildData func(p *common.Project) interface{}) {
+	go safe.Run(func() {
+		hook, err := a.GetWebHook(projectID, hookType)
+		if err != nil {
+			wlog.Error("failed to get webhook", zap.String("type", hookType), zap.Int64("project_id", projectID), zap.Error(err))
+			return
+		}
+		if hook == nil {
+			return
+		}
+		p, err := a.GetProject(projectID)
+		if err != nil || p == nil {
+			return
+		}
+
+		wlog.Debug("handle webhook", zap.String("type", hookType), zap.Int64("project_id", projectID))
+		eventID, reqData, err := a.buildWebHookPayload(hook, hookType, hookType, buildData(p), eventTime)
+		if err != nil {
+			wlog.Error("failed to build webhook payload", zap.String("type", hookType), zap.Int64("project_id", projectID), zap.Error(err))
+			return
+		}
+		a.enqueueWebHook(WebHookJob{
+			ProjectID: projectID,
+			Type:      hookType,
+			EventID:   eventID,
+			Payload:   string(reqData),
+		})
+	})
+}
+
 func (a *app) HandleWebHook(agentIP string, res *common.TaskFinishedV2) error {
 	hooks, err := a.GetWebHookList(res.ProjectID)
 	if err != nil {
@@ -119,6 +415,27 @@ func (a *app) HandleWebHook(agentIP string, res *common.TaskFinishedV2) error {
 			hookURLMaps[v.CallbackURL] = &sync.Once{}
 		}
 	}
+
+	buildBody := func(p *common.Project) interface{} {
+		return common.WebHookBody{
+			TaskID:      res.TaskID,
+			TaskName:    res.TaskName,
+			ProjectID:   res.ProjectID,
+			ProjectName: p.Title,
+			Command:     res.Command,
+			StartTime:   res.StartTime,
+			EndTime:     res.EndTime,
+			ClientIP:    agentIP,
+			Result:      res.Result,
+			Error:       res.Error,
+			TmpID:       res.TmpID,
+			Operator:    res.Operator,
+		}
+	}
+	if hookMaps[common.WEBHOOK_TYPE_TASK_TIMEOUT] != nil && isTaskTimeout(res) {
+		a.triggerWebHook(res.ProjectID, common.WEBHOOK_TYPE_TASK_TIMEOUT, time.Unix(res.EndTime, 0), buildBody)
+	}
+
 	// 任务没报错，也没有任务结束钩子的话，提前终止运行
 	if res.Error == "" && hookMaps[common.WEBHOOK_TYPE_TASK_RESULT] == nil {
 		return nil
@@ -135,66 +452,30 @@ func (a *app) HandleWebHook(agentIP string, res *common.TaskFinishedV2) error {
 		return nil
 	}
 
-	body := common.WebHookBody{
-		TaskID:      res.TaskID,
-		TaskName:    res.TaskName,
-		ProjectID:   res.ProjectID,
-		ProjectName: p.Title,
-		Command:     res.Command,
-		StartTime:   res.StartTime,
-		EndTime:     res.EndTime,
-		ClientIP:    agentIP,
-		Result:      res.Result,
-		Error:       res.Error,
-		TmpID:       res.TmpID,
-		Operator:    res.Operator,
-	}
-
 	var eventType = "succeeded"
 	if res.Error != "" {
 		eventType = "failure"
 	}
-	event := cloudevents.NewEvent()
-	event.SetID(utils.GetStrID())
-	event.SetSubject(common.WEBHOOK_TYPE_TASK_RESULT)
-	event.SetData(cloudevents.ApplicationJSON, body)
-	event.SetSource(fmt.Sprintf("%s-%d", common.GOPHERCRON_CENTER_NAME, a.ClusterID()))
-	event.SetType(eventType)
-	event.SetTime(time.Unix(res.EndTime, 0))
-	reqData, _ := event.MarshalJSON()
+	body := buildBody(p)
 
-	handleFunc := func(hook *common.WebHook) error {
-		var err error
+	handleFunc := func(hook *common.WebHook) {
+		// 同一回调地址只推送一次
 		hookURLMaps[hook.CallbackURL].Do(func() {
-			err = retry.Do(func() error {
-				req, _ := http.NewRequest(http.MethodPost, hook.CallbackURL, bytes.NewReader(reqData))
-				req.Header.Add("Authorization", p.Token)
-				resp, err := a.httpClient.Do(req)
-				if err != nil {
-					return errors.NewError(http.StatusInternalServerError, err.Error())
-				}
-				defer resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					return errors.NewError(resp.StatusCode, "回调响应失败，"+resp.Status)
-				}
-				return nil
-			}, retry.Attempts(5), retry.DelayType(retry.BackOffDelay),
-				retry.MaxJitter(time.Minute), retry.LastErrorOnly(true))
-		})
-
-		if err != nil {
-			a.Metrics().CustomInc("handle_webhook", a.GetIP(), fmt.Sprintf("%d", hook.ProjectID))
-			wlog.Error("failed to handle webhook", zap.String("type", hook.Type),
-				zap.Int64("project_id", res.ProjectID), zap.String("task_id", res.TaskID), zap.Error(err))
-			a.Warning(warning.NewTaskWarningData(warning.TaskWarning{
-				AgentIP:   a.localip,
-				TaskName:  res.TaskName,
-				TaskID:    res.TaskID,
+			eventID, reqData, err := a.buildWebHookPayload(hook, common.WEBHOOK_TYPE_TASK_RESULT, eventType, body, time.Unix(res.EndTime, 0))
+			if err != nil {
+				wlog.Error("failed to build webhook payload", zap.String("type", hook.Type), zap.Int64("project_id", res.ProjectID),
+					zap.String("task_id", res.TaskID), zap.Error(err))
+				return
+			}
+			a.enqueueWebHook(WebHookJob{
 				ProjectID: res.ProjectID,
-				Message:   fmt.Sprintf("webhook request error %s, callback-url: %s", err.Error(), hook.CallbackURL),
-			}))
-		}
-		return err
+				Type:      hook.Type,
+				EventID:   eventID,
+				Payload:   string(reqData),
+				TaskID:    res.TaskID,
+				TaskName:  res.TaskName,
+			})
+		})
 	}
 
 	if eventType == "failure" && hookMaps[common.WEBHOOK_TYPE_TASK_FAILURE] != nil {
@@ -207,3 +488,99 @@ func (a *app) HandleWebHook(agentIP string, res *common.TaskFinishedV2) error {
 
 	return nil
 }
+
+// handleTaskStartedWebHook 任务开始执行
+func (a *app) handleTaskStartedWebHook(agentIP string, execInfo *common.TaskExecutingInfo) {
+	startTime := time.Now()
+	a.triggerWebHook(execInfo.Task.ProjectID, common.WEBHOOK_TYPE_TASK_STARTED, startTime, func(p *common.Project) interface{} {
+		return common.WebHookBody{
+			TaskID:      execInfo.Task.TaskID,
+			TaskName:    execInfo.Task.Name,
+			ProjectID:   execInfo.Task.ProjectID,
+			ProjectName: p.Title,
+			Command:     execInfo.Task.Command,
+			StartTime:   startTime.Unix(),
+			ClientIP:    agentIP,
+			TmpID:       execInfo.TmpID,
+		}
+	})
+}
+
+// HandleTaskSkipped agent上一次执行尚未结束，跳过了本次调度
+func (a *app) HandleTaskSkipped(agentIP string, res *common.TaskFinishedV2) {
+	a.PublishMessage(messageTaskStatusChanged(res.ProjectID, res.TaskID, res.TmpID, common.TASK_STATUS_SKIPPED_V2))
+	// agent上的告警不经过中心，由中心再次告警以便按告警路由通知到人
+	a.Warning(warning.NewTaskWarningData(warning.TaskWarning{
+		AgentIP:   agentIP,
+		TaskName:  res.TaskName,
+		TaskID:    res.TaskID,
+		ProjectID: res.ProjectID,
+		Message:   res.Error,
+	}))
+	a.triggerWebHook(res.ProjectID, common.WEBHOOK_TYPE_TASK_SKIPPED, time.Unix(res.EndTime, 0), func(p *common.Project) interface{} {
+		return common.WebHookBody{
+			TaskID:      res.TaskID,
+			TaskName:    res.TaskName,
+			ProjectID:   res.ProjectID,
+			ProjectName: p.Title,
+			Command:     res.Command,
+			StartTime:   res.StartTime,
+			EndTime:     res.EndTime,
+			ClientIP:    agentIP,
+			Error:       res.Error,
+			TmpID:       res.TmpID,
+		}
+	})
+}
+
+// handleWorkflowWebHook workflow开始或结束，事件推送给workflow中任务所属的各个项目
+func (a *app) handleWorkflowWebHook(hookType string, plan *WorkflowPlan, state PlanState) {
+	if state.DryRun {
+		return
+	}
+	eventTime := time.Unix(state.StartTime, 0)
+	if state.EndTime > 0 {
+		eventTime = time.Unix(state.EndTime, 0)
+	}
+	for _, projectID := range plan.projectIDs() {
+		a.triggerWebHook(projectID, hookType, eventTime, func(p *common.Project) interface{} {
+			return common.WebHookWorkflowBody{
+				WorkflowID:    plan.Workflow.ID,
+				WorkflowTitle: plan.Workflow.Title,
+				RunID:         state.RunID,
+				ProjectID:     p.ID,
+				ProjectName:   p.Title,
+				Status:        state.Status,
+				StartTime:     state.StartTime,
+				EndTime:       state.EndTime,
+				Reason:        state.Reason,
+				Params:        state.Params,
+			}
+		})
+	}
+}
+
+// handleAgentWebHook agent上线或下线
+func (a *app) handleAgentWebHook(hookType, agentIP string, projectIDs []int64) {
+	handled := make(map[int64]bool)
+	for _, projectID := range projectIDs {
+		if handled[projectID] {
+			continue
+		}
+		handled[projectID] = true
+		a.triggerWebHook(projectID, hookType, time.Now(), func(p *common.Project) interface{} {
+			return common.WebHookAgentBody{
+				AgentIP:     agentIP,
+				ProjectID:   p.ID,
+				ProjectName: p.Title,
+			}
+		})
+	}
+}
+
+// HandleAgentRegistered agent注册到中心
+func (a *app) HandleAgentRegistered(agentIP string, projectIDs []int64) {
+	// 上次退出时留下的记录不能影响本次连接的失联跟踪
+	a.clearAgentDraining(agentIP)
+	a.handleAgentWebHook(common.WEBHOOK_TYPE_AGENT_ONLINE, agentIP, projectIDs)
+}
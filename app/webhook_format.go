@@ -0,0 +1,246 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+// webhook类型对应的消息标题
+var webHookTitles = map[string]string{
+	common.WEBHOOK_TYPE_TASK_RESULT:              "任务执行结束",
+	common.WEBHOOK_TYPE_TASK_FAILURE:             "任务执行失败",
+	common.WEBHOOK_TYPE_TASK_STARTED:             "任务开始执行",
+	common.WEBHOOK_TYPE_TASK_TIMEOUT:             "任务执行超时",
+	common.WEBHOOK_TYPE_TASK_SKIPPED:             "任务跳过本次调度",
+	common.WEBHOOK_TYPE_WORKFLOW_STARTED:         "Workflow开始运行",
+	common.WEBHOOK_TYPE_WORKFLOW_FINISHED:        "Workflow运行结束",
+	common.WEBHOOK_TYPE_WORKFLOW_FAILED:          "Workflow运行失败",
+	common.WEBHOOK_TYPE_AGENT_ONLINE:             "Agent上线",
+	common.WEBHOOK_TYPE_AGENT_OFFLINE:            "Agent下线",
+	common.WEBHOOK_TYPE_TEMPORARY_TASK_SCHEDULED: "临时任务已调度",
+}
+
+// 测试推送的事件类型
+const webHookTestEventType = "test"
+
+func isValidWebHookFormat(format string) bool {
+	switch format {
+	case "", common.WEBHOOK_FORMAT_CLOUDEVENT, common.WEBHOOK_FORMAT_DINGTALK, common.WEBHOOK_FORMAT_FEISHU,
+		common.WEBHOOK_FORMAT_SLACK, common.WEBHOOK_FORMAT_WECOM, common.WEBHOOK_FORMAT_TEMPLATE:
+		return true
+	}
+	return false
+}
+
+func isCloudEventFormat(format string) bool {
+	return format == "" || format == common.WEBHOOK_FORMAT_CLOUDEVENT
+}
+
+func webHookTitle(hookType, eventType string) string {
+	title := webHookTitles[hookType]
+	if hookType == common.WEBHOOK_TYPE_TASK_RESULT {
+		switch eventType {
+		case "succeeded":
+			title = "任务执行成功"
+		case "failure":
+			title = "任务执行失败"
+		}
+	}
+	if title == "" {
+		title = hookType
+	}
+	if eventType == webHookTestEventType {
+		title += "(测试)"
+	}
+	return title
+}
+
+// webHookSummary 生成事件的文字摘要，用于聊天机器人消息
+func webHookSummary(data common.WebHookTemplateData) string {
+	lines := []string{fmt.Sprintf("[gopherCron] %s", webHookTitle(data.Type, data.EventType))}
+	add := func(name, value string) {
+		if value != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+		}
+	}
+	switch body := data.Data.(type) {
+	case common.WebHookBody:
+		add("项目", body.ProjectName)
+		add("任务", body.TaskName)
+		add("节点", body.ClientIP)
+		add("操作人", body.Operator)
+		add("错误", body.Error)
+	case common.WebHookWorkflowBody:
+		add("Workflow", body.WorkflowTitle)
+		add("项目", body.ProjectName)
+		add("状态", body.Status)
+		add("原因", body.Reason)
+	case common.WebHookAgentBody:
+		add("项目", body.ProjectName)
+		add("Agent", body.AgentIP)
+	case common.WebHookTemporaryTaskBody:
+		add("项目", body.ProjectName)
+		add("任务", body.TaskName)
+		add("指定节点", body.Host)
+		add("操作人", body.Operator)
+	}
+	add("时间", data.Time.Format(time.DateTime))
+	return strings.Join(lines, "\n")
+}
+
+func parseWebHookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Option("missingkey=error").Funcs(template.FuncMap{
+		// 将值编码为json，用于在json模板中安全地嵌入字符串
+		"json": func(v interface{}) (string, error) {
+			raw, err := json.Marshal(v)
+			return string(raw), err
+		},
+	}).Parse(text)
+}
+
+// renderWebHookPayload 按webhook的推送格式生成聊天机器人消息或自定义模板内容，cloudevent格式不在此处理
+func renderWebHookPayload(format, text string, data common.WebHookTemplateData) ([]byte, error) {
+	data.Summary = webHookSummary(data)
+	switch format {
+	case common.WEBHOOK_FORMAT_DINGTALK, common.WEBHOOK_FORMAT_WECOM, common.WEBHOOK_FORMAT_FEISHU, common.WEBHOOK_FORMAT_SLACK:
+		return common.BuildChatRobotMessage(format, data.Summary)
+	case common.WEBHOOK_FORMAT_TEMPLATE:
+		tpl, err := parseWebHookTemplate(text)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(nil)
+		if err = tpl.Execute(buf, data); err != nil {
+			return nil, err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("模板渲染结果不是合法的json")
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("不支持的推送格式: %s", format)
+	}
+}
+
+// sampleWebHookData 生成各类型webhook的示例负载，用于模板校验与测试推送
+func sampleWebHookData(hookType string, p *common.Project) interface{} {
+	now := time.Now().Unix()
+	switch hookType {
+	case common.WEBHOOK_TYPE_WORKFLOW_STARTED, common.WEBHOOK_TYPE_WORKFLOW_FINISHED, common.WEBHOOK_TYPE_WORKFLOW_FAILED:
+		return common.WebHookWorkflowBody{
+			WorkflowID:    1,
+			WorkflowTitle: "test-workflow",
+			ProjectID:     p.ID,
+			ProjectName:   p.Title,
+			Status:        common.TASK_STATUS_DONE_V2,
+			StartTime:     now,
+			EndTime:       now,
+			Params:        map[string]string{},
+		}
+	case common.WEBHOOK_TYPE_AGENT_ONLINE, common.WEBHOOK_TYPE_AGENT_OFFLINE:
+		return common.WebHookAgentBody{
+			AgentIP:     "127.0.0.1",
+			ProjectID:   p.ID,
+			ProjectName: p.Title,
+		}
+	case common.WEBHOOK_TYPE_TEMPORARY_TASK_SCHEDULED:
+		return common.WebHookTemporaryTaskBody{
+			TaskID:       "test-task",
+			TaskName:     "test-task",
+			ProjectID:    p.ID,
+			ProjectName:  p.Title,
+			Command:      "echo test",
+			TmpID:        "test",
+			ScheduleTime: now,
+			Operator:     "admin(1)",
+		}
+	default:
+		return common.WebHookBody{
+			TaskID:      "test-task",
+			TaskName:    "test-task",
+			ProjectID:   p.ID,
+			ProjectName: p.Title,
+			Command:     "echo test",
+			StartTime:   now,
+			EndTime:     now,
+			Result:      "test",
+			ClientIP:    "127.0.0.1",
+			TmpID:       "test",
+			Operator:    "admin(1)",
+		}
+	}
+}
+
+// validateWebHookFormat 校验推送格式，自定义模板使用该类型webhook的示例负载试渲染
+func validateWebHookFormat(hookType, format, text string) error {
+	if !isValidWebHookFormat(format) {
+		return errors.NewError(http.StatusBadRequest, "不支持的推送格式: "+format)
+	}
+	if format != common.WEBHOOK_FORMAT_TEMPLATE {
+		return nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.NewError(http.StatusBadRequest, "自定义推送格式需要提供模板")
+	}
+	_, err := renderWebHookPayload(format, text, common.WebHookTemplateData{
+		Type:      hookType,
+		EventType: webHookTestEventType,
+		EventID:   "test",
+		Time:      time.Now(),
+		Data:      sampleWebHookData(hookType, &common.Project{ID: 1, Title: "test-project"}),
+	})
+	if err != nil {
+		return errors.NewError(http.StatusBadRequest, "推送模板错误: "+err.Error())
+	}
+	return nil
+}
+
+// buildWebHookPayload 按webhook的推送格式生成推送内容，返回事件id与请求内容
+func (a *app) buildWebHookPayload(hook *common.WebHook, subject, eventType string, data interface{}, eventTime time.Time) (string, []byte, error) {
+	eventID, reqData := a.buildWebHookEvent(subject, eventType, data, eventTime)
+	if isCloudEventFormat(hook.Format) {
+		return eventID, reqData, nil
+	}
+	payload, err := renderWebHookPayload(hook.Format, hook.Template, common.WebHookTemplateData{
+		Type:      hook.Type,
+		EventType: eventType,
+		EventID:   eventID,
+		Time:      eventTime,
+		Data:      data,
+	})
+	return eventID, payload, err
+}
+
+// TestWebHook 使用示例负载向webhook推送一次测试事件，返回推送记录
+func (a *app) TestWebHook(projectID int64, types string) (*common.WebHookDelivery, error) {
+	hook, err := a.GetWebHook(projectID, types)
+	if err != nil {
+		return nil, err
+	}
+	if hook == nil {
+		return nil, errors.NewError(http.StatusNotFound, "webhook不存在")
+	}
+	p, err := a.GetProject(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, errors.NewError(http.StatusNotFound, "项目不存在")
+	}
+
+	eventID, payload, err := a.buildWebHookPayload(hook, types, webHookTestEventType, sampleWebHookData(types, p), time.Now())
+	if err != nil {
+		return nil, errors.NewError(http.StatusBadRequest, "生成推送内容失败: "+err.Error())
+	}
+	// 推送失败的原因记录在推送记录中
+	delivery, _ := a.deliverWebHook(hook, p.Token, eventID, payload, 1, 0)
+	return delivery, nil
+}
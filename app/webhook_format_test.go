@@ -0,0 +1,63 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+)
+
+func TestRenderWebHookPayload(t *testing.T) {
+	data := common.WebHookTemplateData{
+		Type:      common.WEBHOOK_TYPE_TASK_RESULT,
+		EventType: "failure",
+		EventID:   "1",
+		Time:      time.Unix(1700000000, 0),
+		Data:      common.WebHookBody{TaskName: "backup", ProjectName: "ops", Error: "exit status 1"},
+	}
+
+	raw, err := renderWebHookPayload(common.WEBHOOK_FORMAT_FEISHU, "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feishu struct {
+		MsgType string `json:"msg_type"`
+		Content struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err = json.Unmarshal(raw, &feishu); err != nil {
+		t.Fatal(err)
+	}
+	if feishu.MsgType != "text" || !strings.Contains(feishu.Content.Text, "任务执行失败") || !strings.Contains(feishu.Content.Text, "任务: backup") {
+		t.Fatalf("unexpected feishu payload: %s", raw)
+	}
+
+	raw, err = renderWebHookPayload(common.WEBHOOK_FORMAT_TEMPLATE, `{"text": {{ json .Data.TaskName }}, "id": "{{ .EventID }}"}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"text": "backup", "id": "1"}` {
+		t.Fatalf("unexpected template payload: %s", raw)
+	}
+}
+
+func TestValidateWebHookFormat(t *testing.T) {
+	if err := validateWebHookFormat(common.WEBHOOK_TYPE_TASK_RESULT, "", ""); err != nil {
+		t.Fatalf("cloudevent format should be valid: %v", err)
+	}
+	if err := validateWebHookFormat(common.WEBHOOK_TYPE_TASK_RESULT, "unknown", ""); err == nil {
+		t.Fatal("unknown format should be rejected")
+	}
+	if err := validateWebHookFormat(common.WEBHOOK_TYPE_TASK_RESULT, common.WEBHOOK_FORMAT_TEMPLATE, `{"text": {{ json .Data.WorkflowTitle }}}`); err == nil {
+		t.Fatal("template referencing a field missing from the payload should be rejected")
+	}
+	if err := validateWebHookFormat(common.WEBHOOK_TYPE_WORKFLOW_FAILED, common.WEBHOOK_FORMAT_TEMPLATE, `{"text": {{ json .Data.WorkflowTitle }}}`); err != nil {
+		t.Fatalf("workflow template should be valid: %v", err)
+	}
+	if err := validateWebHookFormat(common.WEBHOOK_TYPE_TASK_RESULT, common.WEBHOOK_FORMAT_TEMPLATE, `text {{ .Data.TaskName }}`); err == nil {
+		t.Fatal("template rendering non-json content should be rejected")
+	}
+}
@@ -0,0 +1,395 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/pkg/queue"
+	"github.com/holdno/gopherCron/pkg/warning"
+)
+
+const (
+	// 单个webhook最多推送次数，超过后进入死信列表
+	webHookMaxAttempts = 5
+	// 同一回调地址同时推送的最大数量
+	webHookEndpointConcurrency = 4
+	// 从队列中取出、尚未推送完成的最大数量，等待重试的推送不占用
+	webHookMaxPending = 1000
+	// 检查等待重试的推送是否到达重试时间的间隔
+	webHookDelayCheckInterval = time.Second
+	// 回调地址推送数已满时推送转为等待的时长，不计入推送次数
+	webHookEndpointBusyDelay = 2 * time.Second
+	// 首次重试的等待时间，之后每次翻倍
+	webHookRetryBaseDelay = 10 * time.Second
+	webHookRetryMaxDelay  = 10 * time.Minute
+)
+
+// WebHookJob webhook推送队列中的一次推送
+type WebHookJob struct {
+	ID         string `json:"id"` // 由事件id与webhook类型组成
+	ProjectID  int64  `json:"project_id"`
+	Type       string `json:"type"`
+	EventID    string `json:"event_id"`
+	Payload    string `json:"payload"`
+	TaskID     string `json:"task_id,omitempty"` // 任务相关的事件，推送失败时按任务告警
+	TaskName   string `json:"task_name,omitempty"`
+	Attempt    int    `json:"attempt"`              // 已推送次数
+	NotBefore  int64  `json:"not_before,omitempty"` // 重试前需等待至该时间
+	LastError  string `json:"last_error,omitempty"`
+	CreateTime int64  `json:"create_time"`
+	FailedTime int64  `json:"failed_time,omitempty"` // 进入死信列表的时间
+}
+
+func webHookRetryDelay(attempt int) time.Duration {
+	delay := webHookRetryBaseDelay
+	for i := 1; i < attempt && delay < webHookRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > webHookRetryMaxDelay {
+		delay = webHookRetryMaxDelay
+	}
+	return delay
+}
+
+// enqueueWebHook 将推送加入etcd中的推送队列，由webhook推送节点异步推送，中心重启不会丢失待推送的事件
+func (a *app) enqueueWebHook(job WebHookJob) {
+	job.ID = fmt.Sprintf("%s-%s", job.EventID, job.Type)
+	job.CreateTime = time.Now().Unix()
+	raw, _ := json.Marshal(job)
+	if err := queue.New(a.ctx, a.GetEtcdClient(), common.BuildWebhookQueueKey()).Enqueue(string(raw)); err != nil {
+		a.Metrics().CustomInc("handle_webhook", a.GetIP(), fmt.Sprintf("%d", job.ProjectID))
+		wlog.Error("failed to enqueue webhook", zap.String("type", job.Type), zap.Int64("project_id", job.ProjectID),
+			zap.String("event_id", job.EventID), zap.Error(err))
+		a.Warning(warning.NewSystemWarningData(warning.SystemWarning{
+			Endpoint: a.GetIP(),
+			Type:     warning.SERVICE_TYPE_CENTER,
+			Message:  fmt.Sprintf("webhook enqueue error %s, project: %d, type: %s", err.Error(), job.ProjectID, job.Type),
+		}))
+	}
+}
+
+func startWebHookDelivery(app *app) {
+	app.election(common.BuildWebhookMasterKey(), func(s *concurrency.Session) error {
+		wlog.Info("new webhook delivery leader")
+		app.metrics.CustomInc("webhook_delivery_leader", app.localip, "")
+
+		ctx, cancel := context.WithCancel(app.ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.Done():
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+
+		d := &webHookDispatcher{
+			app:       app,
+			ctx:       ctx,
+			pending:   make(chan struct{}, webHookMaxPending),
+			endpoints: make(map[string]chan struct{}),
+		}
+		d.recoverInflight()
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.promoteDelayed()
+		}()
+		d.run()
+		d.wg.Wait()
+		return nil
+	})
+}
+
+// webHookDispatcher 消费webhook推送队列，只在webhook推送节点(WEBHOOK_MASTER)上运行
+type webHookDispatcher struct {
+	app     *app
+	ctx     context.Context
+	pending chan struct{}
+	wg      sync.WaitGroup
+
+	locker    sync.Mutex
+	endpoints map[string]chan struct{}
+}
+
+// recoverInflight 上一任推送节点取出后未完成的推送重新入队
+func (d *webHookDispatcher) recoverInflight() {
+	cli := d.app.GetEtcdClient()
+	resp, err := cli.Get(d.ctx, common.BuildWebhookInflightKeyPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		wlog.Error("failed to get inflight webhooks", zap.Error(err))
+		return
+	}
+	q := queue.New(d.ctx, cli, common.BuildWebhookQueueKey())
+	for _, kv := range resp.Kvs {
+		if err = q.EnqueueWithOps(string(kv.Value), clientv3.OpDelete(string(kv.Key))); err != nil {
+			wlog.Error("failed to requeue inflight webhook", zap.String("key", string(kv.Key)), zap.Error(err))
+		}
+	}
+}
+
+// promoteDelayed 将到达重试时间的推送重新入队
+func (d *webHookDispatcher) promoteDelayed() {
+	cli := d.app.GetEtcdClient()
+	q := queue.New(d.ctx, cli, common.BuildWebhookQueueKey())
+	ticker := time.NewTicker(webHookDelayCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+
+		resp, err := cli.Get(d.ctx, common.BuildWebhookDelayKeyPrefix(), clientv3.WithPrefix())
+		if err != nil {
+			if d.ctx.Err() == nil {
+				wlog.Error("failed to get delayed webhooks", zap.Error(err))
+			}
+			continue
+		}
+		now := time.Now().Unix()
+		for _, kv := range resp.Kvs {
+			var job WebHookJob
+			if err = json.Unmarshal(kv.Value, &job); err == nil && job.NotBefore > now {
+				continue
+			}
+			if err = q.EnqueueWithOps(string(kv.Value), clientv3.OpDelete(string(kv.Key))); err != nil {
+				wlog.Error("failed to requeue delayed webhook", zap.String("key", string(kv.Key)), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (d *webHookDispatcher) run() {
+	cli := d.app.GetEtcdClient()
+	q := queue.New(d.ctx, cli, common.BuildWebhookQueueKey())
+	for {
+		select {
+		case d.pending <- struct{}{}:
+		case <-d.ctx.Done():
+			return
+		}
+
+		// 出队与记录为推送中在同一事务中完成，记录失败时推送保留在队列中，推送节点异常退出后可由新的推送节点恢复
+		value, err := q.DequeueWithOps(func(val string) []clientv3.Op {
+			var job WebHookJob
+			if err := json.Unmarshal([]byte(val), &job); err != nil {
+				return nil
+			}
+			return []clientv3.Op{clientv3.OpPut(common.BuildWebhookInflightKey(job.ID), val)}
+		})
+		if err != nil {
+			<-d.pending
+			if d.ctx.Err() != nil {
+				return
+			}
+			wlog.Error("failed to dequeue webhook", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var job WebHookJob
+		if err = json.Unmarshal([]byte(value), &job); err != nil {
+			<-d.pending
+			wlog.Error("failed to unmarshal webhook job", zap.String("value", value), zap.Error(err))
+			continue
+		}
+
+		d.wg.Add(1)
+		go func() {
+			defer func() {
+				<-d.pending
+				d.wg.Done()
+			}()
+			d.process(job)
+		}()
+	}
+}
+
+func (d *webHookDispatcher) endpoint(callbackURL string) chan struct{} {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	sem, exist := d.endpoints[callbackURL]
+	if !exist {
+		sem = make(chan struct{}, webHookEndpointConcurrency)
+		d.endpoints[callbackURL] = sem
+	}
+	return sem
+}
+
+func (d *webHookDispatcher) process(job WebHookJob) {
+	if job.NotBefore > time.Now().Unix() {
+		// 未到重试时间，转为等待重试，不占用推送中的数量
+		d.delay(job)
+		return
+	}
+
+	hook, err := d.app.GetWebHook(job.ProjectID, job.Type)
+	if err != nil {
+		d.retry(job, err)
+		return
+	}
+	p, err := d.app.GetProject(job.ProjectID)
+	if err != nil {
+		d.retry(job, err)
+		return
+	}
+	if hook == nil || p == nil {
+		// webhook或项目已被删除，不再推送
+		d.finish(job)
+		return
+	}
+
+	// 回调地址的推送数已满时不在此等待，否则一个响应缓慢的回调地址会占满推送中的数量，阻塞其他地址的推送
+	sem := d.endpoint(hook.CallbackURL)
+	select {
+	case sem <- struct{}{}:
+	default:
+		job.NotBefore = time.Now().Add(webHookEndpointBusyDelay).Unix()
+		d.delay(job)
+		return
+	}
+	_, err = d.app.deliverWebHook(hook, p.Token, job.EventID, []byte(job.Payload), job.Attempt+1, 0)
+	<-sem
+
+	job.Attempt++
+	if err != nil {
+		d.retry(job, err)
+		return
+	}
+	d.finish(job)
+}
+
+func (d *webHookDispatcher) finish(job WebHookJob) {
+	if _, err := d.app.GetEtcdClient().Delete(d.ctx, common.BuildWebhookInflightKey(job.ID)); err != nil {
+		wlog.Error("failed to delete inflight webhook", zap.String("id", job.ID), zap.Error(err))
+	}
+}
+
+// retry 推送失败后延迟重新入队，超过最大推送次数后进入死信列表
+func (d *webHookDispatcher) retry(job WebHookJob, reason error) {
+	job.LastError = reason.Error()
+	if job.Attempt >= webHookMaxAttempts {
+		d.deadLetter(job)
+		return
+	}
+
+	job.NotBefore = time.Now().Add(webHookRetryDelay(job.Attempt)).Unix()
+	d.delay(job)
+}
+
+// delay 推送转为等待重试，到达重试时间后由promoteDelayed重新入队
+func (d *webHookDispatcher) delay(job WebHookJob) {
+	raw, _ := json.Marshal(job)
+	_, err := d.app.GetEtcdClient().Txn(d.ctx).Then(
+		clientv3.OpPut(common.BuildWebhookDelayKey(job.ID), string(raw)),
+		clientv3.OpDelete(common.BuildWebhookInflightKey(job.ID)),
+	).Commit()
+	if err != nil {
+		// 保留推送中记录，由下一任推送节点恢复
+		wlog.Error("failed to delay webhook", zap.String("id", job.ID), zap.Error(err))
+	}
+}
+
+func (d *webHookDispatcher) deadLetter(job WebHookJob) {
+	job.FailedTime = time.Now().Unix()
+	raw, _ := json.Marshal(job)
+	_, err := d.app.GetEtcdClient().Txn(d.ctx).Then(
+		clientv3.OpPut(common.BuildWebhookDeadLetterKey(job.ProjectID, job.ID), string(raw)),
+		clientv3.OpDelete(common.BuildWebhookInflightKey(job.ID)),
+	).Commit()
+	if err != nil {
+		wlog.Error("failed to save webhook dead letter", zap.String("id", job.ID), zap.Error(err))
+	}
+
+	d.app.Metrics().CustomInc("handle_webhook", d.app.GetIP(), fmt.Sprintf("%d", job.ProjectID))
+	wlog.Error("failed to handle webhook", zap.String("type", job.Type), zap.Int64("project_id", job.ProjectID),
+		zap.String("event_id", job.EventID), zap.String("error", job.LastError))
+	if job.TaskID != "" {
+		d.app.Warning(warning.NewTaskWarningData(warning.TaskWarning{
+			AgentIP:   d.app.localip,
+			TaskName:  job.TaskName,
+			TaskID:    job.TaskID,
+			ProjectID: job.ProjectID,
+			Message:   fmt.Sprintf("webhook request error %s, type: %s", job.LastError, job.Type),
+		}).WithLevel(warning.LevelWarning))
+		return
+	}
+	d.app.Warning(warning.NewSystemWarningData(warning.SystemWarning{
+		Endpoint: d.app.GetIP(),
+		Type:     warning.SERVICE_TYPE_CENTER,
+		Message:  fmt.Sprintf("webhook request error %s, project: %d, type: %s", job.LastError, job.ProjectID, job.Type),
+	}).WithLevel(warning.LevelWarning))
+}
+
+// GetWebHookDeadLetters 获取项目下多次推送仍失败的webhook，按失败时间倒序
+func (a *app) GetWebHookDeadLetters(projectID int64) ([]WebHookJob, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	resp, err := a.etcd.KV().Get(ctx, common.BuildWebhookDeadLetterKeyPrefix(projectID), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取webhook死信列表失败").WithLog(err.Error())
+	}
+
+	list := make([]WebHookJob, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var job WebHookJob
+		if err = json.Unmarshal(kv.Value, &job); err != nil {
+			continue
+		}
+		list = append(list, job)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FailedTime > list[j].FailedTime })
+	return list, nil
+}
+
+// RetryWebHookDeadLetter 将死信重新加入推送队列，推送次数重新计算
+func (a *app) RetryWebHookDeadLetter(projectID int64, jobID string) error {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	key := common.BuildWebhookDeadLetterKey(projectID, jobID)
+	resp, err := a.etcd.KV().Get(ctx, key)
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "获取webhook死信失败").WithLog(err.Error())
+	}
+	if len(resp.Kvs) == 0 {
+		return errors.NewError(http.StatusNotFound, "死信不存在")
+	}
+
+	var job WebHookJob
+	if err = json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "解析webhook死信失败").WithLog(err.Error())
+	}
+	job.Attempt = 0
+	job.NotBefore = 0
+	job.LastError = ""
+	job.FailedTime = 0
+	raw, _ := json.Marshal(job)
+	if err = queue.New(a.ctx, a.GetEtcdClient(), common.BuildWebhookQueueKey()).EnqueueWithOps(string(raw), clientv3.OpDelete(key)); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "webhook重新入队失败").WithLog(err.Error())
+	}
+	return nil
+}
+
+// DeleteWebHookDeadLetter 删除死信，不再推送
+func (a *app) DeleteWebHookDeadLetter(projectID int64, jobID string) error {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.GetConfig().Deploy.Timeout)*time.Second)
+	defer cancel()
+	if _, err := a.etcd.KV().Delete(ctx, common.BuildWebhookDeadLetterKey(projectID, jobID)); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "删除webhook死信失败").WithLog(err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/pkg/queue"
+	"github.com/holdno/gopherCron/protocol"
+)
+
+// memoryKV 内存中的etcd KV，仅实现推送队列用到的读写及事务
+type memoryKV struct {
+	clientv3.KV
+	locker sync.Mutex
+	rev    int64
+	data   map[string]*mvccpb.KeyValue
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{data: make(map[string]*mvccpb.KeyValue)}
+}
+
+func (m *memoryKV) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: m.rev}
+}
+
+func (m *memoryKV) rangeKeys(op clientv3.Op) []*mvccpb.KeyValue {
+	var list []*mvccpb.KeyValue
+	key, end := op.KeyBytes(), op.RangeBytes()
+	for k, v := range m.data {
+		if len(end) == 0 && k == string(key) ||
+			len(end) > 0 && bytes.Compare([]byte(k), key) >= 0 && bytes.Compare([]byte(k), end) < 0 {
+			list = append(list, v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ModRevision < list[j].ModRevision })
+	return list
+}
+
+func (m *memoryKV) apply(op clientv3.Op) {
+	switch {
+	case op.IsPut():
+		m.rev++
+		kv := &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), CreateRevision: m.rev, ModRevision: m.rev, Version: 1}
+		if old, exist := m.data[string(op.KeyBytes())]; exist {
+			kv.CreateRevision, kv.Version = old.CreateRevision, old.Version+1
+		}
+		m.data[string(op.KeyBytes())] = kv
+	case op.IsDelete():
+		m.rev++
+		for _, kv := range m.rangeKeys(op) {
+			delete(m.data, string(kv.Key))
+		}
+	}
+}
+
+func (m *memoryKV) compare(cmp clientv3.Cmp) bool {
+	var actual, expected int64
+	kv := m.data[string(cmp.Key)]
+	switch v := cmp.TargetUnion.(type) {
+	case *pb.Compare_Version:
+		expected = v.Version
+		if kv != nil {
+			actual = kv.Version
+		}
+	case *pb.Compare_ModRevision:
+		expected = v.ModRevision
+		if kv != nil {
+			actual = kv.ModRevision
+		}
+	case *pb.Compare_CreateRevision:
+		expected = v.CreateRevision
+		if kv != nil {
+			actual = kv.CreateRevision
+		}
+	}
+	return cmp.Result == pb.Compare_EQUAL && actual == expected
+}
+
+func (m *memoryKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	kvs := m.rangeKeys(clientv3.OpGet(key, opts...))
+	return &clientv3.GetResponse{Header: m.header(), Kvs: kvs, Count: int64(len(kvs))}, nil
+}
+
+func (m *memoryKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.apply(clientv3.OpPut(key, val, opts...))
+	return &clientv3.PutResponse{Header: m.header()}, nil
+}
+
+func (m *memoryKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.apply(clientv3.OpDelete(key, opts...))
+	return &clientv3.DeleteResponse{Header: m.header()}, nil
+}
+
+func (m *memoryKV) Txn(ctx context.Context) clientv3.Txn {
+	return &memoryTxn{kv: m}
+}
+
+type memoryTxn struct {
+	kv      *memoryKV
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+func (t *memoryTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { t.cmps = cs; return t }
+func (t *memoryTxn) Then(ops ...clientv3.Op) clientv3.Txn { t.thenOps = ops; return t }
+func (t *memoryTxn) Else(ops ...clientv3.Op) clientv3.Txn { t.elseOps = ops; return t }
+
+func (t *memoryTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.kv.locker.Lock()
+	defer t.kv.locker.Unlock()
+	succeeded := true
+	for _, cmp := range t.cmps {
+		if !t.kv.compare(cmp) {
+			succeeded = false
+			break
+		}
+	}
+	ops := t.thenOps
+	if !succeeded {
+		ops = t.elseOps
+	}
+	for _, op := range ops {
+		t.kv.apply(op)
+	}
+	return &clientv3.TxnResponse{Header: t.kv.header(), Succeeded: succeeded}, nil
+}
+
+type memoryEtcd struct {
+	protocol.EtcdManager
+	client *clientv3.Client
+}
+
+func (m memoryEtcd) Client() *clientv3.Client { return m.client }
+func (m memoryEtcd) KV() clientv3.KV          { return m.client.KV }
+func (m memoryEtcd) Lease() clientv3.Lease    { return memoryLease{} }
+
+// memoryLease 仅发放租约，不处理过期
+type memoryLease struct {
+	clientv3.Lease
+}
+
+func (memoryLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(ttl), TTL: ttl}, nil
+}
+
+func TestWebHookQueueInflightRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kv := newMemoryKV()
+	cli := &clientv3.Client{KV: kv}
+	a := &app{ctx: ctx, etcd: memoryEtcd{client: cli}}
+	q := queue.New(ctx, cli, common.BuildWebhookQueueKey())
+
+	for _, id := range []string{"first", "second"} {
+		raw, _ := json.Marshal(WebHookJob{ID: id})
+		if err := q.Enqueue(string(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inflight := func(val string) []clientv3.Op {
+		var job WebHookJob
+		json.Unmarshal([]byte(val), &job)
+		return []clientv3.Op{clientv3.OpPut(common.BuildWebhookInflightKey(job.ID), val)}
+	}
+	value, err := q.DequeueWithOps(inflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job WebHookJob
+	if json.Unmarshal([]byte(value), &job); job.ID != "first" {
+		t.Fatalf("queue should be FIFO, got %s", job.ID)
+	}
+	// 出队与推送中记录在同一事务中完成
+	resp, _ := kv.Get(ctx, common.BuildWebhookInflightKey("first"))
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != value {
+		t.Fatal("dequeued webhook should be recorded as inflight")
+	}
+	if resp, _ = kv.Get(ctx, common.BuildWebhookQueueKey(), clientv3.WithPrefix()); len(resp.Kvs) != 1 {
+		t.Fatalf("dequeued webhook should be removed from the queue, got %d", len(resp.Kvs))
+	}
+
+	// 推送节点在推送完成前退出，新的推送节点将推送中的记录重新入队
+	d := &webHookDispatcher{app: a, ctx: ctx}
+	d.recoverInflight()
+	if resp, _ = kv.Get(ctx, common.BuildWebhookInflightKeyPrefix(), clientv3.WithPrefix()); len(resp.Kvs) != 0 {
+		t.Fatalf("inflight webhooks should be cleared after recovery, got %d", len(resp.Kvs))
+	}
+	var order []string
+	for i := 0; i < 2; i++ {
+		if value, err = q.DequeueWithOps(inflight); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal([]byte(value), &job)
+		order = append(order, job.ID)
+	}
+	if order[0] != "second" || order[1] != "first" {
+		t.Fatalf("unexpected order after recovery: %v", order)
+	}
+}
@@ -69,6 +69,20 @@ func messageWorkflowTaskStatusChanged(workflowID, projectID int64, taskID, statu
 	}
 }
 
+// messageWorkflowApprovalRequested 通知审批人有待审批的workflow节点
+func messageWorkflowApprovalRequested(userID, workflowID int64, runID string, projectID int64, taskID, taskName string) PublishData {
+	return PublishData{
+		Topic: fmt.Sprintf("/workflow/approval/user/%d", userID),
+		Data: map[string]interface{}{
+			"workflow_id": workflowID,
+			"run_id":      runID,
+			"project_id":  projectID,
+			"task_id":     taskID,
+			"task_name":   taskName,
+		},
+	}
+}
+
 type FireTowerPusher struct {
 	manager  tower.Manager[CloudEventWithNil]
 	clientID string
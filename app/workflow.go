@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -127,6 +129,15 @@ func (a *app) CreateWorkflow(userID int64, data common.Workflow) error {
 	if _, err = cronexpr.Parse(data.Cron); err != nil {
 		return errors.NewError(errors.CodeInvalidArgument, "cron表达式校验失败: "+err.Error()).WithLog(err.Error())
 	}
+	if err = a.checkWorkflowTrigger(userID, &data); err != nil {
+		return err
+	}
+	if !isValidWorkflowConcurrencyPolicy(data.ConcurrencyPolicy) {
+		return errors.NewError(http.StatusBadRequest, "不支持的运行重叠处理策略: "+data.ConcurrencyPolicy)
+	}
+	if err = normalizeWorkflowParams(&data); err != nil {
+		return err
+	}
 
 	defer func() {
 		if r := recover(); r != nil && err != nil {
@@ -186,11 +197,36 @@ func checkUserWorkflowPermission(checkFunc interface {
 	return nil
 }
 
+func checkWorkflowTaskArgs(data common.WorkflowTask) error {
+	switch data.Type {
+	case common.WORKFLOW_TASK_TYPE_COMMAND:
+		if data.Command == "" {
+			return errors.NewError(http.StatusBadRequest, "任务命令不能为空")
+		}
+	case common.WORKFLOW_TASK_TYPE_APPROVAL:
+	case common.WORKFLOW_TASK_TYPE_WORKFLOW:
+		if data.RefWorkflowID <= 0 {
+			return errors.NewError(http.StatusBadRequest, "子workflow节点需要指定引用的workflow")
+		}
+	default:
+		return errors.NewError(http.StatusBadRequest, "不支持的任务类型: "+data.Type)
+	}
+	return nil
+}
+
 func (a *app) CreateWorkflowTask(userID int64, data common.WorkflowTask) error {
 	var err error
 	if err = a.CheckPermissions(data.ProjectID, userID, PermissionView); err != nil {
 		return err
 	}
+	if err = checkWorkflowTaskArgs(data); err != nil {
+		return err
+	}
+	if data.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+		if err = checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, data.RefWorkflowID); err != nil {
+			return err
+		}
+	}
 
 	if data.TaskID == "" {
 		data.TaskID = utils.GetStrID()
@@ -207,6 +243,14 @@ func (a *app) UpdateWorkflowTask(userID int64, data common.WorkflowTask) error {
 	if err := a.CheckPermissions(data.ProjectID, userID, PermissionView); err != nil {
 		return err
 	}
+	if err := checkWorkflowTaskArgs(data); err != nil {
+		return err
+	}
+	if data.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+		if err := a.checkWorkflowTaskReference(userID, data); err != nil {
+			return err
+		}
+	}
 
 	if err := a.store.WorkflowTask().Save(nil, &data); err != nil {
 		return errors.NewError(http.StatusInternalServerError, "更新workflow任务失败").WithLog(err.Error())
@@ -242,7 +286,7 @@ func (a *app) DeleteWorkflowTask(userID, projectID int64, taskID string) error {
 
 type CreateWorkflowSchedulePlanArgs struct {
 	WorkflowTaskInfo
-	Dependencies []WorkflowTaskInfo
+	Dependencies []WorkflowTaskDependency
 }
 
 func (a *app) CreateWorkflowSchedulePlan(userID, workflowID int64, taskList []CreateWorkflowSchedulePlanArgs) error {
@@ -251,6 +295,27 @@ func (a *app) CreateWorkflowSchedulePlan(userID, workflowID int64, taskList []Cr
 		return err
 	}
 
+	taskDetails, err := a.checkWorkflowTasks(userID, taskList)
+	if err != nil {
+		return err
+	}
+	var (
+		names = make(map[WorkflowTaskInfo]string)
+		refs  []int64
+	)
+	for k, v := range taskDetails {
+		names[k] = v.TaskName
+		if v.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+			refs = append(refs, v.RefWorkflowID)
+		}
+	}
+	if err = validateWorkflowGraph(taskList, names); err != nil {
+		return err
+	}
+	if err = a.checkWorkflowReferenceCycle(workflowID, refs); err != nil {
+		return err
+	}
+
 	plan := a.workflowRunner.GetPlan(workflowID)
 	if plan == nil {
 		if err = a.workflowRunner.RefreshPlan(); err != nil {
@@ -281,12 +346,20 @@ func (a *app) CreateWorkflowSchedulePlan(userID, workflowID int64, taskList []Cr
 	for _, v := range taskList {
 		if len(v.Dependencies) > 0 {
 			for _, vv := range v.Dependencies {
+				condition := vv.Condition
+				if condition == "" {
+					condition = common.WORKFLOW_CONDITION_SUCCESS
+				}
+				if !isValidWorkflowCondition(condition) {
+					return errors.NewError(http.StatusBadRequest, fmt.Sprintf("不支持的依赖条件: %s, projectid: %d, taskid: %s", vv.Condition, v.ProjectID, v.TaskID))
+				}
 				needToCreate = append(needToCreate, common.WorkflowSchedulePlan{
 					WorkflowID:          workflowID,
 					TaskID:              v.TaskID,
 					ProjectID:           v.ProjectID,
 					DependencyTaskID:    vv.TaskID,
 					DependencyProjectID: vv.ProjectID,
+					DependencyCondition: condition,
 					CreateTime:          time.Now().Unix(),
 				})
 			}
@@ -302,38 +375,6 @@ func (a *app) CreateWorkflowSchedulePlan(userID, workflowID int64, taskList []Cr
 		}
 	}
 
-	tasks := make(map[string]map[string]bool)
-	for _, v := range needToCreate {
-		checkKey := common.BuildWorkflowTaskIndex(v.ProjectID, v.TaskID)
-		sons, exist := tasks[checkKey]
-		if !exist {
-			tasks[checkKey] = make(map[string]bool)
-			sons = tasks[checkKey]
-		}
-		sonkey := common.BuildWorkflowTaskIndex(v.DependencyProjectID, v.DependencyTaskID)
-		if (v.DependencyProjectID == 0 && len(sons) > 0) || (sons[sonkey] || sons["0_"]) {
-			return errors.NewError(http.StatusBadRequest, fmt.Sprintf("workflow出现重复执行任务, projectid: %d, taskid: %s", v.ProjectID, v.TaskID))
-		}
-		sons[sonkey] = true
-	}
-
-	for _, v := range needToCreate {
-		if v.DependencyTaskID == "" {
-			continue
-		}
-		if _, exist := tasks[common.BuildWorkflowTaskIndex(v.DependencyProjectID, v.DependencyTaskID)]; !exist {
-			return errors.NewError(http.StatusBadRequest, fmt.Sprintf("缺少依赖任务, projectid: %d, taskid: %s", v.DependencyProjectID, v.DependencyTaskID))
-		}
-
-		exist, err := a.GetWorkflowTask(v.ProjectID, v.TaskID)
-		if err != nil {
-			return err
-		}
-		if exist == nil {
-			return errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务不存在, projectid: %d, taskid: %s", v.ProjectID, v.TaskID))
-		}
-	}
-
 	tx := a.store.BeginTx()
 	defer func() {
 		if r := recover(); r != nil || err != nil {
@@ -404,17 +445,31 @@ func disposeWorkflowTaskData(workflowTaskList []common.WorkflowSchedulePlan, tas
 	return needToDelete, needToCreate
 }
 
-func (a *app) CreateWorkflowLog(workflowID int64, startTime, endTime int64, result string) error {
-	err := a.store.WorkflowLog().Create(nil, &common.WorkflowLog{
-		WorkflowID: workflowID,
-		StartTime:  startTime,
-		EndTime:    endTime,
-		Result:     result,
-		CreateTime: time.Now().Unix(),
-	})
-	if err != nil {
+// CreateWorkflowLog 记录workflow的一次运行及其中各节点的执行记录
+func (a *app) CreateWorkflowLog(data *common.WorkflowLog, taskLogs []*common.WorkflowTaskLog) error {
+	var err error
+	tx := a.store.BeginTx()
+	defer func() {
+		if r := recover(); r != nil || err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	data.CreateTime = time.Now().Unix()
+	if err = a.store.WorkflowLog().Create(tx, data); err != nil {
 		return errors.NewError(http.StatusInternalServerError, "workflow任务日志入库失败").WithLog(err.Error())
 	}
+	for _, v := range taskLogs {
+		v.RunID = data.ID
+		v.CreateTime = data.CreateTime
+		if err = a.store.WorkflowTaskLog().Create(tx, v); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "workflow节点执行记录入库失败").WithLog(err.Error())
+		}
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return errors.NewError(http.StatusInternalServerError, "存储事务提交失败").WithLog(err.Error())
+	}
 	return nil
 }
 
@@ -508,6 +563,10 @@ func (a *app) ClearWorkflowLog(workflowID int64) error {
 	if err != nil {
 		return errors.NewError(http.StatusInternalServerError, "清理workflow日志失败").WithLog(err.Error())
 	}
+	err = a.store.WorkflowTaskLog().Clear(nil, selection.NewSelector(selection.NewRequirement("workflow_id", selection.Equals, workflowID)))
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "清理workflow节点执行记录失败").WithLog(err.Error())
+	}
 	return nil
 }
 
@@ -528,6 +587,15 @@ func (a *app) UpdateWorkflow(userID int64, data common.Workflow) error {
 	if err != nil {
 		return err
 	}
+	if err = a.checkWorkflowTrigger(userID, &data); err != nil {
+		return err
+	}
+	if !isValidWorkflowConcurrencyPolicy(data.ConcurrencyPolicy) {
+		return errors.NewError(http.StatusBadRequest, "不支持的运行重叠处理策略: "+data.ConcurrencyPolicy)
+	}
+	if err = normalizeWorkflowParams(&data); err != nil {
+		return err
+	}
 
 	tx := a.store.BeginTx()
 	defer func() {
@@ -577,8 +645,8 @@ func (a *app) GetMultiWorkflowTaskList(taskIDs []string) ([]common.WorkflowTask,
 	return list, nil
 }
 
-func (a *app) GetWorkflowAllTaskStates(workflowID int64) ([]*WorkflowTaskStates, error) {
-	states, err := getWorkflowAllTaskStates(a.GetEtcdClient().KV, workflowID)
+func (a *app) GetWorkflowAllTaskStates(workflowID int64, runID string) ([]*WorkflowTaskStates, error) {
+	states, err := getWorkflowAllTaskStates(a.GetEtcdClient().KV, workflowID, runID)
 	if err != nil {
 		return nil, errors.NewError(http.StatusInternalServerError, "获取任务详情失败")
 	}
@@ -622,6 +690,9 @@ func (a *app) DeleteWorkflow(userID int64, workflowID int64) error {
 				return err
 			}
 		}
+		if err = a.workflowRunner.finishRunPlans(workflowID, ErrWorkflowDeleted); err != nil {
+			return err
+		}
 	}
 
 	a.workflowRunner.DelPlan(workflowID)
@@ -633,17 +704,178 @@ func (a *app) DeleteWorkflow(userID int64, workflowID int64) error {
 	return err
 }
 
-func (a *app) StartWorkflow(workflowID int64) error {
+// StartWorkflow 手动启动workflow，dryRun为true时只试运行，不实际执行任务命令
+// params为本次运行的参数，未传入的参数使用workflow声明的默认值
+func (a *app) StartWorkflow(workflowID int64, dryRun bool, params map[string]string) error {
 	plan := a.workflowRunner.GetPlan(workflowID)
 	if plan == nil {
 		return errors.NewError(http.StatusBadRequest, "该workflow不存在")
 	}
-	if err := a.workflowRunner.TryStartPlan(plan); err != nil {
+	params, err := plan.resolveParams(params)
+	if err != nil {
+		return errors.NewError(http.StatusBadRequest, err.Error())
+	}
+	if dryRun {
+		return a.workflowRunner.startDryRun(plan, params)
+	}
+	policy := plan.Workflow.ConcurrencyPolicy
+	if policy == "" || policy == common.WORKFLOW_CONCURRENCY_SKIP {
+		// 手动启动不记录跳过，直接提示
+		running, err := plan.IsRunning()
+		if err != nil {
+			return errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+		}
+		if running {
+			return errors.NewError(http.StatusBadRequest, "workflow正在运行中")
+		}
+	}
+	if childRunning, err := a.workflowRunner.hasActiveChildRuns(workflowID, ""); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+	} else if childRunning {
+		return errors.NewError(http.StatusBadRequest, "workflow正在作为子workflow运行中")
+	}
+	if err = a.workflowRunner.startPlan(plan, params); err != nil {
 		return err
 	}
 	return nil
 }
 
+// ResumeWorkflow 从失败处恢复workflow的某次运行，之前成功的任务不再执行，只调度失败及其下游的任务
+// logID为0时使用最近一次运行记录
+func (a *app) ResumeWorkflow(workflowID, logID int64) error {
+	plan := a.workflowRunner.GetPlan(workflowID)
+	if plan == nil {
+		return errors.NewError(http.StatusBadRequest, "该workflow不存在")
+	}
+
+	runLog, state, err := a.getWorkflowRunState(workflowID, logID)
+	if err != nil {
+		return err
+	}
+	if runLog.DryRun {
+		return errors.NewError(http.StatusBadRequest, "试运行的记录不能用于恢复运行")
+	}
+	if runLog.Status != common.TASK_STATUS_FAIL_V2 {
+		return errors.NewError(http.StatusBadRequest, "只有运行失败的记录才能恢复运行")
+	}
+
+	scope := workflowResumeScope(plan.TaskFlow, state.Records)
+	if len(scope) == 0 {
+		return errors.NewError(http.StatusBadRequest, "该次运行没有需要恢复的任务")
+	}
+
+	return a.workflowRunner.TryResumePlan(plan, runLog.ID, preservedWorkflowTaskStates(state.Records, scope), scope, state.Params)
+}
+
+// RerunWorkflowTask 在某次已结束的运行中单独重跑一个任务，不会触发其下游任务
+func (a *app) RerunWorkflowTask(workflowID, logID int64, task WorkflowTaskInfo) error {
+	plan := a.workflowRunner.GetPlan(workflowID)
+	if plan == nil {
+		return errors.NewError(http.StatusBadRequest, "该workflow不存在")
+	}
+	if _, exist := plan.TaskFlow[task]; !exist {
+		return errors.NewError(http.StatusBadRequest, "该任务不在workflow中")
+	}
+
+	runLog, state, err := a.getWorkflowRunState(workflowID, logID)
+	if err != nil {
+		return err
+	}
+	if runLog.DryRun {
+		return errors.NewError(http.StatusBadRequest, "试运行的记录不能用于恢复运行")
+	}
+
+	scope := []WorkflowTaskInfo{task}
+	return a.workflowRunner.TryResumePlan(plan, runLog.ID, preservedWorkflowTaskStates(state.Records, scope), scope, state.Params)
+}
+
+// getWorkflowRunState 获取workflow某次运行结束时的状态
+func (a *app) getWorkflowRunState(workflowID, logID int64) (*common.WorkflowLog, *PlanState, error) {
+	opts := selection.NewSelector(selection.NewRequirement("workflow_id", selection.Equals, workflowID))
+	if logID > 0 {
+		opts.AddQuery(selection.NewRequirement("id", selection.Equals, logID))
+	} else {
+		// 跳过的调度没有运行状态，试运行不作为最近一次运行
+		opts.AddQuery(selection.NewRequirement("status", selection.NotEquals, common.TASK_STATUS_SKIPPED_V2),
+			selection.NewRequirement("dry_run", selection.Equals, false))
+	}
+	list, err := a.store.WorkflowLog().GetList(opts, 1, 1)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, nil, errors.NewError(http.StatusInternalServerError, "获取workflow运行记录失败").WithLog(err.Error())
+	}
+	if len(list) == 0 {
+		return nil, nil, errors.NewError(http.StatusBadRequest, "workflow运行记录不存在")
+	}
+
+	var state PlanState
+	if err = json.Unmarshal([]byte(list[0].Result), &state); err != nil {
+		return nil, nil, errors.NewError(http.StatusInternalServerError, "解析workflow运行记录失败").WithLog(err.Error())
+	}
+	return &list[0], &state, nil
+}
+
+// workflowResumeScope 计算从失败处恢复时需要重新调度的任务：未成功的任务及其所有下游任务
+// 被正常跳过的任务视同已完成，除非其上游需要重新调度
+func workflowResumeScope(taskFlow map[WorkflowTaskInfo][]WorkflowTaskDependency, records []*WorkflowTaskStates) []WorkflowTaskInfo {
+	done := make(map[WorkflowTaskInfo]bool)
+	for _, v := range records {
+		if isWorkflowTaskSettled(v.CurrentStatus) {
+			done[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}] = true
+		}
+	}
+
+	rerun := make(map[WorkflowTaskInfo]bool)
+	for task := range taskFlow {
+		if !done[task] {
+			rerun[task] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for task, deps := range taskFlow {
+			if rerun[task] {
+				continue
+			}
+			for _, dep := range deps {
+				if rerun[dep.WorkflowTaskInfo] {
+					rerun[task] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// 只有失败的运行才需要恢复
+	if len(rerun) == 0 {
+		return nil
+	}
+	scope := make([]WorkflowTaskInfo, 0, len(rerun))
+	for task := range rerun {
+		scope = append(scope, task)
+	}
+	sortWorkflowTasks(scope)
+	return scope
+}
+
+// isWorkflowTaskSettled 任务在上一次运行中已成功或被正常跳过，恢复运行时无需重新调度
+func isWorkflowTaskSettled(status string) bool {
+	return status == common.TASK_STATUS_DONE_V2 || status == common.TASK_STATUS_SKIPPED_V2
+}
+
+// preservedWorkflowTaskStates 不需要重新调度且已成功或已跳过的任务状态，恢复运行时保留到本次运行中
+func preservedWorkflowTaskStates(records []*WorkflowTaskStates, scope []WorkflowTaskInfo) []*WorkflowTaskStates {
+	planState := &PlanState{Scope: scope}
+	var list []*WorkflowTaskStates
+	for _, v := range records {
+		if !isWorkflowTaskSettled(v.CurrentStatus) || planState.InScope(WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}) {
+			continue
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
 func (a *app) KillWorkflow(workflowID int64) error {
 	plan := a.workflowRunner.GetPlan(workflowID)
 	if plan == nil {
@@ -657,7 +889,8 @@ func (a *app) KillWorkflow(workflowID int64) error {
 			zap.String("finished_with_error", ErrWorkflowKilled.Error()))
 		return err
 	}
-	return nil
+	// 同时停止所有并发运行
+	return a.workflowRunner.finishRunPlans(workflowID, ErrWorkflowKilled)
 }
 
 func (a *app) killWorkflowTasks(region string, killList []WorkflowTaskInfo) error {
@@ -727,6 +960,7 @@ type workflowRunner struct {
 	etcd              *clientv3.Client
 	app               *app
 	plans             sync.Map
+	runs              sync.Map // 并发运行的plan，key为 workflowID/runID
 	planCounter       int64
 	nextWorkflow      common.Workflow
 	scheduleEventChan chan *common.TaskEvent
@@ -790,18 +1024,33 @@ type WorkflowPlan struct {
 	Expr           *cronexpr.Expression // 解析后的cron表达式
 	NextTime       time.Time
 	Tasks          map[WorkflowTaskInfo]*common.WorkflowTask
-	TaskFlow       map[WorkflowTaskInfo][]WorkflowTaskInfo // map[任务][]依赖
+	TaskFlow       map[WorkflowTaskInfo][]WorkflowTaskDependency // map[任务][]依赖
 	PlanUpdateTime int64
 	planState      *PlanState
+	runID          string // 并发运行的id，workflow的主运行为空
 
 	LatestScheduleTime time.Time
 
 	locker sync.Mutex
 }
 
+// failedWarning workflow运行失败(包括整体超时)的告警
+func (p *WorkflowPlan) failedWarning(serviceIP, message string) warning.WarningData {
+	return warning.NewWorkflowWarningData(warning.WorkflowWarning{
+		WorkflowID:    p.Workflow.ID,
+		WorkflowTitle: p.Workflow.Title,
+		ProjectIDs:    p.projectIDs(),
+		ServiceIP:     serviceIP,
+		Message:       message,
+	}).WithLevel(warning.LevelCritical)
+}
+
 func (p *WorkflowPlan) Finished(withError error) error {
 	p.locker.Lock()
 	defer p.locker.Unlock()
+	if p.runID != "" {
+		defer p.runner.runs.Delete(workflowRunKey(p.Workflow.ID, p.runID))
+	}
 	if err := p.RefreshStates(); err != nil {
 		return err
 	}
@@ -814,7 +1063,7 @@ func (p *WorkflowPlan) Finished(withError error) error {
 		p.planState.Status = common.TASK_STATUS_FAIL_V2
 	}
 
-	states, err := getWorkflowAllTaskStates(p.runner.etcd.KV, p.Workflow.ID)
+	states, err := getWorkflowAllTaskStates(p.runner.etcd.KV, p.Workflow.ID, p.runID)
 	if err != nil {
 		return err
 	}
@@ -824,16 +1073,14 @@ func (p *WorkflowPlan) Finished(withError error) error {
 	defer func() {
 		if failedReason.Len() > 0 {
 			failedReason.WriteStringPrefix(fmt.Sprintf("Workflow \"%s\" 运行失败", p.Workflow.Title))
-			p.runner.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
-				WorkflowID:    p.Workflow.ID,
-				WorkflowTitle: p.Workflow.Title,
-				ServiceIP:     p.runner.app.GetIP(),
-				Message:       failedReason.String(),
-			}))
+			p.runner.app.Warning(p.failedWarning(p.runner.app.GetIP(), failedReason.String()))
 		}
 	}()
 
-	var killList []WorkflowTaskInfo
+	var (
+		killList  []WorkflowTaskInfo
+		childList []*common.WorkflowTask
+	)
 	for _, v := range states {
 		// get task info
 		taskDetail, err := p.runner.app.GetWorkflowTask(v.ProjectID, v.TaskID)
@@ -842,6 +1089,10 @@ func (p *WorkflowPlan) Finished(withError error) error {
 			return err
 		}
 		if v.CurrentStatus == common.TASK_STATUS_FAIL_V2 {
+			if workflowFailureHandled(p.TaskFlow, WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}) {
+				// 失败已由下游的失败分支处理
+				continue
+			}
 			p.planState.Status = common.TASK_STATUS_FAIL_V2
 			failedReason.WriteString(taskDetail.TaskName)
 			failedReason.WriteString("任务执行失败")
@@ -853,12 +1104,19 @@ func (p *WorkflowPlan) Finished(withError error) error {
 			failedReason.WriteString(taskDetail.TaskName)
 			failedReason.WriteString("任务启动失败")
 		} else if v.CurrentStatus == common.TASK_STATUS_RUNNING_V2 {
-			killList = append(killList, WorkflowTaskInfo{
-				ProjectID: v.ProjectID,
-				TaskID:    v.TaskID,
-			})
+			if taskDetail.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+				childList = append(childList, taskDetail)
+			} else {
+				killList = append(killList, WorkflowTaskInfo{
+					ProjectID: v.ProjectID,
+					TaskID:    v.TaskID,
+				})
+			}
 			failedReason.WriteString(taskDetail.TaskName)
 			failedReason.WriteString("任务执行失败")
+		} else if v.CurrentStatus == common.TASK_STATUS_WAITING_APPROVAL_V2 {
+			failedReason.WriteString(taskDetail.TaskName)
+			failedReason.WriteString("审批未完成")
 		}
 	}
 	if withError != nil {
@@ -872,6 +1130,9 @@ func (p *WorkflowPlan) Finished(withError error) error {
 	finalState.Status = common.TASK_STATUS_FINISHED_V2
 
 	p.runner.app.PublishMessage(messageWorkflowStatusChanged(p.Workflow.ID, finalState.Status))
+	if p.planState.Parent != nil {
+		p.notifyParentWorkflow(p.planState.Parent, p.planState.Status != common.TASK_STATUS_FAIL_V2, finalState.Reason)
+	}
 
 	result, err := json.Marshal(finalState)
 	if err != nil {
@@ -880,19 +1141,37 @@ func (p *WorkflowPlan) Finished(withError error) error {
 
 	// 一定要先清理workflow相关的key，这样在kill过程中，任务就不会写入新的状态
 	err = rego.Retry(func() error {
-		return clearWorkflowKeys(p.runner.etcd.KV, p.Workflow.ID)
+		return clearWorkflowKeys(p.runner.etcd.KV, p.Workflow.ID, p.runID)
 	}, rego.WithPeriod(time.Second), rego.WithTimes(3), rego.WithLatestError())
 	if err != nil {
 		p.runner.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
 			WorkflowID:    p.Workflow.ID,
 			WorkflowTitle: p.Workflow.Title,
+			ProjectIDs:    p.projectIDs(),
 			ServiceIP:     p.runner.app.GetIP(),
 			Message:       fmt.Sprintf("workflow: %s, 运行结束时清除运行状态失败, 失败原因: %s", p.Workflow.Title, err.Error()),
-		}))
+		}).WithLevel(warning.LevelCritical))
 		return err
 	}
 
-	if withError != nil {
+	if !p.planState.DryRun {
+		go p.runner.triggerDownstreamWorkflows(p.Workflow.ID, p.runID, p.planState.StartTime, p.planState.Status != common.TASK_STATUS_FAIL_V2)
+	}
+	// webhook中的状态为运行的最终结果 done/fail
+	hookState := finalState
+	hookState.Status = p.planState.Status
+	p.runner.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_FINISHED, p, hookState)
+	if hookState.Status == common.TASK_STATUS_FAIL_V2 {
+		p.runner.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_FAILED, p, hookState)
+	}
+	if finalState.Queued > 0 && withError != ErrWorkflowKilled && withError != ErrWorkflowDeleted {
+		// 运行记录入库后再启动排队中的运行
+		defer p.startQueuedRun(finalState.Queued-1, finalState.QueuedParams)
+	}
+
+	// 试运行的任务没有实际执行，不需要强杀，避免误杀该任务正常的运行
+	if withError != nil && !p.planState.DryRun {
+		p.killChildWorkflows(childList)
 		err = rego.Retry(func() error {
 			return p.runner.app.killWorkflowTasks(p.runner.app.GetConfig().Micro.Region, killList)
 		}, rego.WithPeriod(time.Second), rego.WithTimes(3), rego.WithLatestError())
@@ -900,20 +1179,29 @@ func (p *WorkflowPlan) Finished(withError error) error {
 			p.runner.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
 				WorkflowID:    p.Workflow.ID,
 				WorkflowTitle: p.Workflow.Title,
+				ProjectIDs:    p.projectIDs(),
 				ServiceIP:     p.runner.app.GetIP(),
 				Message:       fmt.Sprintf("workflow: %s, 运行结束时强杀任务失败, 失败原因: %s", p.Workflow.Title, err.Error()),
-			}))
+			}).WithLevel(warning.LevelCritical))
 			return err
 		}
 	}
 
-	if err = p.runner.app.CreateWorkflowLog(finalState.WorkflowID, finalState.StartTime, finalState.EndTime, string(result)); err != nil {
+	if err = p.runner.app.CreateWorkflowLog(&common.WorkflowLog{
+		WorkflowID: finalState.WorkflowID,
+		StartTime:  finalState.StartTime,
+		EndTime:    finalState.EndTime,
+		Result:     string(result),
+		Status:     p.planState.Status,
+		DryRun:     p.planState.DryRun,
+	}, buildWorkflowTaskLogs(finalState.WorkflowID, p.taskNames(), states, finalState.EndTime)); err != nil {
 		p.runner.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
 			WorkflowID:    p.Workflow.ID,
 			WorkflowTitle: p.Workflow.Title,
+			ProjectIDs:    p.projectIDs(),
 			ServiceIP:     p.runner.app.GetIP(),
 			Message:       fmt.Sprintf("workflow: %s, 执行结果入库失败, 失败原因: %s", p.Workflow.Title, err.Error()),
-		}))
+		}).WithLevel(warning.LevelCritical))
 		return err
 	}
 
@@ -932,7 +1220,7 @@ func (a *workflowRunner) scheduleWorkflowPlan(plan *WorkflowPlan) error {
 	}
 
 	needToScheduleTasks, finished, err := plan.CanSchedule(a)
-	if err != nil && err != ErrWorkflowFailed {
+	if err != nil && err != ErrWorkflowFailed && err != ErrWorkflowTimeout {
 		if err != ErrWorkflowInProcess {
 			return err
 		}
@@ -954,36 +1242,167 @@ func (a *workflowRunner) scheduleWorkflowPlan(plan *WorkflowPlan) error {
 		return nil
 	}
 
+	var (
+		outputs  map[string]string
+		advanced bool
+	)
 	for _, v := range needToScheduleTasks {
 		task := plan.Tasks[v]
+		if plan.isDryRun() && task.Type != common.WORKFLOW_TASK_TYPE_COMMAND {
+			if err = plan.dryRunNode(task); err != nil {
+				wlog.Error("failed to finish workflow dry-run node", zap.Int64("workflow_id", plan.Workflow.ID),
+					zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID), zap.Error(err))
+				continue
+			}
+			advanced = true
+			continue
+		}
+		switch task.Type {
+		case common.WORKFLOW_TASK_TYPE_APPROVAL:
+			if err = plan.requestApproval(task); err != nil {
+				wlog.Error("failed to request workflow approval", zap.Int64("workflow_id", plan.Workflow.ID),
+					zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID), zap.Error(err))
+			}
+			continue
+		case common.WORKFLOW_TASK_TYPE_WORKFLOW:
+			if err = plan.startChildWorkflow(task); err != nil {
+				wlog.Error("failed to start child workflow", zap.Int64("workflow_id", plan.Workflow.ID),
+					zap.Int64("child_workflow_id", task.RefWorkflowID), zap.String("task_id", task.TaskID), zap.Error(err))
+			}
+			continue
+		}
+		command := task.Command
+		if plan.isDryRun() {
+			// 试运行不下发真实的命令，避免agent未识别试运行标记时实际执行
+			command = ""
+		} else if strings.Contains(command, "${{") {
+			command = renderWorkflowParams(command)
+		}
+		if strings.Contains(command, "${{") {
+			command = renderWorkflowCommand(command, workflowOutputRefs(plan.Tasks, task.ProjectID))
+		}
+		if outputs == nil && !plan.isDryRun() {
+			if outputs, err = plan.collectTaskOutputs(); err != nil {
+				return err
+			}
+		}
 		a.scheduleEventChan <- common.BuildTaskEvent(common.TASK_EVENT_WORKFLOW_SCHEDULE, &common.TaskWithOperator{
 			TaskInfo: &common.TaskInfo{
 				TaskID:    task.TaskID,
 				Name:      task.TaskName,
 				ProjectID: task.ProjectID,
-				Command:   task.Command,
+				Command:   command,
 				Remark:    task.Remark,
 				Timeout:   task.Timeout,
 				Noseize:   task.Noseize,
 				FlowInfo: &common.WorkflowInfo{
 					WorkflowID: plan.Workflow.ID,
+					RunID:      plan.runID,
+					DryRun:     plan.isDryRun(),
+					Params:     plan.runParams(),
+					Outputs:    outputs,
 				},
 			},
 		})
 	}
+	if advanced {
+		// 试运行中直接完成的节点没有任务结果回调，需要主动调度其下游任务
+		return a.scheduleWorkflowPlan(plan)
+	}
 	return nil
 }
 
+var outputReferencePattern = regexp.MustCompile(`\$\{\{\s*outputs\.([^.\s}]+)\.([A-Za-z0-9_\-]+)\s*\}\}`)
+
+// renderWorkflowCommand 将命令中形如 ${{ outputs.<任务名称或任务id>.<变量名> }} 的引用替换为对应环境变量的引用，未找到的任务替换为空
+// 输出的值由agent以环境变量的方式提供，不直接拼入命令，避免输出中的内容被shell当作命令执行
+func renderWorkflowCommand(command string, refs map[string]WorkflowTaskInfo) string {
+	return outputReferencePattern.ReplaceAllStringFunc(command, func(ref string) string {
+		matches := outputReferencePattern.FindStringSubmatch(ref)
+		task, exist := refs[matches[1]]
+		if !exist {
+			return ""
+		}
+		return "${" + common.BuildWorkflowOutputEnv(task.ProjectID, task.TaskID, matches[2]) + "}"
+	})
+}
+
+// workflowOutputRefs 命令中可引用的任务，以任务id及任务名称作为索引
+// 任务名称重复时优先使用projectID下的任务，其他项目中名称不唯一的任务只能通过任务id引用
+func workflowOutputRefs(tasks map[WorkflowTaskInfo]*common.WorkflowTask, projectID int64) map[string]WorkflowTaskInfo {
+	var (
+		refs      = make(map[string]WorkflowTaskInfo, len(tasks)*2)
+		ambiguous = make(map[string]bool)
+	)
+	for k, v := range tasks {
+		if k.ProjectID == projectID {
+			continue
+		}
+		if _, exist := refs[v.TaskName]; exist {
+			ambiguous[v.TaskName] = true
+		}
+		refs[v.TaskName] = k
+	}
+	for name := range ambiguous {
+		delete(refs, name)
+	}
+	for k, v := range tasks {
+		if k.ProjectID == projectID {
+			refs[v.TaskName] = k
+		}
+	}
+	for k := range tasks {
+		refs[k.TaskID] = k
+	}
+	return refs
+}
+
+// collectTaskOutputs 获取本次运行中各任务输出的变量，以环境变量名作为索引
+func (p *WorkflowPlan) collectTaskOutputs() (map[string]string, error) {
+	states, err := getWorkflowAllTaskStates(p.runner.etcd.KV, p.Workflow.ID, p.runID)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]string)
+	for _, v := range states {
+		for name, value := range v.Outputs {
+			outputs[common.BuildWorkflowOutputEnv(v.ProjectID, v.TaskID, name)] = value
+		}
+	}
+	return outputs, nil
+}
+
+// TryStartPlan 定时调度及上游触发的运行，运行参数均使用默认值
 func (a *workflowRunner) TryStartPlan(plan *WorkflowPlan) error {
+	params, err := plan.resolveParams(nil)
+	if err != nil && plan.Workflow.Status == common.TASK_STATUS_RUNNING {
+		return a.skipWorkflowRun(plan, "运行参数不完整，跳过本次调度: "+err.Error())
+	}
+	return a.startPlan(plan, params)
+}
+
+func (a *workflowRunner) startPlan(plan *WorkflowPlan, params map[string]string) error {
 	// 获取当前plan是否在运行中
 	// TODO lock
 	running, err := plan.IsRunning()
-	if err != nil || running {
-		// TODO latest workflow not compalete
+	if err != nil {
 		return err
 	}
+	if running {
+		// 上一次运行尚未结束
+		return a.startOverlappingRun(plan, params)
+	}
+	// 作为子workflow的运行会下发相同的任务，在其结束前不启动新的运行
+	if childRunning, err := a.hasActiveChildRuns(plan.Workflow.ID, ""); err != nil {
+		return err
+	} else if childRunning {
+		if plan.Workflow.Status != common.TASK_STATUS_RUNNING {
+			return nil
+		}
+		return a.skipWorkflowRun(plan, "作为子workflow的运行尚未结束，跳过本次调度")
+	}
 
-	if err = plan.SetRunning(); err != nil {
+	if err = plan.SetRunning(params); err != nil {
 		return err
 	}
 
@@ -995,6 +1414,28 @@ func (a *workflowRunner) TryStartPlan(plan *WorkflowPlan) error {
 	return a.scheduleWorkflowPlan(plan)
 }
 
+// TryResumePlan 基于历史运行结果恢复plan的运行，只调度scope中的任务
+// params为被恢复的运行所使用的参数
+func (a *workflowRunner) TryResumePlan(plan *WorkflowPlan, resumeFrom int64, preserved []*WorkflowTaskStates, scope []WorkflowTaskInfo, params map[string]string) error {
+	// 运行状态的检查与上一次运行残留状态的清理在同一个事务中完成
+	newState, err := setWorkflowPlanResumed(a.etcd, plan.Workflow.ID, resumeFrom, preserved, scope, params)
+	if err != nil {
+		if _, ok := err.(*errors.Error); ok {
+			return err
+		}
+		return errors.NewError(http.StatusInternalServerError, "恢复workflow运行状态失败").WithLog(err.Error())
+	}
+	plan.planState = newState
+	a.app.PublishMessage(messageWorkflowStatusChanged(plan.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+	a.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_STARTED, plan, *newState)
+
+	if !a.isLeader {
+		return nil
+	}
+
+	return a.scheduleWorkflowPlan(plan)
+}
+
 func (s *WorkflowPlan) RefreshPlanTasks() error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
@@ -1004,7 +1445,7 @@ func (s *WorkflowPlan) RefreshPlanTasks() error {
 		return err
 	}
 
-	depsMap := make(map[WorkflowTaskInfo][]WorkflowTaskInfo)
+	depsMap := make(map[WorkflowTaskInfo][]WorkflowTaskDependency)
 	tasksMap := make(map[WorkflowTaskInfo]*common.WorkflowTask)
 
 	if latestCreateTask == nil {
@@ -1028,9 +1469,12 @@ func (s *WorkflowPlan) RefreshPlanTasks() error {
 			TaskID:    v.TaskID,
 			ProjectID: v.ProjectID,
 		}
-		depsMap[key] = append(depsMap[key], WorkflowTaskInfo{
-			TaskID:    v.DependencyTaskID,
-			ProjectID: v.DependencyProjectID,
+		depsMap[key] = append(depsMap[key], WorkflowTaskDependency{
+			WorkflowTaskInfo: WorkflowTaskInfo{
+				TaskID:    v.DependencyTaskID,
+				ProjectID: v.DependencyProjectID,
+			},
+			Condition: v.DependencyCondition,
 		})
 
 		if _, exist := tasksMap[key]; !exist {
@@ -1053,6 +1497,7 @@ var (
 	ErrWorkflowKilled    = fmt.Errorf("人工停止workflow")
 	ErrWorkflowDeleted   = fmt.Errorf("人工删除workflow")
 	ErrWorkflowInProcess = fmt.Errorf("workflow in process")
+	ErrWorkflowTimeout   = fmt.Errorf("workflow运行超时")
 )
 
 // CanSchedule 判断下一步可调度的任务
@@ -1071,7 +1516,7 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 		finished      bool = true
 	)
 
-	states, err := getWorkflowTasksStates(s.runner.etcd.KV, common.BuildWorkflowTaskStatusKeyPrefix(s.Workflow.ID))
+	states, err := getWorkflowTasksStates(s.runner.etcd.KV, common.BuildWorkflowTaskStatusKeyPrefix(s.Workflow.ID, s.runID))
 	if err != nil {
 		return nil, false, err
 	}
@@ -1080,24 +1525,50 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 		taskStatesMap[WorkflowTaskInfo{v.ProjectID, v.TaskID}] = v
 	}
 
+	planState, err := getWorkflowPlanState(s.runner.etcd.KV, s.Workflow.ID, s.runID)
+	if err != nil {
+		return nil, false, err
+	}
+	if planState != nil {
+		// 排队的运行可能由其他节点启动，调度时以最新的运行状态(如运行参数)为准
+		s.planState = planState
+	}
+
+	if s.Workflow.Timeout > 0 && planState != nil && planState.StartTime > 0 &&
+		time.Now().Unix()-planState.StartTime >= int64(s.Workflow.Timeout) {
+		// 整体运行超时，结束workflow并强杀运行中的任务
+		return nil, true, ErrWorkflowTimeout
+	}
+
+	// 依赖条件不满足的任务标记为跳过，跳过的状态会继续向下游传递
+	if err = s.skipUnreachableTasks(planState, taskStatesMap); err != nil {
+		return nil, false, err
+	}
+
+	var hasFailed bool
 	for task, deps := range s.TaskFlow {
+		if !planState.InScope(task) {
+			continue
+		}
+		deps = planState.scopeDependencies(deps)
 		taskStates, exist := taskStatesMap[WorkflowTaskInfo{task.ProjectID, task.TaskID}]
-		if exist && taskStates.CurrentStatus == common.TASK_STATUS_DONE_V2 {
+		if exist && (taskStates.CurrentStatus == common.TASK_STATUS_DONE_V2 || taskStates.CurrentStatus == common.TASK_STATUS_SKIPPED_V2) {
 			continue
 		}
 
-		// 检查依赖的任务是否都已结束
-		ok := true
-		for _, check := range deps {
-			if check.TaskID != "" {
-				states := taskStatesMap[check]
-				if states == nil || states.CurrentStatus != common.TASK_STATUS_DONE_V2 {
-					ok = false
-					break
-				}
+		if exist && isWorkflowTaskFailed(taskStates) {
+			if !workflowFailureTolerated(s.TaskFlow, task) {
+				// 失败没有下游分支处理，直接结束整个workflow
+				return nil, true, ErrWorkflowFailed
+			}
+			if !workflowFailureHandled(s.TaskFlow, task) {
+				hasFailed = true
 			}
+			continue
 		}
-		if !ok { // 上游还未跑完
+
+		// 检查依赖的任务是否都已结束且满足触发条件
+		if ready, _ := checkWorkflowDependencies(deps, taskStatesMap); !ready { // 上游还未跑完
 			finished = false
 			continue
 		}
@@ -1122,6 +1593,11 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 			if !afterDebounce() {
 				continue
 			}
+			if detail := s.Tasks[task]; detail != nil && detail.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+				// 子workflow节点没有agent锁，通过子workflow的运行状态判断
+				s.checkChildWorkflow(detail)
+				continue
+			}
 			// 1.可以通过注册中心感知节点下线，如果节点有下线记录，则在此处调用agent check任务是否运行中
 			// 2.看锁是否存在，若存在则任务执行中
 			locker := s.runner.app.GetTaskLocker(&common.TaskInfo{TaskID: task.TaskID, ProjectID: task.ProjectID})
@@ -1159,6 +1635,7 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 					TaskName:   task.TaskName,
 					TmpID:      taskStates.GetLatestScheduleRecord().TmpID,
 					WorkflowID: s.Workflow.ID,
+					RunID:      s.runID,
 				}, "waiting re-run"); err != nil {
 					wlog.Error("mark the task as failed and in need of retry when it fails", zap.Int64("workflow_id", s.Workflow.ID),
 						zap.String("task_id", task.TaskID), zap.Int64("project_id", task.ProjectID), zap.String("task_name", task.TaskName))
@@ -1172,8 +1649,8 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 			}
 
 		case common.TASK_STATUS_FAIL_V2:
-			// 判断是否已经重复跑3次
-			if taskStates.ScheduleCount >= common.WORKFLOW_SCHEDULE_LIMIT {
+			// 判断是否已经达到重试上限
+			if taskStates.ScheduleCount >= taskStates.AttemptLimit() {
 				return nil, true, ErrWorkflowFailed
 			}
 			fallthrough
@@ -1182,14 +1659,18 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 			if len(taskStates.ScheduleRecords) > 1 && !afterDebounce() {
 				continue
 			}
+			// 失败重试的退避时间未到
+			if taskStates.NextRetryTime > time.Now().Unix() {
+				continue
+			}
 
 			readys = append(readys, task)
 		case common.TASK_STATUS_STARTING_V2: // 异常补救
-			if taskStates.ScheduleCount >= common.WORKFLOW_SCHEDULE_LIMIT {
+			if taskStates.ScheduleCount >= taskStates.AttemptLimit() {
 				return nil, true, ErrWorkflowFailed
 			}
 			// 任务启动的超时间隔内也先不处理
-			if runner.IsInProcess(task.TaskID) || (len(taskStates.ScheduleRecords) > 0 &&
+			if runner.IsInProcess(workflowProcessKey(s.runID, task.TaskID)) || (len(taskStates.ScheduleRecords) > 0 &&
 				taskStates.ScheduleRecords[len(taskStates.ScheduleRecords)-1].Status == common.TASK_STATUS_STARTING_V2 &&
 				!afterDebounce()) {
 				finished = false
@@ -1198,22 +1679,173 @@ func (s *WorkflowPlan) CanSchedule(runner *workflowRunner) ([]WorkflowTaskInfo,
 
 			finished = false
 			readys = append(readys, task)
+		case common.TASK_STATUS_WAITING_APPROVAL_V2:
+			finished = false
+			if isApprovalExpired(s.Tasks[task], taskStates) {
+				s.expireApproval(task)
+			}
 		default:
 		}
 	}
 
 	if finished {
+		if hasFailed {
+			return nil, finished, ErrWorkflowFailed
+		}
 		return nil, finished, nil
 	}
 
+	if s.Workflow.MaxParallel > 0 {
+		readys = limitWorkflowParallel(readys, taskStatesMap, s.Workflow.MaxParallel)
+	}
+
 	return readys, finished, nil
 }
 
+// limitWorkflowParallel 按最大并行数限制本次可调度的任务，正在启动中的任务已占用并行数，优先重新调度
+func limitWorkflowParallel(readys []WorkflowTaskInfo, taskStatesMap map[WorkflowTaskInfo]*WorkflowTaskStates, maxParallel int) []WorkflowTaskInfo {
+	var active int
+	for _, v := range taskStatesMap {
+		if v.CurrentStatus == common.TASK_STATUS_RUNNING_V2 || v.CurrentStatus == common.TASK_STATUS_STARTING_V2 {
+			active++
+		}
+	}
+
+	var starting, waiting []WorkflowTaskInfo
+	for _, v := range readys {
+		if states := taskStatesMap[v]; states != nil && states.CurrentStatus == common.TASK_STATUS_STARTING_V2 {
+			starting = append(starting, v)
+		} else {
+			waiting = append(waiting, v)
+		}
+	}
+	sortWorkflowTasks(waiting)
+	if slots := maxParallel - active; slots < len(waiting) {
+		if slots < 0 {
+			slots = 0
+		}
+		waiting = waiting[:slots]
+	}
+	return append(starting, waiting...)
+}
+
 type WorkflowTaskInfo struct {
 	ProjectID int64  `json:"project_id"`
 	TaskID    string `json:"task_id"`
 }
 
+// WorkflowTaskDependency 任务依赖及触发条件
+type WorkflowTaskDependency struct {
+	WorkflowTaskInfo
+	Condition string `json:"condition"`
+}
+
+func isValidWorkflowCondition(condition string) bool {
+	switch condition {
+	case common.WORKFLOW_CONDITION_SUCCESS, common.WORKFLOW_CONDITION_FAILURE, common.WORKFLOW_CONDITION_ALWAYS:
+		return true
+	}
+	return false
+}
+
+// isWorkflowTaskFailed 任务是否已最终失败(重试次数耗尽)
+func isWorkflowTaskFailed(states *WorkflowTaskStates) bool {
+	return states.CurrentStatus == common.TASK_STATUS_FAIL_V2 && states.ScheduleCount >= states.AttemptLimit()
+}
+
+// checkWorkflowDependencies 检查任务的依赖，所有依赖结束且条件均满足时ready，依赖结束但存在条件不满足时skip
+func checkWorkflowDependencies(deps []WorkflowTaskDependency, states map[WorkflowTaskInfo]*WorkflowTaskStates) (ready bool, skip bool) {
+	for _, dep := range deps {
+		if dep.TaskID == "" {
+			continue
+		}
+		state := states[dep.WorkflowTaskInfo]
+		if state == nil {
+			return false, false
+		}
+
+		var satisfied bool
+		switch {
+		case state.CurrentStatus == common.TASK_STATUS_DONE_V2:
+			satisfied = dep.Condition != common.WORKFLOW_CONDITION_FAILURE
+		case state.CurrentStatus == common.TASK_STATUS_SKIPPED_V2:
+			// 人工跳过的任务不影响下游继续执行
+			satisfied = dep.Condition == common.WORKFLOW_CONDITION_ALWAYS ||
+				(state.Operator != "" && dep.Condition != common.WORKFLOW_CONDITION_FAILURE)
+		case isWorkflowTaskFailed(state):
+			satisfied = dep.Condition == common.WORKFLOW_CONDITION_FAILURE || dep.Condition == common.WORKFLOW_CONDITION_ALWAYS
+		default:
+			// 依赖任务还未结束
+			return false, false
+		}
+		if !satisfied {
+			skip = true
+		}
+	}
+	return !skip, skip
+}
+
+// workflowFailureHandled 任务失败后是否有下游的失败分支(failure)进行处理，被处理的失败不会导致workflow失败
+func workflowFailureHandled(taskFlow map[WorkflowTaskInfo][]WorkflowTaskDependency, task WorkflowTaskInfo) bool {
+	for _, deps := range taskFlow {
+		for _, dep := range deps {
+			if dep.WorkflowTaskInfo == task && dep.Condition == common.WORKFLOW_CONDITION_FAILURE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// workflowFailureTolerated 任务失败后是否还有下游分支(failure/always)需要继续执行
+func workflowFailureTolerated(taskFlow map[WorkflowTaskInfo][]WorkflowTaskDependency, task WorkflowTaskInfo) bool {
+	for _, deps := range taskFlow {
+		for _, dep := range deps {
+			if dep.WorkflowTaskInfo == task &&
+				(dep.Condition == common.WORKFLOW_CONDITION_FAILURE || dep.Condition == common.WORKFLOW_CONDITION_ALWAYS) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipUnreachableTasks 将依赖条件不满足、永远不会被执行的任务标记为跳过
+func (s *WorkflowPlan) skipUnreachableTasks(planState *PlanState, taskStatesMap map[WorkflowTaskInfo]*WorkflowTaskStates) error {
+	for changed := true; changed; {
+		changed = false
+		for task, deps := range s.TaskFlow {
+			if !planState.InScope(task) {
+				continue
+			}
+			deps = planState.scopeDependencies(deps)
+			if states := taskStatesMap[task]; states != nil &&
+				(states.CurrentStatus != common.TASK_STATUS_NOT_RUNNING_V2 || states.ScheduleCount > 0) {
+				continue
+			}
+			if _, skip := checkWorkflowDependencies(deps, taskStatesMap); !skip {
+				continue
+			}
+
+			var skipped *WorkflowTaskStates
+			_, err := concurrency.NewSTM(s.runner.etcd, func(stm concurrency.STM) error {
+				var err error
+				skipped, err = setWorkflowTaskSkipped(stm, s.Workflow.ID, s.runID, s.Tasks[task], "依赖条件不满足，跳过执行")
+				return err
+			})
+			if err != nil {
+				wlog.Error("failed to set workflow task skipped", zap.Int64("workflow_id", s.Workflow.ID),
+					zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID), zap.Error(err))
+				return err
+			}
+			taskStatesMap[task] = skipped
+			changed = true
+			s.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(s.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_SKIPPED_V2))
+		}
+	}
+	return nil
+}
+
 func inverseGraph(graph map[WorkflowTaskInfo][]WorkflowTaskInfo) (igraph map[WorkflowTaskInfo][]WorkflowTaskInfo) {
 	igraph = make(map[WorkflowTaskInfo][]WorkflowTaskInfo)
 	for node, outcomes := range graph {
@@ -1242,7 +1874,7 @@ func (a *workflowRunner) SetPlan(data common.Workflow) error {
 			runner:   a,
 			Workflow: data,
 			Tasks:    make(map[WorkflowTaskInfo]*common.WorkflowTask),
-			TaskFlow: make(map[WorkflowTaskInfo][]WorkflowTaskInfo),
+			TaskFlow: make(map[WorkflowTaskInfo][]WorkflowTaskDependency),
 		}
 		atomic.AddInt64(&a.planCounter, 1)
 	} else {
@@ -1391,6 +2023,15 @@ BreakHere:
 				}
 				return true
 			})
+			runs, err := a.refreshRunPlans()
+			if err != nil {
+				wlog.Error("failed to refresh workflow concurrent runs", zap.Error(err))
+			}
+			for _, run := range runs {
+				if run.LatestScheduleTime.Before(time.Now().Add(-time.Second * 10)) {
+					a.scheduleWorkflowPlan(run)
+				}
+			}
 		case <-scheduleTimer.C: // 最近的一个调度任务到期执行
 		case <-a.reCalcScheduleTimeChan:
 			wlog.Debug("got recalculate schedule time event")
@@ -1428,19 +2069,24 @@ func (a *workflowRunner) handleTaskResultV1(agentIP string, data *common.TaskFin
 
 	a.app.PublishMessage(messageWorkflowTaskStatusChanged(data.WorkflowID, data.ProjectID, data.TaskID, data.Status))
 
-	// 任务如果失败三次，则终止整个workflow
+	// 任务如果失败三次，且没有下游分支处理失败，则终止整个workflow
 	if planFinished {
-		next = false
-		plan := a.GetPlan(data.WorkflowID)
+		plan := a.GetRunPlan(data.WorkflowID, data.WorkflowRunID)
 		if plan != nil {
-			plan.Finished(nil)
+			plan.locker.Lock()
+			tolerated := workflowFailureTolerated(plan.TaskFlow, WorkflowTaskInfo{ProjectID: data.ProjectID, TaskID: data.TaskID})
+			plan.locker.Unlock()
+			if !tolerated {
+				next = false
+				plan.Finished(nil)
+			}
 		}
 	}
 
 	if !next || !a.isLeader {
 		return nil
 	}
-	plan := a.GetPlan(data.WorkflowID)
+	plan := a.GetRunPlan(data.WorkflowID, data.WorkflowRunID)
 	if plan == nil {
 		return nil
 	}
@@ -1462,12 +2108,12 @@ func (a *workflowRunner) handleTaskEvent(event *common.TaskEvent) {
 				ServiceIP:  a.app.GetIP(),
 				Message: fmt.Sprintf("workflow任务调度失败，workflow_id: %d\n panic: %v",
 					event.Task.FlowInfo.WorkflowID, r),
-			}))
+			}).WithLevel(warning.LevelCritical))
 		}
 	}()
 	switch event.EventType {
 	case common.TASK_EVENT_WORKFLOW_SCHEDULE:
-		plan := a.GetPlan(event.Task.FlowInfo.WorkflowID)
+		plan := a.GetRunPlan(event.Task.FlowInfo.WorkflowID, event.Task.FlowInfo.RunID)
 		if plan == nil {
 			return
 		}
@@ -1478,6 +2124,7 @@ func (a *workflowRunner) handleTaskEvent(event *common.TaskEvent) {
 			a.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
 				WorkflowID:    event.Task.FlowInfo.WorkflowID,
 				WorkflowTitle: plan.Workflow.Title,
+				ProjectIDs:    plan.projectIDs(),
 				ServiceIP:     a.app.GetIP(),
 				Message: fmt.Sprintf("workflow任务调度失败，workflow_id: %d\n%s",
 					event.Task.FlowInfo.WorkflowID, err.Error()),
@@ -1487,7 +2134,7 @@ func (a *workflowRunner) handleTaskEvent(event *common.TaskEvent) {
 }
 
 func (p *WorkflowPlan) RefreshStates() error {
-	states, err := getWorkflowPlanState(p.runner.etcd.KV, p.Workflow.ID)
+	states, err := getWorkflowPlanState(p.runner.etcd.KV, p.Workflow.ID, p.runID)
 	if err != nil {
 		return err
 	}
@@ -1507,18 +2154,23 @@ func (p *WorkflowPlan) IsRunning() (bool, error) {
 
 	now := time.Now()
 
-	if now.Unix()-p.planState.LatestTryTime > p.Expr.Next(now).Unix()-now.Unix() {
+	// 并发运行不会被重新调度唤醒，只要状态存在就在运行中
+	if p.runID == "" && now.Unix()-p.planState.LatestTryTime > p.Expr.Next(now).Unix()-now.Unix() {
 		return false, nil
 	}
 	return p.planState.Status == common.TASK_STATUS_RUNNING_V2, nil
 }
 
-func (p *WorkflowPlan) SetRunning() error {
-	newState, err := setWorkflowPlanRunning(p.runner.etcd, p.Workflow.ID)
+// SetRunning 设置plan为运行中，params仅在开始新的运行时生效
+func (p *WorkflowPlan) SetRunning(params map[string]string) error {
+	newState, started, err := setWorkflowPlanRunning(p.runner.etcd, p.Workflow.ID, p.runID, params)
 	if err != nil {
 		return err
 	}
 	p.planState = newState
 	p.runner.app.PublishMessage(messageWorkflowStatusChanged(p.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+	if started {
+		p.runner.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_STARTED, p, *newState)
+	}
 	return nil
 }
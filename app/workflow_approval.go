@@ -0,0 +1,162 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/pkg/warning"
+)
+
+// requestApproval 审批节点进入待审批状态，并通知审批人
+func (p *WorkflowPlan) requestApproval(task *common.WorkflowTask) error {
+	var changed bool
+	_, err := concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		var err error
+		changed, err = setWorkflowTaskWaitingApproval(stm, p.Workflow.ID, p.runID, task)
+		return err
+	})
+	if err != nil || !changed {
+		return err
+	}
+
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_WAITING_APPROVAL_V2))
+
+	var approvers []string
+	for _, uid := range task.ApproverIDs() {
+		p.runner.app.PublishMessage(messageWorkflowApprovalRequested(uid, p.Workflow.ID, p.runID, task.ProjectID, task.TaskID, task.TaskName))
+		if user, err := p.runner.app.GetUserInfo(uid); err == nil && user != nil {
+			approvers = append(approvers, fmt.Sprintf("%s(%d)", user.Name, user.ID))
+		} else {
+			approvers = append(approvers, fmt.Sprintf("%d", uid))
+		}
+	}
+	if len(approvers) == 0 {
+		approvers = append(approvers, "workflow成员")
+	}
+
+	p.runner.app.Warning(warning.NewWorkflowWarningData(warning.WorkflowWarning{
+		WorkflowID:    p.Workflow.ID,
+		WorkflowTitle: p.Workflow.Title,
+		ProjectIDs:    p.projectIDs(),
+		ServiceIP:     p.runner.app.GetIP(),
+		Message: fmt.Sprintf("workflow: %s, 审批节点: %s 等待审批，审批人: %s",
+			p.Workflow.Title, task.TaskName, strings.Join(approvers, ", ")),
+	}).WithLevel(warning.LevelInfo))
+	return nil
+}
+
+// expireApproval 审批超时，按审批拒绝处理
+func (p *WorkflowPlan) expireApproval(task WorkflowTaskInfo) {
+	_, err := concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		return setWorkflowTaskApprovalResult(stm, p.Workflow.ID, p.runID, task, false, "", "审批超时")
+	})
+	if err != nil {
+		wlog.Error("failed to set workflow approval timeout", zap.Int64("workflow_id", p.Workflow.ID),
+			zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID), zap.Error(err))
+		return
+	}
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_FAIL_V2))
+}
+
+// isApprovalExpired 审批节点是否已超过审批时限，审批节点的超时时间即为任务的超时时间
+func isApprovalExpired(task *common.WorkflowTask, states *WorkflowTaskStates) bool {
+	return task != nil && task.Timeout > 0 && states.StartTime > 0 &&
+		time.Now().Unix()-states.StartTime >= int64(task.Timeout)
+}
+
+// ApproveWorkflowTask 审批workflow中的审批节点，审批通过后继续执行下游任务，拒绝则该节点失败
+// runID为并发运行的id，审批主运行中的节点时为空
+func (a *app) ApproveWorkflowTask(userID, workflowID int64, runID string, task WorkflowTaskInfo, approved bool, remark string) error {
+	plan := a.workflowRunner.GetRunPlan(workflowID, runID)
+	if plan == nil {
+		return errors.NewError(http.StatusBadRequest, "该workflow运行不存在")
+	}
+	detail := plan.Tasks[task]
+	if detail == nil || detail.Type != common.WORKFLOW_TASK_TYPE_APPROVAL {
+		return errors.NewError(http.StatusBadRequest, "该任务不是审批节点")
+	}
+
+	if err := a.checkApprovalPermission(userID, workflowID, detail); err != nil {
+		return err
+	}
+
+	running, err := plan.IsRunning()
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+	}
+	if !running {
+		return errors.NewError(http.StatusBadRequest, "workflow未在运行中")
+	}
+
+	operator, err := a.workflowOperator(userID)
+	if err != nil {
+		return err
+	}
+
+	reason, status := "审批通过", common.TASK_STATUS_DONE_V2
+	if !approved {
+		reason, status = "审批拒绝", common.TASK_STATUS_FAIL_V2
+	}
+	if remark != "" {
+		reason += "，备注: " + remark
+	}
+
+	_, err = concurrency.NewSTM(a.GetEtcdClient(), func(stm concurrency.STM) error {
+		return setWorkflowTaskApprovalResult(stm, workflowID, runID, task, approved, operator, reason)
+	})
+	if err != nil {
+		if _, ok := err.(*errors.Error); ok {
+			return err
+		}
+		return errors.NewError(http.StatusInternalServerError, "保存审批结果失败").WithLog(err.Error())
+	}
+	a.PublishMessage(messageWorkflowTaskStatusChanged(workflowID, task.ProjectID, task.TaskID, status))
+
+	if a.workflowRunner.isLeader {
+		if err = a.workflowRunner.scheduleWorkflowPlan(plan); err != nil && err != ErrWorkflowInProcess {
+			wlog.Error("failed to schedule workflow after approval", zap.Int64("workflow_id", workflowID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// checkApprovalPermission 配置了审批人时仅审批人及管理员可审批，否则有workflow权限的用户均可审批
+func (a *app) checkApprovalPermission(userID, workflowID int64, task *common.WorkflowTask) error {
+	approvers := task.ApproverIDs()
+	if len(approvers) == 0 {
+		return checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, workflowID)
+	}
+	for _, v := range approvers {
+		if v == userID {
+			return nil
+		}
+	}
+	isAdmin, err := a.IsAdmin(userID)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return errors.NewError(http.StatusForbidden, "无权审批该任务")
+	}
+	return nil
+}
+
+// workflowOperator 记录在任务状态中的操作人
+func (a *app) workflowOperator(userID int64) (string, error) {
+	user, err := a.GetUserInfo(userID)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return fmt.Sprintf("%d", userID), nil
+	}
+	return fmt.Sprintf("%s(%d)", user.Name, user.ID), nil
+}
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/utils"
+)
+
+// 子workflow最大嵌套层数，防止运行时出现循环调用
+const workflowMaxNestingDepth = 16
+
+// startChildWorkflow 启动子workflow节点引用的workflow，子workflow运行结束后将结果同步到该节点
+func (p *WorkflowPlan) startChildWorkflow(task *common.WorkflowTask) error {
+	node := WorkflowTaskInfo{ProjectID: task.ProjectID, TaskID: task.TaskID}
+	child := p.runner.GetPlan(task.RefWorkflowID)
+	if child == nil {
+		return p.failChildNode(task, fmt.Sprintf("子workflow(%d)不存在", task.RefWorkflowID))
+	}
+
+	ancestors, err := p.workflowAncestors()
+	if err != nil {
+		return err
+	}
+	for _, v := range ancestors {
+		if v == task.RefWorkflowID {
+			return p.failChildNode(task, fmt.Sprintf("子workflow(%d)循环调用", task.RefWorkflowID))
+		}
+	}
+	if len(ancestors) >= workflowMaxNestingDepth {
+		return p.failChildNode(task, fmt.Sprintf("子workflow嵌套超过%d层", workflowMaxNestingDepth))
+	}
+
+	// 子workflow使用其声明的默认参数运行
+	params, err := child.resolveParams(nil)
+	if err != nil {
+		return p.failChildNode(task, fmt.Sprintf("子workflow(%d)运行参数不完整: %s", task.RefWorkflowID, err.Error()))
+	}
+
+	// 子workflow以独立的运行进行，不占用其自身的主运行
+	runID := childWorkflowRunID(p.Workflow.ID, p.runID, node)
+
+	// agent及任务锁尚未按运行隔离，同一workflow的两次运行会下发相同的任务而互相冲突，
+	// 子workflow有其他运行时节点保持等待，下次调度时再尝试启动
+	busy, err := p.runner.isChildWorkflowBusy(child, runID)
+	if err != nil {
+		return err
+	}
+	if busy {
+		wlog.Debug("child workflow is running, wait for it to finish", zap.Int64("workflow_id", p.Workflow.ID),
+			zap.Int64("child_workflow_id", child.Workflow.ID), zap.String("task_id", task.TaskID))
+		return nil
+	}
+	newState, started, err := setWorkflowChildPlanRunning(p.runner.etcd, child.Workflow.ID, runID, &WorkflowParentInfo{
+		WorkflowID:       p.Workflow.ID,
+		RunID:            p.runID,
+		WorkflowTaskInfo: node,
+	}, params)
+	if err != nil {
+		return err
+	}
+
+	// 子workflow的运行已存在时(上次启动后节点状态未能更新)仍需补充节点的运行状态
+	_, err = concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		_, err := setWorkflowTaskChildRunning(stm, p.Workflow.ID, p.runID, task)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !started {
+		return nil
+	}
+
+	run := child.fork(runID)
+	run.planState = newState
+	p.runner.runs.Store(workflowRunKey(run.Workflow.ID, runID), run)
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_RUNNING_V2))
+	p.runner.app.PublishMessage(messageWorkflowStatusChanged(child.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+	p.runner.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_STARTED, run, *newState)
+	return p.runner.scheduleWorkflowPlan(run)
+}
+
+// isChildWorkflowBusy 子workflow的主运行或其他子workflow运行是否在进行中，runID为本节点对应的运行，已存在时不视为冲突
+func (a *workflowRunner) isChildWorkflowBusy(child *WorkflowPlan, runID string) (bool, error) {
+	running, err := child.IsRunning()
+	if err != nil || running {
+		return running, err
+	}
+	return a.hasActiveChildRuns(child.Workflow.ID, runID)
+}
+
+// hasActiveChildRuns workflow是否有作为子workflow进行中的运行，exceptRunID对应的运行除外
+func (a *workflowRunner) hasActiveChildRuns(workflowID int64, exceptRunID string) (bool, error) {
+	ctx, _ := utils.GetContextWithTimeout()
+	resp, err := a.etcd.KV.Get(ctx, common.BuildWorkflowRunPlanKeyPrefix()+workflowRunKey(workflowID, ""), clientv3.WithPrefix())
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range resp.Kvs {
+		var state PlanState
+		if err = json.Unmarshal(kv.Value, &state); err != nil {
+			continue
+		}
+		if state.Parent != nil && state.RunID != exceptRunID && state.Status == common.TASK_STATUS_RUNNING_V2 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// childWorkflowRunID 子workflow运行的id，由父workflow的运行及节点确定，同一节点重复调度时不会重复启动
+func childWorkflowRunID(workflowID int64, runID string, node WorkflowTaskInfo) string {
+	return fmt.Sprintf("child-%d-%s-%d-%s", workflowID, runID, node.ProjectID, node.TaskID)
+}
+
+// failChildNode 子workflow无法启动时直接将节点标记为失败
+func (p *WorkflowPlan) failChildNode(task *common.WorkflowTask, reason string) error {
+	_, err := concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		if _, err := setWorkflowTaskChildRunning(stm, p.Workflow.ID, p.runID, task); err != nil {
+			return err
+		}
+		_, err := setWorkflowTaskChildFinished(stm, p.Workflow.ID, p.runID, WorkflowTaskInfo{ProjectID: task.ProjectID, TaskID: task.TaskID}, false, reason)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_FAIL_V2))
+	return nil
+}
+
+// workflowAncestors 当前运行及其所有父workflow的id
+func (p *WorkflowPlan) workflowAncestors() ([]int64, error) {
+	ancestors := []int64{p.Workflow.ID}
+	workflowID, runID := p.Workflow.ID, p.runID
+	for len(ancestors) <= workflowMaxNestingDepth {
+		state, err := getWorkflowPlanState(p.runner.etcd.KV, workflowID, runID)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil || state.Parent == nil {
+			break
+		}
+		workflowID, runID = state.Parent.WorkflowID, state.Parent.RunID
+		ancestors = append(ancestors, workflowID)
+	}
+	return ancestors, nil
+}
+
+// checkChildWorkflow 子workflow已不在运行中但节点仍为运行状态时(例如结果同步失败)，将节点标记为失败
+func (p *WorkflowPlan) checkChildWorkflow(task *common.WorkflowTask) {
+	node := WorkflowTaskInfo{ProjectID: task.ProjectID, TaskID: task.TaskID}
+	state, err := getWorkflowPlanState(p.runner.etcd.KV, task.RefWorkflowID, childWorkflowRunID(p.Workflow.ID, p.runID, node))
+	if err != nil {
+		wlog.Error("failed to get child workflow state", zap.Int64("workflow_id", p.Workflow.ID),
+			zap.Int64("child_workflow_id", task.RefWorkflowID), zap.Error(err))
+		return
+	}
+	if state != nil && state.Status == common.TASK_STATUS_RUNNING_V2 && p.isParentOf(state, task) {
+		return
+	}
+
+	_, err = concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		_, err := setWorkflowTaskChildFinished(stm, p.Workflow.ID, p.runID, node, false, "子workflow异常结束")
+		return err
+	})
+	if err != nil {
+		wlog.Error("failed to set child workflow node failed", zap.Int64("workflow_id", p.Workflow.ID),
+			zap.Int64("child_workflow_id", task.RefWorkflowID), zap.Error(err))
+		return
+	}
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_FAIL_V2))
+}
+
+// notifyParentWorkflow 子workflow运行结束，将结果同步到父workflow节点并触发父workflow继续调度
+func (p *WorkflowPlan) notifyParentWorkflow(parent *WorkflowParentInfo, succeeded bool, reason string) {
+	result := "子workflow运行成功"
+	if !succeeded {
+		result = "子workflow运行失败"
+		if reason != "" {
+			result += ": " + reason
+		}
+	}
+
+	var changed bool
+	_, err := concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		var err error
+		changed, err = setWorkflowTaskChildFinished(stm, parent.WorkflowID, parent.RunID, parent.WorkflowTaskInfo, succeeded, result)
+		return err
+	})
+	if err != nil {
+		p.runner.app.Metrics().CustomInc("workflow_notify_parent", fmt.Sprintf("%d_%d", parent.WorkflowID, p.Workflow.ID), err.Error())
+		wlog.Error("failed to notify parent workflow", zap.Int64("workflow_id", p.Workflow.ID),
+			zap.Int64("parent_workflow_id", parent.WorkflowID), zap.Error(err))
+		return
+	}
+	if !changed {
+		return
+	}
+
+	status := common.TASK_STATUS_FAIL_V2
+	if succeeded {
+		status = common.TASK_STATUS_DONE_V2
+	}
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(parent.WorkflowID, parent.ProjectID, parent.TaskID, status))
+
+	if parentPlan := p.runner.GetRunPlan(parent.WorkflowID, parent.RunID); parentPlan != nil && p.runner.isLeader {
+		go func() {
+			if err := p.runner.scheduleWorkflowPlan(parentPlan); err != nil && err != ErrWorkflowInProcess {
+				wlog.Error("failed to schedule parent workflow", zap.Int64("workflow_id", parent.WorkflowID), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// killChildWorkflows 父workflow异常结束时停止由其启动的子workflow
+func (p *WorkflowPlan) killChildWorkflows(tasks []*common.WorkflowTask) {
+	for _, task := range tasks {
+		runID := childWorkflowRunID(p.Workflow.ID, p.runID, WorkflowTaskInfo{ProjectID: task.ProjectID, TaskID: task.TaskID})
+		child := p.runner.GetRunPlan(task.RefWorkflowID, runID)
+		if child == nil || child.planState == nil || !p.isParentOf(child.planState, task) {
+			continue
+		}
+		if err := child.Finished(ErrWorkflowKilled); err != nil {
+			wlog.Error("failed to kill child workflow", zap.Int64("workflow_id", p.Workflow.ID),
+				zap.Int64("child_workflow_id", task.RefWorkflowID), zap.Error(err))
+		}
+	}
+}
+
+// isParentOf 子workflow的运行是否由本次运行中的task节点启动
+func (p *WorkflowPlan) isParentOf(state *PlanState, task *common.WorkflowTask) bool {
+	return state.Parent != nil && state.Parent.WorkflowID == p.Workflow.ID && state.Parent.RunID == p.runID &&
+		state.Parent.ProjectID == task.ProjectID && state.Parent.TaskID == task.TaskID
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/pkg/warning"
+	"github.com/holdno/gopherCron/utils"
+)
+
+// 排队等待及并发执行(试运行、子workflow)的运行数上限，超出后按跳过处理
+const (
+	workflowMaxQueuedRuns     = 10
+	workflowMaxConcurrentRuns = 10
+)
+
+// isValidWorkflowConcurrencyPolicy 同一workflow的两次运行会向agent下发相同的任务，
+// agent的执行表、任务状态及任务锁都只按项目与任务区分，两次运行会互相冲突，因此暂不允许配置并发运行
+func isValidWorkflowConcurrencyPolicy(policy string) bool {
+	switch policy {
+	case "", common.WORKFLOW_CONCURRENCY_SKIP, common.WORKFLOW_CONCURRENCY_QUEUE:
+		return true
+	}
+	return false
+}
+
+// workflowOverlapPolicy 运行重叠时实际采用的策略，此前保存的并发运行配置按排队处理
+func workflowOverlapPolicy(policy string) string {
+	if policy == common.WORKFLOW_CONCURRENCY_CONCURRENT {
+		return common.WORKFLOW_CONCURRENCY_QUEUE
+	}
+	return policy
+}
+
+// workflowProcessKey 任务调度中的标记，并发运行中的同一任务需要区分开
+func workflowProcessKey(runID, taskID string) string {
+	if runID == "" {
+		return taskID
+	}
+	return runID + "/" + taskID
+}
+
+func workflowRunKey(workflowID int64, runID string) string {
+	return fmt.Sprintf("%d/%s", workflowID, runID)
+}
+
+// fork 基于workflow的配置创建一次并发运行的plan，任务及依赖在调度时加载
+func (p *WorkflowPlan) fork(runID string) *WorkflowPlan {
+	return &WorkflowPlan{
+		runner:   p.runner,
+		Workflow: p.Workflow,
+		Expr:     p.Expr,
+		NextTime: p.NextTime,
+		Tasks:    make(map[WorkflowTaskInfo]*common.WorkflowTask),
+		TaskFlow: make(map[WorkflowTaskInfo][]WorkflowTaskDependency),
+		runID:    runID,
+	}
+}
+
+// GetRunPlan 获取workflow某次运行的plan，runID为空时为workflow的主运行
+// 并发运行的plan不在内存中时(如leader切换)，根据etcd中的运行状态重新创建
+func (a *workflowRunner) GetRunPlan(workflowID int64, runID string) *WorkflowPlan {
+	if runID == "" {
+		return a.GetPlan(workflowID)
+	}
+	if data, exist := a.runs.Load(workflowRunKey(workflowID, runID)); exist {
+		return data.(*WorkflowPlan)
+	}
+
+	plan := a.GetPlan(workflowID)
+	if plan == nil {
+		return nil
+	}
+	state, err := getWorkflowPlanState(a.etcd.KV, workflowID, runID)
+	if err != nil || state == nil {
+		return nil
+	}
+
+	run := plan.fork(runID)
+	run.planState = state
+	if err = run.RefreshPlanTasks(); err != nil {
+		wlog.Error("failed to load workflow run tasks", zap.Int64("workflow_id", workflowID), zap.String("run_id", runID), zap.Error(err))
+		return nil
+	}
+	data, _ := a.runs.LoadOrStore(workflowRunKey(workflowID, runID), run)
+	return data.(*WorkflowPlan)
+}
+
+// refreshRunPlans 根据etcd中的运行状态同步内存中的并发运行，返回所有进行中的并发运行
+func (a *workflowRunner) refreshRunPlans() ([]*WorkflowPlan, error) {
+	ctx, _ := utils.GetContextWithTimeout()
+	resp, err := a.etcd.KV.Get(ctx, common.BuildWorkflowRunPlanKeyPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		list  []*WorkflowPlan
+		alive = make(map[string]struct{}, len(resp.Kvs))
+	)
+	for _, kv := range resp.Kvs {
+		var state PlanState
+		if err = json.Unmarshal(kv.Value, &state); err != nil || state.RunID == "" {
+			continue
+		}
+		alive[workflowRunKey(state.WorkflowID, state.RunID)] = struct{}{}
+		if run := a.GetRunPlan(state.WorkflowID, state.RunID); run != nil {
+			list = append(list, run)
+		}
+	}
+
+	// 其他节点上已经结束的运行
+	a.runs.Range(func(key, value interface{}) bool {
+		if _, exist := alive[key.(string)]; !exist {
+			a.runs.Delete(key)
+		}
+		return true
+	})
+	return list, nil
+}
+
+// finishRunPlans 结束workflow所有进行中的并发运行
+func (a *workflowRunner) finishRunPlans(workflowID int64, withError error) error {
+	runs, err := a.refreshRunPlans()
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if run.Workflow.ID != workflowID {
+			continue
+		}
+		if err = run.Finished(withError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetWorkflowRunStates 获取workflow进行中的并发运行状态
+func (a *app) GetWorkflowRunStates(workflowID int64) ([]*PlanState, error) {
+	ctx, _ := utils.GetContextWithTimeout()
+	resp, err := a.GetEtcdClient().KV.Get(ctx, common.BuildWorkflowRunPlanKeyPrefix()+workflowRunKey(workflowID, ""), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow并发运行状态失败").WithLog(err.Error())
+	}
+	var list []*PlanState
+	for _, kv := range resp.Kvs {
+		var state PlanState
+		if err = json.Unmarshal(kv.Value, &state); err != nil {
+			continue
+		}
+		list = append(list, &state)
+	}
+	return list, nil
+}
+
+func (a *workflowRunner) countRunPlans(workflowID int64) (int64, error) {
+	ctx, _ := utils.GetContextWithTimeout()
+	resp, err := a.etcd.KV.Get(ctx, common.BuildWorkflowRunPlanKeyPrefix()+workflowRunKey(workflowID, ""), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// startOverlappingRun 上一次运行尚未结束时按workflow配置的策略处理新的调度
+func (a *workflowRunner) startOverlappingRun(plan *WorkflowPlan, params map[string]string) error {
+	if plan.Workflow.Status != common.TASK_STATUS_RUNNING {
+		// workflow已暂停，只等待当前运行结束
+		return nil
+	}
+
+	switch workflowOverlapPolicy(plan.Workflow.ConcurrencyPolicy) {
+	case common.WORKFLOW_CONCURRENCY_QUEUE:
+		queued, err := queueWorkflowPlanRun(a.etcd, plan.Workflow.ID, workflowMaxQueuedRuns, params)
+		if err != nil {
+			return err
+		}
+		if queued {
+			return nil
+		}
+		return a.skipWorkflowRun(plan, fmt.Sprintf("排队等待的运行已达上限(%d)，跳过本次调度", workflowMaxQueuedRuns))
+	default:
+		return a.skipWorkflowRun(plan, "上一次运行尚未结束，跳过本次调度")
+	}
+}
+
+// skipWorkflowRun 记录一次被跳过的运行并告警
+func (a *workflowRunner) skipWorkflowRun(plan *WorkflowPlan, reason string) error {
+	now := time.Now().Unix()
+	result, _ := json.Marshal(PlanState{
+		WorkflowID: plan.Workflow.ID,
+		StartTime:  now,
+		EndTime:    now,
+		Status:     common.TASK_STATUS_SKIPPED_V2,
+		Reason:     reason,
+	})
+	if err := a.app.CreateWorkflowLog(&common.WorkflowLog{
+		WorkflowID: plan.Workflow.ID,
+		StartTime:  now,
+		EndTime:    now,
+		Result:     string(result),
+		Status:     common.TASK_STATUS_SKIPPED_V2,
+	}, nil); err != nil {
+		return err
+	}
+
+	a.app.Metrics().CustomInc("workflow_run_skipped", fmt.Sprintf("%d_%s", plan.Workflow.ID, plan.Workflow.Title), reason)
+	a.app.Warning(plan.skippedWarning(a.app.GetIP(), reason))
+	return nil
+}
+
+// skippedWarning 按重叠策略跳过调度的提示，属于预期内的行为
+func (p *WorkflowPlan) skippedWarning(serviceIP, reason string) warning.WarningData {
+	return warning.NewWorkflowWarningData(warning.WorkflowWarning{
+		WorkflowID:    p.Workflow.ID,
+		WorkflowTitle: p.Workflow.Title,
+		ProjectIDs:    p.projectIDs(),
+		ServiceIP:     serviceIP,
+		Message:       fmt.Sprintf("Workflow \"%s\" %s", p.Workflow.Title, reason),
+	}).WithLevel(warning.LevelInfo)
+}
+
+// startQueuedRun 主运行结束后启动排队中的下一次运行，调用方需持有plan的锁
+func (p *WorkflowPlan) startQueuedRun(queued int, queuedParams []map[string]string) {
+	var params map[string]string
+	if len(queuedParams) > 0 {
+		params, queuedParams = queuedParams[0], queuedParams[1:]
+	} else {
+		// 未记录参数的排队运行使用默认参数
+		params, _ = p.resolveParams(nil)
+	}
+	newState, started, err := setWorkflowPlanQueuedRunning(p.runner.etcd, p.Workflow.ID, queued, params, queuedParams)
+	if err != nil {
+		wlog.Error("failed to start queued workflow run", zap.Int64("workflow_id", p.Workflow.ID), zap.Error(err))
+		return
+	}
+	if !started {
+		return
+	}
+	p.planState = newState
+	p.runner.app.PublishMessage(messageWorkflowStatusChanged(p.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+	p.runner.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_STARTED, p, *newState)
+
+	if !p.runner.isLeader {
+		return
+	}
+	go func() {
+		if err := p.runner.scheduleWorkflowPlan(p); err != nil && err != ErrWorkflowInProcess {
+			wlog.Error("failed to schedule queued workflow run", zap.Int64("workflow_id", p.Workflow.ID), zap.Error(err))
+		}
+	}()
+}
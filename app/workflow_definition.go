@@ -0,0 +1,665 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/holdno/gocommons/selection"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/yaml.v3"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/utils"
+)
+
+const (
+	WORKFLOW_DEFINITION_FORMAT_YAML = "yaml"
+	WORKFLOW_DEFINITION_FORMAT_JSON = "json"
+)
+
+// WorkflowDefinition workflow的声明式定义，包含workflow配置、任务及依赖关系，用于导入导出
+type WorkflowDefinition struct {
+	Title             string                   `json:"title" yaml:"title"`
+	Remark            string                   `json:"remark,omitempty" yaml:"remark,omitempty"`
+	Cron              string                   `json:"cron" yaml:"cron"`
+	Status            int                      `json:"status,omitempty" yaml:"status,omitempty"` // 1启用2暂停，为空时新建的workflow为暂停
+	Timeout           int                      `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	MaxParallel       int                      `json:"max_parallel,omitempty" yaml:"max_parallel,omitempty"`
+	TriggerWorkflowID int64                    `json:"trigger_workflow_id,omitempty" yaml:"trigger_workflow_id,omitempty"`
+	TriggerCondition  string                   `json:"trigger_condition,omitempty" yaml:"trigger_condition,omitempty"`
+	ConcurrencyPolicy string                   `json:"concurrency_policy,omitempty" yaml:"concurrency_policy,omitempty"`
+	Params            []common.WorkflowParam   `json:"params,omitempty" yaml:"params,omitempty"`
+	Tasks             []WorkflowTaskDefinition `json:"tasks" yaml:"tasks"`
+}
+
+// WorkflowTaskDefinition workflow中的任务，依赖通过key引用，key为空时使用任务名称
+// 未指定task_id时按项目下的任务名称匹配已有任务，匹配不到则新建
+type WorkflowTaskDefinition struct {
+	Key           string                         `json:"key,omitempty" yaml:"key,omitempty"`
+	Name          string                         `json:"name" yaml:"name"`
+	ProjectID     int64                          `json:"project_id" yaml:"project_id"`
+	TaskID        string                         `json:"task_id,omitempty" yaml:"task_id,omitempty"`
+	Type          string                         `json:"type,omitempty" yaml:"type,omitempty"`
+	Command       string                         `json:"command,omitempty" yaml:"command,omitempty"`
+	Remark        string                         `json:"remark,omitempty" yaml:"remark,omitempty"`
+	Timeout       int                            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Noseize       int                            `json:"noseize,omitempty" yaml:"noseize,omitempty"`
+	MaxRetries    *int                           `json:"max_retries,omitempty" yaml:"max_retries,omitempty"` // 为空时使用默认重试策略
+	RetryBackoff  int                            `json:"retry_backoff,omitempty" yaml:"retry_backoff,omitempty"`
+	Approvers     []int64                        `json:"approvers,omitempty" yaml:"approvers,omitempty"`
+	RefWorkflowID int64                          `json:"ref_workflow_id,omitempty" yaml:"ref_workflow_id,omitempty"`
+	DependsOn     []WorkflowDependencyDefinition `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+}
+
+type WorkflowDependencyDefinition struct {
+	Task      string `json:"task" yaml:"task"`
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+// WorkflowImportResult 导入workflow定义时与现有配置的差异
+type WorkflowImportResult struct {
+	WorkflowID   int64    `json:"workflow_id"`
+	Workflow     string   `json:"workflow"` // create/update/unchanged
+	CreatedTasks []string `json:"created_tasks,omitempty"`
+	UpdatedTasks []string `json:"updated_tasks,omitempty"`
+	AddedEdges   []string `json:"added_edges,omitempty"`
+	RemovedEdges []string `json:"removed_edges,omitempty"`
+	Applied      bool     `json:"applied"`
+}
+
+func (d WorkflowTaskDefinition) key() string {
+	if d.Key != "" {
+		return d.Key
+	}
+	return d.Name
+}
+
+// toWorkflowTask 按定义生成任务，base为已存在的任务
+func (d WorkflowTaskDefinition) toWorkflowTask(base *common.WorkflowTask) common.WorkflowTask {
+	task := common.WorkflowTask{
+		TaskID:     d.TaskID,
+		ProjectID:  d.ProjectID,
+		CreateTime: time.Now().Unix(),
+		MaxRetries: -1,
+	}
+	if base != nil {
+		task = *base
+	}
+	task.TaskName = d.Name
+	task.Type = d.Type
+	task.Command = d.Command
+	task.Remark = d.Remark
+	task.Timeout = d.Timeout
+	task.Noseize = d.Noseize
+	task.MaxRetries = -1
+	if d.MaxRetries != nil && *d.MaxRetries >= 0 {
+		task.MaxRetries = *d.MaxRetries
+	}
+	task.RetryBackoff = d.RetryBackoff
+	var approvers []string
+	for _, v := range d.Approvers {
+		approvers = append(approvers, strconv.FormatInt(v, 10))
+	}
+	task.Approvers = strings.Join(approvers, ",")
+	task.RefWorkflowID = d.RefWorkflowID
+	return task
+}
+
+func newWorkflowTaskDefinition(task common.WorkflowTask) WorkflowTaskDefinition {
+	d := WorkflowTaskDefinition{
+		Name:          task.TaskName,
+		ProjectID:     task.ProjectID,
+		TaskID:        task.TaskID,
+		Type:          task.Type,
+		Command:       task.Command,
+		Remark:        task.Remark,
+		Timeout:       task.Timeout,
+		Noseize:       task.Noseize,
+		RetryBackoff:  task.RetryBackoff,
+		Approvers:     task.ApproverIDs(),
+		RefWorkflowID: task.RefWorkflowID,
+	}
+	if task.MaxRetries >= 0 {
+		retries := task.MaxRetries
+		d.MaxRetries = &retries
+	}
+	return d
+}
+
+// buildWorkflowDefinition 根据workflow配置、任务依赖及任务详情生成定义，任务及依赖按配置顺序排列
+// 名称重复的任务使用 名称#任务id 作为key
+func buildWorkflowDefinition(workflow common.Workflow, plans []common.WorkflowSchedulePlan, tasks map[WorkflowTaskInfo]common.WorkflowTask) *WorkflowDefinition {
+	def := &WorkflowDefinition{
+		Title:             workflow.Title,
+		Remark:            workflow.Remark,
+		Cron:              workflow.Cron,
+		Status:            workflow.Status,
+		Timeout:           workflow.Timeout,
+		MaxParallel:       workflow.MaxParallel,
+		TriggerWorkflowID: workflow.TriggerWorkflowID,
+		TriggerCondition:  workflow.TriggerCondition,
+		ConcurrencyPolicy: workflow.ConcurrencyPolicy,
+	}
+	def.Params, _ = workflow.ParamSchema()
+
+	var (
+		order     []WorkflowTaskInfo
+		deps      = make(map[WorkflowTaskInfo][]common.WorkflowSchedulePlan)
+		nameCount = make(map[string]int)
+	)
+	for _, v := range plans {
+		task := WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}
+		if _, exist := deps[task]; !exist {
+			order = append(order, task)
+			deps[task] = nil
+			nameCount[tasks[task].TaskName]++
+		}
+		if v.DependencyTaskID != "" {
+			deps[task] = append(deps[task], v)
+		}
+	}
+
+	keys := make(map[WorkflowTaskInfo]string, len(order))
+	for _, v := range order {
+		keys[v] = tasks[v].TaskName
+		if nameCount[keys[v]] > 1 || keys[v] == "" {
+			keys[v] = fmt.Sprintf("%s#%s", keys[v], v.TaskID)
+		}
+	}
+
+	for _, v := range order {
+		item := newWorkflowTaskDefinition(tasks[v])
+		item.ProjectID, item.TaskID = v.ProjectID, v.TaskID
+		if keys[v] != item.Name {
+			item.Key = keys[v]
+		}
+		for _, dep := range deps[v] {
+			condition := dep.DependencyCondition
+			if condition == common.WORKFLOW_CONDITION_SUCCESS {
+				condition = ""
+			}
+			item.DependsOn = append(item.DependsOn, WorkflowDependencyDefinition{
+				Task:      keys[WorkflowTaskInfo{ProjectID: dep.DependencyProjectID, TaskID: dep.DependencyTaskID}],
+				Condition: condition,
+			})
+		}
+		def.Tasks = append(def.Tasks, item)
+	}
+	return def
+}
+
+// diffWorkflowEdges 对比新旧依赖关系，没有依赖的任务以 "-> 任务" 表示
+func diffWorkflowEdges(current, target []common.WorkflowSchedulePlan, names map[WorkflowTaskInfo]string) (added, removed []string) {
+	describe := func(v common.WorkflowSchedulePlan) string {
+		task := workflowGraphNodeLabel(WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}, names)
+		if v.DependencyTaskID == "" {
+			return "-> " + task
+		}
+		condition := v.DependencyCondition
+		if condition == "" {
+			condition = common.WORKFLOW_CONDITION_SUCCESS
+		}
+		dep := workflowGraphNodeLabel(WorkflowTaskInfo{ProjectID: v.DependencyProjectID, TaskID: v.DependencyTaskID}, names)
+		return fmt.Sprintf("%s -> %s (%s)", dep, task, condition)
+	}
+
+	exist := make(map[string]bool)
+	for _, v := range current {
+		exist[describe(v)] = true
+	}
+	want := make(map[string]bool)
+	for _, v := range target {
+		edge := describe(v)
+		if !want[edge] && !exist[edge] {
+			added = append(added, edge)
+		}
+		want[edge] = true
+	}
+	for _, v := range current {
+		edge := describe(v)
+		if !want[edge] {
+			removed = append(removed, edge)
+			want[edge] = true
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func isWorkflowTaskChanged(current, target common.WorkflowTask) bool {
+	return current.TaskName != target.TaskName || current.Type != target.Type || current.Command != target.Command ||
+		current.Remark != target.Remark || current.Timeout != target.Timeout || current.Noseize != target.Noseize ||
+		current.MaxRetries != target.MaxRetries || current.RetryBackoff != target.RetryBackoff ||
+		current.Approvers != target.Approvers || current.RefWorkflowID != target.RefWorkflowID
+}
+
+func isWorkflowChanged(current, target common.Workflow) bool {
+	return current.Title != target.Title || current.Remark != target.Remark || current.Cron != target.Cron ||
+		current.Status != target.Status || current.Timeout != target.Timeout || current.MaxParallel != target.MaxParallel ||
+		current.TriggerWorkflowID != target.TriggerWorkflowID || current.TriggerCondition != target.TriggerCondition ||
+		current.ConcurrencyPolicy != target.ConcurrencyPolicy || current.Params != target.Params
+}
+
+// ExportWorkflowDefinition 将workflow导出为yaml或json格式的定义
+func (a *app) ExportWorkflowDefinition(workflowID int64, format string) (string, error) {
+	if format == "" {
+		format = WORKFLOW_DEFINITION_FORMAT_YAML
+	}
+	if format != WORKFLOW_DEFINITION_FORMAT_YAML && format != WORKFLOW_DEFINITION_FORMAT_JSON {
+		return "", errors.NewError(http.StatusBadRequest, "不支持的导出格式: "+format)
+	}
+
+	workflow, err := a.GetWorkflow(workflowID)
+	if err != nil {
+		return "", err
+	}
+	if workflow == nil {
+		return "", errors.NewError(http.StatusNotFound, "workflow不存在")
+	}
+	plans, err := a.store.WorkflowSchedulePlan().GetList(workflowID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return "", errors.NewError(http.StatusInternalServerError, "获取workflow任务依赖失败").WithLog(err.Error())
+	}
+	tasks, err := a.getWorkflowPlanTasks(plans)
+	if err != nil {
+		return "", err
+	}
+
+	def := buildWorkflowDefinition(*workflow, plans, tasks)
+	var content []byte
+	if format == WORKFLOW_DEFINITION_FORMAT_JSON {
+		content, err = json.MarshalIndent(def, "", "  ")
+	} else {
+		content, err = yaml.Marshal(def)
+	}
+	if err != nil {
+		return "", errors.NewError(http.StatusInternalServerError, "生成workflow定义失败").WithLog(err.Error())
+	}
+	return string(content), nil
+}
+
+// getWorkflowPlanTasks 获取依赖关系中所有任务的详情
+func (a *app) getWorkflowPlanTasks(plans []common.WorkflowSchedulePlan) (map[WorkflowTaskInfo]common.WorkflowTask, error) {
+	tasks := make(map[WorkflowTaskInfo]common.WorkflowTask)
+	var taskIDs []string
+	for _, v := range plans {
+		taskIDs = append(taskIDs, v.TaskID)
+	}
+	if len(taskIDs) == 0 {
+		return tasks, nil
+	}
+	list, err := a.GetMultiWorkflowTaskList(taskIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		tasks[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}] = v
+	}
+	return tasks, nil
+}
+
+// ImportWorkflowDefinition 按定义创建或更新workflow，重复导入相同的定义不会产生变更
+// workflowID为0时按组织及标题匹配已有workflow，dryRun为true时只返回差异不做变更
+func (a *app) ImportWorkflowDefinition(userID int64, oid string, workflowID int64, content []byte, dryRun bool) (*WorkflowImportResult, error) {
+	var def WorkflowDefinition
+	// json是yaml的子集，两种格式都可以直接解析
+	if err := yaml.Unmarshal(content, &def); err != nil {
+		return nil, errors.NewError(http.StatusBadRequest, "解析workflow定义失败: "+err.Error())
+	}
+	if def.Title == "" || def.Cron == "" {
+		return nil, errors.NewError(http.StatusBadRequest, "workflow定义缺少标题或cron表达式")
+	}
+	if _, err := cronexpr.Parse(def.Cron); err != nil {
+		return nil, errors.NewError(errors.CodeInvalidArgument, "cron表达式校验失败: "+err.Error()).WithLog(err.Error())
+	}
+
+	current, err := a.findImportWorkflow(userID, oid, workflowID, def.Title)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &WorkflowImportResult{Workflow: "create"}
+	data := common.Workflow{
+		OID:               oid,
+		Title:             def.Title,
+		Remark:            def.Remark,
+		Cron:              def.Cron,
+		Status:            def.Status,
+		Timeout:           def.Timeout,
+		MaxParallel:       def.MaxParallel,
+		TriggerWorkflowID: def.TriggerWorkflowID,
+		TriggerCondition:  def.TriggerCondition,
+		ConcurrencyPolicy: def.ConcurrencyPolicy,
+		Params:            encodeWorkflowParams(def.Params),
+		CreateTime:        time.Now().Unix(),
+	}
+	if current != nil {
+		data.ID, data.OID, data.CreateTime = current.ID, current.OID, current.CreateTime
+		if data.Status == 0 {
+			data.Status = current.Status
+		}
+		result.WorkflowID = current.ID
+		result.Workflow = "update"
+	} else if data.Status == 0 {
+		data.Status = common.TASK_STATUS_STOP
+	}
+	if err = a.checkWorkflowTrigger(userID, &data); err != nil {
+		return nil, err
+	}
+	if !isValidWorkflowConcurrencyPolicy(data.ConcurrencyPolicy) {
+		return nil, errors.NewError(http.StatusBadRequest, "不支持的运行重叠处理策略: "+data.ConcurrencyPolicy)
+	}
+	if err = normalizeWorkflowParams(&data); err != nil {
+		return nil, err
+	}
+	if current != nil && !isWorkflowChanged(*current, data) {
+		result.Workflow = "unchanged"
+	}
+
+	tasks, createTasks, updateTasks, err := a.resolveDefinitionTasks(userID, def.Tasks)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		taskList = make([]CreateWorkflowSchedulePlanArgs, 0, len(def.Tasks))
+		names    = make(map[WorkflowTaskInfo]string)
+		refs     []int64
+	)
+	for _, v := range def.Tasks {
+		task := tasks[v.key()]
+		info := WorkflowTaskInfo{ProjectID: task.ProjectID, TaskID: task.TaskID}
+		names[info] = task.TaskName
+		if task.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+			refs = append(refs, task.RefWorkflowID)
+		}
+		item := CreateWorkflowSchedulePlanArgs{WorkflowTaskInfo: info}
+		for _, dep := range v.DependsOn {
+			depTask, exist := tasks[dep.Task]
+			if !exist {
+				return nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s依赖的任务%s不在workflow定义中", v.key(), dep.Task))
+			}
+			condition := dep.Condition
+			if condition == "" {
+				condition = common.WORKFLOW_CONDITION_SUCCESS
+			}
+			if !isValidWorkflowCondition(condition) {
+				return nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("不支持的依赖条件: %s, 任务: %s", dep.Condition, v.key()))
+			}
+			item.Dependencies = append(item.Dependencies, WorkflowTaskDependency{
+				WorkflowTaskInfo: WorkflowTaskInfo{ProjectID: depTask.ProjectID, TaskID: depTask.TaskID},
+				Condition:        condition,
+			})
+		}
+		taskList = append(taskList, item)
+	}
+	if err = validateWorkflowGraph(taskList, names); err != nil {
+		return nil, err
+	}
+	if err = a.checkWorkflowReferenceCycle(data.ID, refs); err != nil {
+		return nil, err
+	}
+
+	var currentPlans []common.WorkflowSchedulePlan
+	if current != nil {
+		if currentPlans, err = a.store.WorkflowSchedulePlan().GetList(current.ID); err != nil && err != gorm.ErrRecordNotFound {
+			return nil, errors.NewError(http.StatusInternalServerError, "获取workflow任务依赖失败").WithLog(err.Error())
+		}
+		currentTasks, err := a.getWorkflowPlanTasks(currentPlans)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range currentTasks {
+			if _, exist := names[k]; !exist {
+				names[k] = v.TaskName
+			}
+		}
+	}
+	targetPlans := buildWorkflowSchedulePlans(data.ID, taskList)
+	result.AddedEdges, result.RemovedEdges = diffWorkflowEdges(currentPlans, targetPlans, names)
+	for _, v := range createTasks {
+		result.CreatedTasks = append(result.CreatedTasks, workflowGraphNodeLabel(WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}, names))
+	}
+	for _, v := range updateTasks {
+		result.UpdatedTasks = append(result.UpdatedTasks, workflowGraphNodeLabel(WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}, names))
+	}
+
+	edgesChanged := len(result.AddedEdges) > 0 || len(result.RemovedEdges) > 0
+	if dryRun || (result.Workflow == "unchanged" && len(createTasks) == 0 && len(updateTasks) == 0 && !edgesChanged) {
+		return result, nil
+	}
+
+	if current != nil && edgesChanged {
+		if plan := a.workflowRunner.GetPlan(current.ID); plan != nil {
+			running, err := plan.IsRunning()
+			if err != nil {
+				return nil, errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+			}
+			if running {
+				return nil, errors.NewError(http.StatusBadRequest, "当前workflow正在运行中，请稍后再试")
+			}
+		}
+	}
+
+	if err = a.applyWorkflowDefinition(userID, &data, current, createTasks, updateTasks, currentPlans, taskList, edgesChanged); err != nil {
+		return nil, err
+	}
+	result.WorkflowID = data.ID
+	result.Applied = true
+	return result, nil
+}
+
+// findImportWorkflow 获取导入的目标workflow，不存在时返回nil并校验创建权限
+func (a *app) findImportWorkflow(userID int64, oid string, workflowID int64, title string) (*common.Workflow, error) {
+	if workflowID > 0 {
+		if err := checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, workflowID); err != nil {
+			return nil, err
+		}
+		workflow, err := a.GetWorkflow(workflowID)
+		if err != nil {
+			return nil, err
+		}
+		if workflow == nil {
+			return nil, errors.NewError(http.StatusNotFound, "workflow不存在")
+		}
+		return workflow, nil
+	}
+
+	if oid == "" {
+		return nil, errors.NewError(http.StatusBadRequest, "未指定workflow时需要指定组织")
+	}
+	list, err := a.store.Workflow().GetList(selection.NewSelector(
+		selection.NewRequirement("oid", selection.Equals, oid),
+		selection.NewRequirement("title", selection.Equals, title),
+	))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow列表失败").WithLog(err.Error())
+	}
+	if len(list) > 1 {
+		return nil, errors.NewError(http.StatusBadRequest, "组织下存在多个同名workflow，请指定workflow id")
+	}
+	if len(list) == 1 {
+		if err = checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, list[0].ID); err != nil {
+			return nil, err
+		}
+		return &list[0], nil
+	}
+
+	isAdmin, err := a.IsAdmin(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		exist, err := a.store.OrgRelevance().GetUserOrg(oid, userID)
+		if err != nil && err != common.ErrNoRows {
+			return nil, errors.NewError(http.StatusInternalServerError, "获取用户组织信息失败").WithLog(err.Error())
+		}
+		if exist == nil {
+			return nil, errors.NewError(http.StatusForbidden, "无权限")
+		}
+	}
+	return nil, nil
+}
+
+// resolveDefinitionTasks 将定义中的任务与已有任务匹配，返回key到任务的映射以及需要新建、更新的任务
+func (a *app) resolveDefinitionTasks(userID int64, defs []WorkflowTaskDefinition) (map[string]common.WorkflowTask, []common.WorkflowTask, []common.WorkflowTask, error) {
+	var (
+		tasks        = make(map[string]common.WorkflowTask, len(defs))
+		projectTasks = make(map[int64][]common.WorkflowTask)
+		createTasks  []common.WorkflowTask
+		updateTasks  []common.WorkflowTask
+	)
+	for _, v := range defs {
+		key := v.key()
+		if key == "" {
+			return nil, nil, nil, errors.NewError(http.StatusBadRequest, "workflow定义中的任务名称不能为空")
+		}
+		if _, exist := tasks[key]; exist {
+			return nil, nil, nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s在workflow定义中重复", key))
+		}
+
+		if _, checked := projectTasks[v.ProjectID]; !checked {
+			if err := a.CheckPermissions(v.ProjectID, userID, PermissionView); err != nil {
+				return nil, nil, nil, err
+			}
+			list, err := a.store.WorkflowTask().GetList(v.ProjectID)
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return nil, nil, nil, errors.NewError(http.StatusInternalServerError, "获取项目workflow任务失败").WithLog(err.Error())
+			}
+			projectTasks[v.ProjectID] = list
+		}
+
+		var current *common.WorkflowTask
+		for i, task := range projectTasks[v.ProjectID] {
+			if (v.TaskID != "" && task.TaskID != v.TaskID) || (v.TaskID == "" && task.TaskName != v.Name) {
+				continue
+			}
+			if current != nil {
+				return nil, nil, nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("项目(%d)下存在多个名为%s的任务，请指定task_id", v.ProjectID, v.Name))
+			}
+			current = &projectTasks[v.ProjectID][i]
+		}
+		if current == nil && v.TaskID != "" {
+			return nil, nil, nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务不存在, projectid: %d, taskid: %s", v.ProjectID, v.TaskID))
+		}
+
+		task := v.toWorkflowTask(current)
+		if err := checkWorkflowTaskArgs(task); err != nil {
+			return nil, nil, nil, err
+		}
+		if task.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW && (current == nil || current.RefWorkflowID != task.RefWorkflowID) {
+			if err := checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, task.RefWorkflowID); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if current == nil {
+			task.TaskID = utils.GetStrID()
+			createTasks = append(createTasks, task)
+		} else if isWorkflowTaskChanged(*current, task) {
+			updateTasks = append(updateTasks, task)
+		}
+		tasks[key] = task
+	}
+	return tasks, createTasks, updateTasks, nil
+}
+
+// buildWorkflowSchedulePlans 将任务依赖转换为存储的依赖关系，没有依赖的任务保存一条空依赖
+func buildWorkflowSchedulePlans(workflowID int64, taskList []CreateWorkflowSchedulePlanArgs) []common.WorkflowSchedulePlan {
+	var list []common.WorkflowSchedulePlan
+	now := time.Now().Unix()
+	for _, v := range taskList {
+		if len(v.Dependencies) == 0 {
+			list = append(list, common.WorkflowSchedulePlan{
+				WorkflowID: workflowID,
+				TaskID:     v.TaskID,
+				ProjectID:  v.ProjectID,
+				CreateTime: now,
+			})
+			continue
+		}
+		for _, dep := range v.Dependencies {
+			list = append(list, common.WorkflowSchedulePlan{
+				WorkflowID:          workflowID,
+				TaskID:              v.TaskID,
+				ProjectID:           v.ProjectID,
+				DependencyTaskID:    dep.TaskID,
+				DependencyProjectID: dep.ProjectID,
+				DependencyCondition: dep.Condition,
+				CreateTime:          now,
+			})
+		}
+	}
+	return list
+}
+
+// applyWorkflowDefinition 在一个事务中保存workflow、任务及依赖关系
+func (a *app) applyWorkflowDefinition(userID int64, data *common.Workflow, current *common.Workflow, createTasks, updateTasks []common.WorkflowTask,
+	currentPlans []common.WorkflowSchedulePlan, taskList []CreateWorkflowSchedulePlanArgs, edgesChanged bool) (err error) {
+	tx := a.store.BeginTx()
+	defer func() {
+		if r := recover(); r != nil || err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if current == nil {
+		if err = a.store.Workflow().Create(tx, data); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "创建workflow失败").WithLog(err.Error())
+		}
+		if err = a.store.UserWorkflowRelevance().Create(tx, &common.UserWorkflowRelevance{
+			UserID:     userID,
+			WorkflowID: data.ID,
+			CreateTime: time.Now().Unix(),
+		}); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "创建workflow用户关联关系失败").WithLog(err.Error())
+		}
+	} else if isWorkflowChanged(*current, *data) {
+		if err = a.store.Workflow().Update(tx, *data); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "更新workflow失败").WithLog(err.Error())
+		}
+	}
+
+	for i := range createTasks {
+		if err = a.store.WorkflowTask().Create(tx, &createTasks[i]); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "创建workflow任务失败").WithLog(err.Error())
+		}
+	}
+	for i := range updateTasks {
+		if err = a.store.WorkflowTask().Save(tx, &updateTasks[i]); err != nil {
+			return errors.NewError(http.StatusInternalServerError, "更新workflow任务失败").WithLog(err.Error())
+		}
+	}
+
+	if edgesChanged {
+		var needToDelete []int64
+		for _, v := range currentPlans {
+			needToDelete = append(needToDelete, v.ID)
+		}
+		if len(needToDelete) > 0 {
+			if err = a.store.WorkflowSchedulePlan().DeleteList(tx, needToDelete); err != nil {
+				return errors.NewError(http.StatusInternalServerError, "更新workflow任务依赖失败").WithLog(err.Error())
+			}
+		}
+		for _, v := range buildWorkflowSchedulePlans(data.ID, taskList) {
+			if err = a.store.WorkflowSchedulePlan().Create(tx, &v); err != nil {
+				return errors.NewError(http.StatusInternalServerError, "创建workflow任务依赖失败").WithLog(err.Error())
+			}
+		}
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return errors.NewError(http.StatusInternalServerError, "存储事务提交失败").WithLog(err.Error())
+	}
+
+	if err = a.workflowRunner.SetPlan(*data); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "设置workflow执行计划失败："+err.Error()).WithLog(err.Error())
+	}
+	return a.notifyCenterToRefreshWorkflowPlan()
+}
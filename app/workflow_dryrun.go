@@ -0,0 +1,66 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/pkg/infra"
+	"github.com/holdno/gopherCron/utils"
+)
+
+const (
+	// 试运行中任务的执行结果
+	workflowDryRunResult = "dry-run"
+	// workflowDryRunAgentVersion 该版本之后的agent才识别试运行标记，更早的agent会实际执行任务
+	workflowDryRunAgentVersion = "v2.4.7"
+)
+
+// agentSupportDryRun 试运行任务只能下发给识别试运行标记的agent
+func agentSupportDryRun(meta infra.NodeMeta) bool {
+	return utils.CompareVersion(workflowDryRunAgentVersion, meta.Tags["agent-version"])
+}
+
+func (p *WorkflowPlan) isDryRun() bool {
+	return p.planState != nil && p.planState.DryRun
+}
+
+// startDryRun 试运行workflow，按真实的依赖关系调度，但agent不执行任务命令，直接上报成功
+// 试运行以并发运行的方式进行，不影响workflow正常的调度
+func (a *workflowRunner) startDryRun(plan *WorkflowPlan, params map[string]string) error {
+	count, err := a.countRunPlans(plan.Workflow.ID)
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+	}
+	if count >= workflowMaxConcurrentRuns {
+		return errors.NewError(http.StatusBadRequest, fmt.Sprintf("并发运行数已达上限(%d)", workflowMaxConcurrentRuns))
+	}
+
+	run := plan.fork(utils.GetStrID())
+	if run.planState, err = setWorkflowPlanDryRunning(a.etcd, run.Workflow.ID, run.runID, params); err != nil {
+		return errors.NewError(http.StatusInternalServerError, "设置workflow试运行状态失败").WithLog(err.Error())
+	}
+	a.runs.Store(workflowRunKey(run.Workflow.ID, run.runID), run)
+	a.app.PublishMessage(messageWorkflowStatusChanged(run.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+
+	if !a.isLeader {
+		return nil
+	}
+	return a.scheduleWorkflowPlan(run)
+}
+
+// dryRunNode 试运行中的审批及子workflow节点不发起审批、不启动子workflow，直接标记为成功
+func (p *WorkflowPlan) dryRunNode(task *common.WorkflowTask) error {
+	_, err := concurrency.NewSTM(p.runner.etcd, func(stm concurrency.STM) error {
+		_, err := setWorkflowTaskManualResult(stm, p.Workflow.ID, p.runID, task, common.TASK_STATUS_DONE_V2, "", workflowDryRunResult)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.runner.app.PublishMessage(messageWorkflowTaskStatusChanged(p.Workflow.ID, task.ProjectID, task.TaskID, common.TASK_STATUS_DONE_V2))
+	return nil
+}
@@ -0,0 +1,450 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+const (
+	WORKFLOW_GRAPH_FORMAT_DOT     = "dot"
+	WORKFLOW_GRAPH_FORMAT_MERMAID = "mermaid"
+)
+
+// checkWorkflowTasks 校验workflow中引用的任务是否存在、用户是否有对应项目的权限，返回任务详情
+func (a *app) checkWorkflowTasks(userID int64, taskList []CreateWorkflowSchedulePlanArgs) (map[WorkflowTaskInfo]*common.WorkflowTask, error) {
+	var (
+		tasks    = make(map[WorkflowTaskInfo]*common.WorkflowTask)
+		projects = make(map[int64]bool)
+	)
+	for _, v := range taskList {
+		if !projects[v.ProjectID] {
+			if err := a.CheckPermissions(v.ProjectID, userID, PermissionView); err != nil {
+				if e, ok := err.(errors.Error); ok &&
+					(e.Code == errors.CodeProjectNotExist || e.Code == errors.CodeInsufficientPermissions) {
+					return nil, errors.NewError(http.StatusForbidden, fmt.Sprintf("无权使用项目(%d)下的任务", v.ProjectID))
+				}
+				return nil, err
+			}
+			projects[v.ProjectID] = true
+		}
+
+		if _, exist := tasks[v.WorkflowTaskInfo]; exist {
+			continue
+		}
+		task, err := a.GetWorkflowTask(v.ProjectID, v.TaskID)
+		if err != nil {
+			return nil, err
+		}
+		if task == nil {
+			return nil, errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务不存在, projectid: %d, taskid: %s", v.ProjectID, v.TaskID))
+		}
+		tasks[v.WorkflowTaskInfo] = task
+	}
+	return tasks, nil
+}
+
+// getWorkflowRefs 获取workflow中子workflow节点引用的workflow
+func (a *app) getWorkflowRefs(workflowID int64) ([]int64, error) {
+	plans, err := a.store.WorkflowSchedulePlan().GetList(workflowID)
+	if err != nil {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow任务依赖失败").WithLog(err.Error())
+	}
+	var (
+		taskIDs []string
+		exist   = make(map[WorkflowTaskInfo]bool)
+	)
+	for _, v := range plans {
+		exist[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}] = true
+		taskIDs = append(taskIDs, v.TaskID)
+	}
+	if len(taskIDs) == 0 {
+		return nil, nil
+	}
+	tasks, err := a.GetMultiWorkflowTaskList(taskIDs)
+	if err != nil {
+		return nil, err
+	}
+	var refs []int64
+	for _, v := range tasks {
+		if v.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW && exist[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}] {
+			refs = append(refs, v.RefWorkflowID)
+		}
+	}
+	return refs, nil
+}
+
+// checkWorkflowTaskReference 校验子workflow节点引用的workflow权限，以及修改引用后已使用该节点的workflow是否会出现循环引用
+func (a *app) checkWorkflowTaskReference(userID int64, task common.WorkflowTask) error {
+	if err := checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, task.RefWorkflowID); err != nil {
+		return err
+	}
+	plans, err := a.store.WorkflowSchedulePlan().GetTaskWorkflowIDs([]string{common.BuildWorkflowTaskIndex(task.ProjectID, task.TaskID)})
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "检查workflow任务依赖失败").WithLog(err.Error())
+	}
+	checked := make(map[int64]bool)
+	for _, v := range plans {
+		if checked[v.WorkflowID] {
+			continue
+		}
+		checked[v.WorkflowID] = true
+		if err = a.checkWorkflowReferenceCycle(v.WorkflowID, []int64{task.RefWorkflowID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWorkflowReferenceCycle 检查workflow引用refs中的子workflow后是否会出现循环引用
+func (a *app) checkWorkflowReferenceCycle(workflowID int64, refs []int64) error {
+	cycle, err := findWorkflowReferenceCycle(workflowID, refs, a.getWorkflowRefs)
+	if err != nil {
+		return err
+	}
+	if len(cycle) == 0 {
+		return nil
+	}
+	path := make([]string, 0, len(cycle))
+	for _, v := range cycle {
+		path = append(path, fmt.Sprintf("%d", v))
+	}
+	return errors.NewError(http.StatusBadRequest, fmt.Sprintf("子workflow存在循环引用: %s", strings.Join(path, " -> ")))
+}
+
+// findWorkflowReferenceCycle 从root引用的workflow出发查找能否回到root，返回引用路径
+func findWorkflowReferenceCycle(root int64, refs []int64, getRefs func(workflowID int64) ([]int64, error)) ([]int64, error) {
+	var (
+		visited = make(map[int64]bool)
+		visit   func(workflowID int64, path []int64) ([]int64, error)
+	)
+	visit = func(workflowID int64, path []int64) ([]int64, error) {
+		path = append(path, workflowID)
+		if workflowID == root {
+			return path, nil
+		}
+		if visited[workflowID] {
+			return nil, nil
+		}
+		visited[workflowID] = true
+		children, err := getRefs(workflowID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range children {
+			if cycle, err := visit(v, path); err != nil || cycle != nil {
+				return cycle, err
+			}
+		}
+		return nil, nil
+	}
+
+	for _, v := range refs {
+		if cycle, err := visit(v, []int64{root}); err != nil || cycle != nil {
+			return cycle, err
+		}
+	}
+	return nil, nil
+}
+
+// validateWorkflowGraph 校验workflow的依赖关系：重复任务、悬空依赖、循环依赖以及因循环依赖而永远无法执行的任务
+func validateWorkflowGraph(taskList []CreateWorkflowSchedulePlanArgs, names map[WorkflowTaskInfo]string) error {
+	describe := func(task WorkflowTaskInfo) string {
+		if name := names[task]; name != "" {
+			return fmt.Sprintf("%s(%d/%s)", name, task.ProjectID, task.TaskID)
+		}
+		return fmt.Sprintf("%d/%s", task.ProjectID, task.TaskID)
+	}
+
+	graph := make(map[WorkflowTaskInfo][]WorkflowTaskInfo) // map[任务][]依赖
+	for _, v := range taskList {
+		if _, exist := graph[v.WorkflowTaskInfo]; exist {
+			return errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s在workflow中重复配置", describe(v.WorkflowTaskInfo)))
+		}
+		graph[v.WorkflowTaskInfo] = nil
+	}
+
+	for _, v := range taskList {
+		deps := make(map[WorkflowTaskInfo]bool)
+		for _, dep := range v.Dependencies {
+			if dep.TaskID == "" {
+				continue
+			}
+			if dep.WorkflowTaskInfo == v.WorkflowTaskInfo {
+				return errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s不能依赖自身", describe(v.WorkflowTaskInfo)))
+			}
+			if _, exist := graph[dep.WorkflowTaskInfo]; !exist {
+				return errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s依赖的任务%s不在workflow中", describe(v.WorkflowTaskInfo), describe(dep.WorkflowTaskInfo)))
+			}
+			if deps[dep.WorkflowTaskInfo] {
+				return errors.NewError(http.StatusBadRequest, fmt.Sprintf("任务%s重复依赖任务%s", describe(v.WorkflowTaskInfo), describe(dep.WorkflowTaskInfo)))
+			}
+			deps[dep.WorkflowTaskInfo] = true
+			graph[v.WorkflowTaskInfo] = append(graph[v.WorkflowTaskInfo], dep.WorkflowTaskInfo)
+		}
+	}
+
+	blocked := findBlockedWorkflowTasks(graph)
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	cycle := findWorkflowCycle(graph, blocked)
+	inCycle := make(map[WorkflowTaskInfo]bool)
+	path := make([]string, 0, len(cycle))
+	for _, v := range cycle {
+		inCycle[v] = true
+		path = append(path, describe(v))
+	}
+
+	msg := fmt.Sprintf("workflow存在循环依赖: %s", strings.Join(path, " -> "))
+	var unreachable []string
+	for _, v := range blocked {
+		if !inCycle[v] {
+			unreachable = append(unreachable, describe(v))
+		}
+	}
+	if len(unreachable) > 0 {
+		msg += fmt.Sprintf("，以下任务将永远无法执行: %s", strings.Join(unreachable, ", "))
+	}
+	return errors.NewError(http.StatusBadRequest, msg)
+}
+
+// findBlockedWorkflowTasks 按拓扑顺序遍历，返回无法从起始任务到达的任务(处于循环依赖中或依赖了循环中的任务)
+func findBlockedWorkflowTasks(graph map[WorkflowTaskInfo][]WorkflowTaskInfo) []WorkflowTaskInfo {
+	var (
+		indegree = make(map[WorkflowTaskInfo]int)
+		children = inverseGraph(graph)
+		queue    []WorkflowTaskInfo
+	)
+	for task, deps := range graph {
+		indegree[task] = len(deps)
+		if len(deps) == 0 {
+			queue = append(queue, task)
+		}
+	}
+	for len(queue) > 0 {
+		task := queue[0]
+		queue = queue[1:]
+		delete(indegree, task)
+		for _, child := range children[task] {
+			indegree[child]--
+			if indegree[child] == 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	blocked := make([]WorkflowTaskInfo, 0, len(indegree))
+	for task := range indegree {
+		blocked = append(blocked, task)
+	}
+	sortWorkflowTasks(blocked)
+	return blocked
+}
+
+// findWorkflowCycle 在被阻塞的任务中找出一条循环依赖路径，路径首尾为同一个任务
+func findWorkflowCycle(graph map[WorkflowTaskInfo][]WorkflowTaskInfo, blocked []WorkflowTaskInfo) []WorkflowTaskInfo {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	var (
+		state = make(map[WorkflowTaskInfo]int)
+		stack []WorkflowTaskInfo
+		visit func(task WorkflowTaskInfo) []WorkflowTaskInfo
+	)
+	visit = func(task WorkflowTaskInfo) []WorkflowTaskInfo {
+		state[task] = visiting
+		stack = append(stack, task)
+		deps := append([]WorkflowTaskInfo(nil), graph[task]...)
+		sortWorkflowTasks(deps)
+		for _, dep := range deps {
+			switch state[dep] {
+			case visiting:
+				for i, v := range stack {
+					if v == dep {
+						// stack中是依赖方向，反转为执行方向
+						cycle := append([]WorkflowTaskInfo(nil), stack[i:]...)
+						for l, r := 0, len(cycle)-1; l < r; l, r = l+1, r-1 {
+							cycle[l], cycle[r] = cycle[r], cycle[l]
+						}
+						return append(cycle, cycle[0])
+					}
+				}
+			case 0:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[task] = visited
+		return nil
+	}
+
+	for _, task := range blocked {
+		if state[task] == 0 {
+			if cycle := visit(task); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+func workflowTaskLess(a, b WorkflowTaskInfo) bool {
+	if a.ProjectID != b.ProjectID {
+		return a.ProjectID < b.ProjectID
+	}
+	return a.TaskID < b.TaskID
+}
+
+func sortWorkflowTasks(list []WorkflowTaskInfo) {
+	sort.Slice(list, func(i, j int) bool {
+		return workflowTaskLess(list[i], list[j])
+	})
+}
+
+type workflowGraphEdge struct {
+	From      WorkflowTaskInfo
+	To        WorkflowTaskInfo
+	Condition string
+}
+
+// ExportWorkflowGraph 将workflow的依赖关系导出为 Graphviz DOT 或 Mermaid 格式
+func (a *app) ExportWorkflowGraph(workflowID int64, format string) (string, error) {
+	if format == "" {
+		format = WORKFLOW_GRAPH_FORMAT_DOT
+	}
+	if format != WORKFLOW_GRAPH_FORMAT_DOT && format != WORKFLOW_GRAPH_FORMAT_MERMAID {
+		return "", errors.NewError(http.StatusBadRequest, "不支持的导出格式: "+format)
+	}
+
+	workflow, err := a.GetWorkflow(workflowID)
+	if err != nil {
+		return "", err
+	}
+	if workflow == nil {
+		return "", errors.NewError(http.StatusNotFound, "workflow不存在")
+	}
+
+	plans, err := a.store.WorkflowSchedulePlan().GetList(workflowID)
+	if err != nil {
+		return "", errors.NewError(http.StatusInternalServerError, "获取workflow任务依赖失败").WithLog(err.Error())
+	}
+
+	var (
+		nodes   []WorkflowTaskInfo
+		edges   []workflowGraphEdge
+		exist   = make(map[WorkflowTaskInfo]bool)
+		taskIDs []string
+	)
+	for _, v := range plans {
+		task := WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}
+		if !exist[task] {
+			exist[task] = true
+			nodes = append(nodes, task)
+			taskIDs = append(taskIDs, v.TaskID)
+		}
+		if v.DependencyTaskID != "" {
+			condition := v.DependencyCondition
+			if condition == "" {
+				condition = common.WORKFLOW_CONDITION_SUCCESS
+			}
+			edges = append(edges, workflowGraphEdge{
+				From:      WorkflowTaskInfo{ProjectID: v.DependencyProjectID, TaskID: v.DependencyTaskID},
+				To:        task,
+				Condition: condition,
+			})
+		}
+	}
+
+	names := make(map[WorkflowTaskInfo]string)
+	if len(taskIDs) > 0 {
+		tasks, err := a.GetMultiWorkflowTaskList(taskIDs)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range tasks {
+			names[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}] = v.TaskName
+		}
+	}
+
+	sortWorkflowTasks(nodes)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return workflowTaskLess(edges[i].From, edges[j].From)
+		}
+		return workflowTaskLess(edges[i].To, edges[j].To)
+	})
+
+	if format == WORKFLOW_GRAPH_FORMAT_MERMAID {
+		return buildWorkflowMermaid(nodes, edges, names), nil
+	}
+	return buildWorkflowDOT(workflow.Title, nodes, edges, names), nil
+}
+
+func workflowGraphNodeID(task WorkflowTaskInfo) string {
+	id := fmt.Sprintf("t%d_%s", task.ProjectID, task.TaskID)
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+func workflowGraphNodeLabel(task WorkflowTaskInfo, names map[WorkflowTaskInfo]string) string {
+	if name := names[task]; name != "" {
+		return name
+	}
+	return task.TaskID
+}
+
+func buildWorkflowDOT(title string, nodes []WorkflowTaskInfo, edges []workflowGraphEdge, names map[WorkflowTaskInfo]string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", " ")
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("digraph \"%s\" {\n", escape.Replace(title)))
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, v := range nodes {
+		b.WriteString(fmt.Sprintf("  %s [label=\"%s\"];\n", workflowGraphNodeID(v), escape.Replace(workflowGraphNodeLabel(v, names))))
+	}
+	for _, v := range edges {
+		b.WriteString(fmt.Sprintf("  %s -> %s", workflowGraphNodeID(v.From), workflowGraphNodeID(v.To)))
+		switch v.Condition {
+		case common.WORKFLOW_CONDITION_FAILURE:
+			b.WriteString(" [label=\"failure\", style=dashed, color=red]")
+		case common.WORKFLOW_CONDITION_ALWAYS:
+			b.WriteString(" [label=\"always\", style=dotted]")
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func buildWorkflowMermaid(nodes []WorkflowTaskInfo, edges []workflowGraphEdge, names map[WorkflowTaskInfo]string) string {
+	escape := strings.NewReplacer(`"`, "#quot;", "\n", " ")
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, v := range nodes {
+		b.WriteString(fmt.Sprintf("  %s[\"%s\"]\n", workflowGraphNodeID(v), escape.Replace(workflowGraphNodeLabel(v, names))))
+	}
+	for _, v := range edges {
+		switch v.Condition {
+		case common.WORKFLOW_CONDITION_FAILURE:
+			b.WriteString(fmt.Sprintf("  %s -. failure .-> %s\n", workflowGraphNodeID(v.From), workflowGraphNodeID(v.To)))
+		case common.WORKFLOW_CONDITION_ALWAYS:
+			b.WriteString(fmt.Sprintf("  %s -- always --> %s\n", workflowGraphNodeID(v.From), workflowGraphNodeID(v.To)))
+		default:
+			b.WriteString(fmt.Sprintf("  %s --> %s\n", workflowGraphNodeID(v.From), workflowGraphNodeID(v.To)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+func TestValidateWorkflowGraph(t *testing.T) {
+	var (
+		a = WorkflowTaskInfo{ProjectID: 1, TaskID: "a"}
+		b = WorkflowTaskInfo{ProjectID: 1, TaskID: "b"}
+		c = WorkflowTaskInfo{ProjectID: 1, TaskID: "c"}
+		d = WorkflowTaskInfo{ProjectID: 2, TaskID: "d"}
+	)
+	names := map[WorkflowTaskInfo]string{a: "extract", b: "transform", c: "load", d: "report"}
+	dep := func(task WorkflowTaskInfo) WorkflowTaskDependency {
+		return WorkflowTaskDependency{WorkflowTaskInfo: task}
+	}
+
+	valid := []CreateWorkflowSchedulePlanArgs{
+		{WorkflowTaskInfo: a},
+		{WorkflowTaskInfo: b, Dependencies: []WorkflowTaskDependency{dep(a)}},
+		{WorkflowTaskInfo: c, Dependencies: []WorkflowTaskDependency{dep(a), dep(b)}},
+	}
+	if err := validateWorkflowGraph(valid, names); err != nil {
+		t.Fatal(err)
+	}
+
+	dangling := []CreateWorkflowSchedulePlanArgs{
+		{WorkflowTaskInfo: a, Dependencies: []WorkflowTaskDependency{dep(d)}},
+	}
+	if err := validateWorkflowGraph(dangling, names); err == nil || !strings.Contains(err.Error(), "不在workflow中") {
+		t.Fatalf("dangling dependency should be rejected, got %v", err)
+	}
+
+	cyclic := []CreateWorkflowSchedulePlanArgs{
+		{WorkflowTaskInfo: a},
+		{WorkflowTaskInfo: b, Dependencies: []WorkflowTaskDependency{dep(c)}},
+		{WorkflowTaskInfo: c, Dependencies: []WorkflowTaskDependency{dep(b)}},
+		{WorkflowTaskInfo: d, Dependencies: []WorkflowTaskDependency{dep(c)}},
+	}
+	err := validateWorkflowGraph(cyclic, names)
+	if err == nil {
+		t.Fatal("cycle should be rejected")
+	}
+	msg := err.(*errors.Error).Msg
+	if !strings.Contains(msg, "load(1/c) -> transform(1/b) -> load(1/c)") || !strings.Contains(msg, "report(2/d)") {
+		t.Fatalf("unexpected error message: %s", msg)
+	}
+}
+
+func TestFindWorkflowReferenceCycle(t *testing.T) {
+	refs := map[int64][]int64{2: {3}, 3: {4}, 4: nil}
+	getRefs := func(workflowID int64) ([]int64, error) {
+		return refs[workflowID], nil
+	}
+
+	cycle, err := findWorkflowReferenceCycle(1, []int64{2}, getRefs)
+	if err != nil || cycle != nil {
+		t.Fatalf("unexpected cycle %v, err %v", cycle, err)
+	}
+
+	refs[4] = []int64{1}
+	cycle, err = findWorkflowReferenceCycle(1, []int64{2}, getRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cycle) != "[1 2 3 4 1]" {
+		t.Fatalf("unexpected cycle %v", cycle)
+	}
+
+	if cycle, _ = findWorkflowReferenceCycle(1, []int64{1}, getRefs); fmt.Sprint(cycle) != "[1 1]" {
+		t.Fatalf("self reference should be rejected, got %v", cycle)
+	}
+}
+
+func TestWorkflowDefinitionRoundTrip(t *testing.T) {
+	var (
+		extract = WorkflowTaskInfo{ProjectID: 1, TaskID: "e1"}
+		load    = WorkflowTaskInfo{ProjectID: 2, TaskID: "l1"}
+		alert   = WorkflowTaskInfo{ProjectID: 2, TaskID: "l2"}
+	)
+	plans := []common.WorkflowSchedulePlan{
+		{ProjectID: 1, TaskID: "e1"},
+		{ProjectID: 2, TaskID: "l1", DependencyProjectID: 1, DependencyTaskID: "e1", DependencyCondition: common.WORKFLOW_CONDITION_SUCCESS},
+		{ProjectID: 2, TaskID: "l2", DependencyProjectID: 1, DependencyTaskID: "e1", DependencyCondition: common.WORKFLOW_CONDITION_FAILURE},
+	}
+	tasks := map[WorkflowTaskInfo]common.WorkflowTask{
+		extract: {ProjectID: 1, TaskID: "e1", TaskName: "extract", Command: "echo e", MaxRetries: -1},
+		load:    {ProjectID: 2, TaskID: "l1", TaskName: "load", Command: "echo l", MaxRetries: 0},
+		alert:   {ProjectID: 2, TaskID: "l2", TaskName: "load", Command: "echo a", MaxRetries: -1},
+	}
+
+	def := buildWorkflowDefinition(common.Workflow{Title: "etl", Cron: "0 * * * * *"}, plans, tasks)
+	if len(def.Tasks) != 3 || def.Tasks[0].Key != "" || def.Tasks[1].Key != "load#l1" || def.Tasks[2].DependsOn[0].Task != "extract" {
+		t.Fatalf("unexpected definition: %+v", def.Tasks)
+	}
+	if def.Tasks[0].MaxRetries != nil || def.Tasks[1].MaxRetries == nil || *def.Tasks[1].MaxRetries != 0 {
+		t.Fatal("max retries should only be exported when it is not the default policy")
+	}
+	for _, v := range def.Tasks {
+		if v.toWorkflowTask(nil).MaxRetries != tasks[WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}].MaxRetries {
+			t.Fatalf("task %s should convert back to the same retry policy", v.key())
+		}
+	}
+
+	var list []CreateWorkflowSchedulePlanArgs
+	for _, v := range def.Tasks {
+		item := CreateWorkflowSchedulePlanArgs{WorkflowTaskInfo: WorkflowTaskInfo{ProjectID: v.ProjectID, TaskID: v.TaskID}}
+		for _, dep := range v.DependsOn {
+			condition := dep.Condition
+			if condition == "" {
+				condition = common.WORKFLOW_CONDITION_SUCCESS
+			}
+			item.Dependencies = append(item.Dependencies, WorkflowTaskDependency{WorkflowTaskInfo: extract, Condition: condition})
+		}
+		list = append(list, item)
+	}
+	names := map[WorkflowTaskInfo]string{extract: "extract", load: "load", alert: "alert"}
+	if added, removed := diffWorkflowEdges(plans, buildWorkflowSchedulePlans(0, list), names); len(added) != 0 || len(removed) != 0 {
+		t.Fatalf("importing an exported definition should not change edges: %v %v", added, removed)
+	}
+
+	added, removed := diffWorkflowEdges(plans, buildWorkflowSchedulePlans(0, list[:2]), names)
+	if len(added) != 0 || len(removed) != 1 || removed[0] != "extract -> alert (failure)" {
+		t.Fatalf("unexpected diff: %v %v", added, removed)
+	}
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/holdno/gocommons/selection"
+	"github.com/jinzhu/gorm"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+// 单个节点耗时趋势最多查询的运行次数
+const workflowTrendMaxRuns = 200
+
+// WorkflowRunTimeline workflow单次运行的时间线，节点执行记录按开始时间排序
+type WorkflowRunTimeline struct {
+	Run   common.WorkflowLog        `json:"run"`
+	Tasks []*common.WorkflowTaskLog `json:"tasks"`
+}
+
+// WorkflowTaskDurationItem 节点在一次workflow运行中的执行情况
+type WorkflowTaskDurationItem struct {
+	RunID     int64  `json:"run_id"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+	Duration  int64  `json:"duration"` // 首次开始到最后一次结束的耗时(s)，包含重试
+}
+
+func (p *WorkflowPlan) taskNames() map[WorkflowTaskInfo]string {
+	names := make(map[WorkflowTaskInfo]string, len(p.Tasks))
+	for k, v := range p.Tasks {
+		names[k] = v.TaskName
+	}
+	return names
+}
+
+// projectIDs workflow中任务所属的项目，按id升序
+func (p *WorkflowPlan) projectIDs() []int64 {
+	exist := make(map[int64]struct{})
+	var list []int64
+	for k := range p.Tasks {
+		if _, ok := exist[k.ProjectID]; ok || k.ProjectID == 0 {
+			continue
+		}
+		exist[k.ProjectID] = struct{}{}
+		list = append(list, k.ProjectID)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func isWorkflowTaskLogFinished(status string) bool {
+	switch status {
+	case common.TASK_STATUS_DONE_V2, common.TASK_STATUS_FAIL_V2, common.TASK_STATUS_SKIPPED_V2:
+		return true
+	}
+	return false
+}
+
+// buildWorkflowTaskLogs 将运行结束时各节点的调度记录整理为每次执行一条的记录
+// 调度记录按事件追加，同一次执行通过attempt或tmp_id关联，未结束的执行以workflow结束时间作为结束时间
+func buildWorkflowTaskLogs(workflowID int64, names map[WorkflowTaskInfo]string, states []*WorkflowTaskStates, endTime int64) []*common.WorkflowTaskLog {
+	var result []*common.WorkflowTaskLog
+	for _, state := range states {
+		var (
+			task      = WorkflowTaskInfo{ProjectID: state.ProjectID, TaskID: state.TaskID}
+			attempts  = make(map[int]*common.WorkflowTaskLog)
+			tmpIDs    = make(map[string]int)
+			execution []*common.WorkflowTaskLog
+		)
+		for _, record := range state.ScheduleRecords {
+			attempt := record.Attempt
+			if attempt == 0 && record.TmpID != "" {
+				attempt = tmpIDs[record.TmpID]
+			}
+			item := attempts[attempt]
+			if item == nil {
+				item = &common.WorkflowTaskLog{
+					WorkflowID: workflowID,
+					ProjectID:  state.ProjectID,
+					TaskID:     state.TaskID,
+					TaskName:   names[task],
+					Attempt:    attempt,
+					StartTime:  record.EventTime,
+				}
+				attempts[attempt] = item
+				execution = append(execution, item)
+			}
+			if record.TmpID != "" {
+				tmpIDs[record.TmpID] = attempt
+				item.TmpID = record.TmpID
+			}
+			if record.AgentIP != "" {
+				item.AgentIP = record.AgentIP
+			}
+			// 执行结束后追加的记录(如重试提示)不再改变该次执行的结果
+			if isWorkflowTaskLogFinished(item.Status) {
+				continue
+			}
+			item.Status = record.Status
+			if record.Result != "" {
+				item.Result = record.Result
+			}
+			if isWorkflowTaskLogFinished(record.Status) || record.Status == common.TASK_STATUS_NOT_RUNNING_V2 {
+				item.EndTime = record.EventTime
+			}
+		}
+
+		for _, v := range execution {
+			if v.EndTime == 0 {
+				v.EndTime = endTime
+			}
+		}
+		result = append(result, execution...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].StartTime < result[j].StartTime
+	})
+	return result
+}
+
+// summarizeWorkflowTaskRuns 按运行汇总节点的执行记录，runIDs需按时间先后排序
+func summarizeWorkflowTaskRuns(runIDs []int64, logs []common.WorkflowTaskLog) []WorkflowTaskDurationItem {
+	runs := make(map[int64]*WorkflowTaskDurationItem)
+	for _, v := range logs {
+		item := runs[v.RunID]
+		if item == nil {
+			item = &WorkflowTaskDurationItem{RunID: v.RunID, StartTime: v.StartTime}
+			runs[v.RunID] = item
+		}
+		if v.Attempt > 0 {
+			item.Attempts++
+		}
+		if v.StartTime < item.StartTime {
+			item.StartTime = v.StartTime
+		}
+		if v.EndTime >= item.EndTime {
+			item.EndTime = v.EndTime
+			item.Status = v.Status
+		}
+	}
+
+	var result []WorkflowTaskDurationItem
+	for _, id := range runIDs {
+		if item := runs[id]; item != nil {
+			item.Duration = item.EndTime - item.StartTime
+			result = append(result, *item)
+		}
+	}
+	return result
+}
+
+// GetWorkflowRunTimeline 获取workflow单次运行的节点时间线，logID为0时使用最近一次运行
+// 早于节点执行记录入库的历史运行从运行结果中解析
+func (a *app) GetWorkflowRunTimeline(workflowID, logID int64) (*WorkflowRunTimeline, error) {
+	run, state, err := a.getWorkflowRunState(workflowID, logID)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := a.store.WorkflowTaskLog().GetList(selection.NewSelector(selection.NewRequirement("run_id", selection.Equals, run.ID)))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow节点执行记录失败").WithLog(err.Error())
+	}
+
+	timeline := &WorkflowRunTimeline{Run: *run}
+	for i := range list {
+		timeline.Tasks = append(timeline.Tasks, &list[i])
+	}
+	if len(timeline.Tasks) == 0 {
+		names := make(map[WorkflowTaskInfo]string)
+		if plan := a.workflowRunner.GetPlan(workflowID); plan != nil {
+			names = plan.taskNames()
+		}
+		timeline.Tasks = buildWorkflowTaskLogs(workflowID, names, state.Records, run.EndTime)
+	}
+	if timeline.Run.Status == "" {
+		// 历史运行没有记录运行结果，从运行状态中判断
+		var failed bool
+		for _, v := range state.Records {
+			failed = failed || isWorkflowTaskFailed(v)
+		}
+		timeline.Run.Status = common.TASK_STATUS_DONE_V2
+		if failed {
+			timeline.Run.Status = common.TASK_STATUS_FAIL_V2
+		}
+	}
+	timeline.Run.Result = ""
+	return timeline, nil
+}
+
+// GetWorkflowTaskDurationTrend 获取节点在最近limit次workflow运行中的耗时，按运行先后排序
+func (a *app) GetWorkflowTaskDurationTrend(workflowID int64, task WorkflowTaskInfo, limit int) ([]WorkflowTaskDurationItem, error) {
+	if limit <= 0 || limit > workflowTrendMaxRuns {
+		limit = workflowTrendMaxRuns
+	}
+
+	opts := selection.NewSelector(
+		selection.NewRequirement("workflow_id", selection.Equals, workflowID),
+		selection.NewRequirement("status", selection.NotEquals, common.TASK_STATUS_SKIPPED_V2),
+		selection.NewRequirement("dry_run", selection.Equals, false),
+	)
+	opts.Select = "id"
+	runs, err := a.store.WorkflowLog().GetList(opts, 1, uint64(limit))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow运行记录失败").WithLog(err.Error())
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+
+	runIDs := make([]int64, 0, len(runs))
+	for i := len(runs) - 1; i >= 0; i-- {
+		runIDs = append(runIDs, runs[i].ID)
+	}
+	logs, err := a.store.WorkflowTaskLog().GetList(selection.NewSelector(
+		selection.NewRequirement("run_id", selection.In, runIDs),
+		selection.NewRequirement("project_id", selection.Equals, task.ProjectID),
+		selection.NewRequirement("task_id", selection.Equals, task.TaskID),
+	))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewError(http.StatusInternalServerError, "获取workflow节点执行记录失败").WithLog(err.Error())
+	}
+	return summarizeWorkflowTaskRuns(runIDs, logs), nil
+}
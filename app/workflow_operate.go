@@ -0,0 +1,136 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+// MarkWorkflowTask 人工将运行中workflow的节点标记为成功(done)或跳过(skipped)，标记后继续调度下游任务
+// 节点正在执行时会先停止执行中的任务，runID为并发运行的id，操作主运行时为空
+// 主运行已经失败结束时，标记最近一次失败运行中的节点，并以恢复运行的方式继续调度其余未完成的任务
+func (a *app) MarkWorkflowTask(userID, workflowID int64, runID string, task WorkflowTaskInfo, status, reason string) error {
+	if status != common.TASK_STATUS_DONE_V2 && status != common.TASK_STATUS_SKIPPED_V2 {
+		return errors.NewError(http.StatusBadRequest, "不支持的标记状态: "+status)
+	}
+	if err := checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, workflowID); err != nil {
+		return err
+	}
+
+	plan := a.workflowRunner.GetRunPlan(workflowID, runID)
+	if plan == nil {
+		return errors.NewError(http.StatusBadRequest, "该workflow运行不存在")
+	}
+	detail := plan.Tasks[task]
+	if detail == nil {
+		return errors.NewError(http.StatusBadRequest, "该任务不在workflow中")
+	}
+
+	running, err := plan.IsRunning()
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "获取workflow运行状态失败").WithLog(err.Error())
+	}
+
+	operator, err := a.workflowOperator(userID)
+	if err != nil {
+		return err
+	}
+
+	if !running {
+		if runID != "" {
+			return errors.NewError(http.StatusBadRequest, "该workflow运行已结束")
+		}
+		return a.markFailedWorkflowTask(plan, task, detail, status, operator, reason)
+	}
+	if !plan.planState.InScope(task) {
+		return errors.NewError(http.StatusBadRequest, "该任务不在本次运行范围内")
+	}
+
+	var previous string
+	_, err = concurrency.NewSTM(a.GetEtcdClient(), func(stm concurrency.STM) error {
+		var err error
+		previous, err = setWorkflowTaskManualResult(stm, workflowID, runID, detail, status, operator, reason)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(*errors.Error); ok {
+			return err
+		}
+		return errors.NewError(http.StatusInternalServerError, "保存任务状态失败").WithLog(err.Error())
+	}
+	a.PublishMessage(messageWorkflowTaskStatusChanged(workflowID, task.ProjectID, task.TaskID, status))
+
+	if (previous == common.TASK_STATUS_RUNNING_V2 || previous == common.TASK_STATUS_STARTING_V2) && !plan.isDryRun() {
+		// 状态已经变更，停止失败不影响后续调度
+		if detail.Type == common.WORKFLOW_TASK_TYPE_WORKFLOW {
+			plan.killChildWorkflows([]*common.WorkflowTask{detail})
+		} else if detail.Type == common.WORKFLOW_TASK_TYPE_COMMAND {
+			if err = a.killWorkflowTasks(a.GetConfig().Micro.Region, []WorkflowTaskInfo{task}); err != nil {
+				wlog.Error("failed to kill workflow task after manual mark", zap.Int64("workflow_id", workflowID),
+					zap.Int64("project_id", task.ProjectID), zap.String("task_id", task.TaskID), zap.Error(err))
+			}
+		}
+	}
+
+	if a.workflowRunner.isLeader {
+		if err = a.workflowRunner.scheduleWorkflowPlan(plan); err != nil && err != ErrWorkflowInProcess {
+			wlog.Error("failed to schedule workflow after manual mark", zap.Int64("workflow_id", workflowID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// markFailedWorkflowTask 在最近一次失败的运行记录上标记节点，随后从失败处恢复运行
+// 被标记的节点保持标记结果，其余未完成的任务及其下游重新调度
+func (a *app) markFailedWorkflowTask(plan *WorkflowPlan, task WorkflowTaskInfo, detail *common.WorkflowTask, status, operator, reason string) error {
+	runLog, state, err := a.getWorkflowRunState(plan.Workflow.ID, 0)
+	if err != nil {
+		return err
+	}
+	if runLog.Status != common.TASK_STATUS_FAIL_V2 {
+		return errors.NewError(http.StatusBadRequest, "workflow未在运行中且最近一次运行没有失败")
+	}
+
+	marked := &WorkflowTaskStates{
+		ProjectID:     task.ProjectID,
+		TaskID:        task.TaskID,
+		WorkflowID:    plan.Workflow.ID,
+		Command:       detail.Command,
+		CurrentStatus: common.TASK_STATUS_NOT_RUNNING_V2,
+	}
+	records := make([]*WorkflowTaskStates, 0, len(state.Records)+1)
+	for _, v := range state.Records {
+		if v.ProjectID == task.ProjectID && v.TaskID == task.TaskID {
+			copied := *v
+			marked = &copied
+			continue
+		}
+		records = append(records, v)
+	}
+	if err = applyWorkflowTaskManualResult(marked, status, operator, reason); err != nil {
+		return err
+	}
+
+	// 被标记的节点即使处于其他失败节点的下游也不再重新调度
+	var scope []WorkflowTaskInfo
+	for _, v := range workflowResumeScope(plan.TaskFlow, append(records, marked)) {
+		if v != task {
+			scope = append(scope, v)
+		}
+	}
+	if len(scope) == 0 {
+		// 没有其余需要调度的任务，仅以被标记的节点作为运行范围，调度时会直接结束本次运行
+		scope = []WorkflowTaskInfo{task}
+	}
+	preserved := append(preservedWorkflowTaskStates(records, scope), marked)
+	if err = a.workflowRunner.TryResumePlan(plan, runLog.ID, preserved, scope, state.Params); err != nil {
+		return err
+	}
+	a.PublishMessage(messageWorkflowTaskStatusChanged(plan.Workflow.ID, task.ProjectID, task.TaskID, status))
+	return nil
+}
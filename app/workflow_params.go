@@ -0,0 +1,188 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+)
+
+// 单次补数最多启动的运行数
+const workflowMaxBackfillRuns = 366
+
+var (
+	workflowParamNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	paramReferencePattern    = regexp.MustCompile(`\$\{\{\s*params\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// normalizeWorkflowParams 校验workflow声明的运行参数，并统一存储格式
+func normalizeWorkflowParams(data *common.Workflow) error {
+	schema, err := data.ParamSchema()
+	if err != nil {
+		return errors.NewError(http.StatusBadRequest, "运行参数声明格式错误").WithLog(err.Error())
+	}
+	exist := make(map[string]struct{}, len(schema))
+	for _, v := range schema {
+		if !workflowParamNamePattern.MatchString(v.Name) {
+			return errors.NewError(http.StatusBadRequest, "运行参数名称不合法: "+v.Name)
+		}
+		// 参数以大写的环境变量名提供给任务，仅大小写不同的参数视为重复
+		if _, ok := exist[strings.ToUpper(v.Name)]; ok {
+			return errors.NewError(http.StatusBadRequest, "运行参数重复声明: "+v.Name)
+		}
+		exist[strings.ToUpper(v.Name)] = struct{}{}
+	}
+	data.Params = encodeWorkflowParams(schema)
+	return nil
+}
+
+func encodeWorkflowParams(schema []common.WorkflowParam) string {
+	if len(schema) == 0 {
+		return ""
+	}
+	raw, _ := json.Marshal(schema)
+	return string(raw)
+}
+
+// resolveWorkflowParams 按声明校验运行参数，未传入的参数使用默认值
+func resolveWorkflowParams(schema []common.WorkflowParam, input map[string]string) (map[string]string, error) {
+	var (
+		params   = make(map[string]string, len(schema))
+		declared = make(map[string]struct{}, len(schema))
+	)
+	for _, v := range schema {
+		declared[v.Name] = struct{}{}
+		value, exist := input[v.Name]
+		if !exist {
+			value = v.Default
+		}
+		if v.Required && value == "" {
+			return nil, fmt.Errorf("缺少运行参数: %s", v.Name)
+		}
+		params[v.Name] = value
+	}
+
+	var unknown []string
+	for k := range input {
+		if _, exist := declared[k]; !exist {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("未声明的运行参数: %s", unknown[0])
+	}
+	return params, nil
+}
+
+// resolveParams 获取plan本次运行的参数，input为空时全部使用默认值
+func (p *WorkflowPlan) resolveParams(input map[string]string) (map[string]string, error) {
+	schema, err := p.Workflow.ParamSchema()
+	if err != nil {
+		return nil, err
+	}
+	return resolveWorkflowParams(schema, input)
+}
+
+// runParams 当前运行的参数
+func (p *WorkflowPlan) runParams() map[string]string {
+	if p.planState == nil {
+		return nil
+	}
+	return p.planState.Params
+}
+
+// renderWorkflowParams 将命令中形如 ${{ params.<name> }} 的引用替换为对应环境变量的引用
+// 参数值由agent以环境变量的方式提供，不直接拼入命令，避免参数中的内容被shell当作命令执行
+func renderWorkflowParams(command string) string {
+	return paramReferencePattern.ReplaceAllStringFunc(command, func(ref string) string {
+		return "${" + common.WORKFLOW_PARAM_ENV_PREFIX + strings.ToUpper(paramReferencePattern.FindStringSubmatch(ref)[1]) + "}"
+	})
+}
+
+// buildBackfillParams 为日期区间内的每一天生成一次运行的参数，日期格式为 2006-01-02
+func buildBackfillParams(schema []common.WorkflowParam, dateParam, startDate, endDate string, params map[string]string) ([]map[string]string, error) {
+	start, err := time.Parse(time.DateOnly, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("开始日期格式错误: %s", startDate)
+	}
+	end, err := time.Parse(time.DateOnly, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("结束日期格式错误: %s", endDate)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("结束日期不能早于开始日期")
+	}
+	if days := int(end.Sub(start).Hours()/24) + 1; days > workflowMaxBackfillRuns {
+		return nil, fmt.Errorf("补数最多支持%d天", workflowMaxBackfillRuns)
+	}
+
+	var list []map[string]string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		input := make(map[string]string, len(params)+1)
+		for k, v := range params {
+			input[k] = v
+		}
+		input[dateParam] = day.Format(time.DateOnly)
+		resolved, err := resolveWorkflowParams(schema, input)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, resolved)
+	}
+	return list, nil
+}
+
+// BackfillWorkflow 补数，为日期区间内的每一天依次启动一次运行，日期通过dateParam参数传入
+// 各次运行按日期先后排队，前一次运行结束后再启动下一次，返回加入的运行数
+func (a *app) BackfillWorkflow(workflowID int64, dateParam, startDate, endDate string, params map[string]string) (int, error) {
+	plan := a.workflowRunner.GetPlan(workflowID)
+	if plan == nil {
+		return 0, errors.NewError(http.StatusBadRequest, "该workflow不存在")
+	}
+	schema, err := plan.Workflow.ParamSchema()
+	if err != nil {
+		return 0, errors.NewError(http.StatusInternalServerError, "解析运行参数声明失败").WithLog(err.Error())
+	}
+	var declared bool
+	for _, v := range schema {
+		declared = declared || v.Name == dateParam
+	}
+	if !declared {
+		return 0, errors.NewError(http.StatusBadRequest, "未声明的运行参数: "+dateParam)
+	}
+
+	runs, err := buildBackfillParams(schema, dateParam, startDate, endDate, params)
+	if err != nil {
+		return 0, errors.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err = a.workflowRunner.startBackfill(plan, runs); err != nil {
+		return 0, err
+	}
+	return len(runs), nil
+}
+
+// startBackfill 将多次运行依次加入主运行的排队中，workflow未在运行时立即启动第一次运行
+func (a *workflowRunner) startBackfill(plan *WorkflowPlan, runs []map[string]string) error {
+	newState, started, err := queueWorkflowPlanRuns(a.etcd, plan.Workflow.ID, runs)
+	if err != nil {
+		return errors.NewError(http.StatusInternalServerError, "创建补数运行失败").WithLog(err.Error())
+	}
+	if !started {
+		return nil
+	}
+	plan.planState = newState
+	a.app.PublishMessage(messageWorkflowStatusChanged(plan.Workflow.ID, common.TASK_STATUS_RUNNING_V2))
+	a.app.handleWorkflowWebHook(common.WEBHOOK_TYPE_WORKFLOW_STARTED, plan, *newState)
+
+	if !a.isLeader {
+		return nil
+	}
+	return a.scheduleWorkflowPlan(plan)
+}
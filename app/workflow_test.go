@@ -0,0 +1,269 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/holdno/gopherCron/common"
+)
+
+func TestCheckWorkflowDependencies(t *testing.T) {
+	var (
+		load    = WorkflowTaskInfo{ProjectID: 1, TaskID: "load"}
+		notify  = WorkflowTaskInfo{ProjectID: 1, TaskID: "notify_failure"}
+		cleanup = WorkflowTaskInfo{ProjectID: 1, TaskID: "cleanup"}
+	)
+
+	states := map[WorkflowTaskInfo]*WorkflowTaskStates{
+		load: {CurrentStatus: common.TASK_STATUS_RUNNING_V2, ScheduleCount: 1},
+	}
+	onFailure := []WorkflowTaskDependency{{WorkflowTaskInfo: load, Condition: common.WORKFLOW_CONDITION_FAILURE}}
+	if ready, skip := checkWorkflowDependencies(onFailure, states); ready || skip {
+		t.Fatal("dependency is still running, should wait")
+	}
+
+	states[load] = &WorkflowTaskStates{CurrentStatus: common.TASK_STATUS_DONE_V2, ScheduleCount: 1}
+	if _, skip := checkWorkflowDependencies(onFailure, states); !skip {
+		t.Fatal("failure branch should be skipped when dependency succeeded")
+	}
+
+	states[load] = &WorkflowTaskStates{CurrentStatus: common.TASK_STATUS_FAIL_V2, ScheduleCount: common.WORKFLOW_SCHEDULE_LIMIT}
+	if ready, _ := checkWorkflowDependencies(onFailure, states); !ready {
+		t.Fatal("failure branch should run when dependency failed")
+	}
+	onSuccess := []WorkflowTaskDependency{{WorkflowTaskInfo: load}}
+	if _, skip := checkWorkflowDependencies(onSuccess, states); !skip {
+		t.Fatal("success branch should be skipped when dependency failed")
+	}
+
+	states[notify] = &WorkflowTaskStates{CurrentStatus: common.TASK_STATUS_SKIPPED_V2}
+	always := []WorkflowTaskDependency{
+		{WorkflowTaskInfo: load, Condition: common.WORKFLOW_CONDITION_ALWAYS},
+		{WorkflowTaskInfo: notify, Condition: common.WORKFLOW_CONDITION_ALWAYS},
+	}
+	if ready, _ := checkWorkflowDependencies(always, states); !ready {
+		t.Fatal("always branch should run after dependencies finished")
+	}
+
+	states[notify] = &WorkflowTaskStates{CurrentStatus: common.TASK_STATUS_SKIPPED_V2, Operator: "admin(1)"}
+	if ready, _ := checkWorkflowDependencies([]WorkflowTaskDependency{{WorkflowTaskInfo: notify}}, states); !ready {
+		t.Fatal("downstream should continue after dependency was skipped manually")
+	}
+
+	taskFlow := map[WorkflowTaskInfo][]WorkflowTaskDependency{
+		load:    {{}},
+		notify:  onFailure,
+		cleanup: always,
+	}
+	if !workflowFailureHandled(taskFlow, load) {
+		t.Fatal("load failure should be handled by notify_failure")
+	}
+	if workflowFailureTolerated(taskFlow, cleanup) {
+		t.Fatal("cleanup has no downstream")
+	}
+}
+
+func TestWorkflowTaskRetryDelay(t *testing.T) {
+	states := &WorkflowTaskStates{}
+	if states.AttemptLimit() != common.WORKFLOW_SCHEDULE_LIMIT {
+		t.Fatal("states without retry policy should use the default limit")
+	}
+
+	states.RetryBackoff = 10
+	for attempt, want := range map[int]int64{1: 10, 2: 20, 3: 40, 20: 3600} {
+		if got := states.retryDelay(attempt); got != want {
+			t.Fatalf("attempt %d: want delay %d, got %d", attempt, want, got)
+		}
+	}
+
+	task := common.WorkflowTask{MaxRetries: 0}
+	if task.MaxAttempts() != 1 {
+		t.Fatal("task without retries should be scheduled only once")
+	}
+}
+
+func TestWorkflowResumeScope(t *testing.T) {
+	var (
+		extract   = WorkflowTaskInfo{ProjectID: 1, TaskID: "extract"}
+		transform = WorkflowTaskInfo{ProjectID: 1, TaskID: "transform"}
+		load      = WorkflowTaskInfo{ProjectID: 1, TaskID: "load"}
+		report    = WorkflowTaskInfo{ProjectID: 1, TaskID: "report"}
+		notify    = WorkflowTaskInfo{ProjectID: 1, TaskID: "notify"}
+		alert     = WorkflowTaskInfo{ProjectID: 1, TaskID: "alert"}
+	)
+	taskFlow := map[WorkflowTaskInfo][]WorkflowTaskDependency{
+		extract:   {{}},
+		report:    {{}},
+		transform: {{WorkflowTaskInfo: extract}},
+		load:      {{WorkflowTaskInfo: transform}},
+		notify:    {{WorkflowTaskInfo: extract}},
+		alert:     {{WorkflowTaskInfo: transform}},
+	}
+	records := []*WorkflowTaskStates{
+		{ProjectID: 1, TaskID: "extract", CurrentStatus: common.TASK_STATUS_DONE_V2},
+		{ProjectID: 1, TaskID: "report", CurrentStatus: common.TASK_STATUS_DONE_V2},
+		{ProjectID: 1, TaskID: "transform", CurrentStatus: common.TASK_STATUS_FAIL_V2},
+		{ProjectID: 1, TaskID: "notify", CurrentStatus: common.TASK_STATUS_SKIPPED_V2},
+		{ProjectID: 1, TaskID: "alert", CurrentStatus: common.TASK_STATUS_SKIPPED_V2},
+	}
+
+	// 被跳过的notify保持原样，上游需要重跑的alert随之重新调度
+	scope := workflowResumeScope(taskFlow, records)
+	if len(scope) != 3 || scope[0] != alert || scope[1] != load || scope[2] != transform {
+		t.Fatalf("unexpected resume scope: %v", scope)
+	}
+	if preserved := preservedWorkflowTaskStates(records, scope); len(preserved) != 3 {
+		t.Fatalf("successful and skipped tasks should be preserved, got %d", len(preserved))
+	}
+
+	records[2].CurrentStatus = common.TASK_STATUS_DONE_V2
+	records = append(records, &WorkflowTaskStates{ProjectID: 1, TaskID: "load", CurrentStatus: common.TASK_STATUS_DONE_V2})
+	if scope = workflowResumeScope(taskFlow, records); len(scope) != 0 {
+		t.Fatalf("successful run should not be resumed, got %v", scope)
+	}
+}
+
+func TestRenderWorkflowCommand(t *testing.T) {
+	tasks := map[WorkflowTaskInfo]*common.WorkflowTask{
+		{ProjectID: 1, TaskID: "11"}: {TaskName: "extract"},
+		{ProjectID: 2, TaskID: "21"}: {TaskName: "extract"},
+		{ProjectID: 2, TaskID: "22"}: {TaskName: "load"},
+		{ProjectID: 3, TaskID: "31"}: {TaskName: "load"},
+	}
+	refs := workflowOutputRefs(tasks, 1)
+	got := renderWorkflowCommand("FILE=${{ outputs.extract.file }} ./load.sh ${{outputs.21.out-dir}} ${{ outputs.load.file }}", refs)
+	if got != "FILE=${GOPHERCRON_OUTPUT_1_11_FILE} ./load.sh ${GOPHERCRON_OUTPUT_2_21_OUT_DIR} " {
+		t.Fatalf("unexpected command: %q", got)
+	}
+}
+
+func TestResolveWorkflowParams(t *testing.T) {
+	schema := []common.WorkflowParam{
+		{Name: "date", Required: true},
+		{Name: "tenant", Default: "all"},
+	}
+	params, err := resolveWorkflowParams(schema, map[string]string{"date": "2024-01-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["date"] != "2024-01-02" || params["tenant"] != "all" {
+		t.Fatalf("unexpected params: %v", params)
+	}
+	got := renderWorkflowParams("./run.sh ${{ params.date }} ${{params.tenant}}; ${{ params.missing }}")
+	if got != "./run.sh ${GOPHERCRON_PARAM_DATE} ${GOPHERCRON_PARAM_TENANT}; ${GOPHERCRON_PARAM_MISSING}" {
+		t.Fatalf("unexpected command: %q", got)
+	}
+
+	if _, err = resolveWorkflowParams(schema, nil); err == nil {
+		t.Fatal("required param without default should be rejected")
+	}
+	if _, err = resolveWorkflowParams(schema, map[string]string{"date": "2024-01-02", "region": "cn"}); err == nil {
+		t.Fatal("undeclared param should be rejected")
+	}
+}
+
+func TestBuildBackfillParams(t *testing.T) {
+	schema := []common.WorkflowParam{{Name: "date", Required: true}, {Name: "tenant", Default: "all"}}
+	runs, err := buildBackfillParams(schema, "date", "2024-02-28", "2024-03-01", map[string]string{"tenant": "t1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 || runs[0]["date"] != "2024-02-28" || runs[1]["date"] != "2024-02-29" ||
+		runs[2]["date"] != "2024-03-01" || runs[2]["tenant"] != "t1" {
+		t.Fatalf("unexpected runs: %v", runs)
+	}
+	if _, err = buildBackfillParams(schema, "date", "2024-03-01", "2024-02-28", nil); err == nil {
+		t.Fatal("end date before start date should be rejected")
+	}
+}
+
+func TestLimitWorkflowParallel(t *testing.T) {
+	var (
+		a = WorkflowTaskInfo{ProjectID: 1, TaskID: "a"}
+		b = WorkflowTaskInfo{ProjectID: 1, TaskID: "b"}
+		c = WorkflowTaskInfo{ProjectID: 1, TaskID: "c"}
+		d = WorkflowTaskInfo{ProjectID: 1, TaskID: "d"}
+	)
+	states := map[WorkflowTaskInfo]*WorkflowTaskStates{
+		a: {CurrentStatus: common.TASK_STATUS_RUNNING_V2},
+		b: {CurrentStatus: common.TASK_STATUS_STARTING_V2},
+	}
+
+	readys := limitWorkflowParallel([]WorkflowTaskInfo{d, c, b}, states, 3)
+	if len(readys) != 2 || readys[0] != b || readys[1] != c {
+		t.Fatalf("unexpected readys: %v", readys)
+	}
+	if readys = limitWorkflowParallel([]WorkflowTaskInfo{d, c}, states, 2); len(readys) != 0 {
+		t.Fatalf("no slot left, got %v", readys)
+	}
+}
+
+func TestBuildWorkflowTaskLogs(t *testing.T) {
+	load := WorkflowTaskInfo{ProjectID: 1, TaskID: "load"}
+	states := []*WorkflowTaskStates{{
+		ProjectID:     load.ProjectID,
+		TaskID:        load.TaskID,
+		CurrentStatus: common.TASK_STATUS_DONE_V2,
+		ScheduleRecords: []*WorkflowTaskScheduleRecord{
+			{TmpID: "t1", Status: common.TASK_STATUS_STARTING_V2, EventTime: 100, Attempt: 1},
+			{TmpID: "t1", AgentIP: "10.0.0.1", Status: common.TASK_STATUS_RUNNING_V2, EventTime: 101},
+			{TmpID: "t1", AgentIP: "10.0.0.1", Status: common.TASK_STATUS_FAIL_V2, Result: "exit 1", EventTime: 110, Attempt: 1},
+			{TmpID: "t1", Status: common.TASK_STATUS_NOT_RUNNING_V2, Result: "retry", EventTime: 110, Attempt: 1},
+			{TmpID: "t2", Status: common.TASK_STATUS_STARTING_V2, EventTime: 120, Attempt: 2},
+			{TmpID: "t2", AgentIP: "10.0.0.2", Status: common.TASK_STATUS_RUNNING_V2, EventTime: 121},
+			{TmpID: "t2", AgentIP: "10.0.0.2", Status: common.TASK_STATUS_DONE_V2, Result: "ok", EventTime: 130, Attempt: 2},
+		},
+	}, {
+		ProjectID:     1,
+		TaskID:        "report",
+		CurrentStatus: common.TASK_STATUS_RUNNING_V2,
+		ScheduleRecords: []*WorkflowTaskScheduleRecord{
+			{TmpID: "t3", Status: common.TASK_STATUS_STARTING_V2, EventTime: 105, Attempt: 1},
+		},
+	}}
+
+	logs := buildWorkflowTaskLogs(9, map[WorkflowTaskInfo]string{load: "load"}, states, 200)
+	if len(logs) != 3 {
+		t.Fatalf("expected 3 executions, got %d", len(logs))
+	}
+	first, report, second := logs[0], logs[1], logs[2]
+	if first.Attempt != 1 || first.Status != common.TASK_STATUS_FAIL_V2 || first.AgentIP != "10.0.0.1" ||
+		first.Result != "exit 1" || first.StartTime != 100 || first.EndTime != 110 || first.TaskName != "load" {
+		t.Fatalf("unexpected first attempt %+v", first)
+	}
+	if second.Attempt != 2 || second.Status != common.TASK_STATUS_DONE_V2 || second.TmpID != "t2" || second.EndTime != 130 {
+		t.Fatalf("unexpected second attempt %+v", second)
+	}
+	if report.TaskID != "report" || report.EndTime != 200 {
+		t.Fatalf("unfinished execution should end with the workflow, got %+v", report)
+	}
+
+	var rows []common.WorkflowTaskLog
+	for _, v := range logs {
+		if v.TaskID == load.TaskID {
+			v.RunID = 1
+			rows = append(rows, *v)
+		}
+	}
+	trend := summarizeWorkflowTaskRuns([]int64{1, 2}, rows)
+	if len(trend) != 1 || trend[0].Duration != 30 || trend[0].Attempts != 2 || trend[0].Status != common.TASK_STATUS_DONE_V2 {
+		t.Fatalf("unexpected trend %+v", trend)
+	}
+}
+
+func TestWorkflowOverlapPolicy(t *testing.T) {
+	// 第二次运行在第一次运行未结束时到来，已保存的并发配置不能再让两次运行同时下发相同的任务
+	cases := map[string]string{
+		"":                                     "",
+		common.WORKFLOW_CONCURRENCY_SKIP:       common.WORKFLOW_CONCURRENCY_SKIP,
+		common.WORKFLOW_CONCURRENCY_QUEUE:      common.WORKFLOW_CONCURRENCY_QUEUE,
+		common.WORKFLOW_CONCURRENCY_CONCURRENT: common.WORKFLOW_CONCURRENCY_QUEUE,
+	}
+	for policy, want := range cases {
+		if got := workflowOverlapPolicy(policy); got != want {
+			t.Errorf("policy %q: got %q, want %q", policy, got, want)
+		}
+	}
+	if isValidWorkflowConcurrencyPolicy(common.WORKFLOW_CONCURRENCY_CONCURRENT) {
+		t.Fatal("concurrent policy should be rejected until runs are isolated on agents")
+	}
+}
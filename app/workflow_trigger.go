@@ -0,0 +1,126 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spacegrower/watermelon/infra/wlog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/errors"
+	"github.com/holdno/gopherCron/utils"
+)
+
+const (
+	// 触发链路最大长度，防止上游链路过长或数据异常时无限查询
+	workflowMaxTriggerDepth = 32
+	// 上游运行触发记录的保留时长，期间同一次运行的重复结束不会再次触发下游
+	workflowTriggerClaimTTL = int64(time.Hour / time.Second)
+)
+
+// checkWorkflowTrigger 校验workflow的上游触发配置：需要有上游workflow的权限且触发链路不能成环
+func (a *app) checkWorkflowTrigger(userID int64, data *common.Workflow) error {
+	if data.TriggerWorkflowID == 0 {
+		data.TriggerCondition = ""
+		return nil
+	}
+	if data.TriggerCondition == "" {
+		data.TriggerCondition = common.WORKFLOW_CONDITION_SUCCESS
+	}
+	if !isValidWorkflowCondition(data.TriggerCondition) {
+		return errors.NewError(http.StatusBadRequest, "不支持的触发条件: "+data.TriggerCondition)
+	}
+	if data.TriggerWorkflowID == data.ID {
+		return errors.NewError(http.StatusBadRequest, "workflow不能由自身触发")
+	}
+	if err := checkUserWorkflowPermission(a.store.UserWorkflowRelevance(), userID, data.TriggerWorkflowID); err != nil {
+		return err
+	}
+
+	// 沿上游链路查找，新建的workflow还没有id，不会出现在任何workflow的上游中
+	upstream := data.TriggerWorkflowID
+	for i := 0; upstream != 0 && data.ID != 0; i++ {
+		if upstream == data.ID {
+			return errors.NewError(http.StatusBadRequest, "workflow触发关系存在循环")
+		}
+		if i >= workflowMaxTriggerDepth {
+			return errors.NewError(http.StatusBadRequest, fmt.Sprintf("workflow触发链路超过%d层", workflowMaxTriggerDepth))
+		}
+		workflow, err := a.store.Workflow().GetOne(upstream)
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return errors.NewError(http.StatusInternalServerError, "获取上游workflow信息失败").WithLog(err.Error())
+		}
+		if workflow == nil {
+			if upstream == data.TriggerWorkflowID {
+				return errors.NewError(http.StatusBadRequest, "上游workflow不存在")
+			}
+			break
+		}
+		upstream = workflow.TriggerWorkflowID
+	}
+	return nil
+}
+
+// isWorkflowTriggerSatisfied 上游workflow的运行结果是否满足触发条件
+func isWorkflowTriggerSatisfied(condition string, succeeded bool) bool {
+	switch condition {
+	case common.WORKFLOW_CONDITION_ALWAYS:
+		return true
+	case common.WORKFLOW_CONDITION_FAILURE:
+		return !succeeded
+	default:
+		return succeeded
+	}
+}
+
+// triggerDownstreamWorkflows workflow运行结束后启动以其为上游且满足触发条件的workflow
+// 同一次运行可能在多个中心上结束，只有抢到该次运行触发记录的中心会启动下游
+func (a *workflowRunner) triggerDownstreamWorkflows(workflowID int64, runID string, startTime int64, succeeded bool) {
+	if !a.claimWorkflowTrigger(workflowID, runID, startTime) {
+		return
+	}
+	a.PlanRange(func(key int64, plan *WorkflowPlan) bool {
+		if plan.Workflow.TriggerWorkflowID != workflowID || plan.Workflow.Status != common.TASK_STATUS_RUNNING {
+			return true
+		}
+		if !isWorkflowTriggerSatisfied(plan.Workflow.TriggerCondition, succeeded) {
+			return true
+		}
+
+		wlog.Info("workflow triggered by upstream", zap.Int64("workflow_id", plan.Workflow.ID),
+			zap.Int64("upstream_workflow_id", workflowID), zap.Bool("upstream_succeeded", succeeded))
+		if err := a.TryStartPlan(plan); err != nil {
+			wlog.Error("failed to start triggered workflow plan", zap.Error(err),
+				zap.Int64("workflow_id", plan.Workflow.ID),
+				zap.Int64("upstream_workflow_id", workflowID))
+			a.app.Metrics().CustomInc("workflow_trigger_fail", fmt.Sprintf("%d_%s", plan.Workflow.ID, plan.Workflow.Title), err.Error())
+		}
+		return true
+	})
+}
+
+// claimWorkflowTrigger 抢占上游workflow某次运行的下游触发权，保证每次运行只触发一次下游
+func (a *workflowRunner) claimWorkflowTrigger(workflowID int64, runID string, startTime int64) bool {
+	ctx, cancel := utils.GetContextWithTimeout()
+	defer cancel()
+
+	lease, err := a.etcd.Lease.Grant(ctx, workflowTriggerClaimTTL)
+	if err != nil {
+		wlog.Error("failed to grant workflow trigger lease", zap.Error(err), zap.Int64("workflow_id", workflowID))
+		return false
+	}
+	key := common.BuildWorkflowTriggerKey(workflowID, runID, startTime)
+	resp, err := a.etcd.KV.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, a.app.GetIP(), clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		wlog.Error("failed to claim workflow trigger", zap.Error(err), zap.Int64("workflow_id", workflowID), zap.String("run_id", runID))
+		return false
+	}
+	return resp.Succeeded
+}
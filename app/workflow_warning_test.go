@@ -0,0 +1,52 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spacegrower/watermelon/infra/wlog"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/config"
+	"github.com/holdno/gopherCron/pkg/warning"
+)
+
+func TestWorkflowWarningLevelRouting(t *testing.T) {
+	received := make(chan warning.WarningData, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data warning.WarningData
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- data
+	}))
+	defer srv.Close()
+
+	router, err := warning.NewRouter(warning.NewDefaultWarner(wlog.With()), config.Alert{
+		Channels: []config.AlertChannel{{Name: "oncall", Type: warning.ChannelTypeWebhook, URL: srv.URL}},
+		Rules:    []config.AlertRule{{MinLevel: warning.LevelCritical, Channels: []string{"oncall"}}},
+	}, wlog.With())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := &WorkflowPlan{Workflow: common.Workflow{ID: 1, Title: "ingest"}}
+	// 按策略跳过的调度只是提示，运行失败才需要通知值班
+	router.Warning(plan.skippedWarning("127.0.0.1", "上一次运行尚未结束，跳过本次调度"))
+	router.Warning(plan.failedWarning("127.0.0.1", "Workflow \"ingest\" 运行失败"))
+
+	select {
+	case data := <-received:
+		if data.Type != warning.WarningTypeWorkflow || data.GetLevel() != warning.LevelCritical {
+			t.Fatalf("unexpected alert: %+v", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("workflow failure should be routed to the critical channel")
+	}
+	select {
+	case data := <-received:
+		t.Fatalf("info alert should not be routed to the critical channel: %+v", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -59,7 +59,14 @@ func waitingShutdown(c agent.Client) {
 
 	sig := <-stopSignalChan
 	if sig != nil {
-		fmt.Println(utils.GetCurrentTimeText(), "got system signal:"+sig.String()+", going to shutdown.")
+		fmt.Println(utils.GetCurrentTimeText(), "got system signal:"+sig.String()+", going to shutdown, "+
+			fmt.Sprintf("waiting up to %ds for running tasks to finish.", c.Cfg().ShutdownTimeout))
+		go func() {
+			// 再次收到退出信号时不再等待任务结束，直接退出
+			sig := <-stopSignalChan
+			fmt.Println(utils.GetCurrentTimeText(), "got system signal:"+sig.String()+" again, force shutdown.")
+			os.Exit(1)
+		}()
 		c.Close()
 	}
 }
@@ -27,6 +27,8 @@ type TaskSaveRequest struct {
 	Status    int    `form:"status" json:"status"` // 执行状态 1立即加入执行队列 0存入etcd但是不执行
 	Noseize   int    `form:"noseize" json:"noseize"`
 	Exclusion int    `form:"exclusion" json:"exclusion"`
+	// agent失联导致任务中断时，是否重新调度到其他agent 1是 0否
+	RescheduleOnAgentLost int `form:"reschedule_on_agent_lost" json:"reschedule_on_agent_lost"`
 }
 
 // TaskSave save tast to etcd
@@ -98,6 +100,8 @@ func SaveTask(c *gin.Context) {
 		Exclusion:  req.Exclusion,
 		CreateTime: time.Now().Unix(),
 		IsRunning:  common.TASK_STATUS_UNDEFINED,
+
+		RescheduleOnAgentLost: req.RescheduleOnAgentLost,
 	}); err != nil {
 		response.APIError(c, err)
 		return
@@ -162,6 +162,45 @@ func GetClientListWithMeta(c *gin.Context) {
 	})
 }
 
+// GetClientConsistencyListRequest 获取调度计划与中心不一致的节点的请求参数
+type GetClientConsistencyListRequest struct {
+	ProjectID int64 `json:"project_id" form:"project_id" binding:"required"`
+}
+
+type GetClientConsistencyListResponse struct {
+	List []common.AgentConsistencyInfo `json:"list"`
+}
+
+// GetClientConsistencyList 获取调度计划与中心不一致(或近期已修复)的节点
+func GetClientConsistencyList(c *gin.Context) {
+	var (
+		err error
+		req GetClientConsistencyListRequest
+		res []common.AgentConsistencyInfo
+		srv = app.GetApp(c)
+		uid = utils.GetUserID(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, errors.ErrInvalidArgument)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionView); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if res, err = srv.GetAgentConsistencyList(req.ProjectID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, GetClientConsistencyListResponse{
+		List: res,
+	})
+}
+
 // 通过多个projectID来获取所有workerlist
 // GetWorkerListInfoRequest 获取节点的请求参数
 type GetWorkerListInfoRequest struct {
@@ -1,6 +1,8 @@
 package project_func
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/holdno/gopherCron/app"
@@ -68,9 +70,16 @@ func Create(c *gin.Context) {
 type CreateProjectWorkflowTaskRequest struct {
 	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
 	TaskName  string `json:"task_name" form:"task_name" binding:"required"`
-	Command   string `json:"command" form:"command" binding:"required"`
+	Command   string `json:"command" form:"command"`
 	Remark    string `json:"remark" form:"remark"`
-	Timeout   int    `json:"timeout" form:"timeout" binding:"required"`
+	Timeout   int    `json:"timeout" form:"timeout" binding:"required"` // 审批节点为审批超时时间
+	// 失败后最大重试次数，不传则使用默认策略
+	MaxRetries   *int `json:"max_retries" form:"max_retries"`
+	RetryBackoff int  `json:"retry_backoff" form:"retry_backoff"`
+	// 任务类型，approval为人工审批节点，workflow为子workflow节点
+	Type          string  `json:"type" form:"type"`
+	Approvers     []int64 `json:"approvers" form:"approvers"`
+	RefWorkflowID int64   `json:"ref_workflow_id" form:"ref_workflow_id"`
 }
 
 func CreateProjectWorkflowTask(c *gin.Context) {
@@ -87,12 +96,17 @@ func CreateProjectWorkflowTask(c *gin.Context) {
 	uid := utils.GetUserID(c)
 
 	err = srv.CreateWorkflowTask(uid, common.WorkflowTask{
-		ProjectID:  req.ProjectID,
-		TaskName:   req.TaskName,
-		Command:    req.Command,
-		Remark:     req.Remark,
-		Timeout:    req.Timeout,
-		CreateTime: time.Now().Unix(),
+		ProjectID:     req.ProjectID,
+		TaskName:      req.TaskName,
+		Command:       req.Command,
+		Remark:        req.Remark,
+		Timeout:       req.Timeout,
+		MaxRetries:    maxRetries(req.MaxRetries),
+		RetryBackoff:  req.RetryBackoff,
+		Type:          req.Type,
+		Approvers:     joinApprovers(req.Approvers),
+		RefWorkflowID: req.RefWorkflowID,
+		CreateTime:    time.Now().Unix(),
 	})
 	if err != nil {
 		response.APIError(c, err)
@@ -100,3 +114,18 @@ func CreateProjectWorkflowTask(c *gin.Context) {
 	}
 	response.APISuccess(c, nil)
 }
+
+func maxRetries(retries *int) int {
+	if retries == nil || *retries < 0 {
+		return -1
+	}
+	return *retries
+}
+
+func joinApprovers(ids []int64) string {
+	list := make([]string, 0, len(ids))
+	for _, v := range ids {
+		list = append(list, strconv.FormatInt(v, 10))
+	}
+	return strings.Join(list, ",")
+}
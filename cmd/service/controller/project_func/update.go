@@ -177,9 +177,16 @@ type UpdateProjectWorkflowTaskRequest struct {
 	TaskID    string `json:"task_id" form:"task_id" binding:"required"`
 	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
 	TaskName  string `json:"task_name" form:"task_name" binding:"required"`
-	Command   string `json:"command" form:"command" binding:"required"`
+	Command   string `json:"command" form:"command"`
 	Remark    string `json:"remark" form:"remark"`
-	Timeout   int    `json:"timeout" form:"timeout" binding:"required"`
+	Timeout   int    `json:"timeout" form:"timeout" binding:"required"` // 审批节点为审批超时时间
+	// 失败后最大重试次数，不传则使用默认策略
+	MaxRetries   *int `json:"max_retries" form:"max_retries"`
+	RetryBackoff int  `json:"retry_backoff" form:"retry_backoff"`
+	// 任务类型，approval为人工审批节点，workflow为子workflow节点
+	Type          string  `json:"type" form:"type"`
+	Approvers     []int64 `json:"approvers" form:"approvers"`
+	RefWorkflowID int64   `json:"ref_workflow_id" form:"ref_workflow_id"`
 }
 
 func UpdateProjectWorkflowTask(c *gin.Context) {
@@ -196,13 +203,18 @@ func UpdateProjectWorkflowTask(c *gin.Context) {
 	srv := app.GetApp(c)
 
 	err = srv.UpdateWorkflowTask(uid, common.WorkflowTask{
-		TaskID:     req.TaskID,
-		ProjectID:  req.ProjectID,
-		TaskName:   req.TaskName,
-		Command:    req.Command,
-		Remark:     req.Remark,
-		Timeout:    req.Timeout,
-		CreateTime: time.Now().Unix(),
+		TaskID:        req.TaskID,
+		ProjectID:     req.ProjectID,
+		TaskName:      req.TaskName,
+		Command:       req.Command,
+		Remark:        req.Remark,
+		Timeout:       req.Timeout,
+		MaxRetries:    maxRetries(req.MaxRetries),
+		RetryBackoff:  req.RetryBackoff,
+		Type:          req.Type,
+		Approvers:     joinApprovers(req.Approvers),
+		RefWorkflowID: req.RefWorkflowID,
+		CreateTime:    time.Now().Unix(),
 	})
 	if err != nil {
 		response.APIError(c, err)
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/holdno/gopherCron/app"
 	"github.com/holdno/gopherCron/cmd/service/response"
+	"github.com/holdno/gopherCron/common"
 	"github.com/holdno/gopherCron/utils"
 )
 
@@ -11,6 +12,8 @@ type CreateWebHookRequest struct {
 	ProjectID   int64  `json:"project_id" form:"project_id" binding:"required"`
 	CallBackURL string `json:"call_back_url" form:"call_back_url" binding:"required"`
 	Type        string `json:"type" form:"type" binding:"required"`
+	Format      string `json:"format" form:"format"`     // 推送格式，为空时为cloudevent
+	Template    string `json:"template" form:"template"` // format为template时的go template
 }
 
 func CreateWebHook(c *gin.Context) {
@@ -31,7 +34,7 @@ func CreateWebHook(c *gin.Context) {
 		return
 	}
 
-	if err = srv.CreateWebHook(req.ProjectID, req.Type, req.CallBackURL); err != nil {
+	if err = srv.CreateWebHook(req.ProjectID, req.Type, req.CallBackURL, req.Format, req.Template); err != nil {
 		response.APIError(c, err)
 		return
 	}
@@ -39,6 +42,108 @@ func CreateWebHook(c *gin.Context) {
 	response.APISuccess(c, nil)
 }
 
+type UpdateWebHookRequest struct {
+	ProjectID   int64  `json:"project_id" form:"project_id" binding:"required"`
+	CallBackURL string `json:"call_back_url" form:"call_back_url" binding:"required"`
+	Type        string `json:"type" form:"type" binding:"required"`
+	Format      string `json:"format" form:"format"`
+	Template    string `json:"template" form:"template"`
+}
+
+func UpdateWebHook(c *gin.Context) {
+	var (
+		err error
+		req UpdateWebHookRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.UpdateWebHook(req.ProjectID, req.Type, req.CallBackURL, req.Format, req.Template); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
+type RotateWebHookSecretRequest struct {
+	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
+	Type      string `json:"type" form:"type" binding:"required"`
+}
+
+// RotateWebHookSecret 重新生成webhook的签名密钥
+func RotateWebHookSecret(c *gin.Context) {
+	var (
+		err error
+		req RotateWebHookSecretRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	secret, err := srv.RotateWebHookSecret(req.ProjectID, req.Type)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, &gin.H{
+		"secret": secret,
+	})
+}
+
+type TestWebHookRequest struct {
+	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
+	Type      string `json:"type" form:"type" binding:"required"`
+}
+
+// TestWebHook 向webhook推送一次测试事件，返回推送记录
+func TestWebHook(c *gin.Context) {
+	var (
+		err error
+		req TestWebHookRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	delivery, err := srv.TestWebHook(req.ProjectID, req.Type)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, delivery)
+}
+
 type GetWebHookListRequest struct {
 	ProjectID int64 `json:"project_id" form:"project_id" binding:"required"`
 }
@@ -132,3 +237,171 @@ func DeleteWebHook(c *gin.Context) {
 
 	response.APISuccess(c, nil)
 }
+
+type GetWebHookDeliveryListRequest struct {
+	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
+	Type      string `json:"type" form:"type"`
+	Status    string `json:"status" form:"status"`
+	Page      uint64 `json:"page" form:"page" binding:"required"`
+	Pagesize  uint64 `json:"pagesize" form:"pagesize" binding:"required"`
+}
+
+type GetWebHookDeliveryListResponse struct {
+	List  []common.WebHookDelivery `json:"list"`
+	Total int                      `json:"total"`
+}
+
+// GetWebHookDeliveryList 获取webhook推送记录
+func GetWebHookDeliveryList(c *gin.Context) {
+	var (
+		err error
+		req GetWebHookDeliveryListRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	list, total, err := srv.GetWebHookDeliveryList(req.ProjectID, req.Type, req.Status, req.Page, req.Pagesize)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, GetWebHookDeliveryListResponse{
+		List:  list,
+		Total: total,
+	})
+}
+
+type RedeliverWebHookRequest struct {
+	ProjectID  int64 `json:"project_id" form:"project_id" binding:"required"`
+	DeliveryID int64 `json:"delivery_id" form:"delivery_id" binding:"required"`
+}
+
+// RedeliverWebHook 重新推送一条历史推送记录，返回新的推送记录
+func RedeliverWebHook(c *gin.Context) {
+	var (
+		err error
+		req RedeliverWebHookRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	delivery, err := srv.RedeliverWebHook(req.ProjectID, req.DeliveryID)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, delivery)
+}
+
+type GetWebHookDeadLettersRequest struct {
+	ProjectID int64 `json:"project_id" form:"project_id" binding:"required"`
+}
+
+// GetWebHookDeadLetters 获取多次推送仍失败的webhook
+func GetWebHookDeadLetters(c *gin.Context) {
+	var (
+		err error
+		req GetWebHookDeadLettersRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	list, err := srv.GetWebHookDeadLetters(req.ProjectID)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, list)
+}
+
+type WebHookDeadLetterRequest struct {
+	ProjectID int64  `json:"project_id" form:"project_id" binding:"required"`
+	ID        string `json:"id" form:"id" binding:"required"`
+}
+
+// RetryWebHookDeadLetter 将死信重新加入推送队列
+func RetryWebHookDeadLetter(c *gin.Context) {
+	var (
+		err error
+		req WebHookDeadLetterRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.RetryWebHookDeadLetter(req.ProjectID, req.ID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
+// DeleteWebHookDeadLetter 删除死信
+func DeleteWebHookDeadLetter(c *gin.Context) {
+	var (
+		err error
+		req WebHookDeadLetterRequest
+		uid = utils.GetUserID(c)
+		srv = app.GetApp(c)
+	)
+
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.CheckPermissions(req.ProjectID, uid, app.PermissionEdit); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.DeleteWebHookDeadLetter(req.ProjectID, req.ID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
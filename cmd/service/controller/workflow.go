@@ -19,6 +19,16 @@ type CreateWorkflowRequest struct {
 	Remark string `json:"remark" form:"remark"`
 	Cron   string `json:"cron" form:"cron" binding:"required"`
 	Status int    `json:"status" form:"status"`
+	// workflow整体超时时间(s)及最大并行任务数，0为不限制
+	Timeout     int `json:"timeout" form:"timeout"`
+	MaxParallel int `json:"max_parallel" form:"max_parallel"`
+	// 上游workflow运行结束后触发，trigger_condition: success(默认)/failure/always
+	TriggerWorkflowID int64  `json:"trigger_workflow_id" form:"trigger_workflow_id"`
+	TriggerCondition  string `json:"trigger_condition" form:"trigger_condition"`
+	// 上一次运行未结束时新调度的处理方式: skip(默认)/queue/concurrent
+	ConcurrencyPolicy string `json:"concurrency_policy" form:"concurrency_policy"`
+	// 运行参数声明，json格式: [{"name":"date","default":"","required":true,"description":""}]
+	Params string `json:"params" form:"params"`
 }
 
 func CreateWorkflow(c *gin.Context) {
@@ -34,12 +44,18 @@ func CreateWorkflow(c *gin.Context) {
 	srv := app.GetApp(c)
 	uid := utils.GetUserID(c)
 	if err = srv.CreateWorkflow(uid, common.Workflow{
-		OID:        req.OID,
-		Title:      req.Title,
-		Remark:     req.Remark,
-		Cron:       req.Cron,
-		Status:     req.Status,
-		CreateTime: time.Now().Unix(),
+		OID:               req.OID,
+		Title:             req.Title,
+		Remark:            req.Remark,
+		Cron:              req.Cron,
+		Status:            req.Status,
+		Timeout:           req.Timeout,
+		MaxParallel:       req.MaxParallel,
+		TriggerWorkflowID: req.TriggerWorkflowID,
+		TriggerCondition:  req.TriggerCondition,
+		ConcurrencyPolicy: req.ConcurrencyPolicy,
+		Params:            req.Params,
+		CreateTime:        time.Now().Unix(),
 	}); err != nil {
 		response.APIError(c, err)
 		return
@@ -48,7 +64,8 @@ func CreateWorkflow(c *gin.Context) {
 }
 
 type GetWorkflowTaskListRequest struct {
-	WorkflowID int64 `json:"workflow_id" form:"workflow_id" binding:"required"`
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	RunID      string `json:"run_id" form:"run_id"` // 并发运行的id，为空时获取主运行的任务状态
 }
 
 type GetWorkflowTaskListResponseItem struct {
@@ -80,7 +97,7 @@ func GetWorkflowTaskList(c *gin.Context) {
 		return
 	}
 
-	taskStates, err := srv.GetWorkflowAllTaskStates(req.WorkflowID)
+	taskStates, err := srv.GetWorkflowAllTaskStates(req.WorkflowID, req.RunID)
 	if err != nil {
 		response.APIError(c, err)
 		return
@@ -125,8 +142,8 @@ type CreateWorkflowSchedulePlanRequest struct {
 }
 
 type WorkflowScheduleTaskItem struct {
-	Task         app.WorkflowTaskInfo   `json:"task" form:"task" binding:"required"`
-	Dependencies []app.WorkflowTaskInfo `json:"dependencies" form:"dependencies"`
+	Task         app.WorkflowTaskInfo         `json:"task" form:"task" binding:"required"`
+	Dependencies []app.WorkflowTaskDependency `json:"dependencies" form:"dependencies"` // condition: success(默认)/failure/always
 }
 
 func CreateWorkflowSchedulePlan(c *gin.Context) {
@@ -156,6 +173,116 @@ func CreateWorkflowSchedulePlan(c *gin.Context) {
 	response.APISuccess(c, nil)
 }
 
+type ExportWorkflowGraphRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	Format     string `json:"format" form:"format"` // dot(默认)/mermaid
+}
+
+type ExportWorkflowGraphResponse struct {
+	Format  string `json:"format"`
+	Content string `json:"content"`
+}
+
+// ExportWorkflowGraph 导出workflow的依赖关系图
+func ExportWorkflowGraph(c *gin.Context) {
+	var (
+		err error
+		req ExportWorkflowGraphRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if req.Format == "" {
+		req.Format = app.WORKFLOW_GRAPH_FORMAT_DOT
+	}
+	content, err := srv.ExportWorkflowGraph(req.WorkflowID, req.Format)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, ExportWorkflowGraphResponse{
+		Format:  req.Format,
+		Content: content,
+	})
+}
+
+type ExportWorkflowDefinitionRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	Format     string `json:"format" form:"format"` // yaml(默认)/json
+}
+
+// ExportWorkflowDefinition 导出workflow的声明式定义
+func ExportWorkflowDefinition(c *gin.Context) {
+	var (
+		err error
+		req ExportWorkflowDefinitionRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if req.Format == "" {
+		req.Format = app.WORKFLOW_DEFINITION_FORMAT_YAML
+	}
+	content, err := srv.ExportWorkflowDefinition(req.WorkflowID, req.Format)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, ExportWorkflowGraphResponse{
+		Format:  req.Format,
+		Content: content,
+	})
+}
+
+type ImportWorkflowDefinitionRequest struct {
+	OID        string `json:"oid" form:"oid"`                            // 新建workflow时所属的组织
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id"`            // 为空时按组织及标题匹配已有workflow
+	Content    string `json:"content" form:"content" binding:"required"` // yaml或json格式的workflow定义
+	DryRun     bool   `json:"dry_run" form:"dry_run"`                    // 只返回差异，不做变更
+}
+
+// ImportWorkflowDefinition 按声明式定义创建或更新workflow
+func ImportWorkflowDefinition(c *gin.Context) {
+	var (
+		err error
+		req ImportWorkflowDefinitionRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	result, err := srv.ImportWorkflowDefinition(uid, req.OID, req.WorkflowID, []byte(req.Content), req.DryRun)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, result)
+}
+
 type GetWorkflowRequest struct {
 	ID int64 `json:"id" form:"id" binding:"required"`
 }
@@ -195,9 +322,16 @@ func GetWorkflow(c *gin.Context) {
 		return
 	}
 
+	runs, err := srv.GetWorkflowRunStates(data.ID)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
 	response.APISuccess(c, WorkflowWithState{
 		Workflow: *data,
 		State:    state,
+		Runs:     runs,
 	})
 }
 
@@ -215,7 +349,8 @@ type GetWorkflowListResponse struct {
 
 type WorkflowWithState struct {
 	common.Workflow
-	State *app.PlanState `json:"state"`
+	State *app.PlanState   `json:"state"`
+	Runs  []*app.PlanState `json:"runs,omitempty"` // 进行中的并发运行
 }
 
 func GetWorkflowList(c *gin.Context) {
@@ -269,8 +404,8 @@ func GetWorkflowList(c *gin.Context) {
 			return
 		}
 		listWithState = append(listWithState, WorkflowWithState{
-			v,
-			state,
+			Workflow: v,
+			State:    state,
 		})
 	}
 
@@ -307,6 +442,9 @@ func DeleteWorkflow(c *gin.Context) {
 
 type StartWorkflowRequest struct {
 	WorkflowID int64 `json:"workflow_id" form:"workflow_id" binding:"required"`
+	DryRun     bool  `json:"dry_run" form:"dry_run"` // 试运行，不实际执行任务命令
+	// 本次运行的参数，未传入的参数使用workflow声明的默认值
+	Params map[string]string `json:"params"`
 }
 
 func StartWorkflow(c *gin.Context) {
@@ -327,7 +465,7 @@ func StartWorkflow(c *gin.Context) {
 		return
 	}
 
-	if err = srv.StartWorkflow(req.WorkflowID); err != nil {
+	if err = srv.StartWorkflow(req.WorkflowID, req.DryRun, req.Params); err != nil {
 		response.APIError(c, err)
 		return
 	}
@@ -335,6 +473,47 @@ func StartWorkflow(c *gin.Context) {
 	response.APISuccess(c, nil)
 }
 
+type BackfillWorkflowRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	DateParam  string `json:"date_param" form:"date_param" binding:"required"` // 接收日期的运行参数
+	StartDate  string `json:"start_date" form:"start_date" binding:"required"` // 2006-01-02
+	EndDate    string `json:"end_date" form:"end_date" binding:"required"`
+	// 其他运行参数，每次运行相同
+	Params map[string]string `json:"params"`
+}
+
+type BackfillWorkflowResponse struct {
+	Runs int `json:"runs"`
+}
+
+// BackfillWorkflow 按日期区间补数，每天一次运行，依次执行
+func BackfillWorkflow(c *gin.Context) {
+	var (
+		err error
+		req BackfillWorkflowRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	runs, err := srv.BackfillWorkflow(req.WorkflowID, req.DateParam, req.StartDate, req.EndDate, req.Params)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, BackfillWorkflowResponse{Runs: runs})
+}
+
 type KillWorkflowRequest struct {
 	WorkflowID int64 `json:"workflow_id" form:"workflow_id" binding:"required"`
 }
@@ -364,12 +543,165 @@ func KillWorkflow(c *gin.Context) {
 	response.APISuccess(c, nil)
 }
 
+const (
+	WorkflowApproveActionApprove = "approve"
+	WorkflowApproveActionReject  = "reject"
+)
+
+type ApproveWorkflowTaskRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	ProjectID  int64  `json:"project_id" form:"project_id" binding:"required"`
+	TaskID     string `json:"task_id" form:"task_id" binding:"required"`
+	Action     string `json:"action" form:"action" binding:"required"` // approve/reject
+	Remark     string `json:"remark" form:"remark"`
+	RunID      string `json:"run_id" form:"run_id"` // 并发运行的id，审批主运行时为空
+}
+
+// ApproveWorkflowTask 审批workflow中的审批节点
+func ApproveWorkflowTask(c *gin.Context) {
+	var (
+		err error
+		req ApproveWorkflowTaskRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+	if req.Action != WorkflowApproveActionApprove && req.Action != WorkflowApproveActionReject {
+		response.APIError(c, errors.NewError(http.StatusBadRequest, "不支持的审批操作: "+req.Action))
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	// 审批人的权限校验在审批逻辑中处理，审批人不一定是workflow成员
+	if err = srv.ApproveWorkflowTask(uid, req.WorkflowID, req.RunID, app.WorkflowTaskInfo{
+		ProjectID: req.ProjectID,
+		TaskID:    req.TaskID,
+	}, req.Action == WorkflowApproveActionApprove, req.Remark); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
+type MarkWorkflowTaskRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	ProjectID  int64  `json:"project_id" form:"project_id" binding:"required"`
+	TaskID     string `json:"task_id" form:"task_id" binding:"required"`
+	Status     string `json:"status" form:"status" binding:"required"` // done/skipped
+	Reason     string `json:"reason" form:"reason" binding:"required"`
+	RunID      string `json:"run_id" form:"run_id"` // 并发运行的id，操作主运行时为空
+}
+
+// MarkWorkflowTask 人工将运行中workflow的节点标记为成功或跳过
+func MarkWorkflowTask(c *gin.Context) {
+	var (
+		err error
+		req MarkWorkflowTaskRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	if err = srv.MarkWorkflowTask(uid, req.WorkflowID, req.RunID, app.WorkflowTaskInfo{
+		ProjectID: req.ProjectID,
+		TaskID:    req.TaskID,
+	}, req.Status, req.Reason); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
+type ResumeWorkflowRequest struct {
+	WorkflowID int64 `json:"workflow_id" form:"workflow_id" binding:"required"`
+	LogID      int64 `json:"log_id" form:"log_id"` // 为空时从最近一次运行恢复
+}
+
+// ResumeWorkflow 从失败处恢复workflow的运行
+func ResumeWorkflow(c *gin.Context) {
+	var (
+		err error
+		req ResumeWorkflowRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.ResumeWorkflow(req.WorkflowID, req.LogID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
+type RerunWorkflowTaskRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	LogID      int64  `json:"log_id" form:"log_id"`
+	ProjectID  int64  `json:"project_id" form:"project_id" binding:"required"`
+	TaskID     string `json:"task_id" form:"task_id" binding:"required"`
+}
+
+// RerunWorkflowTask 单独重跑workflow中的某个任务
+func RerunWorkflowTask(c *gin.Context) {
+	var (
+		err error
+		req RerunWorkflowTaskRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	if err = srv.RerunWorkflowTask(req.WorkflowID, req.LogID, app.WorkflowTaskInfo{
+		ProjectID: req.ProjectID,
+		TaskID:    req.TaskID,
+	}); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, nil)
+}
+
 type UpdateWorkflowRequest struct {
 	ID     int64  `json:"id" form:"id" binding:"required"`
 	Title  string `json:"title" form:"title" binding:"required"`
 	Remark string `json:"remark" form:"remark"`
 	Cron   string `json:"cron" form:"cron" binding:"required"`
 	Status int    `json:"status" form:"status"`
+	// workflow整体超时时间(s)及最大并行任务数，0为不限制
+	Timeout     int `json:"timeout" form:"timeout"`
+	MaxParallel int `json:"max_parallel" form:"max_parallel"`
+	// 上游workflow运行结束后触发，trigger_condition: success(默认)/failure/always
+	TriggerWorkflowID int64  `json:"trigger_workflow_id" form:"trigger_workflow_id"`
+	TriggerCondition  string `json:"trigger_condition" form:"trigger_condition"`
+	// 上一次运行未结束时新调度的处理方式: skip(默认)/queue/concurrent
+	ConcurrencyPolicy string `json:"concurrency_policy" form:"concurrency_policy"`
+	// 运行参数声明，json格式: [{"name":"date","default":"","required":true,"description":""}]
+	Params string `json:"params" form:"params"`
 }
 
 func UpdateWorkflow(c *gin.Context) {
@@ -385,11 +717,17 @@ func UpdateWorkflow(c *gin.Context) {
 	srv := app.GetApp(c)
 	uid := utils.GetUserID(c)
 	if err = srv.UpdateWorkflow(uid, common.Workflow{
-		ID:     req.ID,
-		Title:  req.Title,
-		Remark: req.Remark,
-		Cron:   req.Cron,
-		Status: req.Status,
+		ID:                req.ID,
+		Title:             req.Title,
+		Remark:            req.Remark,
+		Cron:              req.Cron,
+		Status:            req.Status,
+		Timeout:           req.Timeout,
+		MaxParallel:       req.MaxParallel,
+		TriggerWorkflowID: req.TriggerWorkflowID,
+		TriggerCondition:  req.TriggerCondition,
+		ConcurrencyPolicy: req.ConcurrencyPolicy,
+		Params:            req.Params,
 	}); err != nil {
 		response.APIError(c, err)
 		return
@@ -467,6 +805,80 @@ func GetWorkflowLogList(c *gin.Context) {
 	})
 }
 
+type GetWorkflowRunTimelineRequest struct {
+	WorkflowID int64 `json:"workflow_id" form:"workflow_id" binding:"required"`
+	LogID      int64 `json:"log_id" form:"log_id"` // 为空时使用最近一次运行
+}
+
+// GetWorkflowRunTimeline 获取workflow单次运行中各节点的执行时间线
+func GetWorkflowRunTimeline(c *gin.Context) {
+	var (
+		err error
+		req GetWorkflowRunTimelineRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	timeline, err := srv.GetWorkflowRunTimeline(req.WorkflowID, req.LogID)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, timeline)
+}
+
+type GetWorkflowTaskDurationTrendRequest struct {
+	WorkflowID int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
+	ProjectID  int64  `json:"project_id" form:"project_id" binding:"required"`
+	TaskID     string `json:"task_id" form:"task_id" binding:"required"`
+	Limit      int    `json:"limit" form:"limit"` // 最近的运行次数，默认30
+}
+
+// GetWorkflowTaskDurationTrend 获取节点在最近多次workflow运行中的耗时趋势
+func GetWorkflowTaskDurationTrend(c *gin.Context) {
+	var (
+		err error
+		req GetWorkflowTaskDurationTrendRequest
+	)
+	if err = utils.BindArgsWithGin(c, &req); err != nil {
+		response.APIError(c, err)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 30
+	}
+
+	srv := app.GetApp(c)
+	uid := utils.GetUserID(c)
+
+	if err = srv.GetUserWorkflowPermission(uid, req.WorkflowID); err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	list, err := srv.GetWorkflowTaskDurationTrend(req.WorkflowID, app.WorkflowTaskInfo{
+		ProjectID: req.ProjectID,
+		TaskID:    req.TaskID,
+	}, req.Limit)
+	if err != nil {
+		response.APIError(c, err)
+		return
+	}
+
+	response.APISuccess(c, list)
+}
+
 type WorkflowAddUserRequest struct {
 	WorkflowID  int64  `json:"workflow_id" form:"workflow_id" binding:"required"`
 	UserAccount string `json:"user_account" form:"user_account" binding:"required"`
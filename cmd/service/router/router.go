@@ -82,9 +82,17 @@ func SetupRoute(srv app.App, r *gin.Engine, conf *config.ServiceConfig) {
 		{
 			webhook.Use(middleware.TokenVerify([]byte(conf.JWT.PublicKey)))
 			webhook.POST("/create", controller.CreateWebHook)
+			webhook.POST("/update", controller.UpdateWebHook)
+			webhook.POST("/secret/rotate", controller.RotateWebHookSecret)
+			webhook.POST("/test", controller.TestWebHook)
 			webhook.POST("/delete", controller.DeleteWebHook)
 			webhook.GET("/list", controller.GetWebHookList)
 			webhook.GET("/info", controller.GetWebHook)
+			webhook.GET("/delivery/list", controller.GetWebHookDeliveryList)
+			webhook.POST("/delivery/redeliver", controller.RedeliverWebHook)
+			webhook.GET("/deadletter/list", controller.GetWebHookDeadLetters)
+			webhook.POST("/deadletter/retry", controller.RetryWebHookDeadLetter)
+			webhook.POST("/deadletter/delete", controller.DeleteWebHookDeadLetter)
 		}
 
 		org := api.Group("/org")
@@ -119,6 +127,7 @@ func SetupRoute(srv app.App, r *gin.Engine, conf *config.ServiceConfig) {
 			client.POST("/weight", etcd_func.SetClientWeight)
 			client.GET("/list", etcd_func.GetWorkerListInfo)
 			client.POST("/reload/config", etcd_func.ReloadConfig)
+			client.GET("/consistency/list", etcd_func.GetClientConsistencyList)
 		}
 
 		temporaryTask := api.Group("/temporary_task")
@@ -137,8 +146,14 @@ func SetupRoute(srv app.App, r *gin.Engine, conf *config.ServiceConfig) {
 			workflow.POST("/update", controller.UpdateWorkflow)
 			workflow.GET("/list", controller.GetWorkflowList)
 			workflow.GET("/detail", controller.GetWorkflow)
+			workflow.GET("/graph", controller.ExportWorkflowGraph)
+			workflow.GET("/export", controller.ExportWorkflowDefinition)
+			workflow.POST("/import", controller.ImportWorkflowDefinition)
 			workflow.POST("/start", controller.StartWorkflow)
+			workflow.POST("/backfill", controller.BackfillWorkflow)
 			workflow.POST("/kill", controller.KillWorkflow)
+			workflow.POST("/resume", controller.ResumeWorkflow)
+			workflow.POST("/approve", controller.ApproveWorkflowTask)
 			manage := workflow.Group("/manage")
 			{
 				manage.POST("/add_user", controller.WorkflowAddUser)
@@ -149,11 +164,15 @@ func SetupRoute(srv app.App, r *gin.Engine, conf *config.ServiceConfig) {
 			{
 				task.POST("/schedule/create", controller.CreateWorkflowSchedulePlan)
 				task.GET("/list", controller.GetWorkflowTaskList)
+				task.POST("/rerun", controller.RerunWorkflowTask)
+				task.POST("/mark", controller.MarkWorkflowTask)
 			}
 			log := workflow.Group("/log")
 			{
 				log.GET("/list", controller.GetWorkflowLogList)
 				log.POST("/clear", controller.ClearWorkflowLog)
+				log.GET("/timeline", controller.GetWorkflowRunTimeline)
+				log.GET("/task/trend", controller.GetWorkflowTaskDurationTrend)
 			}
 		}
 
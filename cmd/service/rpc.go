@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -180,7 +181,8 @@ func (s *cronRpc) StatusReporter(ctx context.Context, req *cronpb.ScheduleReply)
 			return nil, err
 		}
 
-		if existAgentVersion && utils.CompareVersion("v2.1.9999", agentVersion) {
+		// 试运行的任务没有实际执行，不写入任务执行日志
+		if existAgentVersion && utils.CompareVersion("v2.1.9999", agentVersion) && !result.WorkflowDryRun {
 			s.app.SaveTaskLog(agentIP, result)
 		}
 
@@ -190,6 +192,13 @@ func (s *cronRpc) StatusReporter(ctx context.Context, req *cronpb.ScheduleReply)
 				zap.Int64("workflow_id", result.WorkflowID))
 			return nil, err
 		}
+	case common.TASK_STATUS_SKIPPED_V2:
+		// 上一次执行尚未结束，agent跳过了本次调度
+		var result common.TaskFinishedV2
+		if err := json.Unmarshal(req.Event.Value, &result); err != nil {
+			return nil, err
+		}
+		s.app.HandleTaskSkipped(agentIP, &result)
 	}
 	return &cronpb.Result{
 		Result:  true,
@@ -363,11 +372,11 @@ Here:
 			for _, info := range multiService.Agents {
 				for _, v := range info.Systems {
 					// Dispatch 依赖 gRPC stream, 所以需要先 SaveStream 再 DispatchAgentJob
-					if err := s.app.DispatchAgentJob(v, func(taskRaw []byte) error {
+					if err := s.app.DispatchAgentJob(v, func(eventType string, value []byte) error {
 						if err := req.Send(&cronpb.Event{
 							Version:   common.VERSION_TYPE_V1,
-							Type:      common.REMOTE_EVENT_PUT,
-							Value:     taskRaw,
+							Type:      eventType,
+							Value:     value,
 							EventTime: time.Now().Unix(),
 						}); err != nil {
 							wlog.Info("failed to dispatch agent job v1", zap.String("host", fmt.Sprintf("%s:%d", info.Host, info.Port)), zap.Error(err))
@@ -535,6 +544,20 @@ func (s *cronRpc) buildAgentRegister(ctx context.Context) (registerFunc func(req
 	return registerFunc, deRegisterFunc
 }
 
+// agentDrainingDeadline 获取agent注册信息中携带的退出截止时间
+func agentDrainingDeadline(metas []infra.NodeMeta) (time.Time, bool) {
+	for _, meta := range metas {
+		if v, exist := meta.Tags[common.AGENT_TAG_DRAINING_DEADLINE]; exist {
+			deadline, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.Unix(deadline, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
 type dispatcher func(reqID string, meta infra.NodeMeta) app.JobDispatcher
 
 func buildDispatchJobsV2Handler(sendEvent func(ctx context.Context, e *cronpb.ServiceEvent) error) dispatcher {
@@ -542,7 +565,7 @@ func buildDispatchJobsV2Handler(sendEvent func(ctx context.Context, e *cronpb.Se
 		// firstReqID 代表需要向agent回复的任务下发id，agent在发起注册后，会监听该id的事件来作为中心对agent注册的回应
 		// 但该id仅需要被回复一次即可
 		once := sync.Once{}
-		return func(taskRaw []byte) error {
+		return func(eventType string, value []byte) error {
 			reqID := utils.GetStrID()
 			once.Do(func() {
 				reqID = firstReqID
@@ -556,8 +579,8 @@ func buildDispatchJobsV2Handler(sendEvent func(ctx context.Context, e *cronpb.Se
 				Event: &cronpb.ServiceEvent_RegisterReply{
 					RegisterReply: &cronpb.Event{
 						Version:   common.VERSION_TYPE_V1,
-						Type:      common.REMOTE_EVENT_PUT,
-						Value:     taskRaw,
+						Type:      eventType,
+						Value:     value,
 						EventTime: time.Now().Unix(),
 					},
 				},
@@ -609,8 +632,14 @@ func (s *cronRpc) RegisterAgentV2(req cronpb.Center_RegisterAgentV2Server) error
 	// 链接关闭后调用反注册
 	defer deRegister(func(allRegisteredMetas []infra.NodeMeta) {
 		// 反注册后，需要将stream从内存中剔除
+		var projectIDs []int64
 		for _, meta := range allRegisteredMetas {
 			s.app.StreamManagerV2().RemoveStream(meta)
+			projectIDs = append(projectIDs, meta.System)
+		}
+		// 跟踪agent断开时仍在运行中的任务，agent失联时标记任务并按需重新调度
+		if agentIP, ok := middleware.GetAgentIP(req.Context()); ok {
+			s.app.HandleAgentDeregistered(agentIP, projectIDs)
 		}
 	})
 
@@ -626,6 +655,8 @@ func (s *cronRpc) RegisterAgentV2(req cronpb.Center_RegisterAgentV2Server) error
 		// heartbeat error 关闭连接
 		cancel()
 	})
+	// 同一链接可能多次注册(更新注册信息)，每个项目只通知一次上线
+	onlineProjects := make(map[int64]bool)
 
 	for {
 		select {
@@ -635,14 +666,33 @@ func (s *cronRpc) RegisterAgentV2(req cronpb.Center_RegisterAgentV2Server) error
 			}
 			// 将agent信息进行注册
 			err := register(multiService.info, func(nm []infra.NodeMeta) error {
+				if deadline, draining := agentDrainingDeadline(nm); draining {
+					// agent正在退出，记录后仅回应本次注册，不再下发任务
+					agentIP, _ := middleware.GetAgentIP(req.Context())
+					if err := s.app.MarkAgentDraining(agentIP, deadline); err != nil {
+						wlog.Error("failed to mark agent draining", zap.String("agent_ip", agentIP), zap.Error(err))
+					}
+					for _, meta := range nm {
+						s.app.StreamManagerV2().SaveStream(meta, req, cancel)
+					}
+					return dispatchHandler(multiService.reqID, nm[0])("", nil)
+				}
 				// 完成注册后将stream缓存至内存中，方便后续中心与agent通信时使用
+				var newProjectIDs []int64
 				for _, meta := range nm {
+					if !onlineProjects[meta.System] {
+						onlineProjects[meta.System] = true
+						newProjectIDs = append(newProjectIDs, meta.System)
+					}
 					s.app.StreamManagerV2().SaveStream(meta, req, cancel)
 					// 下发对应项目的任务列表
 					if err := s.app.DispatchAgentJob(meta.System, dispatchHandler(multiService.reqID, meta)); err != nil {
 						return err
 					}
 				}
+				if agentIP, ok := middleware.GetAgentIP(req.Context()); ok && len(newProjectIDs) > 0 {
+					s.app.HandleAgentRegistered(agentIP, newProjectIDs)
+				}
 				return nil
 			})
 			if err != nil {
@@ -10,6 +10,7 @@ const (
 	TASK_EVENT_KILL              = 3
 	TASK_EVENT_TEMPORARY         = 4
 	TASK_EVENT_WORKFLOW_SCHEDULE = 5
+	TASK_EVENT_RECONCILE         = 6
 
 	TASK_STATUS_START = 1
 	TASK_STATUS_STOP  = 2
@@ -26,9 +27,36 @@ const (
 	TASK_STATUS_NOT_RUNNING_V2 = ""
 	TASK_STATUS_DONE_V2        = "done"
 	TASK_STATUS_FAIL_V2        = "fail"
+	TASK_STATUS_AGENT_LOST_V2  = "agent-lost"
+	TASK_STATUS_SKIPPED_V2     = "skipped"
+
+	TASK_STATUS_WAITING_APPROVAL_V2 = "waiting_approval" // 审批节点等待人工审批
+
+	// workflow 任务依赖的触发条件
+	WORKFLOW_CONDITION_SUCCESS = "success" // 依赖任务成功后执行(默认)
+	WORKFLOW_CONDITION_FAILURE = "failure" // 依赖任务失败后执行
+	WORKFLOW_CONDITION_ALWAYS  = "always"  // 依赖任务结束后始终执行
+
+	// workflow 任务类型
+	WORKFLOW_TASK_TYPE_COMMAND  = ""         // 在agent上执行命令
+	WORKFLOW_TASK_TYPE_APPROVAL = "approval" // 人工审批
+	WORKFLOW_TASK_TYPE_WORKFLOW = "workflow" // 子workflow
+
+	// workflow 上一次运行未结束时新调度的处理策略
+	WORKFLOW_CONCURRENCY_SKIP       = "skip"       // 跳过本次调度并记录(默认)
+	WORKFLOW_CONCURRENCY_QUEUE      = "queue"      // 排队，等上一次运行结束后执行
+	WORKFLOW_CONCURRENCY_CONCURRENT = "concurrent" // 与上一次运行同时执行，agent及任务锁尚未按运行隔离，暂不支持，已保存的配置按排队处理
+
+	// workflow运行参数提供给任务的环境变量前缀，参数名转为大写
+	WORKFLOW_PARAM_ENV_PREFIX = "GOPHERCRON_PARAM_"
+	// workflow上游任务输出的变量提供给任务的环境变量前缀，格式为 GOPHERCRON_OUTPUT_<项目id>_<任务id>_<变量名>
+	WORKFLOW_OUTPUT_ENV_PREFIX = "GOPHERCRON_OUTPUT_"
 
 	WORKFLOW_SCHEDULE_LIMIT int = 3
 
+	// agent失联后任务最多重新调度的次数
+	AGENT_LOST_RESCHEDULE_LIMIT int = 3
+
 	APP_KEY = "app_impl"
 	USER_ID = "user_id"
 
@@ -50,8 +78,32 @@ const (
 	PERMISSION_MANAGER = "manager"
 	PERMISSION_USER    = "user"
 
-	WEBHOOK_TYPE_TASK_RESULT  = "task-result"
-	WEBHOOK_TYPE_TASK_FAILURE = "task-failure"
+	WEBHOOK_TYPE_TASK_RESULT              = "task-result"
+	WEBHOOK_TYPE_TASK_FAILURE             = "task-failure"
+	WEBHOOK_TYPE_TASK_STARTED             = "task-started"
+	WEBHOOK_TYPE_TASK_TIMEOUT             = "task-timeout"
+	WEBHOOK_TYPE_TASK_SKIPPED             = "task-skipped" // 上一次执行未结束，跳过本次调度
+	WEBHOOK_TYPE_WORKFLOW_STARTED         = "workflow-started"
+	WEBHOOK_TYPE_WORKFLOW_FINISHED        = "workflow-finished"
+	WEBHOOK_TYPE_WORKFLOW_FAILED          = "workflow-failed"
+	WEBHOOK_TYPE_AGENT_ONLINE             = "agent-online"
+	WEBHOOK_TYPE_AGENT_OFFLINE            = "agent-offline"
+	WEBHOOK_TYPE_TEMPORARY_TASK_SCHEDULED = "temporary-task-scheduled"
+
+	// webhook签名，签名内容为 "{timestamp}.{body}"，算法为HMAC-SHA256，密钥为webhook的secret
+	WEBHOOK_HEADER_TIMESTAMP = "X-GopherCron-Timestamp"
+	WEBHOOK_HEADER_SIGNATURE = "X-GopherCron-Signature"
+
+	// webhook推送内容格式
+	WEBHOOK_FORMAT_CLOUDEVENT = "cloudevent" // 默认
+	WEBHOOK_FORMAT_DINGTALK   = "dingtalk"
+	WEBHOOK_FORMAT_FEISHU     = "feishu"
+	WEBHOOK_FORMAT_SLACK      = "slack"
+	WEBHOOK_FORMAT_WECOM      = "wecom"
+	WEBHOOK_FORMAT_TEMPLATE   = "template" // 用户自定义go template
+
+	WEBHOOK_DELIVERY_STATUS_SUCCESS = "success"
+	WEBHOOK_DELIVERY_STATUS_FAILURE = "failure"
 
 	ACK_RESPONSE_V1 = "v1"
 	VERSION_TYPE_V1 = "v1"
@@ -1,7 +1,11 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ClientInfo struct {
@@ -73,6 +77,7 @@ type TaskLog struct {
 	ClientIP     string `json:"client_ip" gorm:"client_ip;index:client_ip;type:varchar(20);not null;comment:'节点ip'"`
 	TmpID        string `json:"tmp_id" gorm:"column:tmp_id;type:varchar(50);not null;comment:'任务执行id'"`
 	AgentVersion string `json:"agent_version" gorm:"column:agent_version;type:varchar(50);not null;comment:'节点版本'"`
+	Attempt      int    `json:"attempt" gorm:"column:attempt;type:int(11);not null;default:0;comment:'agent失联后重新调度的次数，0为首次调度'"`
 }
 
 type ExistResult struct {
@@ -83,9 +88,41 @@ type WebHook struct {
 	CallbackURL string `json:"callback_url" gorm:"column:callback_url;type:varchar(255);not null;comment:'回调地址'"`
 	ProjectID   int64  `json:"project_id" gorm:"column:project_id;type:int(11);index:project_id;not null;comment:'关联项目id'"`
 	Type        string `json:"type" gorm:"column:type;type:varchar(30);not null;index:type;comment:'webhook类型'"`
+	Secret      string `json:"secret" gorm:"column:secret;type:varchar(32);not null;default:'';comment:'签名密钥'"`
+	Format      string `json:"format" gorm:"column:format;type:varchar(20);not null;default:'';comment:'推送内容格式，为空时为cloudevent'"`
+	Template    string `json:"template" gorm:"column:template;type:text;not null;comment:'自定义推送内容模板(go template)'"`
 	CreateTime  int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
 }
 
+// WebHookTemplateData 自定义推送内容模板的渲染数据
+// Data为事件负载，如任务事件为 WebHookBody，模板中通过 {{ .Data.TaskName }} 引用
+type WebHookTemplateData struct {
+	Type      string      // webhook类型
+	EventType string      // 事件类型，如任务结束事件的 succeeded/failure
+	EventID   string      // 事件id
+	Time      time.Time   // 事件时间
+	Summary   string      // 事件的文字摘要，与内置聊天机器人格式的消息内容相同
+	Data      interface{} // 事件负载
+}
+
+// WebHookDelivery webhook的每一次推送记录，失败重试与重新推送都会产生新的记录
+type WebHookDelivery struct {
+	ID           int64  `json:"id" gorm:"column:id;primary_key;auto_increment"`
+	ProjectID    int64  `json:"project_id" gorm:"column:project_id;type:int(11);not null;index:project_type;comment:'关联项目id'"`
+	Type         string `json:"type" gorm:"column:type;type:varchar(30);not null;index:project_type;comment:'webhook类型'"`
+	EventID      string `json:"event_id" gorm:"column:event_id;type:varchar(50);not null;index:event_id;comment:'事件id，同一事件的多次推送相同'"`
+	CallbackURL  string `json:"callback_url" gorm:"column:callback_url;type:varchar(255);not null;comment:'回调地址'"`
+	Payload      string `json:"payload" gorm:"column:payload;type:text;not null;comment:'推送内容'"`
+	Attempt      int    `json:"attempt" gorm:"column:attempt;type:int(11);not null;default:1;comment:'第几次尝试'"`
+	RedeliveryOf int64  `json:"redelivery_of" gorm:"column:redelivery_of;type:bigint(20);not null;default:0;comment:'重新推送的原推送记录id，0为正常推送'"`
+	Status       string `json:"status" gorm:"column:status;type:varchar(20);not null;comment:'推送结果 success/failure'"`
+	StatusCode   int    `json:"status_code" gorm:"column:status_code;type:int(11);not null;default:0;comment:'回调响应状态码，请求失败时为0'"`
+	Latency      int64  `json:"latency" gorm:"column:latency;type:int(11);not null;default:0;comment:'耗时(ms)'"`
+	Response     string `json:"response" gorm:"column:response;type:varchar(512);not null;default:'';comment:'回调响应内容摘要'"`
+	Error        string `json:"error" gorm:"column:error;type:varchar(255);not null;default:'';comment:'请求失败原因'"`
+	CreateTime   int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;index:create_time;comment:'创建时间'"`
+}
+
 type WebHookBody struct {
 	TaskID      string `json:"task_id" form:"task_id"`
 	TaskName    string `json:"task_name" form:"task_name"`
@@ -101,6 +138,41 @@ type WebHookBody struct {
 	Operator    string `json:"operator" form:"operator"`
 }
 
+// WebHookWorkflowBody workflow-started/workflow-finished/workflow-failed 事件的负载
+// workflow的事件会推送给workflow中任务所属的各个项目
+type WebHookWorkflowBody struct {
+	WorkflowID    int64             `json:"workflow_id"`
+	WorkflowTitle string            `json:"workflow_title"`
+	RunID         string            `json:"run_id,omitempty"`
+	ProjectID     int64             `json:"project_id"`
+	ProjectName   string            `json:"project_name"`
+	Status        string            `json:"status"`
+	StartTime     int64             `json:"start_time"`
+	EndTime       int64             `json:"end_time,omitempty"`
+	Reason        string            `json:"reason,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+}
+
+// WebHookAgentBody agent-online/agent-offline 事件的负载
+type WebHookAgentBody struct {
+	AgentIP     string `json:"agent_ip"`
+	ProjectID   int64  `json:"project_id"`
+	ProjectName string `json:"project_name"`
+}
+
+// WebHookTemporaryTaskBody temporary-task-scheduled 事件的负载
+type WebHookTemporaryTaskBody struct {
+	TaskID       string `json:"task_id"`
+	TaskName     string `json:"task_name"`
+	ProjectID    int64  `json:"project_id"`
+	ProjectName  string `json:"project_name"`
+	Command      string `json:"command"`
+	TmpID        string `json:"tmp_id"`
+	Host         string `json:"host,omitempty"`
+	ScheduleTime int64  `json:"schedule_time"`
+	Operator     string `json:"operator"`
+}
+
 type Workflow struct {
 	ID         int64  `json:"id" gorm:"column:id;primary_key;auto_increment"`
 	OID        string `json:"oid" gorm:"column:oid;index:oid;type:varchar(32);not null;comment:'关联组织id'"`
@@ -109,6 +181,39 @@ type Workflow struct {
 	Cron       string `json:"cron" gorm:"column:cron;type:varchar(20);not null;comment:'cron表达式'"`
 	Status     int    `json:"status" gorm:"column:status;type:tinyint(1);not null;default:2;comment:'workflow状态，1启用2暂停'"`
 	CreateTime int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
+
+	Timeout     int `json:"timeout" gorm:"column:timeout;type:int(11);not null;default:0;comment:'workflow整体超时时间(s)，0为不限制'"`
+	MaxParallel int `json:"max_parallel" gorm:"column:max_parallel;type:int(11);not null;default:0;comment:'最大并行任务数，0为不限制'"`
+
+	// 上游workflow运行结束后触发本workflow，TriggerCondition取值同依赖条件: success(默认)/failure/always
+	TriggerWorkflowID int64  `json:"trigger_workflow_id" gorm:"column:trigger_workflow_id;type:int(11);not null;default:0;index:trigger_workflow_id;comment:'触发本workflow的上游workflow id，0为不触发'"`
+	TriggerCondition  string `json:"trigger_condition" gorm:"column:trigger_condition;type:varchar(20);not null;default:'';comment:'触发条件'"`
+
+	// 上一次运行未结束时新调度的处理方式: skip(默认)/queue/concurrent
+	ConcurrencyPolicy string `json:"concurrency_policy" gorm:"column:concurrency_policy;type:varchar(20);not null;default:'';comment:'运行重叠时的处理策略'"`
+
+	// 运行参数声明，json格式: [{"name":"date","default":"","required":true,"description":""}]
+	Params string `json:"params" gorm:"column:params;type:text;not null;comment:'运行参数声明'"`
+}
+
+// WorkflowParam workflow运行参数声明，运行时通过 ${{ params.<name> }} 及环境变量 GOPHERCRON_PARAM_<NAME> 提供给任务
+type WorkflowParam struct {
+	Name        string `json:"name" yaml:"name"`
+	Default     string `json:"default,omitempty" yaml:"default,omitempty"`
+	Required    bool   `json:"required,omitempty" yaml:"required,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// ParamSchema 解析workflow声明的运行参数
+func (w *Workflow) ParamSchema() ([]WorkflowParam, error) {
+	if w.Params == "" {
+		return nil, nil
+	}
+	var list []WorkflowParam
+	if err := json.Unmarshal([]byte(w.Params), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
 }
 
 type GetWorkflowListOptions struct {
@@ -124,6 +229,7 @@ type WorkflowSchedulePlan struct {
 	ProjectID           int64  `json:"project_id" gorm:"column:project_id;type:int(11);not null;index:project_id;comment:'project id'"`
 	DependencyTaskID    string `json:"dependency_task_id" gorm:"column:dependency_task_id;not null;type:varchar(50);default:'';index:dependency_task_id;"`
 	DependencyProjectID int64  `json:"dependency_project_id" gorm:"column:dependency_project_id;not null;type:int(11);default:0;index:dependency_project_id;comment:'依赖任务的项目id'"`
+	DependencyCondition string `json:"dependency_condition" gorm:"column:dependency_condition;not null;type:varchar(20);default:'';comment:'依赖条件 success/failure/always，为空同success'"`
 	ProjectTaskIndex    string `json:"project_task_index" gorm:"column:project_task_index;not null;type:varchar(100);default:'';index:project_task_index;comment:'项目+任务索引'"`
 	CreateTime          int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
 }
@@ -142,6 +248,34 @@ type WorkflowTask struct {
 	Noseize    int    `json:"noseize" gorm:"column:noseize;not null;default:0;comment:'不抢占，设为1后多个agent并行执行'"`
 	WorkflowID int64  `json:"workflow_id" gorm:"column:workflow_id;type:int(11);not null;index:workflow_id;comment:'关联workflow id'"`
 	CreateTime int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
+
+	MaxRetries   int `json:"max_retries" gorm:"column:max_retries;not null;default:-1;comment:'失败后最大重试次数，-1为使用默认策略'"`
+	RetryBackoff int `json:"retry_backoff" gorm:"column:retry_backoff;not null;default:0;comment:'重试间隔(s)，每次重试后翻倍'"`
+
+	Type      string `json:"type" gorm:"column:type;type:varchar(20);not null;default:'';comment:'任务类型，空为命令任务，approval为人工审批，workflow为子workflow'"`
+	Approvers string `json:"approvers" gorm:"column:approvers;type:varchar(255);not null;default:'';comment:'审批人用户id，多个以逗号分隔'"`
+
+	RefWorkflowID int64 `json:"ref_workflow_id" gorm:"column:ref_workflow_id;type:int(11);not null;default:0;comment:'子workflow节点引用的workflow id'"`
+}
+
+// ApproverIDs 审批节点的审批人列表，为空时有workflow权限的用户均可审批
+func (t *WorkflowTask) ApproverIDs() []int64 {
+	var ids []int64
+	for _, v := range strings.Split(t.Approvers, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// MaxAttempts 任务在一次workflow运行中最多被调度的次数
+func (t *WorkflowTask) MaxAttempts() int {
+	if t.MaxRetries < 0 {
+		return WORKFLOW_SCHEDULE_LIMIT
+	}
+	return t.MaxRetries + 1
 }
 
 func BuildWorkflowTaskIndex(pid int64, tid string) string {
@@ -162,6 +296,26 @@ type WorkflowLog struct {
 	EndTime    int64  `json:"end_time" gorm:"column:end_time;type:int(11);not null;comment:'结束时间'"`
 	Result     string `json:"result" gorm:"column:result;type:text;not null;comment:'任务执行结果'"`
 	CreateTime int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
+	Status     string `json:"status" gorm:"column:status;type:varchar(20);not null;default:'';comment:'运行结果，done/fail'"`
+	DryRun     bool   `json:"dry_run" gorm:"column:dry_run;type:tinyint(1);not null;default:0;comment:'是否为试运行'"`
+}
+
+// WorkflowTaskLog workflow单次运行中节点的每一次执行
+type WorkflowTaskLog struct {
+	ID         int64  `json:"id" gorm:"column:id;primary_key;auto_increment"`
+	RunID      int64  `json:"run_id" gorm:"column:run_id;type:bigint(20);not null;index:run_id;comment:'关联workflow运行记录(workflow_log) id'"`
+	WorkflowID int64  `json:"workflow_id" gorm:"column:workflow_id;type:int(11);not null;index:workflow_task;comment:'关联workflow id'"`
+	ProjectID  int64  `json:"project_id" gorm:"column:project_id;type:int(11);not null;index:workflow_task;comment:'project id'"`
+	TaskID     string `json:"task_id" gorm:"column:task_id;type:varchar(50);not null;index:workflow_task;comment:'task id'"`
+	TaskName   string `json:"task_name" gorm:"column:task_name;type:varchar(100);not null;comment:'任务名称'"`
+	Attempt    int    `json:"attempt" gorm:"column:attempt;type:int(11);not null;default:0;comment:'第几次调度，0为未被调度(如跳过)'"`
+	Status     string `json:"status" gorm:"column:status;type:varchar(20);not null;comment:'执行状态'"`
+	AgentIP    string `json:"agent_ip" gorm:"column:agent_ip;type:varchar(50);not null;default:'';comment:'执行节点ip'"`
+	TmpID      string `json:"tmp_id" gorm:"column:tmp_id;type:varchar(50);not null;default:'';index:tmp_id;comment:'任务执行id，关联task_log'"`
+	Result     string `json:"result" gorm:"column:result;type:text;not null;comment:'执行结果说明'"`
+	StartTime  int64  `json:"start_time" gorm:"column:start_time;type:int(11);not null;comment:'开始时间'"`
+	EndTime    int64  `json:"end_time" gorm:"column:end_time;type:int(11);not null;comment:'结束时间'"`
+	CreateTime int64  `json:"create_time" gorm:"column:create_time;type:int(11);not null;comment:'创建时间'"`
 }
 
 type TemporaryTask struct {
@@ -2,9 +2,17 @@ package common
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorhill/cronexpr"
@@ -18,6 +26,7 @@ const (
 	REMOTE_EVENT_WORKFLOW_SCHEDULE    = "remote_event_workflow_schedule"
 	REMOTE_EVENT_TASK_STOP            = "remote_event_task_stop"
 	REMOTE_EVENT_CHECK_TASK_ISRUNNING = "remote_event_check_task_isrunning"
+	REMOTE_EVENT_DISPATCH_DONE        = "remote_event_dispatch_done" // 项目任务全量下发完成
 
 	GOPHERCRON_PROXY_TO_MD_KEY      = "gophercron-proxy-to"
 	GOPHERCRON_PROXY_PROJECT_MD_KEY = "gophercron-proxy-project"
@@ -28,6 +37,9 @@ const (
 
 	GOPHERCRON_CENTER_NAME = "gophercron-center"
 	GOPHERCRON_CLIENT_NAME = "gophercron-client"
+
+	// AGENT_TAG_DRAINING_DEADLINE agent退出时携带在注册信息中的标签，值为等待运行中任务结束的截止时间(unix秒)
+	AGENT_TAG_DRAINING_DEADLINE = "draining-deadline"
 )
 
 type TaskWithOperator struct {
@@ -54,6 +66,17 @@ type TaskInfo struct {
 	ClientIP   string        `json:"client_ip"`
 	TmpID      string        `json:"tmp_id"` // 每次任务执行的唯一标识
 	FlowInfo   *WorkflowInfo `json:"flow_info,omitempty"`
+
+	RescheduleOnAgentLost int             `json:"reschedule_on_agent_lost"` // agent失联导致任务中断时，是否重新调度到其他agent 1是 0否
+	RescheduleInfo        *RescheduleInfo `json:"reschedule_info,omitempty"`
+}
+
+// RescheduleInfo agent失联后重新调度任务时携带的信息
+type RescheduleInfo struct {
+	PlanTime    int64  `json:"plan_time"` // 沿用原执行的计划调度时间
+	Attempt     int    `json:"attempt"`   // 第几次重新调度
+	LostAgentIP string `json:"lost_agent_ip"`
+	LostTmpID   string `json:"lost_tmp_id"`
 }
 
 type TaskListItemWithWorkflows struct {
@@ -71,18 +94,27 @@ type TaskListItemWithWorkflows struct {
 	Noseize    int     `json:"noseize"`
 	Exclusion  int     `json:"exclusion"` // 互斥规则
 	Workflows  []int64 `json:"workflows,omitempty"`
+
+	RescheduleOnAgentLost int `json:"reschedule_on_agent_lost"`
 }
 
 type WorkflowInfo struct {
-	WorkflowID int64  `json:"workflow_id"`
-	TmpID      string `json:"tmp_id"`
+	WorkflowID int64             `json:"workflow_id"`
+	TmpID      string            `json:"tmp_id"`
+	RunID      string            `json:"run_id,omitempty"`  // 并发运行的id，主运行为空
+	DryRun     bool              `json:"dry_run,omitempty"` // 试运行，agent不执行命令直接上报成功
+	Params     map[string]string `json:"params,omitempty"`  // 本次运行的参数，agent以环境变量的方式提供给任务
+	Outputs    map[string]string `json:"outputs,omitempty"` // 本次运行中任务输出的变量，key为环境变量名，agent以环境变量的方式提供给任务
 }
 
 type TaskRunningInfo struct {
-	Status    string `json:"status"`
-	TmpID     string `json:"tmp_id"`
-	Timestamp int64  `json:"timestamp,omitempty"`
-	AgentIP   string `json:"agent_ip"`
+	Status     string `json:"status"`
+	TmpID      string `json:"tmp_id"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	AgentIP    string `json:"agent_ip"`
+	PlanTime   int64  `json:"plan_time,omitempty"`
+	WorkflowID int64  `json:"workflow_id,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"` // agent失联后重新调度的次数
 }
 
 // TaskSchedulePlan 任务调度计划
@@ -114,6 +146,19 @@ type TaskExecutingInfo struct {
 
 	CancelCtx  context.Context    `json:"-"`
 	CancelFunc context.CancelFunc `json:"-"` // 用来取消Command执行的cancel函数
+
+	interrupted atomic.Bool // agent关闭等待超时后被强制中断
+}
+
+// Interrupt agent关闭等待超时后强制结束任务，并记录任务是被中断的
+func (t *TaskExecutingInfo) Interrupt() {
+	t.interrupted.Store(true)
+	t.CancelFunc()
+}
+
+// Interrupted 任务是否因agent关闭等待超时被强制中断
+func (t *TaskExecutingInfo) Interrupted() bool {
+	return t.interrupted.Load()
 }
 
 // TaskExecuteResult 任务执行结果
@@ -137,12 +182,14 @@ var (
 	ETCD_PREFIX             = "/cron"
 	TEMPORARY               = "t_scheduler"
 	WORKFLOW                = "t_flow"
+	WORKFLOW_RUN            = "t_flow_run"
 	WORKFLOW_ACK            = "t_flow_ack"
 	WORKFLOW_MASTER         = "t_flow_master"
 	WEBHOOK_MASTER          = "t_webhook_master"
 	CLEANUP_MASTER          = "t_cleanup_master"
 	CALC_CONSISTENCY_MASTER = "t_calc_consistency_master"
 	TEMPORARY_MASTER        = "t_temporary_master"
+	AGENT_LOST_MASTER       = "t_agent_lost_master"
 	STATUS                  = "t_status"
 )
 
@@ -172,6 +219,38 @@ func BuildWebhookMasterKey() string {
 	return fmt.Sprintf("%s/%s", ETCD_PREFIX, WEBHOOK_MASTER)
 }
 
+// BuildWebhookQueueKey webhook待推送队列
+func BuildWebhookQueueKey() string {
+	return fmt.Sprintf("%s/webhook_queue", ETCD_PREFIX)
+}
+
+// BuildWebhookInflightKey 已从队列取出、正在推送的webhook，推送节点异常退出后由新的推送节点重新入队
+func BuildWebhookInflightKey(jobID string) string {
+	return fmt.Sprintf("%s%s", BuildWebhookInflightKeyPrefix(), jobID)
+}
+
+func BuildWebhookInflightKeyPrefix() string {
+	return fmt.Sprintf("%s/webhook_inflight/", ETCD_PREFIX)
+}
+
+// BuildWebhookDelayKey 推送失败等待重试的webhook，到达重试时间后重新入队
+func BuildWebhookDelayKey(jobID string) string {
+	return fmt.Sprintf("%s%s", BuildWebhookDelayKeyPrefix(), jobID)
+}
+
+func BuildWebhookDelayKeyPrefix() string {
+	return fmt.Sprintf("%s/webhook_delay/", ETCD_PREFIX)
+}
+
+// BuildWebhookDeadLetterKey 多次推送仍失败的webhook
+func BuildWebhookDeadLetterKey(projectID int64, jobID string) string {
+	return fmt.Sprintf("%s%s", BuildWebhookDeadLetterKeyPrefix(projectID), jobID)
+}
+
+func BuildWebhookDeadLetterKeyPrefix(projectID int64) string {
+	return fmt.Sprintf("%s/webhook_dead_letter/%d/", ETCD_PREFIX, projectID)
+}
+
 func BuildWorkflowMasterKey() string {
 	return fmt.Sprintf("%s/%s", ETCD_PREFIX, WORKFLOW_MASTER)
 }
@@ -184,6 +263,25 @@ func BuildTemporaryMasterKey() string {
 	return fmt.Sprintf("%s/%s", ETCD_PREFIX, TEMPORARY_MASTER)
 }
 
+func BuildAgentLostMasterKey() string {
+	return fmt.Sprintf("%s/%s", ETCD_PREFIX, AGENT_LOST_MASTER)
+}
+
+// BuildWorkflowTriggerKey workflow某次运行结束后的下游触发记录，避免多个中心重复触发下游workflow
+func BuildWorkflowTriggerKey(workflowID int64, runID string, startTime int64) string {
+	return fmt.Sprintf("%s/workflow_trigger/%d/%s/%d", ETCD_PREFIX, workflowID, runID, startTime)
+}
+
+// BuildAgentLostWatchKey 正在跟踪的失联agent上的任务执行，避免多个中心重复处理
+func BuildAgentLostWatchKey(projectID int64, taskID, tmpID string) string {
+	return fmt.Sprintf("%s/agent_lost/%d/%s/%s", ETCD_PREFIX, projectID, taskID, tmpID)
+}
+
+// BuildAgentDrainingKey 正在退出的agent，截止时间前与中心断开连接不视为失联
+func BuildAgentDrainingKey(agentIP string) string {
+	return fmt.Sprintf("%s/agent_draining/%s", ETCD_PREFIX, agentIP)
+}
+
 func GetTaskStatusPrefixKey() string {
 	return fmt.Sprintf("%s/%s/", ETCD_PREFIX, STATUS)
 }
@@ -210,12 +308,16 @@ func BuildTaskStatusKey(projectID int64, taskID string) string {
 // 	return fmt.Sprintf("%s/%s", BuildTaskRunningKeyPrefix(projectID, taskID), agentIP)
 // }
 
-func BuildWorkflowTaskStatusKey(workflowID, projectID int64, taskID string) string {
-	return fmt.Sprintf("%s%d/%s", BuildWorkflowTaskStatusKeyPrefix(workflowID), projectID, taskID)
+func BuildWorkflowTaskStatusKey(workflowID int64, runID string, projectID int64, taskID string) string {
+	return fmt.Sprintf("%s%d/%s", BuildWorkflowTaskStatusKeyPrefix(workflowID, runID), projectID, taskID)
 }
 
-func BuildWorkflowTaskStatusKeyPrefix(workflowID int64) string {
-	return fmt.Sprintf("%s/%s/%d/", ETCD_PREFIX, WORKFLOW, workflowID)
+// BuildWorkflowTaskStatusKeyPrefix workflow一次运行中任务状态的前缀，runID为空时为workflow的主运行
+func BuildWorkflowTaskStatusKeyPrefix(workflowID int64, runID string) string {
+	if runID == "" {
+		return fmt.Sprintf("%s/%s/%d/", ETCD_PREFIX, WORKFLOW, workflowID)
+	}
+	return fmt.Sprintf("%s/%s/%d/%s/", ETCD_PREFIX, WORKFLOW_RUN, workflowID, runID)
 }
 
 // BuildSchedulerKey 临时调度的key
@@ -282,9 +384,26 @@ func BuildMonitorKey(ip string) string {
 	return ETCD_PREFIX + "/monitor/" + ip
 }
 
-// BuildWorkflowPlanKey 构建
-func BuildWorkflowPlanKey(workflowID int64) string {
-	return fmt.Sprintf("%s/workflow_plan/%d", ETCD_PREFIX, workflowID)
+// BuildAgentConsistencyKey agent调度计划一致性状态的key
+func BuildAgentConsistencyKey(projectID int64, agent string) string {
+	return fmt.Sprintf("%s%s", BuildAgentConsistencyPrefixKey(projectID), agent)
+}
+
+func BuildAgentConsistencyPrefixKey(projectID int64) string {
+	return fmt.Sprintf("%s/consistency/%d/", ETCD_PREFIX, projectID)
+}
+
+// BuildWorkflowPlanKey 构建workflow运行状态的key，runID为空时为workflow的主运行，否则为并发运行
+func BuildWorkflowPlanKey(workflowID int64, runID string) string {
+	if runID == "" {
+		return fmt.Sprintf("%s/workflow_plan/%d", ETCD_PREFIX, workflowID)
+	}
+	return fmt.Sprintf("%s%d/%s", BuildWorkflowRunPlanKeyPrefix(), workflowID, runID)
+}
+
+// BuildWorkflowRunPlanKeyPrefix 所有workflow并发运行状态的前缀
+func BuildWorkflowRunPlanKeyPrefix() string {
+	return fmt.Sprintf("%s/workflow_run_plan/", ETCD_PREFIX)
 }
 
 // BuildTableKey 构建scheduler 关系表中的key
@@ -329,6 +448,69 @@ func ExtractAgentCommand(key string) string {
 type TaskEvent struct {
 	EventType int // save delete
 	Task      *TaskWithOperator
+	Reconcile *PlanReconcileInfo
+}
+
+// PlanReconcileInfo 中心全量下发项目任务后发送给agent，用于agent对齐本地调度计划
+type PlanReconcileInfo struct {
+	ProjectID int64    `json:"project_id"`
+	Revision  int64    `json:"revision"` // 中心读取任务列表时etcd的revision
+	TaskIDs   []string `json:"task_ids"` // 本次下发的全部任务
+	Hash      string   `json:"hash"`     // 中心侧计算的调度计划hash，算法同 BuildPlanHash
+}
+
+const (
+	AGENT_CONSISTENCY_DIVERGED = "diverged" // 与中心不一致，修复中
+	AGENT_CONSISTENCY_REPAIRED = "repaired" // 已修复
+)
+
+const (
+	CONSISTENCY_EVENT_DETECTED      = "detected"       // 检测到调度计划与中心不一致
+	CONSISTENCY_EVENT_RESYNC        = "resync"         // 中心向agent全量下发任务
+	CONSISTENCY_EVENT_REPAIRED      = "repaired"       // 修复成功
+	CONSISTENCY_EVENT_REPAIR_FAILED = "repair_failed"  // 修复失败
+	CONSISTENCY_EVENT_REREGISTER    = "force_register" // 强制agent重新注册
+)
+
+// AgentConsistencyInfo agent调度计划与中心的一致性状态
+type AgentConsistencyInfo struct {
+	ProjectID        int64                   `json:"project_id"`
+	Agent            string                  `json:"agent"`
+	Status           string                  `json:"status"`
+	AgentHash        string                  `json:"agent_hash"`
+	CenterHash       string                  `json:"center_hash"`
+	Revision         int64                   `json:"revision"`
+	Failures         int                     `json:"failures"` // 连续修复失败的次数
+	DetectTime       int64                   `json:"detect_time"`
+	LatestRepairTime int64                   `json:"latest_repair_time"`
+	LatestError      string                  `json:"latest_error"`
+	Events           []AgentConsistencyEvent `json:"events"`
+}
+
+// AgentConsistencyEvent 一致性检测及修复过程中产生的事件
+type AgentConsistencyEvent struct {
+	Event   string `json:"event"`
+	Time    int64  `json:"time"`
+	Message string `json:"message"`
+}
+
+// BuildPlanHash 计算项目调度计划的hash，plans 为 schedulerKey -> command
+// agent与中心使用相同的算法，用于比较两端的调度计划是否一致
+func BuildPlanHash(plans map[string]string) string {
+	keys := make([]string, 0, len(plans))
+	for k := range plans {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(";")
+		b.WriteString(plans[k])
+		b.WriteString(";")
+	}
+	h := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(h[:])
 }
 
 func BuildTaskEvent(eventType int, task *TaskWithOperator) *TaskEvent {
@@ -416,4 +598,78 @@ type TaskFinishedV2 struct {
 	Error      string `json:"error"`
 	Operator   string `json:"operator"`
 	PlanTime   int64  `json:"plan_time"`
+
+	WorkflowRunID  string `json:"workflow_run_id,omitempty"`  // workflow并发运行的id，主运行为空
+	WorkflowDryRun bool   `json:"workflow_dry_run,omitempty"` // workflow试运行，任务未实际执行
+
+	Outputs map[string]string `json:"outputs,omitempty"` // workflow任务通过 ::set-output 输出的变量
+	Attempt int               `json:"attempt,omitempty"` // agent失联后重新调度的次数
+}
+
+const (
+	WORKFLOW_TASK_OUTPUT_LIMIT       = 32   // 单个任务最多输出的变量数
+	WORKFLOW_TASK_OUTPUT_VALUE_LIMIT = 4096 // 单个变量值的最大长度
+)
+
+var setOutputPattern = regexp.MustCompile(`^::set-output name=([A-Za-z0-9_\-]+)::(.*)$`)
+
+// ParseTaskOutputs 解析任务输出中形如 ::set-output name=file::/tmp/x 的行，同名变量以最后一次输出为准
+func ParseTaskOutputs(output string) map[string]string {
+	var outputs map[string]string
+	for _, line := range strings.Split(output, "\n") {
+		matches := setOutputPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		if outputs == nil {
+			outputs = make(map[string]string)
+		}
+		if _, exist := outputs[matches[1]]; !exist && len(outputs) >= WORKFLOW_TASK_OUTPUT_LIMIT {
+			continue
+		}
+		value := matches[2]
+		if len(value) > WORKFLOW_TASK_OUTPUT_VALUE_LIMIT {
+			value = value[:WORKFLOW_TASK_OUTPUT_VALUE_LIMIT]
+		}
+		outputs[matches[1]] = value
+	}
+	return outputs
+}
+
+// BuildWorkflowOutputEnv 任务输出的变量对应的环境变量名，变量名转为大写，其中的 - 替换为 _
+func BuildWorkflowOutputEnv(projectID int64, taskID, name string) string {
+	return fmt.Sprintf("%s%d_%s_%s", WORKFLOW_OUTPUT_ENV_PREFIX, projectID,
+		strings.ReplaceAll(taskID, "-", "_"), strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+}
+
+// SignWebHookPayload 计算webhook推送内容的签名，接收方可使用相同方法校验请求来源
+// 签名结果以 "sha256=" 为前缀，通过 X-GopherCron-Signature 请求头传递
+func SignWebHookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// BuildChatRobotMessage 生成聊天机器人(钉钉/飞书/Slack/企业微信)的文本消息
+func BuildChatRobotMessage(format, text string) ([]byte, error) {
+	var msg interface{}
+	switch format {
+	case WEBHOOK_FORMAT_DINGTALK, WEBHOOK_FORMAT_WECOM:
+		msg = map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": text},
+		}
+	case WEBHOOK_FORMAT_FEISHU:
+		msg = map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": text},
+		}
+	case WEBHOOK_FORMAT_SLACK:
+		msg = map[string]string{"text": text}
+	default:
+		return nil, fmt.Errorf("unsupported chat robot format: %s", format)
+	}
+	return json.Marshal(msg)
 }
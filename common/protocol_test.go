@@ -2,6 +2,7 @@ package common
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +30,39 @@ func Test_JSON_Unmarshal(t *testing.T) {
 	}
 
 }
+
+func TestParseTaskOutputs(t *testing.T) {
+	output := "start\n::set-output name=file::/tmp/x\n  ::set-output name=count::3  \n::set-output name=file::/tmp/y\n::set-output file::bad\n"
+	outputs := ParseTaskOutputs(output)
+	if len(outputs) != 2 || outputs["file"] != "/tmp/y" || outputs["count"] != "3" {
+		t.Fatalf("unexpected outputs: %v", outputs)
+	}
+	if ParseTaskOutputs("nothing here") != nil {
+		t.Fatal("output without set-output lines should not produce outputs")
+	}
+}
+
+func TestBuildWorkflowRunKeys(t *testing.T) {
+	if BuildWorkflowPlanKey(1, "") != "/cron/workflow_plan/1" || BuildWorkflowTaskStatusKeyPrefix(1, "") != "/cron/t_flow/1/" {
+		t.Fatal("keys of the main run should keep the original layout")
+	}
+	plan := BuildWorkflowPlanKey(1, "abc")
+	if !strings.HasPrefix(plan, BuildWorkflowRunPlanKeyPrefix()) || plan == BuildWorkflowPlanKey(1, "") {
+		t.Fatalf("unexpected run plan key: %s", plan)
+	}
+	status := BuildWorkflowTaskStatusKey(1, "abc", 2, "t")
+	if status != "/cron/t_flow_run/1/abc/2/t" || strings.HasPrefix(status, BuildWorkflowTaskStatusKeyPrefix(1, "")) {
+		t.Fatalf("unexpected run task status key: %s", status)
+	}
+}
+
+func TestSignWebHookPayload(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	sign := SignWebHookPayload("secret", 1700000000, body)
+	if sign != "sha256=086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54" {
+		t.Fatalf("unexpected signature: %s", sign)
+	}
+	if SignWebHookPayload("secret", 1700000001, body) == sign || SignWebHookPayload("other", 1700000000, body) == sign {
+		t.Fatal("signature should depend on timestamp and secret")
+	}
+}
@@ -3,18 +3,21 @@ package config
 var serviceConf *ServiceConfig
 
 type ClientConfig struct {
-	Shell           string `toml:"shell,omitempty"`
-	LogLevel        string `toml:"log_level"`
-	LogFile         string `toml:"log_file"`
-	LogSize         int    `toml:"log_size"`
-	LogBackups      int    `toml:"log_backups"`
-	LogAge          int    `toml:"log_age"`
-	LogCompress     bool   `toml:"log_compress"`
-	ReportAddr      string `toml:"report_addr"`
-	Timeout         int    `toml:"timeout"`
-	Token           string `toml:"token"`
-	Address         string `toml:"address"`
-	RegisterAddress string `toml:"register_address"`
+	Shell            string `toml:"shell,omitempty"`
+	LogLevel         string `toml:"log_level"`
+	LogFile          string `toml:"log_file"`
+	LogSize          int    `toml:"log_size"`
+	LogBackups       int    `toml:"log_backups"`
+	LogAge           int    `toml:"log_age"`
+	LogCompress      bool   `toml:"log_compress"`
+	ReportAddr       string `toml:"report_addr"`
+	Timeout          int    `toml:"timeout"`
+	Token            string `toml:"token"`
+	Address          string `toml:"address"`
+	RegisterAddress  string `toml:"register_address"`
+	ShutdownTimeout  int    `toml:"shutdown_timeout"`   // agent关闭时等待运行中任务结束的最长时间(秒)，超时后强制结束任务
+	ResultQueuePath  string `toml:"result_queue_path"`  // 任务执行结果本地预写队列的存储目录，为空则不启用
+	PlanSnapshotPath string `toml:"plan_snapshot_path"` // 调度计划本地快照的存储目录，为空则不启用
 
 	Prometheus Prometheus `toml:"prometheus"`
 	Auth       AgentAuth  `toml:"auth"`
@@ -60,6 +63,39 @@ type ServiceConfig struct {
 	JWT     *JWTConf    `toml:"jwt"`
 	Mysql   *MysqlConf  `toml:"mysql"`
 	OIDC    OIDC        `toml:"oidc"`
+	Alert   Alert       `toml:"alert"` // 告警通知渠道与路由规则，不配置时告警只输出到日志或report_addr
+}
+
+// Alert 告警路由配置，告警按规则发送到对应渠道，可同时命中多条规则
+type Alert struct {
+	Channels []AlertChannel `toml:"channels"`
+	Rules    []AlertRule    `toml:"rules"`
+}
+
+// AlertChannel 告警渠道
+type AlertChannel struct {
+	Name string `toml:"name"`
+	Type string `toml:"type"` // email / webhook / dingtalk / feishu / slack / wecom
+	// webhook及聊天机器人的地址
+	URL    string            `toml:"url"`
+	Header map[string]string `toml:"header"` // webhook请求头
+	// 钉钉/飞书机器人开启签名校验时的密钥
+	Secret string `toml:"secret"`
+	// email
+	SMTPHost string   `toml:"smtp_host"`
+	SMTPPort int      `toml:"smtp_port"`
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+}
+
+// AlertRule 告警路由规则，为空的条件不限制
+type AlertRule struct {
+	Types    []string `toml:"types"`     // system / task / workflow
+	Projects []int64  `toml:"projects"`  // 仅对带有项目信息的任务告警生效
+	MinLevel string   `toml:"min_level"` // info / warning / critical，告警级别不低于该级别时命中
+	Channels []string `toml:"channels"`
 }
 
 type OIDC struct {
@@ -114,6 +114,28 @@ func (s *remoteRegistryV2) SetMetas(metas []infra.NodeMetaRemote) {
 	s.metas = metas
 }
 
+// TagUpdater 支持在连接期间更新注册标签的注册器
+type TagUpdater interface {
+	UpdateTags(tags map[string]string) error
+}
+
+// UpdateTags 合并注册标签后重新向中心注册
+func (s *remoteRegistryV2) UpdateTags(tags map[string]string) error {
+	s.locker.Lock()
+	for i, meta := range s.metas {
+		merged := make(map[string]string, len(meta.Tags)+len(tags))
+		for k, v := range meta.Tags {
+			merged[k] = v
+		}
+		for k, v := range tags {
+			merged[k] = v
+		}
+		s.metas[i].Tags = merged
+	}
+	s.locker.Unlock()
+	return s.Register()
+}
+
 func (s *remoteRegistryV2) Register() error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
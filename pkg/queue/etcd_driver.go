@@ -27,8 +27,57 @@ func (q *Queue) Enqueue(val string) error {
 	return err
 }
 
+// EnqueueWithOps enqueues val and commits ops in the same transaction.
+func (q *Queue) EnqueueWithOps(val string, ops ...v3.Op) error {
+	_, err := newUniqueKV(q.client, q.keyPrefix, val, ops...)
+	return err
+}
+
+// DequeueWithOps returns Enqueue()'d elements in FIFO order like Dequeue,
+// removing the element and committing the ops built from its value in the
+// same transaction. If the transaction fails the element stays in the queue.
+func (q *Queue) DequeueWithOps(ops func(val string) []v3.Op) (string, error) {
+	for {
+		resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithFirstRev()...)
+		if err != nil {
+			return "", err
+		}
+		for _, kv := range resp.Kvs {
+			ok, err := deleteRevKey(q.client, string(kv.Key), kv.ModRevision, ops(string(kv.Value))...)
+			if err != nil {
+				return "", err
+			} else if ok {
+				return string(kv.Value), nil
+			}
+		}
+		if len(resp.Kvs) > 0 || resp.More {
+			// lost the race for the first key, read again
+			continue
+		}
+
+		// nothing yet; wait on elements and read them in again
+		ev, err := WaitPrefixEvents(
+			q.ctx,
+			q.client,
+			q.keyPrefix,
+			resp.Header.Revision,
+			[]mvccpb.Event_EventType{mvccpb.PUT})
+		if err != nil {
+			return "", err
+		}
+		if ev == nil {
+			if err = q.ctx.Err(); err == nil {
+				err = recipe.ErrNoWatcher
+			}
+			return "", err
+		}
+	}
+}
+
 // Dequeue returns Enqueue()'d elements in FIFO order. If the
 // queue is empty, Dequeue blocks until elements are available.
+// The returned ack func is never nil, elements claimed from the
+// existing keys are already removed and their ack func is a no-op.
 func (q *Queue) Dequeue() (string, func(), error) {
 	// TODO: fewer round trips by fetching more than one key
 	resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithFirstRev()...)
@@ -42,7 +91,7 @@ func (q *Queue) Dequeue() (string, func(), error) {
 	if err != nil {
 		return "", ackFunc, err
 	} else if kv != nil {
-		return string(kv.Value), nil, nil
+		return string(kv.Value), ackFunc, nil
 	} else if resp.More {
 		// missed some items, retry to read in more
 		return q.Dequeue()
@@ -58,6 +107,13 @@ func (q *Queue) Dequeue() (string, func(), error) {
 	if err != nil {
 		return "", ackFunc, err
 	}
+	if ev == nil {
+		// watch was closed, usually because the context was canceled
+		if err = q.ctx.Err(); err == nil {
+			err = recipe.ErrNoWatcher
+		}
+		return "", ackFunc, err
+	}
 
 	ackFunc = func() {
 		deleteRevKey(q.client, string(ev.Kv.Key), ev.Kv.ModRevision)
@@ -81,10 +137,10 @@ func newKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (*RemoteKV, error) {
 	return &RemoteKV{kv, key, rev, val}, nil
 }
 
-func newUniqueKV(kv v3.KV, prefix string, val string) (*RemoteKV, error) {
+func newUniqueKV(kv v3.KV, prefix string, val string, ops ...v3.Op) (*RemoteKV, error) {
 	for {
 		newKey := fmt.Sprintf("%s/%v", prefix, time.Now().UnixNano())
-		rev, err := putNewKV(kv, newKey, val, 0)
+		rev, err := putNewKV(kv, newKey, val, 0, ops...)
 		if err == nil {
 			return &RemoteKV{kv, newKey, rev, val}, nil
 		}
@@ -96,10 +152,10 @@ func newUniqueKV(kv v3.KV, prefix string, val string) (*RemoteKV, error) {
 
 // putNewKV attempts to create the given key, only succeeding if the key did
 // not yet exist.
-func putNewKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
+func putNewKV(kv v3.KV, key, val string, leaseID v3.LeaseID, ops ...v3.Op) (int64, error) {
 	cmp := v3.Compare(v3.Version(key), "=", 0)
 	req := v3.OpPut(key, val, v3.WithLease(leaseID))
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(append([]v3.Op{req}, ops...)...).Commit()
 	if err != nil {
 		return 0, err
 	}
@@ -110,10 +166,10 @@ func putNewKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
 }
 
 // deleteRevKey deletes a key by revision, returning false if key is missing
-func deleteRevKey(kv v3.KV, key string, rev int64) (bool, error) {
+func deleteRevKey(kv v3.KV, key string, rev int64, ops ...v3.Op) (bool, error) {
 	cmp := v3.Compare(v3.ModRevision(key), "=", rev)
 	req := v3.OpDelete(key)
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(append([]v3.Op{req}, ops...)...).Commit()
 	if err != nil {
 		return false, err
 	} else if !txnresp.Succeeded {
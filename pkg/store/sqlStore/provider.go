@@ -62,10 +62,12 @@ type SqlProviderStores struct {
 	ProjectRelevance      store.ProjectRelevanceStore
 	TaskLog               store.TaskLogStore
 	WebHook               store.TaskWebHookStore
+	WebHookDelivery       store.WebHookDeliveryStore
 	Workflow              store.WorkflowStore
 	WorkflowSchedulePlan  store.WorkflowSchedulePlanStore
 	UserWorkflowRelevance store.UserWorkflowRelevanceStore
 	WorkflowLog           store.WorkflowLogStore
+	WorkflowTaskLog       store.WorkflowTaskLogStore
 	WorkflowTask          store.WorkflowTaskStore
 	TemporaryTask         store.TemporaryTaskStore
 	Org                   store.OrgStore
@@ -85,11 +87,13 @@ func MustSetup(conf *config.MysqlConf, logger wlog.Logger, install bool) SqlStor
 	provider.stores.TaskLog = NewTaskLogStore(provider)
 	provider.stores.ProjectRelevance = NewProjectRelevanceStore(provider)
 	provider.stores.WebHook = NewWebHookStore(provider)
+	provider.stores.WebHookDelivery = NewWebHookDeliveryStore(provider)
 	provider.stores.Workflow = NewWorkflowStore(provider)
 	provider.stores.WorkflowSchedulePlan = NewWorkflowSchedulePlanStore(provider)
 	provider.stores.WorkflowTask = NewWorkflowTaskStore(provider)
 	provider.stores.UserWorkflowRelevance = NewUserWorkflowRelevanceStore(provider)
 	provider.stores.WorkflowLog = NewWorkflowLogStore(provider)
+	provider.stores.WorkflowTaskLog = NewWorkflowTaskLogStore(provider)
 	provider.stores.TemporaryTask = NewTemporaryTaskStoreStore(provider)
 	provider.stores.Org = NewOrgStore(provider)
 	provider.stores.OrgRelevance = NewOrgRelevanceStore(provider)
@@ -136,6 +140,10 @@ func (s *SqlProvider) WorkflowLog() store.WorkflowLogStore {
 	return s.stores.WorkflowLog
 }
 
+func (s *SqlProvider) WorkflowTaskLog() store.WorkflowTaskLogStore {
+	return s.stores.WorkflowTaskLog
+}
+
 func (s *SqlProvider) UserWorkflowRelevance() store.UserWorkflowRelevanceStore {
 	return s.stores.UserWorkflowRelevance
 }
@@ -170,6 +178,10 @@ func (s *SqlProvider) WebHook() store.TaskWebHookStore {
 	return s.stores.WebHook
 }
 
+func (s *SqlProvider) WebHookDelivery() store.WebHookDeliveryStore {
+	return s.stores.WebHookDelivery
+}
+
 func (s *SqlProvider) BeginTx() *gorm.DB {
 	return s.GetMaster().Begin()
 }
@@ -215,11 +227,13 @@ type SqlStore interface {
 	ProjectRelevance() store.ProjectRelevanceStore
 	TaskLog() store.TaskLogStore
 	WebHook() store.TaskWebHookStore
+	WebHookDelivery() store.WebHookDeliveryStore
 	Workflow() store.WorkflowStore
 	WorkflowSchedulePlan() store.WorkflowSchedulePlanStore
 	WorkflowTask() store.WorkflowTaskStore
 	UserWorkflowRelevance() store.UserWorkflowRelevanceStore
 	WorkflowLog() store.WorkflowLogStore
+	WorkflowTaskLog() store.WorkflowTaskLogStore
 	TemporaryTask() store.TemporaryTaskStore
 	Org() store.OrgStore
 	OrgRelevance() store.OrgRelevanceStore
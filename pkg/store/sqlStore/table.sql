@@ -59,6 +59,7 @@ CREATE TABLE `gc_task_log` (
   `agent_version` varchar(50) NOT NULL DEFAULT '' COMMENT '执行该任务agent的版本',
   `tmp_id` varchar(50) NOT NULL COMMENT '任务执行id',
   `plan_time` bigint(20) NOT NULL DEFAULT '0' COMMENT '任务的计划执行时间',
+  `attempt` int(11) NOT NULL DEFAULT '0' COMMENT 'agent失联后重新调度的次数，0为首次调度',
   PRIMARY KEY (`id`),
   KEY `task_id` (`task_id`),
   KEY `name` (`name`),
@@ -99,13 +100,37 @@ CREATE TABLE `gc_webhook` (
   `callback_url` varchar(255) NOT NULL COMMENT '回调地址',
   `project_id` int(11) NOT NULL COMMENT '关联项目id',
   `type` varchar(30) NOT NULL COMMENT 'webhook类型',
-  `secret` varchar(32) NOT NULL COMMENT 'secret',
+  `secret` varchar(32) NOT NULL DEFAULT '' COMMENT '签名密钥',
+  `format` varchar(20) NOT NULL DEFAULT '' COMMENT '推送内容格式，为空时为cloudevent',
+  `template` text NOT NULL COMMENT '自定义推送内容模板(go template)',
   `create_time` int(11) NOT NULL COMMENT '创建时间',
   KEY `type` (`type`),
   KEY `project_id` (`project_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 
+CREATE TABLE `gc_webhook_delivery` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `project_id` int(11) NOT NULL COMMENT '关联项目id',
+  `type` varchar(30) NOT NULL COMMENT 'webhook类型',
+  `event_id` varchar(50) NOT NULL COMMENT '事件id，同一事件的多次推送相同',
+  `callback_url` varchar(255) NOT NULL COMMENT '回调地址',
+  `payload` text NOT NULL COMMENT '推送内容',
+  `attempt` int(11) NOT NULL DEFAULT '1' COMMENT '第几次尝试',
+  `redelivery_of` bigint(20) NOT NULL DEFAULT '0' COMMENT '重新推送的原推送记录id，0为正常推送',
+  `status` varchar(20) NOT NULL COMMENT '推送结果 success/failure',
+  `status_code` int(11) NOT NULL DEFAULT '0' COMMENT '回调响应状态码，请求失败时为0',
+  `latency` int(11) NOT NULL DEFAULT '0' COMMENT '耗时(ms)',
+  `response` varchar(512) NOT NULL DEFAULT '' COMMENT '回调响应内容摘要',
+  `error` varchar(255) NOT NULL DEFAULT '' COMMENT '请求失败原因',
+  `create_time` int(11) NOT NULL COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `project_type` (`project_id`,`type`),
+  KEY `event_id` (`event_id`),
+  KEY `create_time` (`create_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+
 CREATE TABLE `gc_workflow` (
   `id` bigint(20) NOT NULL AUTO_INCREMENT,
   `title` varchar(100) NOT NULL COMMENT 'flow标题',
@@ -114,8 +139,15 @@ CREATE TABLE `gc_workflow` (
   `status` tinyint(1) NOT NULL DEFAULT '2' COMMENT 'workflow状态，1启用2暂停',
   `create_time` int(11) NOT NULL COMMENT '创建时间',
   `oid` varchar(32) NOT NULL COMMENT '关联组织id',
+  `timeout` int(11) NOT NULL DEFAULT '0' COMMENT 'workflow整体超时时间(s)，0为不限制',
+  `max_parallel` int(11) NOT NULL DEFAULT '0' COMMENT '最大并行任务数，0为不限制',
+  `trigger_workflow_id` int(11) NOT NULL DEFAULT '0' COMMENT '触发本workflow的上游workflow id，0为不触发',
+  `trigger_condition` varchar(20) NOT NULL DEFAULT '' COMMENT '触发条件',
+  `concurrency_policy` varchar(20) NOT NULL DEFAULT '' COMMENT '运行重叠时的处理策略',
+  `params` text NOT NULL COMMENT '运行参数声明',
   PRIMARY KEY (`id`),
-  KEY `oid` (`oid`)
+  KEY `oid` (`oid`),
+  KEY `trigger_workflow_id` (`trigger_workflow_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 
@@ -126,10 +158,33 @@ CREATE TABLE `gc_workflow_log` (
   `end_time` int(11) NOT NULL COMMENT '结束时间',
   `result` text NOT NULL COMMENT '任务执行结果',
   `create_time` int(11) NOT NULL COMMENT '创建时间',
+  `status` varchar(20) NOT NULL DEFAULT '' COMMENT '运行结果，done/fail',
+  `dry_run` tinyint(1) NOT NULL DEFAULT '0' COMMENT '是否为试运行',
   PRIMARY KEY (`id`),
   KEY `workflow_id` (`workflow_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+CREATE TABLE `gc_workflow_task_log` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `run_id` bigint(20) NOT NULL COMMENT '关联workflow运行记录(workflow_log) id',
+  `workflow_id` int(11) NOT NULL COMMENT '关联workflow id',
+  `project_id` int(11) NOT NULL COMMENT 'project id',
+  `task_id` varchar(50) NOT NULL COMMENT 'task id',
+  `task_name` varchar(100) NOT NULL COMMENT '任务名称',
+  `attempt` int(11) NOT NULL DEFAULT '0' COMMENT '第几次调度，0为未被调度(如跳过)',
+  `status` varchar(20) NOT NULL COMMENT '执行状态',
+  `agent_ip` varchar(50) NOT NULL DEFAULT '' COMMENT '执行节点ip',
+  `tmp_id` varchar(50) NOT NULL DEFAULT '' COMMENT '任务执行id，关联task_log',
+  `result` text NOT NULL COMMENT '执行结果说明',
+  `start_time` int(11) NOT NULL COMMENT '开始时间',
+  `end_time` int(11) NOT NULL COMMENT '结束时间',
+  `create_time` int(11) NOT NULL COMMENT '创建时间',
+  PRIMARY KEY (`id`),
+  KEY `run_id` (`run_id`),
+  KEY `workflow_task` (`workflow_id`,`project_id`,`task_id`),
+  KEY `tmp_id` (`tmp_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 
 CREATE TABLE `gc_workflow_schedule_plan` (
   `id` bigint(20) NOT NULL AUTO_INCREMENT,
@@ -138,6 +193,7 @@ CREATE TABLE `gc_workflow_schedule_plan` (
   `project_id` int(11) NOT NULL COMMENT 'project id',
   `dependency_task_id` varchar(50) NOT NULL DEFAULT '',
   `dependency_project_id` int(11) NOT NULL DEFAULT '0' COMMENT '依赖任务的项目id',
+  `dependency_condition` varchar(20) NOT NULL DEFAULT '' COMMENT '依赖条件 success/failure/always，为空同success',
   `project_task_index` varchar(100) NOT NULL DEFAULT '' COMMENT '项目+任务索引',
   `create_time` int(11) NOT NULL COMMENT '创建时间',
   PRIMARY KEY (`id`),
@@ -160,6 +216,11 @@ CREATE TABLE `gc_workflow_task` (
   `noseize` int(11) NOT NULL DEFAULT '0' COMMENT '不抢占，设为1后多个agent并行执行',
   `workflow_id` int(11) NOT NULL COMMENT '关联workflow id',
   `create_time` int(11) NOT NULL COMMENT '创建时间',
+  `max_retries` int(11) NOT NULL DEFAULT '-1' COMMENT '失败后最大重试次数，-1为使用默认策略',
+  `retry_backoff` int(11) NOT NULL DEFAULT '0' COMMENT '重试间隔(s)，每次重试后翻倍',
+  `type` varchar(20) NOT NULL DEFAULT '' COMMENT '任务类型，空为命令任务，approval为人工审批，workflow为子workflow',
+  `approvers` varchar(255) NOT NULL DEFAULT '' COMMENT '审批人用户id，多个以逗号分隔',
+  `ref_workflow_id` int(11) NOT NULL DEFAULT '0' COMMENT '子workflow节点引用的workflow id',
   PRIMARY KEY (`task_id`),
   KEY `project_id` (`project_id`),
   KEY `task_name` (`task_name`),
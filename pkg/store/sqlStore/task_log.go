@@ -84,7 +84,8 @@ func (s *taskLogStore) CheckOrCreateScheduleLog(tx *gorm.DB, taskInfo *common.Ta
 		tx = s.GetMaster()
 	}
 	var exist common.ExistResult
-	if taskInfo.Task.Noseize == common.TASK_EXECUTE_NOSEIZE {
+	// agent失联后的重新调度会沿用原计划时间，只需确认本次执行未被记录
+	if taskInfo.Task.Noseize == common.TASK_EXECUTE_NOSEIZE || taskInfo.Task.RescheduleInfo != nil {
 		err := tx.
 			Raw("SELECT EXISTS(SELECT 1 FROM gc_task_log WHERE project_id = ? AND task_id = ? AND tmp_id = ? AND plan_time = ?) AS result",
 				taskInfo.Task.ProjectID, taskInfo.Task.TaskID, taskInfo.TmpID, taskInfo.PlanTime.Unix()).
@@ -105,7 +106,12 @@ func (s *taskLogStore) CheckOrCreateScheduleLog(tx *gorm.DB, taskInfo *common.Ta
 	if exist.Result {
 		return false, nil
 	}
+	var attempt int
+	if taskInfo.Task.RescheduleInfo != nil {
+		attempt = taskInfo.Task.RescheduleInfo.Attempt
+	}
 	return true, tx.Table(s.table).Create(&common.TaskLog{
+		Attempt:      attempt,
 		ProjectID:    taskInfo.Task.ProjectID,
 		TaskID:       taskInfo.Task.TaskID,
 		TmpID:        taskInfo.TmpID,
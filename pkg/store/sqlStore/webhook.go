@@ -63,6 +63,22 @@ func (s *webHookStore) GetList(projectID int64) ([]*common.WebHook, error) {
 	return res, nil
 }
 
+func (s *webHookStore) Update(tx *gorm.DB, data common.WebHook) error {
+	if tx == nil {
+		tx = s.GetMaster()
+	}
+
+	return tx.Table(s.GetTable()).
+		Where("project_id = ?", data.ProjectID).
+		Where("`type` = ?", data.Type).
+		Updates(map[string]interface{}{
+			"callback_url": data.CallbackURL,
+			"format":       data.Format,
+			"template":     data.Template,
+			"secret":       data.Secret,
+		}).Error
+}
+
 func (s *webHookStore) Delete(tx *gorm.DB, projectID int64, types string) error {
 	if tx == nil {
 		tx = s.GetMaster()
@@ -0,0 +1,83 @@
+package sqlStore
+
+import (
+	"fmt"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/pkg/store"
+
+	"github.com/holdno/gocommons/selection"
+	"github.com/jinzhu/gorm"
+)
+
+type webHookDeliveryStore struct {
+	commonFields
+}
+
+// NewWebHookDeliveryStore
+func NewWebHookDeliveryStore(provider SqlProviderInterface) store.WebHookDeliveryStore {
+	repo := &webHookDeliveryStore{}
+
+	repo.SetProvider(provider)
+	repo.SetTable("gc_webhook_delivery")
+	return repo
+}
+
+func (s *webHookDeliveryStore) AutoMigrate() {
+	if err := s.GetMaster().Table(s.GetTable()).AutoMigrate(&common.WebHookDelivery{}).Error; err != nil {
+		panic(fmt.Errorf("unable to auto migrate %s, %w", s.GetTable(), err))
+	}
+	s.provider.Logger().Info(fmt.Sprintf("%s, complete initialization", s.GetTable()))
+}
+
+func (s *webHookDeliveryStore) Create(tx *gorm.DB, data *common.WebHookDelivery) error {
+	if tx == nil {
+		tx = s.GetMaster()
+	}
+	return tx.Table(s.GetTable()).Create(data).Error
+}
+
+func (s *webHookDeliveryStore) GetOne(projectID, id int64) (*common.WebHookDelivery, error) {
+	var (
+		err error
+		res common.WebHookDelivery
+	)
+	err = s.GetReplica().Table(s.GetTable()).
+		Where("project_id = ?", projectID).
+		Where("id = ?", id).First(&res).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (s *webHookDeliveryStore) GetList(selector selection.Selector, page, pagesize uint64) ([]common.WebHookDelivery, error) {
+	var (
+		err error
+		res []common.WebHookDelivery
+	)
+
+	db := parseSelector(s.GetReplica(), selector, true)
+
+	err = db.Table(s.GetTable()).
+		Offset((page - 1) * pagesize).Limit(pagesize).Order("id DESC").Find(&res).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *webHookDeliveryStore) Clear(tx *gorm.DB, selector selection.Selector) error {
+	if tx == nil {
+		tx = s.GetMaster()
+	}
+	db := parseSelector(tx, selector, true)
+
+	if err := db.Table(s.GetTable()).Delete(nil).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -41,7 +41,18 @@ func (s *workflowStore) Update(tx *gorm.DB, data common.Workflow) error {
 		tx = s.GetMaster()
 	}
 
-	return tx.Table(s.GetTable()).Where("id = ?", data.ID).Update(data).Error
+	if err := tx.Table(s.GetTable()).Where("id = ?", data.ID).Update(data).Error; err != nil {
+		return err
+	}
+	// 零值表示不限制，需要显式更新
+	return tx.Table(s.GetTable()).Where("id = ?", data.ID).Updates(map[string]interface{}{
+		"timeout":             data.Timeout,
+		"max_parallel":        data.MaxParallel,
+		"trigger_workflow_id": data.TriggerWorkflowID,
+		"trigger_condition":   data.TriggerCondition,
+		"concurrency_policy":  data.ConcurrencyPolicy,
+		"params":              data.Params,
+	}).Error
 }
 
 func (s *workflowStore) GetOne(id int64) (*common.Workflow, error) {
@@ -0,0 +1,67 @@
+package sqlStore
+
+import (
+	"fmt"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/pkg/store"
+
+	"github.com/holdno/gocommons/selection"
+	"github.com/jinzhu/gorm"
+)
+
+type workflowTaskLogStore struct {
+	commonFields
+}
+
+// NewWorkflowTaskLogStore
+func NewWorkflowTaskLogStore(provider SqlProviderInterface) store.WorkflowTaskLogStore {
+	repo := &workflowTaskLogStore{}
+
+	repo.SetProvider(provider)
+	repo.SetTable("gc_workflow_task_log")
+	return repo
+}
+
+func (s *workflowTaskLogStore) AutoMigrate() {
+	if err := s.GetMaster().Table(s.GetTable()).AutoMigrate(&common.WorkflowTaskLog{}).Error; err != nil {
+		panic(fmt.Errorf("unable to auto migrate %s, %w", s.GetTable(), err))
+	}
+	s.provider.Logger().Info(fmt.Sprintf("%s, complete initialization", s.GetTable()))
+}
+
+func (s *workflowTaskLogStore) Create(tx *gorm.DB, data *common.WorkflowTaskLog) error {
+	if tx == nil {
+		tx = s.GetMaster()
+	}
+	return tx.Table(s.GetTable()).Create(data).Error
+}
+
+func (s *workflowTaskLogStore) GetList(selector selection.Selector) ([]common.WorkflowTaskLog, error) {
+	var (
+		err error
+		res []common.WorkflowTaskLog
+	)
+
+	db := parseSelector(s.GetReplica(), selector, true)
+
+	err = db.Table(s.GetTable()).Order("start_time ASC, id ASC").Find(&res).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *workflowTaskLogStore) Clear(tx *gorm.DB, selector selection.Selector) error {
+	if tx == nil {
+		tx = s.GetMaster()
+	}
+	db := parseSelector(tx, selector, true)
+
+	if err := db.Table(s.GetTable()).Delete(nil).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -123,13 +123,29 @@ type TaskWebHookStore interface {
 	Create(data common.WebHook) error
 	GetList(projectID int64) ([]*common.WebHook, error)
 	GetOne(projectID int64, types string) (*common.WebHook, error)
+	Update(tx *gorm.DB, data common.WebHook) error
 	Delete(tx *gorm.DB, projectID int64, types string) error
 	DeleteAll(tx *gorm.DB, projectID int64) error
 }
 
+type WebHookDeliveryStore interface {
+	Commons
+	Create(tx *gorm.DB, data *common.WebHookDelivery) error
+	GetOne(projectID, id int64) (*common.WebHookDelivery, error)
+	GetList(selector selection.Selector, page, pagesize uint64) ([]common.WebHookDelivery, error)
+	Clear(tx *gorm.DB, selector selection.Selector) error
+}
+
 type WorkflowLogStore interface {
 	Commons
 	Create(tx *gorm.DB, data *common.WorkflowLog) error
 	GetList(selector selection.Selector, page, pagesize uint64) ([]common.WorkflowLog, error)
 	Clear(tx *gorm.DB, selector selection.Selector) error
 }
+
+type WorkflowTaskLogStore interface {
+	Commons
+	Create(tx *gorm.DB, data *common.WorkflowTaskLog) error
+	GetList(selector selection.Selector) ([]common.WorkflowTaskLog, error)
+	Clear(tx *gorm.DB, selector selection.Selector) error
+}
@@ -0,0 +1,433 @@
+package warning
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/spacegrower/watermelon/infra/wlog"
+	"go.uber.org/zap"
+
+	"github.com/holdno/gopherCron/common"
+	"github.com/holdno/gopherCron/config"
+)
+
+// 告警渠道类型
+const (
+	ChannelTypeEmail    = "email"
+	ChannelTypeWebhook  = "webhook"
+	ChannelTypeDingTalk = common.WEBHOOK_FORMAT_DINGTALK
+	ChannelTypeFeishu   = common.WEBHOOK_FORMAT_FEISHU
+	ChannelTypeSlack    = common.WEBHOOK_FORMAT_SLACK
+	ChannelTypeWeCom    = common.WEBHOOK_FORMAT_WECOM
+)
+
+const (
+	// 渠道发送的并发数及等待发送的告警上限，队列满时丢弃新的告警，避免渠道不可用时堆积
+	routerWorkers   = 4
+	routerQueueSize = 1000
+	// smtp连接及整个发送过程的超时时间
+	smtpDialTimeout = 10 * time.Second
+	smtpSendTimeout = 30 * time.Second
+)
+
+var levelOrder = map[string]int{
+	LevelInfo:     1,
+	LevelWarning:  2,
+	LevelCritical: 3,
+}
+
+// Router 多渠道告警路由，告警先交给base处理(日志或report_addr)，再按规则放入队列由固定数量的worker发送到命中的渠道
+type Router struct {
+	base     Warner
+	channels map[string]Warner
+	rules    []config.AlertRule
+	logger   wlog.Logger
+	queue    chan routerJob
+}
+
+type routerJob struct {
+	channel string
+	data    WarningData
+}
+
+func NewRouter(base Warner, conf config.Alert, logger wlog.Logger) (*Router, error) {
+	r := &Router{
+		base:     base,
+		channels: make(map[string]Warner, len(conf.Channels)),
+		rules:    conf.Rules,
+		logger:   logger,
+		queue:    make(chan routerJob, routerQueueSize),
+	}
+	for _, v := range conf.Channels {
+		if v.Name == "" {
+			return nil, fmt.Errorf("alert channel name is required")
+		}
+		if _, exist := r.channels[v.Name]; exist {
+			return nil, fmt.Errorf("duplicate alert channel: %s", v.Name)
+		}
+		ch, err := newChannel(v)
+		if err != nil {
+			return nil, fmt.Errorf("alert channel %s: %w", v.Name, err)
+		}
+		r.channels[v.Name] = ch
+	}
+	for i, rule := range conf.Rules {
+		if rule.MinLevel != "" && levelOrder[rule.MinLevel] == 0 {
+			return nil, fmt.Errorf("alert rule %d: unsupported level %s", i, rule.MinLevel)
+		}
+		for _, name := range rule.Channels {
+			if _, exist := r.channels[name]; !exist {
+				return nil, fmt.Errorf("alert rule %d: channel %s not found", i, name)
+			}
+		}
+	}
+	if len(r.channels) > 0 {
+		for i := 0; i < routerWorkers; i++ {
+			go r.work()
+		}
+	}
+	return r, nil
+}
+
+func newChannel(conf config.AlertChannel) (Warner, error) {
+	hc := &http.Client{Timeout: 5 * time.Second}
+	switch conf.Type {
+	case ChannelTypeEmail:
+		if conf.SMTPHost == "" || conf.From == "" || len(conf.To) == 0 {
+			return nil, fmt.Errorf("smtp_host, from and to are required")
+		}
+		return &emailChannel{conf: conf}, nil
+	case ChannelTypeWebhook:
+		if conf.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &webhookChannel{hc: hc, url: conf.URL, header: conf.Header}, nil
+	case ChannelTypeDingTalk, ChannelTypeFeishu, ChannelTypeSlack, ChannelTypeWeCom:
+		if conf.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &robotChannel{hc: hc, url: conf.URL, format: conf.Type, secret: conf.Secret}, nil
+	default:
+		return nil, fmt.Errorf("unsupported channel type: %s", conf.Type)
+	}
+}
+
+func (r *Router) Warning(data WarningData) error {
+	err := r.base.Warning(data)
+	for _, name := range r.matchChannels(data) {
+		select {
+		case r.queue <- routerJob{channel: name, data: data}:
+		default:
+			r.logger.Error("alert queue is full, drop alert", zap.String("channel", name), zap.String("type", data.Type))
+		}
+	}
+	return err
+}
+
+func (r *Router) work() {
+	for job := range r.queue {
+		if err := r.channels[job.channel].Warning(job.data); err != nil {
+			r.logger.Error("failed to send alert", zap.String("channel", job.channel), zap.String("type", job.data.Type), zap.Error(err))
+		}
+	}
+}
+
+// matchChannels 告警命中的渠道，同一渠道只发送一次
+func (r *Router) matchChannels(data WarningData) []string {
+	var (
+		list       []string
+		exist      = make(map[string]bool)
+		projectIDs = warningProjectIDs(data)
+		level      = levelOrder[data.GetLevel()]
+	)
+	for _, rule := range r.rules {
+		if len(rule.Types) > 0 && !containsString(rule.Types, data.Type) {
+			continue
+		}
+		if len(rule.Projects) > 0 && !containsProject(rule.Projects, projectIDs) {
+			continue
+		}
+		if rule.MinLevel != "" && level < levelOrder[rule.MinLevel] {
+			continue
+		}
+		for _, name := range rule.Channels {
+			if !exist[name] {
+				exist[name] = true
+				list = append(list, name)
+			}
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsProject 告警所属的项目中任意一个在规则的项目列表中即命中
+func containsProject(list []int64, projectIDs []int64) bool {
+	for _, v := range list {
+		for _, id := range projectIDs {
+			if v == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// warningProjectIDs 告警所属的项目，任务告警为任务所在项目，workflow告警为其节点所属的项目，系统告警不属于任何项目
+func warningProjectIDs(data WarningData) []int64 {
+	switch data.Type {
+	case WarningTypeTask:
+		var task TaskWarning
+		if err := json.Unmarshal(data.Data, &task); err != nil || task.ProjectID == 0 {
+			return nil
+		}
+		return []int64{task.ProjectID}
+	case WarningTypeWorkflow:
+		var workflow WorkflowWarning
+		if err := json.Unmarshal(data.Data, &workflow); err != nil {
+			return nil
+		}
+		return workflow.ProjectIDs
+	default:
+		return nil
+	}
+}
+
+// FormatWarning 将告警转换为标题与文字内容，用于邮件与聊天机器人
+func FormatWarning(data WarningData) (string, string) {
+	var (
+		title string
+		lines []string
+	)
+	add := func(name, value string) {
+		if value != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+		}
+	}
+	switch data.Type {
+	case WarningTypeTask:
+		var v TaskWarning
+		json.Unmarshal(data.Data, &v)
+		title = "任务告警"
+		if v.ProjectTitle != "" {
+			add("项目", v.ProjectTitle)
+		} else if v.ProjectID != 0 {
+			add("项目", strconv.FormatInt(v.ProjectID, 10))
+		}
+		add("任务", v.TaskName)
+		add("任务ID", v.TaskID)
+		add("节点", v.AgentIP)
+		add("内容", v.Message)
+	case WarningTypeWorkflow:
+		var v WorkflowWarning
+		json.Unmarshal(data.Data, &v)
+		title = "Workflow告警"
+		add("Workflow", v.WorkflowTitle)
+		add("服务节点", v.ServiceIP)
+		add("内容", v.Message)
+	default:
+		var v SystemWarning
+		json.Unmarshal(data.Data, &v)
+		title = "系统告警"
+		add("服务", v.Type)
+		add("节点", v.Endpoint)
+		add("内容", v.Message)
+	}
+	title = fmt.Sprintf("[gopherCron][%s] %s", data.GetLevel(), title)
+	add("时间", time.Unix(data.Time, 0).Format(time.DateTime))
+	return title, strings.Join(lines, "\n")
+}
+
+// webhookChannel 以json格式推送原始告警数据
+type webhookChannel struct {
+	hc     *http.Client
+	url    string
+	header map[string]string
+}
+
+func (c *webhookChannel) Warning(data WarningData) error {
+	b, _ := json.Marshal(data)
+	return postAlert(c.hc, c.url, c.header, b)
+}
+
+// robotChannel 推送到聊天机器人，配置了secret时按钉钉/飞书的规则对请求签名
+type robotChannel struct {
+	hc     *http.Client
+	url    string
+	format string
+	secret string
+}
+
+func (c *robotChannel) Warning(data WarningData) error {
+	title, text := FormatWarning(data)
+	b, err := common.BuildChatRobotMessage(c.format, title+"\n"+text)
+	if err != nil {
+		return err
+	}
+	target, b, err := c.sign(b, time.Now())
+	if err != nil {
+		return err
+	}
+	return postAlert(c.hc, target, nil, b)
+}
+
+// sign 钉钉的签名通过地址参数传递，飞书的签名放在消息体中，其他机器人不签名
+func (c *robotChannel) sign(body []byte, now time.Time) (string, []byte, error) {
+	if c.secret == "" {
+		return c.url, body, nil
+	}
+	switch c.format {
+	case ChannelTypeDingTalk:
+		timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+		h := hmac.New(sha256.New, []byte(c.secret))
+		h.Write([]byte(timestamp + "\n" + c.secret))
+		target, err := url.Parse(c.url)
+		if err != nil {
+			return "", nil, err
+		}
+		query := target.Query()
+		query.Set("timestamp", timestamp)
+		query.Set("sign", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		target.RawQuery = query.Encode()
+		return target.String(), body, nil
+	case ChannelTypeFeishu:
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		h := hmac.New(sha256.New, []byte(timestamp+"\n"+c.secret))
+		var msg map[string]interface{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return "", nil, err
+		}
+		msg["timestamp"] = timestamp
+		msg["sign"] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		b, err := json.Marshal(msg)
+		return c.url, b, err
+	default:
+		return c.url, body, nil
+	}
+}
+
+func postAlert(hc *http.Client, url string, header map[string]string, body []byte) error {
+	return retry.Do(func() error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to post alert, %w", err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("alert response status: %d, content: %s", resp.StatusCode, string(respBody))
+		}
+		return nil
+	}, retry.Attempts(3), retry.MaxDelay(time.Second*3), retry.LastErrorOnly(true))
+}
+
+// emailChannel 通过smtp发送邮件，465端口使用tls连接，其他端口在服务端支持时启用starttls
+type emailChannel struct {
+	conf config.AlertChannel
+}
+
+func (c *emailChannel) Warning(data WarningData) error {
+	title, text := FormatWarning(data)
+	msg := bytes.NewBuffer(nil)
+	fmt.Fprintf(msg, "From: %s\r\n", c.conf.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(c.conf.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", title))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	port := c.conf.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(c.conf.SMTPHost, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.conf.SMTPHost}
+
+	// smtp.SendMail没有超时控制，这里自行建立连接并限制整个发送过程的时长
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(smtpSendTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, c.conf.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok && c.conf.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", c.conf.Username, c.conf.Password, c.conf.SMTPHost)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(c.conf.From); err != nil {
+		return err
+	}
+	for _, to := range c.conf.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,91 @@
+package warning
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/holdno/gopherCron/config"
+)
+
+func TestRouterMatchChannels(t *testing.T) {
+	r, err := NewRouter(NewDefaultWarner(nil), config.Alert{
+		Channels: []config.AlertChannel{
+			{Name: "a", Type: ChannelTypeWebhook, URL: "http://localhost/a"},
+			{Name: "b", Type: ChannelTypeDingTalk, URL: "http://localhost/b"},
+		},
+		Rules: []config.AlertRule{
+			{Types: []string{WarningTypeTask}, Projects: []int64{1}, Channels: []string{"a"}},
+			{MinLevel: LevelCritical, Channels: []string{"a", "b"}},
+			{Types: []string{WarningTypeWorkflow}, Projects: []int64{3}, Channels: []string{"b"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		data WarningData
+		want []string
+	}{
+		{"task of project", NewTaskWarningData(TaskWarning{ProjectID: 1}), []string{"a"}},
+		{"task of other project", NewTaskWarningData(TaskWarning{ProjectID: 2}), nil},
+		{"system warning", NewSystemWarningData(SystemWarning{}), nil},
+		{"workflow of project", NewWorkflowWarningData(WorkflowWarning{ProjectIDs: []int64{2, 3}}), []string{"b"}},
+		{"workflow of other project", NewWorkflowWarningData(WorkflowWarning{ProjectIDs: []int64{2}}), nil},
+		{"critical dedupe", NewTaskWarningData(TaskWarning{ProjectID: 1}).WithLevel(LevelCritical), []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		if got := r.matchChannels(c.data); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNewRouterValidate(t *testing.T) {
+	cases := []config.Alert{
+		{Channels: []config.AlertChannel{{Name: "a", Type: "sms"}}},
+		{Channels: []config.AlertChannel{{Name: "a", Type: ChannelTypeWebhook}}},
+		{Rules: []config.AlertRule{{Channels: []string{"missing"}}}},
+		{Rules: []config.AlertRule{{MinLevel: "fatal"}}},
+	}
+	for i, c := range cases {
+		if _, err := NewRouter(nil, c, nil); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+}
+
+func TestRobotChannelSign(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"msg_type":"text"}`)
+
+	ding := &robotChannel{url: "https://oapi.dingtalk.com/robot/send?access_token=xxx", format: ChannelTypeDingTalk, secret: "SEC"}
+	target, _, err := ding.sign(body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(target)
+	if q := u.Query(); q.Get("access_token") != "xxx" || q.Get("timestamp") != "1700000000000" || q.Get("sign") == "" {
+		t.Fatalf("unexpected dingtalk url: %s", target)
+	}
+
+	feishu := &robotChannel{url: "https://open.feishu.cn/hook", format: ChannelTypeFeishu, secret: "SEC"}
+	target, signed, err := feishu.sign(body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]string
+	json.Unmarshal(signed, &msg)
+	if target != feishu.url || msg["msg_type"] != "text" || msg["timestamp"] != "1700000000" || msg["sign"] == "" {
+		t.Fatalf("unexpected feishu request: %s %s", target, signed)
+	}
+
+	feishu.secret = ""
+	if _, unsigned, _ := feishu.sign(body, now); string(unsigned) != string(body) {
+		t.Fatalf("robot without secret should not be signed, got %s", unsigned)
+	}
+}
@@ -14,16 +14,39 @@ const (
 )
 
 type WarningData struct {
-	Data json.RawMessage `json:"data"`
-	Time int64           `json:"time"`
-	Type string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+	Time  int64           `json:"time"`
+	Type  string          `json:"type"`
+	Level string          `json:"level,omitempty"` // 告警级别，为空时视为 warning
+}
+
+// 告警级别
+const (
+	LevelInfo     = "info"
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+)
+
+// WithLevel 设置告警级别
+func (d WarningData) WithLevel(level string) WarningData {
+	d.Level = level
+	return d
+}
+
+// GetLevel 告警级别，未设置时为 warning
+func (d WarningData) GetLevel() string {
+	if d.Level == "" {
+		return LevelWarning
+	}
+	return d.Level
 }
 
 type WorkflowWarning struct {
-	WorkflowID    int64  `json:"workflow_id"`
-	WorkflowTitle string `json:"workflow_title"`
-	ServiceIP     string `json:"service_ip"`
-	Message       string `json:"message"`
+	WorkflowID    int64   `json:"workflow_id"`
+	WorkflowTitle string  `json:"workflow_title"`
+	ProjectIDs    []int64 `json:"project_ids,omitempty"` // workflow中节点所属的项目
+	ServiceIP     string  `json:"service_ip"`
+	Message       string  `json:"message"`
 }
 
 func NewWorkflowWarningData(data WorkflowWarning) WarningData {
@@ -31,7 +54,7 @@ func NewWorkflowWarningData(data WorkflowWarning) WarningData {
 	return WarningData{
 		Time: time.Now().Unix(),
 		Data: raw,
-		Type: WarningTypeTask,
+		Type: WarningTypeWorkflow,
 	}
 }
 